@@ -0,0 +1,89 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The -agency filter selects records by the agencies in 040: the
+// original cataloging agency ($a), the transcribing agency ($c) and the
+// modifying agencies ($d).
+
+var agencySubfields = []string{"a", "c", "d"}
+
+// agencyAliases maps symbols seen in the wild to their MARC
+// Organization Code.
+var agencyAliases = map[string]string{
+	"LC":   "DLC",
+	"OCL":  "OCOLC",
+	"OCLC": "OCOLC",
+}
+
+// normalizeAgency makes symbols that differ only in case, spacing or
+// punctuation compare equal.
+func normalizeAgency(symbol string) string {
+	symbol = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, symbol)
+	if alias, ok := agencyAliases[symbol]; ok {
+		return alias
+	}
+	return symbol
+}
+
+// An agencySelector selects records that any of its agencies created,
+// transcribed or modified.
+type agencySelector struct {
+	agencies map[string]bool
+}
+
+func newAgencySelector(list string) *agencySelector {
+	s := &agencySelector{agencies: make(map[string]bool)}
+	for _, symbol := range strings.Split(list, ",") {
+		if symbol = normalizeAgency(symbol); symbol != "" {
+			s.agencies[symbol] = true
+		}
+	}
+	return s
+}
+
+func (s *agencySelector) Match(r *marc21.MarcRecord) bool {
+	for _, code := range agencySubfields {
+		for _, v := range marcfilter.FieldValues(r, "040", code) {
+			if s.agencies[normalizeAgency(v)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String lists the agencies in the form -agency takes.
+func (s *agencySelector) String() string {
+	var symbols []string
+	for symbol := range s.agencies {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return strings.Join(symbols, ",")
+}
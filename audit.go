@@ -0,0 +1,326 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URL audits. marcdump [-s selector] audit-urls marcfile... checks
+// each 856 $u of the selected records, asking for it with HEAD (or GET
+// where a server will not answer HEAD) and following redirects, and
+// writes a CSV report of a line per record and URL:
+//
+//    record,url,status,final_url,error,cached
+//    ocm001,http://example.com/a,200,https://example.com/a,,false
+//
+// final_url is where the redirects led, if anywhere. A URL in several
+// records is only asked for once. -workers limits how many requests are
+// made at once, and -delay how soon a host is asked again, so that an
+// audit of a large catalog does not hammer the publishers' servers.
+// -cache file keeps the answers, so that a later audit only asks again
+// for the URLs not checked in the last -max-age.
+
+var errAuditArgs = errors.New("marcdump: audit-urls takes the files of records to audit")
+
+var auditColumns = []string{"record", "url", "status", "final_url", "error", "cached"}
+
+// A urlCheck is the answer for a URL.
+type urlCheck struct {
+	status  int
+	final   string
+	err     string
+	checked time.Time
+	cached  bool
+}
+
+// broken reports whether the URL did not lead to a resource.
+func (c *urlCheck) broken() bool {
+	return c.err != "" || c.status >= 400
+}
+
+// A urlCache is the answers of earlier audits, in a file of tab
+// separated url, status, final URL, time checked and error lines, the
+// last line for a URL being the one that counts. It is safe for
+// concurrent use.
+type urlCache struct {
+	mu      sync.Mutex
+	entries map[string]*urlCheck
+	file    *os.File
+}
+
+func openURLCache(name string) (*urlCache, error) {
+	c := &urlCache{entries: make(map[string]*urlCheck)}
+	if name == "" {
+		return c, nil
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), "\t")
+		if len(parts) != 5 {
+			continue
+		}
+		status, _ := strconv.Atoi(parts[1])
+		checked, err := time.Parse(time.RFC3339, parts[3])
+		if err != nil {
+			continue
+		}
+		c.entries[parts[0]] = &urlCheck{status: status, final: parts[2], checked: checked, err: parts[4], cached: true}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	c.file = file
+	return c, nil
+}
+
+// get returns the answer for a URL if it was checked since a time.
+func (c *urlCache) get(u string, since time.Time) *urlCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if check, ok := c.entries[u]; ok && !check.checked.Before(since) {
+		return check
+	}
+	return nil
+}
+
+func (c *urlCache) add(u string, check *urlCheck) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[u] = check
+	if c.file == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(c.file, "%s\t%d\t%s\t%s\t%s\n", u, check.status, check.final, check.checked.Format(time.RFC3339), check.err)
+	return err
+}
+
+func (c *urlCache) close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
+
+// hostDelays spaces out the requests to each host. It is safe for
+// concurrent use.
+type hostDelays struct {
+	delay time.Duration
+	mu    sync.Mutex
+	next  map[string]time.Time
+}
+
+// wait waits until a host may be asked again.
+func (d *hostDelays) wait(host string) {
+	d.mu.Lock()
+	now := time.Now()
+	t := d.next[host]
+	if t.Before(now) {
+		t = now
+	}
+	d.next[host] = t.Add(d.delay)
+	d.mu.Unlock()
+	time.Sleep(t.Sub(now))
+}
+
+// An auditRow is a URL of a record.
+type auditRow struct {
+	record, url string
+}
+
+// auditURLs parses the arguments following "audit-urls" and audits the
+// URLs of the records the selector matches.
+func auditURLs(args []string, selector marcfilter.Selector) error {
+	flags := flag.NewFlagSet("audit-urls", flag.ContinueOnError)
+	cacheFile := flags.String("cache", "", "Keep the answers in `file` for later audits")
+	maxAge := flags.Duration("max-age", 7*24*time.Hour, "Ask again for cached URLs checked longer ago than `duration`")
+	workers := flags.Int("workers", 4, "Make at most `n` requests at once")
+	delay := flags.Duration("delay", time.Second, "Wait `duration` between requests to the same host")
+	outFile := flags.String("out", "", "Write the report to `file` instead of the standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errAuditArgs
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	// the URLs of the records, and each URL once
+	var rows []auditRow
+	var urls []string
+	seen := make(map[string]bool)
+	reader := newInputReader(flags.Args())
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			return err
+		} else if record == nil {
+			break
+		}
+		if !selector.Match(record.MarcRecord) {
+			continue
+		}
+		id := controlNumber(record)
+		for _, u := range marcfilter.FieldValues(record.MarcRecord, "856", "u") {
+			u = strings.TrimSpace(u)
+			if u == "" {
+				continue
+			}
+			rows = append(rows, auditRow{id, u})
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+
+	cache, err := openURLCache(*cacheFile)
+	if err != nil {
+		return err
+	}
+	defer cache.close()
+	checks := checkURLs(urls, cache, time.Now().Add(-*maxAge), *workers, &hostDelays{delay: *delay, next: make(map[string]time.Time)})
+
+	var out io.Writer = os.Stdout
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	w := csv.NewWriter(out)
+	w.Write(auditColumns)
+	broken, cached := 0, 0
+	for _, row := range rows {
+		c := checks[row.url]
+		status := ""
+		if c.status != 0 {
+			status = strconv.Itoa(c.status)
+		}
+		w.Write([]string{row.record, row.url, status, c.final, c.err, strconv.FormatBool(c.cached)})
+	}
+	for _, u := range urls {
+		if checks[u].broken() {
+			broken++
+		}
+		if checks[u].cached {
+			cached++
+		}
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%d URLs in %d places checked, %d of them from the cache; %d broken\n", len(urls), len(rows), cached, broken)
+	return w.Error()
+}
+
+// checkURLs checks the URLs not in the cache, with as many workers, and
+// returns the answers for all of them.
+func checkURLs(urls []string, cache *urlCache, since time.Time, workers int, delays *hostDelays) map[string]*urlCheck {
+	checks := make(map[string]*urlCheck)
+	var mu sync.Mutex
+	todo := make(chan string)
+	var wg sync.WaitGroup
+	client := &http.Client{Timeout: fetchTimeout}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range todo {
+				c := checkURL(client, u, delays)
+				if err := cache.add(u, c); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: URL cache: %v\n", err)
+				}
+				mu.Lock()
+				checks[u] = c
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, u := range urls {
+		if c := cache.get(u, since); c != nil {
+			c.cached = true
+			mu.Lock()
+			checks[u] = c
+			mu.Unlock()
+			continue
+		}
+		todo <- u
+	}
+	close(todo)
+	wg.Wait()
+	return checks
+}
+
+// checkURL asks for a URL, with HEAD and then with GET if the server
+// does not take HEAD.
+func checkURL(client *http.Client, u string, delays *hostDelays) *urlCheck {
+	c := &urlCheck{checked: time.Now().UTC().Truncate(time.Second)}
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		c.err = "not an http or https URL"
+		return c
+	}
+
+	for _, method := range []string{"HEAD", "GET"} {
+		delays.wait(parsed.Host)
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			c.err = err.Error()
+			return c
+		}
+		req.Header.Set("User-Agent", fetchUserAgent)
+		resp, err := client.Do(req)
+		if err != nil {
+			c.err = strings.Join(strings.Fields(err.Error()), " ")
+			return c
+		}
+		resp.Body.Close()
+		c.status = resp.StatusCode
+		if final := resp.Request.URL.String(); final != u {
+			c.final = final
+		} else {
+			c.final = ""
+		}
+		switch resp.StatusCode {
+		case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			// servers that will not answer HEAD
+			continue
+		}
+		break
+	}
+	return c
+}
@@ -0,0 +1,155 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Access control for serve. -api-keys names a file of keys, one per
+// line, that clients send as
+//
+//    Authorization: Bearer key      (or X-API-Key: key)
+//
+// and -users a file of user:hash lines, the bcrypt hash of each user's
+// password, for HTTP basic authentication. htpasswd writes them:
+//
+//    htpasswd -nBC 10 user >> users
+//
+// With either, a request needs a key or a user's password; gRPC clients
+// send them as call metadata. Every password is checked against a
+// bcrypt hash, so that a request for an unknown user takes as long as
+// one with a wrong password. Credentials are only safe from
+// eavesdroppers over TLS.
+//
+// Serving never changes the store, and -read-only (the default) also
+// opens a database so that it cannot be changed: SQLite in read-only
+// mode, PostgreSQL in read-only transactions. -read-only=false opens it
+// as the connection string says, for the databases that refuse to be
+// opened so: a SQLite database in WAL mode in a directory the server
+// cannot write to, or PostgreSQL behind a pooler, such as PgBouncer,
+// that rejects the default_transaction_read_only parameter. The server
+// still answers only reads.
+
+var errBadUsersLine = errors.New("marcdump: -users lines must be user:bcrypt hash of the password")
+
+// An authenticator checks the credentials of requests. A nil
+// authenticator lets every request through.
+type authenticator struct {
+	keys    map[[sha256.Size]byte]bool // hashes of the API keys
+	users   map[string][]byte          // bcrypt password hashes by user
+	unknown []byte                     // a hash to check unknown users against
+}
+
+// newAuthenticator loads the API keys and users files, either of which
+// can be "". It returns nil if both are.
+func newAuthenticator(keysName string, usersName string) (*authenticator, error) {
+	if keysName == "" && usersName == "" {
+		return nil, nil
+	}
+	a := &authenticator{keys: make(map[[sha256.Size]byte]bool), users: make(map[string][]byte)}
+	if keysName != "" {
+		keys, err := loadKeyList(keysName)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			a.keys[sha256.Sum256([]byte(key))] = true
+		}
+	}
+	if usersName != "" {
+		lines, err := loadKeyList(usersName)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			i := strings.LastIndexByte(line, ':')
+			if i < 1 {
+				return nil, errBadUsersLine
+			}
+			hash := []byte(line[i+1:])
+			if _, err := bcrypt.Cost(hash); err != nil {
+				return nil, errBadUsersLine
+			}
+			a.users[line[:i]] = hash
+		}
+		if a.unknown, err = bcrypt.GenerateFromPassword(nil, bcrypt.DefaultCost); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// allowed reports whether a request has valid credentials.
+func (a *authenticator) allowed(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if key != "" && a.keys[sha256.Sum256([]byte(key))] {
+		return true
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := a.users[user]
+	if !known {
+		hash = a.unknown
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && known
+}
+
+// challenge asks an HTTP client for credentials.
+func (a *authenticator) challenge(w http.ResponseWriter) {
+	if len(a.users) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="marcdump", charset="UTF-8"`)
+	}
+	http.Error(w, "missing or invalid credentials", http.StatusUnauthorized)
+}
+
+// readOnlyDSN returns the data source name of a database opened so
+// that it cannot be changed.
+func readOnlyDSN(driver string, dsn string) string {
+	switch driver {
+	case "sqlite3":
+		if !strings.HasPrefix(dsn, "file:") {
+			dsn = "file:" + dsn
+		}
+		if strings.Contains(dsn, "?") {
+			return dsn + "&mode=ro"
+		}
+		return dsn + "?mode=ro"
+	case "postgres":
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn
+		}
+		q := u.Query()
+		q.Set("default_transaction_read_only", "on")
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn
+}
@@ -0,0 +1,201 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Offline reconciliation. The local enrichment source matches headings
+// against the authorized headings (1xx) of the authority records in
+// -enrich-authorities, for machines that cannot reach the web services.
+// The authority file is read into memory, unless an index made on it
+// with -mkindex, such as one on 100_a, is given with -enrich-index, in
+// which case only the records the index finds are read.
+//
+// The URI of an authority record is its id.loc.gov URI if it has an
+// LCCN in 010, a URI in 024 with $2 uri, or otherwise its control
+// number prefixed by its 003, which $0 also allows.
+
+var (
+	errNoAuthorities         = errors.New("marcdump: the local enrichment source needs -enrich-authorities")
+	errCompressedAuthorities = errors.New("marcdump: an index cannot be used with a compressed authority file")
+)
+
+const idLocAuthorityURI = "http://id.loc.gov/authorities/%s/%s"
+
+// authorityKind returns the kind of heading an authority record's 1xx
+// holds, or "" for those that are not names or subjects.
+func authorityKind(f *marcfilter.Field) string {
+	kind := headingKinds["6"+f.Tag[1:]]
+	if kind == kindNames {
+		for _, sf := range f.Subfields {
+			if strings.Contains("vxyz", sf.Code) {
+				return kindSubjects
+			}
+		}
+	}
+	return kind
+}
+
+// authorityURI returns the URI to link an authority record by.
+func authorityURI(m *marcfilter.MutableRecord) string {
+	for _, f := range m.FieldsByTag("010") {
+		if lccn := strings.Replace(f.Subfield("a"), " ", "", -1); lccn != "" {
+			kind := kindNames
+			if strings.HasPrefix(lccn, "sh") {
+				kind = kindSubjects
+			}
+			return fmt.Sprintf(idLocAuthorityURI, kind, lccn)
+		}
+	}
+	for _, f := range m.FieldsByTag("024") {
+		if f.Subfield("2") == "uri" && f.Subfield("a") != "" {
+			return f.Subfield("a")
+		}
+	}
+
+	var id, org string
+	for _, f := range m.Fields {
+		switch f.Tag {
+		case "001":
+			id = strings.TrimSpace(f.Value)
+		case "003":
+			org = strings.TrimSpace(f.Value)
+		}
+	}
+	if id != "" && org != "" {
+		return "(" + org + ")" + id
+	}
+	return id
+}
+
+// authorityEntry returns the reconciliation key and the URI of an
+// authority record, or "" if it has no heading to match.
+func authorityEntry(raw []byte) (string, string, error) {
+	m, err := marcfilter.DecodeRecord(raw)
+	if err != nil {
+		return "", "", err
+	}
+	if len(m.Leader) < marcfilter.LeaderLength || m.Leader[6] != 'z' {
+		return "", "", nil
+	}
+	for _, f := range m.Fields {
+		if f.Tag[0] != '1' {
+			continue
+		}
+		kind, label := authorityKind(f), headingLabel(f)
+		if kind == "" || label == "" {
+			return "", "", nil
+		}
+		return kind + "\t" + label, authorityURI(m), nil
+	}
+	return "", "", nil
+}
+
+// A localReconciler matches headings against an authority file.
+type localReconciler struct {
+	headings map[string][]string
+
+	// with an index the records are read as they are needed
+	file *os.File
+	idx  *marcfilter.Index
+}
+
+// newLocalReconciler reads the authority file, or opens it for lookups
+// through the index if there is one.
+func newLocalReconciler(name string, indexName string) (*localReconciler, error) {
+	r := new(localReconciler)
+	if indexName != "" {
+		idx, err := marcfilter.ReadIndex(indexName)
+		if err != nil {
+			return nil, err
+		}
+		if r.file, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		if isCompressed(r.file) {
+			r.file.Close()
+			return nil, errCompressedAuthorities
+		}
+		r.idx = idx
+		onFinish(func(w *tabwriter.Writer) error {
+			return r.file.Close()
+		})
+		return r, nil
+	}
+
+	r.headings = make(map[string][]string)
+	ir := newInputReader([]string{name})
+	for {
+		f, err := ir.nextFrame()
+		if f == nil || err != nil {
+			return r, err
+		}
+		key, uri, err := authorityEntry(f.raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: record at offset %d: %v", name, f.offset, err)
+		}
+		if key != "" && uri != "" {
+			r.headings[key] = addCandidate(r.headings[key], uri)
+		}
+	}
+}
+
+func (r *localReconciler) reconcile(h *enrichHeading) ([]string, error) {
+	key := h.kind + "\t" + h.label
+	if r.idx == nil {
+		return r.headings[key], nil
+	}
+
+	// the index is on the field of one kind of name, e.g. 100_a,
+	// which serves the 600, 700 and 800 too
+	tag, code := r.idx.Key, ""
+	if i := strings.Index(tag, "_"); i >= 0 {
+		tag, code = tag[:i], tag[i+1:]
+	}
+	if len(tag) != 3 || tag[1:] != h.tag[1:] {
+		return nil, nil
+	}
+	value := h.field.Subfield(code)
+	if code == "" {
+		var parts []string
+		for _, sf := range h.field.Subfields {
+			parts = append(parts, sf.Value)
+		}
+		value = strings.Join(parts, " ")
+	}
+
+	var uris []string
+	for _, e := range r.idx.Lookup(value) {
+		record, err := marcfilter.ReadRecordAt(r.file, e.Offset, e.Length)
+		if err != nil {
+			return nil, err
+		}
+		k, uri, err := authorityEntry(record.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("authority record at offset %d: %v", e.Offset, err)
+		}
+		if k == key && uri != "" {
+			uris = addCandidate(uris, uri)
+		}
+	}
+	return uris, nil
+}
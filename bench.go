@@ -0,0 +1,71 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+// -bench times the run, reporting on the standard error once it is
+// over how many records and bytes were read, how fast, how much memory
+// was allocated doing it, and whether the records were parsed or only
+// framed (see raw.go), so that runs can be compared.
+
+type benchmark struct {
+	start   time.Time
+	raw     bool
+	records int
+	bytes   int64
+	before  runtime.MemStats
+}
+
+// startBench starts timing the run, reporting when the run finishes.
+func startBench(raw bool) *benchmark {
+	b := &benchmark{start: time.Now(), raw: raw}
+	runtime.ReadMemStats(&b.before)
+	onFinish(func(w *tabwriter.Writer) error {
+		b.report()
+		return nil
+	})
+	return b
+}
+
+// add counts a record read.
+func (b *benchmark) add(record *marcfilter.Record) {
+	b.records += 1
+	b.bytes += int64(len(record.Raw))
+}
+
+func (b *benchmark) report() {
+	elapsed := time.Since(b.start)
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	seconds := elapsed.Seconds()
+	mb := float64(b.bytes) / (1 << 20)
+	mode := "parsed"
+	if b.raw {
+		mode = "framed without parsing"
+	}
+	fmt.Fprintf(os.Stderr, "bench: %d records, %.1f MB in %v (%.0f records/s, %.1f MB/s), %s\n",
+		b.records, mb, elapsed.Round(time.Millisecond), float64(b.records)/seconds, mb/seconds, mode)
+	fmt.Fprintf(os.Stderr, "bench: %d allocations, %.1f MB allocated, %d garbage collections\n",
+		after.Mallocs-b.before.Mallocs, float64(after.TotalAlloc-b.before.TotalAlloc)/(1<<20), after.NumGC-b.before.NumGC)
+}
@@ -0,0 +1,157 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Record size budgets. -budget limits.txt cuts each record written as
+// binary MARC, by -extract, -sink marc=... or any other output, down
+// to the max-record-length of a limits profile (see limits.go) rather
+// than writing a record the target ILS would reject. The drop lines of
+// the profile say which fields go, in order, until the record fits:
+//
+//    max-record-length  99999
+//    drop               9xx
+//    drop               5xx 10
+//
+// drops the 9xx fields and then the 5xx beyond the first 10, each
+// from the last one back and only as many as it takes. A record still
+// too long once every drop is made is not written. -budget-log file
+// lists the fields dropped as CSV: the record's 001, the tag and the
+// bytes the field took up.
+
+// A dropRule drops the fields with a tag beyond the first keep.
+type dropRule struct {
+	pattern string
+	keep    int
+}
+
+// A writeBudget cuts records down to the budget, logging the fields
+// dropped.
+type writeBudget struct {
+	limits *limitsProfile
+	log    *csv.Writer
+
+	cut, dropped, rejected int
+}
+
+// marcBudget is the budget of the MARC files written, or nil.
+var marcBudget *writeBudget
+
+// setBudget reads the -budget profile, opens the log and reports what
+// was cut at the end of the run.
+func setBudget(name string, logName string) error {
+	limits, err := loadLimitsProfile(name)
+	if err != nil {
+		return err
+	}
+	if limits.maxRecordLength <= 0 {
+		return fmt.Errorf("%s: a budget needs a max-record-length", name)
+	}
+	b := &writeBudget{limits: limits}
+	var log *os.File
+	if logName != "" {
+		if log, err = os.Create(logName); err != nil {
+			return err
+		}
+		b.log = csv.NewWriter(log)
+		b.log.Write([]string{"001", "tag", "bytes"})
+	}
+	marcBudget = b
+
+	onFinish(func(w *tabwriter.Writer) error {
+		if b.cut > 0 || b.rejected > 0 {
+			fmt.Fprintf(os.Stderr, "%d records cut down to %d bytes, dropping %d fields; %d records over it not written\n",
+				b.cut, limits.maxRecordLength, b.dropped, b.rejected)
+		}
+		if log == nil {
+			return nil
+		}
+		b.log.Flush()
+		if err := b.log.Error(); err != nil {
+			log.Close()
+			return err
+		}
+		return log.Close()
+	})
+	return nil
+}
+
+// fit returns a record cut down to the budget, or nil if it cannot be.
+func (b *writeBudget) fit(raw []byte) ([]byte, error) {
+	max := b.limits.maxRecordLength
+	if len(raw) <= max {
+		return raw, nil
+	}
+	m, err := marcfilter.DecodeRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// a field takes up its data, its terminator and a directory entry
+	size := len(raw)
+	drop := make(map[*marcfilter.Field]bool)
+	for _, rule := range b.limits.drops {
+		var fields []*marcfilter.Field
+		for _, f := range m.Fields {
+			if marcfilter.TagMatches(rule.pattern, f.Tag) {
+				fields = append(fields, f)
+			}
+		}
+		for i := len(fields) - 1; i >= rule.keep && size > max; i-- {
+			drop[fields[i]] = true
+			size -= len(fields[i].Data()) + 1 + 12
+		}
+		if size <= max {
+			break
+		}
+	}
+
+	id := ""
+	var dropped [][]string
+	m.RemoveFields(func(f *marcfilter.Field) bool {
+		if f.Tag == "001" {
+			id = f.Value
+		}
+		if drop[f] {
+			dropped = append(dropped, []string{f.Tag, strconv.Itoa(len(f.Data()) + 1 + 12)})
+		}
+		return drop[f]
+	})
+	out, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		b.rejected++
+		fmt.Fprintf(os.Stderr, "Warning: record %s is %d bytes long after the -budget drops, over %d; not written\n", id, len(out), max)
+		return nil, nil
+	}
+	b.cut++
+	b.dropped += len(dropped)
+	if b.log != nil {
+		for _, d := range dropped {
+			b.log.Write(append([]string{id}, d...))
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sync"
+)
+
+// Record caching. serve -cache n keeps the n records most recently
+// looked up by id parsed in memory, so that hot records, such as a
+// serial every client asks for, are not read and parsed again for each
+// request. The records served do not change while they are served, so
+// a cached record is never out of date. Searches read the store.
+
+// A recordCache is a least recently used cache of records by id. It is
+// safe for concurrent use.
+type recordCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // of *cacheEntry, the most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	id     string
+	record *marcfilter.Record
+}
+
+func newRecordCache(size int) *recordCache {
+	return &recordCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the cached record with an id, or nil.
+func (c *recordCache) get(id string) *marcfilter.Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).record
+}
+
+// add caches a record, evicting the least recently used one if the
+// cache is full.
+func (c *recordCache) add(id string, record *marcfilter.Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		c.order.MoveToFront(e)
+		e.Value.(*cacheEntry).record = record
+		return
+	}
+	c.entries[id] = c.order.PushFront(&cacheEntry{id, record})
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).id)
+	}
+}
+
+// A cachedStore is a record store whose lookups by id go through a
+// cache.
+type cachedStore struct {
+	recordStore
+	cache *recordCache
+}
+
+func (s *cachedStore) get(id string) (*marcfilter.Record, error) {
+	if record := s.cache.get(id); record != nil {
+		return record, nil
+	}
+	record, err := s.recordStore.get(id)
+	if record != nil && err == nil {
+		s.cache.add(id, record)
+	}
+	return record, err
+}
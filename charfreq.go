@@ -0,0 +1,150 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Character frequency diagnostic. Tabulates the non-ASCII characters
+// (and bytes that are not valid UTF-8) found in field data, flagging
+// the ones that usually mean the encoding was damaged somewhere along
+// the way.
+
+type charCount struct {
+	count   int
+	records int
+	example string // 001 of the first record it was seen in
+}
+
+// A charKey is a character, or an invalid byte when invalid is true.
+type charKey struct {
+	r       rune
+	invalid bool
+}
+
+func (k charKey) String() string {
+	if k.invalid {
+		return fmt.Sprintf("byte 0x%02X", k.r)
+	}
+	if unicode.IsPrint(k.r) && !unicode.Is(unicode.Mn, k.r) {
+		return fmt.Sprintf("U+%04X %c", k.r, k.r)
+	}
+	return fmt.Sprintf("U+%04X", k.r)
+}
+
+// suspicion returns why a character is suspicious, or "".
+func (k charKey) suspicion(lone bool) string {
+	switch {
+	case k.invalid:
+		return "invalid UTF-8"
+	case k.r == utf8.RuneError:
+		return "replacement character"
+	case k.r >= 0x80 && k.r <= 0x9F:
+		return "C1 control"
+	case k.r < 0x20:
+		return "C0 control"
+	case lone:
+		return "lone combining mark"
+	}
+	return ""
+}
+
+func getCharFrequencyAction() actionFunc {
+	counts := make(map[charKey]*charCount)
+	loneMarks := make(map[charKey]int)
+
+	onFinish(func(w *tabwriter.Writer) error {
+		keys := make([]charKey, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if counts[keys[i]].count != counts[keys[j]].count {
+				return counts[keys[i]].count > counts[keys[j]].count
+			}
+			return keys[i].r < keys[j].r
+		})
+
+		fmt.Fprintf(w, "character\tcount\trecords\tfirst seen\tnote\n")
+		for _, k := range keys {
+			c := counts[k]
+			note := k.suspicion(false)
+			if loneMarks[k] > 0 {
+				note = fmt.Sprintf("%s (%d)", k.suspicion(true), loneMarks[k])
+			}
+			if note != "" {
+				note = "SUSPICIOUS: " + note
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", k, c.count, c.records, c.example, note)
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+
+		seen := make(map[charKey]bool)
+		count := func(k charKey) {
+			c := counts[k]
+			if c == nil {
+				c = &charCount{example: controlNumber(record)}
+				counts[k] = c
+			}
+			c.count += 1
+			if !seen[k] {
+				seen[k] = true
+				c.records += 1
+			}
+		}
+
+		for _, f := range m.Fields {
+			values := []string{f.Value}
+			if f.Value == "" {
+				values = []string{f.Indicators}
+				for _, sf := range f.Subfields {
+					values = append(values, sf.Value)
+				}
+			}
+			for _, v := range values {
+				base := false
+				for i := 0; i < len(v); {
+					r, size := utf8.DecodeRuneInString(v[i:])
+					switch {
+					case r == utf8.RuneError && size == 1:
+						count(charKey{rune(v[i]), true})
+					case r >= 0x80 || r < 0x20:
+						k := charKey{r: r}
+						count(k)
+						if unicode.Is(unicode.Mn, r) && !base {
+							loneMarks[k] += 1
+						}
+					}
+					base = unicode.IsLetter(r) || unicode.Is(unicode.Mn, r)
+					i += size
+				}
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// Import profile checks. A profile is a list of checks matching the
+// expectations of a target system's import jobs, so that files can be
+// pre-flighted before they are loaded.
+
+// A checkFunc returns a description of each problem found in a record.
+type checkFunc func(record *marcfilter.Record) []string
+
+var errUnknownProfile = errors.New("marcdump: unknown check profile")
+
+var checkProfiles = map[string][]checkFunc{
+	"alma": {
+		checkAlmaLeader,
+		checkAlma008,
+		checkAlmaTitle,
+		checkAlmaSystemID,
+	},
+}
+
+// checkProfileFormats is the record format each profile checks; the
+// other records are passed over. The Alma checks are those of its
+// bibliographic import profiles, so they would find authority, holdings
+// and classification records all wrong.
+var checkProfileFormats = map[string]string{
+	"alma": formatBibliographic,
+}
+
+// getCheckAction returns an action that runs the checks in the named
+// profile against each record of the format it checks.
+func getCheckAction(profile string, group groupFunc) (actionFunc, error) {
+	checks, ok := checkProfiles[profile]
+	if !ok {
+		return nil, errUnknownProfile
+	}
+	check := newCheckAction(checks, group)
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		if recordFormat(record.Leader()) != checkProfileFormats[profile] {
+			return nil
+		}
+		return check(record, w)
+	}, nil
+}
+
+// newCheckAction returns an action that runs the checks against each
+// record, printing the problems found and a summary at the end. If
+// group is not nil the summary is broken down by group.
+func newCheckAction(checks []checkFunc, group groupFunc) actionFunc {
+	checked := make(map[string]int)
+	failed := make(map[string]int)
+	problems := make(map[string]int)
+	onFinish(func(w *tabwriter.Writer) error {
+		if group == nil {
+			fmt.Fprintf(w, "%d records checked, %d with problems, %d problems\n",
+				checked[""], failed[""], problems[""])
+			return w.Flush()
+		}
+		fmt.Fprintf(w, "group\tchecked\twith problems\tproblems\n")
+		for _, name := range sortedGroups(checked) {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", name, checked[name], failed[name], problems[name])
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		var found []string
+		for _, check := range checks {
+			found = append(found, check(record)...)
+		}
+
+		name := ""
+		if group != nil {
+			name = group(record)
+		}
+		checked[name] += 1
+		if len(found) > 0 {
+			failed[name] += 1
+			problems[name] += len(found)
+			for _, p := range found {
+				fmt.Fprintf(w, "record %d\toffset %d\t%s\t%s\n", record.Number, record.Offset, controlNumber(record), p)
+			}
+		}
+		return w.Flush()
+	}
+}
+
+// controlNumber returns the record's 001, or "-" if it has none.
+func controlNumber(record *marcfilter.Record) string {
+	if id, err := record.GetControlField("001"); err == nil && id != "" {
+		return id
+	}
+	return "-"
+}
+
+//
+// Alma
+//
+
+func checkAlmaLeader(record *marcfilter.Record) []string {
+	var problems []string
+	leader := record.Leader()
+	positions := []struct {
+		pos   int
+		valid string
+	}{
+		{5, "acdnp"},
+		{6, "acdefgijkmoprt"},
+		{7, "abcdims"},
+		{9, " a"},
+		{17, " 12345678uzIJKLM"},
+		{18, " acinu"},
+	}
+	for _, p := range positions {
+		if strings.IndexByte(p.valid, leader[p.pos]) < 0 {
+			problems = append(problems, fmt.Sprintf("invalid leader/%02d value %q", p.pos, leader[p.pos]))
+		}
+	}
+	if leader[20:24] != "4500" {
+		problems = append(problems, fmt.Sprintf("invalid leader entry map %q", leader[20:24]))
+	}
+	return problems
+}
+
+func checkAlma008(record *marcfilter.Record) []string {
+	fixed, err := record.GetControlField("008")
+	if err != nil {
+		return []string{"missing 008"}
+	}
+	if len(fixed) != 40 {
+		return []string{fmt.Sprintf("008 is %d characters long, expected 40", len(fixed))}
+	}
+	return nil
+}
+
+func checkAlmaTitle(record *marcfilter.Record) []string {
+	title, _ := record.GetDataField("245")
+	if title.ValueCount() == 0 {
+		return []string{"missing 245"}
+	}
+	if title.ValueCount() > 1 {
+		return []string{"245 is not repeatable"}
+	}
+	return nil
+}
+
+var systemIDRegexp = regexp.MustCompile(`^\([^)]+\)\S`)
+
+// Alma's import profiles take the originating system ID from the 001,
+// and match on 035 $a values carrying an organization code prefix.
+func checkAlmaSystemID(record *marcfilter.Record) []string {
+	var problems []string
+	if controlNumber(record) == "-" {
+		problems = append(problems, "missing 001 originating system ID")
+	}
+	ids, _ := record.GetDataField("035")
+	for i := 0; i < ids.ValueCount(); i++ {
+		if id := ids.GetNthSubfield("a", i); id != "" && !systemIDRegexp.MatchString(id) {
+			problems = append(problems, fmt.Sprintf("035 $a %q has no (organization code) prefix", id))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,68 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"sort"
+	"strings"
+)
+
+// Collation. Values are sorted byte by byte unless -collate names a
+// locale, such as sv or de-u-co-phonebk, when they are sorted by the
+// Unicode Collation Algorithm with that locale's tailoring instead: "Å"
+// after "Z" in Swedish, "Ä" beside "A" in German, and "é" beside "e"
+// rather than after every unaccented letter. It applies to the values
+// reports list in order, such as the groups of -stats -group-by, the
+// headings of -subject-clusters and -publishers, and the keys of -sort.
+
+// valueCollator collates the values sorted, or is nil for byte order.
+// A collator is not safe for concurrent use, and values are only ever
+// sorted by one goroutine at a time.
+var valueCollator *collate.Collator
+
+// setCollation makes values sort in the order of a locale.
+func setCollation(locale string) error {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return fmt.Errorf("-collate %s: %v", locale, err)
+	}
+	valueCollator = collate.New(tag)
+	return nil
+}
+
+// compareValues compares two values as -collate says, returning -1, 0
+// or 1.
+func compareValues(a, b string) int {
+	if valueCollator == nil {
+		return strings.Compare(a, b)
+	}
+	if c := valueCollator.CompareString(a, b); c != 0 {
+		return c
+	}
+	// values the collation holds equal keep a definite order
+	return strings.Compare(a, b)
+}
+
+// sortValues sorts values as -collate says.
+func sortValues(values []string) {
+	if valueCollator == nil {
+		sort.Strings(values)
+		return
+	}
+	sort.Slice(values, func(i, j int) bool { return compareValues(values[i], values[j]) < 0 })
+}
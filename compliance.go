@@ -0,0 +1,314 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// The compliance report. -compliance scores the input against the
+// letter of ISO 2709 and the MARC 21 exchange format, for going back to
+// a vendor whose delivery will not load. Where -validate lists every
+// problem, the report is a document to pass on: it names the input,
+// gives the share of records meeting each requirement and an overall
+// score, and quotes the first few records failing each requirement by
+// number, byte offset and 001. It is written in Markdown, which reads
+// as plain text too.
+//
+// The requirements are stricter than what marcdump itself needs to read
+// a record: the directory has to account for every byte of the data,
+// with no gaps or overlaps, and the character set the leader declares
+// has to be the one the data is in. A record too broken to be read at
+// all stops the run, as it does elsewhere, unless -skip-bad is given.
+
+// complianceExamples is the number of failing records quoted for each
+// requirement.
+const complianceExamples = 5
+
+// A complianceCheck is a requirement and the test of a record against
+// it, returning what is wrong with the record, if anything.
+type complianceCheck struct {
+	name        string
+	requirement string
+	check       func(raw []byte) []string
+}
+
+var complianceChecks = []complianceCheck{
+	{"record-length", "Leader/00-04 is the length of the record, ending with the record terminator (1D)", checkRecordLength},
+	{"leader", "Leader/10-11 is 22, leader/20-23 is 4500 and leader/05-07 hold MARC 21 codes", checkLeaderCodes},
+	{"base-address", "Leader/12-16 is the length of the leader and directory", checkBaseAddress},
+	{"directory", "The directory is made of numeric 12 byte entries with valid tags, ending with the field terminator (1E)", checkDirectoryEntries},
+	{"directory-arithmetic", "The directory entries lay the fields end to end, from the base address to the record terminator", checkDirectoryArithmetic},
+	{"field-terminators", "Each field ends with the field terminator (1E), and has no other", checkFieldTerminators},
+	{"data-fields", "Control fields have no subfields; data fields have two indicators followed by subfields", checkFieldStructure},
+	{"character-set", "Leader/09 declares the character set the data is in: blank for MARC-8, a for UTF-8", checkCharacterSet},
+	{"character-set-declaration", "A MARC-8 record switching to other character sets declares them in 066", checkCharacterSetDeclaration},
+}
+
+// leaderCodes are the MARC 21 values of leader/05, 06 and 07.
+var leaderCodes = []struct {
+	position int
+	codes    string
+}{
+	{5, "acdnps"},
+	{6, marc21RecordTypes},
+	{7, " abcdims"},
+}
+
+func checkRecordLength(raw []byte) []string {
+	var found []string
+	if n, err := strconv.Atoi(string(raw[0:5])); err != nil || n != len(raw) {
+		found = append(found, fmt.Sprintf("record length %q is not the %d bytes read", raw[0:5], len(raw)))
+	}
+	if raw[len(raw)-1] != marcfilter.RecordTerminator {
+		found = append(found, "the record does not end with the record terminator")
+	} else if i := bytes.IndexByte(raw, marcfilter.RecordTerminator); i < len(raw)-1 {
+		found = append(found, fmt.Sprintf("record terminator inside the record, at %d", i))
+	}
+	return found
+}
+
+func checkLeaderCodes(raw []byte) []string {
+	var found []string
+	if string(raw[10:12]) != "22" {
+		found = append(found, fmt.Sprintf("indicator and subfield code counts are %q", raw[10:12]))
+	}
+	if string(raw[20:24]) != "4500" {
+		found = append(found, fmt.Sprintf("entry map is %q", raw[20:24]))
+	}
+	for _, l := range leaderCodes {
+		if strings.IndexByte(l.codes, raw[l.position]) < 0 {
+			found = append(found, fmt.Sprintf("leader/%02d is %q", l.position, raw[l.position]))
+		}
+	}
+	return found
+}
+
+func checkBaseAddress(raw []byte) []string {
+	base, err := strconv.Atoi(string(raw[12:17]))
+	if err != nil || base <= marcfilter.LeaderLength || base > len(raw) {
+		return []string{fmt.Sprintf("base address %q is not within the record", raw[12:17])}
+	}
+	// the directory ends at the first field terminator
+	end := bytes.IndexByte(raw[marcfilter.LeaderLength:], marcfilter.FieldTerminator)
+	if end >= 0 && marcfilter.LeaderLength+end+1 != base {
+		return []string{fmt.Sprintf("base address is %d, but the directory ends at %d", base, marcfilter.LeaderLength+end+1)}
+	}
+	return nil
+}
+
+func checkDirectoryEntries(raw []byte) []string {
+	entries, base, diagnostics := scanDirectory(raw)
+	if base == 0 {
+		return []string{"the directory cannot be found without a base address"}
+	}
+	var found []string
+	for _, d := range diagnostics {
+		found = append(found, d.Message)
+	}
+	for _, e := range entries {
+		if !tagPatternRegexp.MatchString(e.tag) {
+			found = append(found, fmt.Sprintf("invalid tag %q", e.tag))
+		}
+	}
+	if len(entries) == 0 {
+		found = append(found, "the directory is empty")
+	}
+	return found
+}
+
+func checkDirectoryArithmetic(raw []byte) []string {
+	entries, base, _ := scanDirectory(raw)
+	if base == 0 {
+		return []string{"the fields cannot be found without a base address"}
+	}
+	var found []string
+	next := 0
+	for _, e := range entries {
+		switch {
+		case e.start > next:
+			found = append(found, fmt.Sprintf("%s starts at %d, leaving %d bytes unaccounted for", e.tag, e.start, e.start-next))
+		case e.start < next:
+			found = append(found, fmt.Sprintf("%s starts at %d, overlapping the field before", e.tag, e.start))
+		}
+		if base+e.start+e.length > len(raw)-1 {
+			found = append(found, fmt.Sprintf("%s of %d bytes at %d runs past the data", e.tag, e.length, e.start))
+		}
+		if e.start+e.length > next {
+			next = e.start + e.length
+		}
+	}
+	if data := len(raw) - 1 - base; next < data {
+		found = append(found, fmt.Sprintf("the fields end at %d, leaving %d bytes of data unaccounted for", next, data-next))
+	}
+	return found
+}
+
+func checkFieldTerminators(raw []byte) []string {
+	entries, base, _ := scanDirectory(raw)
+	var found []string
+	for _, e := range entries {
+		end := base + e.start + e.length
+		if e.length == 0 || end > len(raw)-1 {
+			continue
+		}
+		switch data := raw[base+e.start : end]; {
+		case data[len(data)-1] != marcfilter.FieldTerminator:
+			found = append(found, fmt.Sprintf("%s does not end with a field terminator", e.tag))
+		case bytes.IndexByte(data, marcfilter.FieldTerminator) < len(data)-1:
+			found = append(found, fmt.Sprintf("%s has a field terminator inside it", e.tag))
+		}
+	}
+	return found
+}
+
+func checkFieldStructure(raw []byte) []string {
+	entries, base, _ := scanDirectory(raw)
+	var found []string
+	for _, e := range entries {
+		end := base + e.start + e.length
+		if e.length == 0 || end > len(raw)-1 {
+			continue
+		}
+		data := raw[base+e.start : end-1]
+		control := strings.HasPrefix(e.tag, "00")
+		switch {
+		case control && bytes.IndexByte(data, marcfilter.SubfieldDelimiter) >= 0:
+			found = append(found, fmt.Sprintf("control field %s has a subfield delimiter", e.tag))
+		case !control && (len(data) < 4 || data[2] != marcfilter.SubfieldDelimiter):
+			found = append(found, fmt.Sprintf("%s does not have two indicators followed by a subfield", e.tag))
+		}
+	}
+	return found
+}
+
+func checkCharacterSet(raw []byte) []string {
+	_, base, _ := scanDirectory(raw)
+	if base == 0 {
+		base = marcfilter.LeaderLength
+	}
+	data := raw[base:]
+	switch raw[9] {
+	case 'a':
+		if !utf8.Valid(data) {
+			return []string{"declared UTF-8, but the data is not valid UTF-8"}
+		}
+		if bytes.IndexByte(data, escape) >= 0 {
+			return []string{"declared UTF-8, but the data has MARC-8 escape sequences"}
+		}
+	case ' ':
+		if utf8.Valid(data) && !isASCII(string(data)) && bytes.IndexByte(data, escape) < 0 {
+			return []string{"declared MARC-8, but the data reads as UTF-8"}
+		}
+		if strings.ContainsRune(decodeMarc8(string(data)), utf8.RuneError) {
+			return []string{"declared MARC-8, but the data has codes outside the MARC-8 character sets known"}
+		}
+	default:
+		return []string{fmt.Sprintf("leader/09 is %q", raw[9])}
+	}
+	return nil
+}
+
+func checkCharacterSetDeclaration(raw []byte) []string {
+	if raw[9] != ' ' || bytes.IndexByte(raw, escape) < 0 {
+		return nil
+	}
+	entries, _, _ := scanDirectory(raw)
+	for _, e := range entries {
+		if e.tag == "066" {
+			return nil
+		}
+	}
+	return []string{"escape sequences switch character sets, but there is no 066"}
+}
+
+// A complianceExample is a record failing a requirement.
+type complianceExample struct {
+	record  int
+	offset  int64
+	id      string
+	problem string
+}
+
+// getComplianceAction returns an action checking each record against
+// the requirements, and reporting on the inputs once all are read.
+func getComplianceAction(inputs []string) actionFunc {
+	checked, compliant := 0, 0
+	failing := make([]int, len(complianceChecks))
+	examples := make([][]complianceExample, len(complianceChecks))
+
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(w, "# ISO 2709 / MARC 21 compliance report\n\n")
+		fmt.Fprintf(w, "- Input: %s\n", strings.Join(inputs, ", "))
+		fmt.Fprintf(w, "- Checked: %s\n", time.Now().Format("2006-01-02 15:04 MST"))
+		fmt.Fprintf(w, "- Records: %d\n", checked)
+		fmt.Fprintf(w, "- Compliant records: %d (%s)\n\n", compliant, percentOf(compliant, checked))
+
+		fmt.Fprintf(w, "| Check | Failing | Passing | Requirement |\n|---|---:|---:|---|\n")
+		for i, c := range complianceChecks {
+			fmt.Fprintf(w, "| %s | %d | %s | %s |\n", c.name, failing[i], percentOf(checked-failing[i], checked), c.requirement)
+		}
+
+		for i, c := range complianceChecks {
+			if failing[i] == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "\n## %s\n\n%s.\n\nRecords failing: %d", c.name, c.requirement, failing[i])
+			if failing[i] > len(examples[i]) {
+				fmt.Fprintf(w, ", the first %d of them", len(examples[i]))
+			}
+			fmt.Fprintf(w, "\n\n")
+			for _, e := range examples[i] {
+				fmt.Fprintf(w, "- record %d at offset %d (001 %s): %s\n", e.record, e.offset, e.id, e.problem)
+			}
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		checked += 1
+		ok := true
+		for i, c := range complianceChecks {
+			problems := c.check(record.Raw)
+			if len(problems) == 0 {
+				continue
+			}
+			ok = false
+			failing[i] += 1
+			if len(examples[i]) < complianceExamples {
+				examples[i] = append(examples[i], complianceExample{record.Number, record.Offset, controlNumber(record), strings.Join(problems, "; ")})
+			}
+		}
+		if ok {
+			compliant += 1
+		}
+		return nil
+	}
+}
+
+// percentOf formats n as a percentage of total.
+func percentOf(n int, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
@@ -0,0 +1,191 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The configuration file, -config, or .marcdump in the home directory
+// if there is one. It defines selector macros, the queries that keep
+// coming back, one to a line:
+//
+//    # the items of a location
+//    bylocation(X) := 852_b=^X$
+//    onshelf(X, Y) := bylocation(X) AND NOT 876_j=Y
+//    ebooks() := ldr/06=a AND 856_u
+//
+// A macro is called in a selector with arguments for its parameters,
+// -s 'bylocation(MAIN) AND 650', and is replaced by its expression,
+// in parentheses, with each parameter replaced by its argument as it
+// is written. Macros can call the macros defined before them. A blank
+// line or one starting with # is ignored.
+
+var (
+	errMacroRecursion   = errors.New("marcdump: selector macros call each other without end")
+	errMacroParenthesis = errors.New("missing closing parenthesis")
+)
+
+var (
+	// Group 1: name
+	// Group 2: parameters
+	// Group 3: expression
+	macroDefinitionRegexp = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)\(([^()]*)\)\s*:=\s*(.+)$`)
+
+	macroCallRegexp = regexp.MustCompile(`(^|[\s(])([A-Za-z][A-Za-z0-9_]*)\(`)
+	parameterRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+)
+
+// A selectorMacro is a named selector expression with parameters.
+type selectorMacro struct {
+	params []string
+	expr   string
+}
+
+var selectorMacros = make(map[string]*selectorMacro)
+
+// maxMacroDepth is how deeply macro calls can be nested.
+const maxMacroDepth = 20
+
+// loadConfig reads the configuration file, the default one only if it
+// exists.
+func loadConfig(name string) error {
+	if name == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return nil
+		}
+		name = filepath.Join(home, ".marcdump")
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		m := macroDefinitionRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return fmt.Errorf("%s:%d: not a macro definition, name(params) := selector", name, n)
+		}
+		macro := &selectorMacro{expr: m[3]}
+		if params := strings.TrimSpace(m[2]); params != "" {
+			for _, p := range strings.Split(params, ",") {
+				p = strings.TrimSpace(p)
+				if !parameterRegexp.MatchString(p) {
+					return fmt.Errorf("%s:%d: invalid macro parameter %q", name, n, p)
+				}
+				macro.params = append(macro.params, p)
+			}
+		}
+		if _, err := expandMacros(macro.expr, 0); err != nil {
+			return fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+		selectorMacros[m[1]] = macro
+	}
+	return scanner.Err()
+}
+
+// expandMacros replaces the macro calls of a selector expression.
+func expandMacros(expr string, depth int) (string, error) {
+	if depth > maxMacroDepth {
+		return "", errMacroRecursion
+	}
+	var b strings.Builder
+	for {
+		loc := macroCallRegexp.FindStringSubmatchIndex(expr)
+		if loc == nil {
+			b.WriteString(expr)
+			return b.String(), nil
+		}
+		name := expr[loc[4]:loc[5]]
+		macro := selectorMacros[name]
+		if macro == nil {
+			// a parenthesis in a criterion, e.g. 245_a=Dracula(
+			b.WriteString(expr[:loc[1]])
+			expr = expr[loc[1]:]
+			continue
+		}
+		args, rest, err := macroArguments(expr[loc[1]:])
+		if err != nil {
+			return "", fmt.Errorf("marcdump: selector macro %s: %v", name, err)
+		}
+		if len(args) != len(macro.params) {
+			return "", fmt.Errorf("marcdump: selector macro %s takes %d arguments, not %d", name, len(macro.params), len(args))
+		}
+		body := macro.expr
+		if len(args) > 0 {
+			values := make(map[string]string)
+			for i, p := range macro.params {
+				values[p] = args[i]
+			}
+			params := regexp.MustCompile(`\b(` + strings.Join(macro.params, "|") + `)\b`)
+			body = params.ReplaceAllStringFunc(body, func(p string) string {
+				return values[p]
+			})
+		}
+		if body, err = expandMacros(body, depth+1); err != nil {
+			return "", err
+		}
+		b.WriteString(expr[:loc[4]])
+		b.WriteString("(" + body + ")")
+		expr = rest
+	}
+}
+
+// macroArguments splits the arguments of a macro call, following its
+// opening parenthesis, at the commas outside parentheses, and returns
+// what follows the call.
+func macroArguments(s string) ([]string, string, error) {
+	var args []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		case ')':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if last := strings.TrimSpace(s[start:i]); last != "" || len(args) > 0 {
+				args = append(args, last)
+			}
+			return args, s[i+1:], nil
+		}
+	}
+	return nil, "", errMacroParenthesis
+}
@@ -0,0 +1,225 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strings"
+)
+
+// Selector conformance. MARCXML and .mrk inputs are read as ISO 2709
+// (see reader.go), so a selector should select the same records of a
+// file whichever of the three it is written in. marcdump conformance
+// file writes each record of a file as MARCXML and as .mrk, reads it
+// back, and checks that each of a suite of selectors, covering
+// subfields, indicators, positions, modifiers and boolean logic,
+// matches the three alike:
+//
+//    ldr/06=a AND 245/ind1=1: iso 900 mrk 900 xml 900 of 2700 records
+//
+// A record the three disagree on is named by its number. -selectors
+// file runs the selectors of a file instead, one to a line, blank lines
+// and lines starting with # being skipped. Records are converted to
+// UTF-8 first, as MARCXML always is, unless -raw is given.
+
+var (
+	errConformanceArgs  = errors.New("marcdump: conformance takes a file of records")
+	errConformanceFails = errors.New("marcdump: the selectors do not match every serialization alike")
+)
+
+// conformanceSelectors is the suite run without -selectors.
+var conformanceSelectors = []string{
+	"001",
+	"245_a",
+	"245_a=^[A-M]",
+	"245_a/i=the",
+	"245_a/p=A",
+	"100_a/en=\"Einstein, Albert\"",
+	"650_a=History OR 651_a=History",
+	"020_a AND NOT 650_v",
+	"(100 OR 110) AND 245_c",
+	"ldr/06=a",
+	"ldr/06-07=am",
+	"ldr/09=a",
+	"008/35-37=eng",
+	"008/35-37/i=ENG",
+	"008/07-10=^[0-9]{4}$",
+	"245/ind1=1",
+	"245/ind2=0",
+	"856/ind2=0",
+	"856_1=4",
+	"856_2=#",
+	"ldr/06=a AND 245/ind1=1",
+	"NOT 001=^ocm",
+	"856_u=^https?://",
+	"852_h OR 866_a",
+}
+
+// conformance parses the arguments following "conformance" and checks
+// the selectors against the records of a file.
+func conformance(args []string) error {
+	flags := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	selectorFile := flags.String("selectors", "", "Check the selectors in `file`, one to a line, instead of the built-in suite")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errConformanceArgs
+	}
+
+	exprs := conformanceSelectors
+	if *selectorFile != "" {
+		var err error
+		if exprs, err = readSelectorSuite(*selectorFile); err != nil {
+			return err
+		}
+	}
+	selectors := make([]marcfilter.Selector, len(exprs))
+	for i, expr := range exprs {
+		s, err := parseSelector(expr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", expr, err)
+		}
+		selectors[i] = s
+	}
+
+	// the matches of each selector by serialization, and the records
+	// they disagree on
+	serializations := []string{"iso", "mrk", "xml"}
+	matches := make([][3]int, len(selectors))
+	disagree := make([][]int, len(selectors))
+	records := 0
+
+	reader := newInputReader(flags.Args())
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			return err
+		} else if record == nil {
+			break
+		}
+		if !rawOutput {
+			if record, err = convertRecord(record); err != nil {
+				return err
+			}
+		}
+		records++
+
+		copies, err := serializedCopies(record)
+		if err != nil {
+			return fmt.Errorf("record %d: %v", record.Number, err)
+		}
+		for i, s := range selectors {
+			var matched [3]bool
+			for j, r := range copies {
+				if matched[j] = s.Match(r.MarcRecord); matched[j] {
+					matches[i][j]++
+				}
+			}
+			if matched[0] != matched[1] || matched[0] != matched[2] {
+				disagree[i] = append(disagree[i], record.Number)
+			}
+		}
+	}
+
+	failed := 0
+	for i, expr := range exprs {
+		fmt.Printf("%s:", expr)
+		for j, name := range serializations {
+			fmt.Printf(" %s %d", name, matches[i][j])
+		}
+		fmt.Printf(" of %d records\n", records)
+		if len(disagree[i]) > 0 {
+			failed++
+			fmt.Printf("    differs on records %s\n", recordNumbers(disagree[i]))
+		}
+	}
+	fmt.Printf("%d of %d selectors match alike\n", len(exprs)-failed, len(exprs))
+	if failed > 0 {
+		return errConformanceFails
+	}
+	return nil
+}
+
+// serializedCopies returns a record as it is, and as read back from
+// .mrk and from MARCXML.
+func serializedCopies(record *marcfilter.Record) ([3]*marcfilter.Record, error) {
+	copies := [3]*marcfilter.Record{record}
+	names := []string{"mrk", "marcxml"}
+	for i, f := range []marcfilter.Formatter{mrkFormatter{}, marcfilter.MARCXMLFormatter{}} {
+		var b bytes.Buffer
+		if err := f.Header(&b); err != nil {
+			return copies, err
+		}
+		if err := f.Record(&b, record); err != nil {
+			return copies, err
+		}
+		if err := f.Footer(&b); err != nil {
+			return copies, err
+		}
+
+		rr := newRecordReader(&b)
+		rr.sniff()
+		if rr.decoder == nil {
+			return copies, fmt.Errorf("%s output not recognized as input", names[i])
+		}
+		r, err := rr.Next()
+		if err != nil {
+			return copies, err
+		} else if r == nil {
+			return copies, fmt.Errorf("no record read back from %s", names[i])
+		}
+		copies[i+1] = r
+	}
+	return copies, nil
+}
+
+// readSelectorSuite reads the selectors of a file, one to a line.
+func readSelectorSuite(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var exprs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			exprs = append(exprs, line)
+		}
+	}
+	return exprs, scanner.Err()
+}
+
+// recordNumbers lists record numbers, the first ten of them.
+func recordNumbers(numbers []int) string {
+	var parts []string
+	for i, n := range numbers {
+		if i == 10 {
+			parts = append(parts, fmt.Sprintf("and %d more", len(numbers)-10))
+			break
+		}
+		parts = append(parts, fmt.Sprint(n))
+	}
+	return strings.Join(parts, " ")
+}
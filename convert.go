@@ -0,0 +1,226 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// -convert-encoding writes the selected records to a file as UTF-8.
+// With -verify the file is read back once it is written and every
+// record is checked against the one it was converted from.
+
+// A subfieldCount is the number of characters a subfield (or control
+// field) should have after conversion.
+type subfieldCount struct {
+	tag   string
+	code  string
+	chars int
+}
+
+func (c subfieldCount) String() string {
+	if c.code == "" {
+		return c.tag
+	}
+	return c.tag + "$" + c.code
+}
+
+// A conversion is what is known about a record before it was converted.
+type conversion struct {
+	number int
+	offset int64
+	id     string
+	marc8  bool
+	counts []subfieldCount
+}
+
+// getConvertAction returns an action writing the selected records to
+// the named file converted to UTF-8, verifying the file afterwards if
+// verify is set.
+func getConvertAction(name string, verify bool) (actionFunc, error) {
+	out, err := createMarcWriter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var conversions []*conversion
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(os.Stderr, "%d records converted to %s\n", out.count, name)
+		if err := out.close(); err != nil {
+			return err
+		}
+		if !verify {
+			return nil
+		}
+		return verifyConversion(w, name, conversions)
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		if verify {
+			c, err := countCharacters(record)
+			if err != nil {
+				return err
+			}
+			conversions = append(conversions, c)
+		}
+		converted, err := convertRecord(record)
+		if err != nil {
+			return err
+		}
+		return out.write(converted.Raw)
+	}, nil
+}
+
+// countCharacters records how many characters each subfield of a record
+// holds, counting the MARC-8 bytes independently of the conversion.
+func countCharacters(record *marcfilter.Record) (*conversion, error) {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return nil, err
+	}
+	c := &conversion{
+		number: record.Number,
+		offset: record.Offset,
+		id:     controlNumber(record),
+		marc8:  m.Leader[9] == ' ',
+	}
+	count := utf8.RuneCountInString
+	if c.marc8 {
+		count = marc8Length
+	}
+	for _, f := range m.Fields {
+		if f.Subfields == nil {
+			c.counts = append(c.counts, subfieldCount{f.Tag, "", count(f.Value)})
+		}
+		for _, sf := range f.Subfields {
+			c.counts = append(c.counts, subfieldCount{f.Tag, sf.Code, count(sf.Value)})
+		}
+	}
+	return c, nil
+}
+
+// marc8Length returns the number of characters in a MARC-8 string,
+// leaving out escape sequences and the non-sort markers that conversion
+// drops.
+func marc8Length(s string) int {
+	d := marc8Decoder{g0: setBasicLatin, g1: setANSEL}
+	n := 0
+	for i := 0; i < len(s); {
+		b := s[i]
+		switch {
+		case b == escape:
+			i += d.designate(s[i:])
+			continue
+		case b == 0x88 || b == 0x89:
+		case b > 0x20 && b != 0x7f && b != 0xff && (b < 0x80 || b > 0xa0):
+			final := d.g0
+			if b >= 0x80 {
+				final = d.g1
+			}
+			if set := marc8Sets[final]; set != nil && set.width > 1 {
+				i += set.width
+				n++
+				continue
+			}
+			n++
+		default:
+			n++
+		}
+		i++
+	}
+	return n
+}
+
+// verifyConversion reads back the converted file and prints the
+// problems found in each record, followed by a summary.
+func verifyConversion(w *tabwriter.Writer, name string, conversions []*conversion) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rr := newRecordReader(file)
+	failed := 0
+	for _, c := range conversions {
+		record, err := rr.Next()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if record == nil {
+			fmt.Fprintf(w, "%s holds %d records, %d were converted\n", name, rr.Count, len(conversions))
+			return w.Flush()
+		}
+
+		problems := c.verify(record)
+		if len(problems) > 0 {
+			failed++
+		}
+		for _, p := range problems {
+			fmt.Fprintf(w, "record %d\toffset %d\t%s\t%s\n", c.number, c.offset, c.id, p)
+		}
+	}
+	fmt.Fprintf(w, "%d records verified, %d with problems\n", len(conversions), failed)
+	return w.Flush()
+}
+
+// verify compares a converted record with the counts taken before it
+// was converted.
+func (c *conversion) verify(record *marcfilter.Record) []string {
+	var problems []string
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if m.Leader[9] != 'a' {
+		problems = append(problems, fmt.Sprintf("Leader/09 is %q, not 'a'", m.Leader[9]))
+	}
+
+	var counts []subfieldCount
+	for _, f := range m.Fields {
+		values := []marcfilter.Subfield{{Value: f.Value}}
+		if f.Subfields != nil {
+			values = f.Subfields
+		}
+		for _, sf := range values {
+			name := subfieldCount{tag: f.Tag, code: sf.Code}.String()
+			if !utf8.ValidString(sf.Value) {
+				problems = append(problems, name+" is not valid UTF-8")
+			} else if n := strings.Count(sf.Value, string(utf8.RuneError)); n > 0 && c.marc8 {
+				problems = append(problems, fmt.Sprintf("%s has %d unmapped characters", name, n))
+			}
+			counts = append(counts, subfieldCount{f.Tag, sf.Code, utf8.RuneCountInString(sf.Value)})
+		}
+	}
+
+	if len(counts) != len(c.counts) {
+		return append(problems, fmt.Sprintf("%d subfields in, %d out", len(c.counts), len(counts)))
+	}
+	for i, in := range c.counts {
+		out := counts[i]
+		switch {
+		case in.tag != out.tag || in.code != out.code:
+			problems = append(problems, fmt.Sprintf("%s became %s", in, out))
+		case in.chars != out.chars:
+			problems = append(problems, fmt.Sprintf("%s has %d characters in, %d out", in, in.chars, out.chars))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,131 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"text/tabwriter"
+)
+
+// Field co-occurrence. -cooccur counts the records each pair of tags
+// appears in together, which shows the local practices of a file that
+// nobody wrote down: the 590 that always comes with a 035 from one
+// vendor, the 9xx fields that only ever appear beside a 856.
+//
+// -cooccur pairs lists the pairs, the most common first, with the share
+// of the records having each tag that also have the other.
+// -cooccur matrix writes a table of every tag against every other, the
+// diagonal holding the records having the tag at all.
+
+var errInvalidCooccur = errors.New("marcdump: -cooccur must be pairs or matrix")
+
+type tagPair struct {
+	a, b string
+}
+
+func getCooccurrenceAction(mode string) (actionFunc, error) {
+	if mode != "pairs" && mode != "matrix" {
+		return nil, errInvalidCooccur
+	}
+	tagRecords := make(map[string]int)
+	pairRecords := make(map[tagPair]int)
+
+	onFinish(func(w *tabwriter.Writer) error {
+		tags := make([]string, 0, len(tagRecords))
+		for tag := range tagRecords {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		if mode == "matrix" {
+			writeCooccurrenceMatrix(w, tags, tagRecords, pairRecords)
+		} else {
+			writeCooccurrencePairs(w, tagRecords, pairRecords)
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		seen := make(map[string]bool)
+		var tags []string
+		for _, f := range m.Fields {
+			if !seen[f.Tag] {
+				seen[f.Tag] = true
+				tags = append(tags, f.Tag)
+			}
+		}
+		sort.Strings(tags)
+		for i, a := range tags {
+			tagRecords[a] += 1
+			for _, b := range tags[i+1:] {
+				pairRecords[tagPair{a, b}] += 1
+			}
+		}
+		return nil
+	}, nil
+}
+
+func writeCooccurrencePairs(w *tabwriter.Writer, tagRecords map[string]int, pairRecords map[tagPair]int) {
+	pairs := make([]tagPair, 0, len(pairRecords))
+	for p := range pairRecords {
+		pairs = append(pairs, p)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairRecords[pairs[i]] != pairRecords[pairs[j]] {
+			return pairRecords[pairs[i]] > pairRecords[pairs[j]]
+		}
+		if pairs[i].a != pairs[j].a {
+			return pairs[i].a < pairs[j].a
+		}
+		return pairs[i].b < pairs[j].b
+	})
+
+	fmt.Fprintf(w, "tag\ttag\trecords\tof first\tof second\n")
+	for _, p := range pairs {
+		n := pairRecords[p]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1f%%\t%.1f%%\n", p.a, p.b, n,
+			100*float64(n)/float64(tagRecords[p.a]), 100*float64(n)/float64(tagRecords[p.b]))
+	}
+}
+
+func writeCooccurrenceMatrix(w *tabwriter.Writer, tags []string, tagRecords map[string]int, pairRecords map[tagPair]int) {
+	fmt.Fprintf(w, "tag")
+	for _, tag := range tags {
+		fmt.Fprintf(w, "\t%s", tag)
+	}
+	fmt.Fprintln(w)
+	for _, a := range tags {
+		fmt.Fprintf(w, "%s", a)
+		for _, b := range tags {
+			var n int
+			switch {
+			case a == b:
+				n = tagRecords[a]
+			case a < b:
+				n = pairRecords[tagPair{a, b}]
+			default:
+				n = pairRecords[tagPair{b, a}]
+			}
+			fmt.Fprintf(w, "\t%d", n)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"text/tabwriter"
+)
+
+// Quiet matching, in the manner of grep -c and grep -l: only the number
+// of selected records, or only their control numbers, is printed.
+
+func getCountAction() actionFunc {
+	count := 0
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(w, "%d\n", count)
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		count += 1
+		return nil
+	}
+}
+
+func getListAction() actionFunc {
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		fmt.Fprintln(w, controlNumber(record))
+		return w.Flush()
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"strings"
+)
+
+// Tabular output, one row per record. -columns lists the columns, each
+// a field or subfield or a part of the parsed title or main name:
+//
+//    001,245_a,260_c,020_a,title.responsibility,name.dates
+//
+// The values of repeated fields are joined with -join. TSV rows are
+// escaped from the tabwriter so that their tabs survive.
+
+// A csvColumn pulls one value out of a record.
+type csvColumn struct {
+	name  string
+	value func(record *marcfilter.Record, parts *parsedRecord) string
+}
+
+// partColumns are the columns taken from the parsed title and names.
+var partColumns = map[string]func(p *parsedRecord) string{
+	"title.proper":         func(p *parsedRecord) string { return titlePart(p).Proper },
+	"title.remainder":      func(p *parsedRecord) string { return titlePart(p).Remainder },
+	"title.responsibility": func(p *parsedRecord) string { return titlePart(p).Responsibility },
+	"name":                 func(p *parsedRecord) string { return mainName(p).Name },
+	"name.dates":           func(p *parsedRecord) string { return mainName(p).Dates },
+	"name.relators":        func(p *parsedRecord) string { return strings.Join(mainName(p).Relators, joinOpt) },
+}
+
+func titlePart(p *parsedRecord) *titleParts {
+	if p.Title == nil {
+		return new(titleParts)
+	}
+	return p.Title
+}
+
+// mainName returns the parsed 100, if the record has one.
+func mainName(p *parsedRecord) nameParts {
+	if len(p.Names) > 0 && p.Names[0].Tag == "100" {
+		return p.Names[0]
+	}
+	return nameParts{}
+}
+
+// parseColumns parses a column specification.
+func parseColumns(spec string) ([]csvColumn, error) {
+	var columns []csvColumn
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if part, ok := partColumns[name]; ok {
+			columns = append(columns, csvColumn{name, func(record *marcfilter.Record, p *parsedRecord) string {
+				return part(p)
+			}})
+			continue
+		}
+
+		m := marcfilter.SpecRegexp.FindStringSubmatch(name)
+		if m == nil || m[3] != "" {
+			return nil, fmt.Errorf("marcdump: invalid column %q", name)
+		}
+		tag, code := m[1], m[2]
+		columns = append(columns, csvColumn{name, func(record *marcfilter.Record, p *parsedRecord) string {
+			return strings.Join(marcfilter.FieldValues(record.MarcRecord, tag, code), joinOpt)
+		}})
+	}
+	return columns, nil
+}
+
+type csvFormatter struct {
+	columns []csvColumn
+	comma   rune
+	parsed  bool // whether any column needs the parsed parts
+}
+
+func newCSVFormatter(comma rune) (marcfilter.Formatter, error) {
+	if presetColumns != nil {
+		// the columns of a preset are titled in words (see presets.go)
+		return &csvFormatter{columns: presetColumns, comma: comma, parsed: true}, nil
+	}
+	columns, err := parseColumns(columnsOpt)
+	if err != nil {
+		return nil, err
+	}
+	f := &csvFormatter{columns: columns, comma: comma}
+	for _, c := range columns {
+		if _, ok := partColumns[c.name]; ok {
+			f.parsed = true
+		}
+	}
+	return f, nil
+}
+
+func (f *csvFormatter) Header(w io.Writer) error {
+	row := make([]string, len(f.columns))
+	for i, c := range f.columns {
+		row[i] = c.name
+	}
+	return f.write(w, row)
+}
+
+func (f *csvFormatter) Record(w io.Writer, record *marcfilter.Record) error {
+	parts := new(parsedRecord)
+	if f.parsed {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		parts = parseRecordParts(m, parseClean)
+	}
+
+	row := make([]string, len(f.columns))
+	for i, c := range f.columns {
+		row[i] = c.value(record, parts)
+	}
+	return f.write(w, row)
+}
+
+func (f *csvFormatter) Footer(w io.Writer) error {
+	return nil
+}
+
+func (f *csvFormatter) write(w io.Writer, row []string) error {
+	var b bytes.Buffer
+	out := csv.NewWriter(&b)
+	out.Comma = f.comma
+	out.Write(row)
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return err
+	}
+
+	if f.comma != '\t' {
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+	return writeVerbatim(w, b.Bytes())
+}
@@ -0,0 +1,154 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Cutting records out of a file by their byte range, to look at the
+// record a diagnostic or an index points to without reading the
+// gigabytes before it. marcdump [options] cut -offset n [-length m]
+// file.mrc reads the records in the m bytes at offset n, or just the
+// record at n, as the input of the options; -o, -validate, -extract
+// and the rest work as they do on a whole file, and offsets are still
+// those of the file. The range must start at a record, as its leader
+// says, and end where a record does; when it does not, the error gives
+// the offsets of the records around it.
+
+var (
+	errCutArgs       = errors.New("marcdump: cut takes -offset and a single file")
+	errCutCompressed = errors.New("marcdump: cannot cut a compressed file")
+)
+
+// cutSearchLength is how far around a bad offset to look for the
+// records around it.
+const cutSearchLength = 1 << 20
+
+// getCutReader parses the arguments following "cut" and returns the
+// name of the file, the offset of the range and the records in it.
+func getCutReader(args []string) (string, int64, io.ReadCloser, error) {
+	flags := flag.NewFlagSet("cut", flag.ContinueOnError)
+	offset := flags.Int64("offset", -1, "Byte `offset` of the first record")
+	length := flags.Int64("length", 0, "Number of `bytes` to read; the length of the first record by default")
+	if err := flags.Parse(args); err != nil {
+		return "", 0, nil, err
+	}
+	if flags.NArg() != 1 || *offset < 0 || *length < 0 {
+		return "", 0, nil, errCutArgs
+	}
+	name := flags.Arg(0)
+
+	file, err := os.Open(name)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if isCompressed(file) {
+		file.Close()
+		return "", 0, nil, errCutCompressed
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return "", 0, nil, err
+	}
+	if err := checkCut(file, info.Size(), *offset, length); err != nil {
+		file.Close()
+		return "", 0, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return name, *offset, struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, *offset, *length), file}, nil
+}
+
+// checkCut checks that the range of a file starts at a record and ends
+// where a record does, following the record lengths of the leaders. A
+// length of 0 is set to that of the record at the offset.
+func checkCut(file io.ReaderAt, size int64, offset int64, length *int64) error {
+	if offset >= size {
+		return fmt.Errorf("offset %d is past the end of the file, at %d", offset, size)
+	}
+	if *length == 0 {
+		n, ok := cutRecordLength(file, offset)
+		if !ok {
+			return cutMisplaced(file, size, offset)
+		}
+		*length = int64(n)
+	}
+	end := offset + *length
+	if end > size {
+		return fmt.Errorf("the range ends at %d, past the end of the file, at %d", end, size)
+	}
+	for at := offset; at < end; {
+		n, ok := cutRecordLength(file, at)
+		if !ok {
+			return cutMisplaced(file, size, at)
+		}
+		if at+int64(n) > end {
+			return fmt.Errorf("the range ends at %d, within the record at %d, which ends at %d", end, at, at+int64(n))
+		}
+		at += int64(n)
+	}
+	return nil
+}
+
+// cutRecordLength returns the record length in the leader at offset, if
+// there is a plausible one.
+func cutRecordLength(file io.ReaderAt, offset int64) (int, bool) {
+	leader := make([]byte, 5)
+	if _, err := file.ReadAt(leader, offset); err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(leader))
+	return n, err == nil && n > marcfilter.LeaderLength
+}
+
+// cutMisplaced returns an error for an offset that is not the start of
+// a record, giving the offsets of the records around it, which start
+// after the record terminators either side.
+func cutMisplaced(file io.ReaderAt, size int64, offset int64) error {
+	msg := fmt.Sprintf("no record starts at offset %d", offset)
+
+	start := offset - cutSearchLength
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, offset-start)
+	file.ReadAt(buf, start)
+	i := bytes.LastIndexByte(buf, marcfilter.RecordTerminator)
+	switch {
+	case i >= 0 && start+int64(i)+1 == offset:
+		msg += ", though a record ends before it"
+	case i >= 0:
+		msg += fmt.Sprintf("; the record it falls in starts at %d", start+int64(i)+1)
+	case start == 0:
+		msg += "; the record it falls in starts at 0"
+	}
+
+	buf = make([]byte, cutSearchLength)
+	n, _ := file.ReadAt(buf, offset)
+	if i := bytes.IndexByte(buf[:n], marcfilter.RecordTerminator); i >= 0 && offset+int64(i)+1 < size {
+		msg += fmt.Sprintf("; the next record starts at %d", offset+int64(i)+1)
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,206 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Deduplication. -dedupe 035_a groups the records sharing a value of
+// the key field, or key expression (-dedupe id for the -id-expr, see
+// ids.go), into clusters; records sharing values with two clusters
+// join them into one. Each cluster of duplicates is reported as
+//
+//    values    count    kept record    other records
+//
+// records being named by their 001. One record of each cluster is kept:
+// the first, or with -dedupe-keep largest the longest one. -dedupe-out
+// writes the kept records, and those without duplicates, in input
+// order. ISBNs are compared in their ISBN-13 form, other values with
+// surrounding spaces trimmed.
+
+var (
+	errInvalidDedupeKey  = errors.New("marcdump: invalid dedupe key field")
+	errInvalidDedupeKeep = errors.New("marcdump: -dedupe-keep must be first or largest")
+)
+
+// A dedupeRecord is what deduplication keeps of a record: where it was
+// spooled, if anywhere, and the cluster it is in.
+type dedupeRecord struct {
+	id     string
+	length int
+	offset int64
+	parent int // union-find parent, the record itself for a cluster root
+}
+
+// getDedupeAction returns an action clustering the records by their key
+// values, reporting the clusters and writing the records kept once all
+// the records have been seen.
+func getDedupeAction(keyField string, keep string, outName string) (actionFunc, error) {
+	if keyField == "id" {
+		keyField = keyOption("")
+	}
+	key, err := parseRecordKey(keyField)
+	if err != nil {
+		return nil, errInvalidDedupeKey
+	}
+	if keep != "first" && keep != "largest" {
+		return nil, errInvalidDedupeKeep
+	}
+
+	// the records to write are spooled, as which ones are kept is only
+	// known at the end
+	var spool *os.File
+	var spoolWriter *marcWriter
+	if outName != "" {
+		var err error
+		if spool, err = ioutil.TempFile("", "marcdump-dedupe"); err != nil {
+			return nil, err
+		}
+		os.Remove(spool.Name())
+		spoolWriter = &marcWriter{file: spool, w: bufio.NewWriter(spool)}
+	}
+
+	var records []*dedupeRecord
+	owner := make(map[string]int) // the first record with each value
+	root := func(i int) int {
+		for records[i].parent != i {
+			records[i].parent = records[records[i].parent].parent
+			i = records[i].parent
+		}
+		return i
+	}
+	var spooled int64
+
+	onFinish(func(w *tabwriter.Writer) error {
+		clusters := make(map[int][]int)
+		for i := range records {
+			r := root(i)
+			clusters[r] = append(clusters[r], i)
+		}
+		values := make(map[int][]string)
+		for v, i := range owner {
+			r := root(i)
+			values[r] = append(values[r], v)
+		}
+
+		// the kept record of each cluster
+		kept := make(map[int]int)
+		for r, members := range clusters {
+			kept[r] = members[0]
+			for _, i := range members[1:] {
+				if keep == "largest" && records[i].length > records[kept[r]].length {
+					kept[r] = i
+				}
+			}
+		}
+
+		var roots []int
+		for r, members := range clusters {
+			if len(members) > 1 {
+				roots = append(roots, r)
+			}
+		}
+		sort.Ints(roots)
+		dropped := 0
+		for _, r := range roots {
+			var others []string
+			for _, i := range clusters[r] {
+				if i != kept[r] {
+					others = append(others, records[i].id)
+				}
+			}
+			sort.Strings(values[r])
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", strings.Join(values[r], " "), len(clusters[r]),
+				records[kept[r]].id, strings.Join(others, " "))
+			dropped += len(others)
+		}
+		fmt.Fprintf(w, "%d clusters of duplicates on %s, %d duplicate records\n", len(roots), keyField, dropped)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if spool == nil {
+			return nil
+		}
+		defer spool.Close()
+		if err := spoolWriter.w.Flush(); err != nil {
+			return err
+		}
+		out, err := createMarcWriter(outName)
+		if err != nil {
+			return err
+		}
+		for i, record := range records {
+			if kept[root(i)] != i {
+				continue
+			}
+			raw := make([]byte, record.length)
+			if _, err := spool.ReadAt(raw, record.offset); err != nil {
+				out.close()
+				return err
+			}
+			if err := out.write(raw); err != nil {
+				out.close()
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%d records written to %s\n", out.count, outName)
+		return out.close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		i := len(records)
+		records = append(records, &dedupeRecord{id: controlNumber(record), length: len(record.Raw), offset: spooled, parent: i})
+		if spoolWriter != nil {
+			if err := spoolWriter.write(record.Raw); err != nil {
+				return err
+			}
+			spooled += int64(len(record.Raw))
+		}
+
+		values, tag := key.values(record)
+		normalize := strings.TrimSpace
+		if tag == "020" {
+			normalize = normalizeISBN
+		}
+		for _, value := range values {
+			v := normalize(value)
+			if v == "" {
+				continue
+			}
+			if j, ok := owner[v]; !ok {
+				owner[v] = i
+			} else if a, b := root(i), root(j); a != b {
+				// the earlier record is the root, so that clusters
+				// are reported in input order
+				if a < b {
+					records[b].parent = a
+				} else {
+					records[a].parent = b
+				}
+			}
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marcdump/marcfilter"
+)
+
+// Deleted records. Incremental feeds send a record with Leader/05 'd'
+// to say the record is to be removed; it is not a record to catalog
+// from. Deleted records are skipped unless -include-deleted or
+// -only-deleted is given.
+
+func isDeleted(record *marcfilter.Record) bool {
+	return record.Leader()[5] == 'd'
+}
+
+// wantStatus reports whether a record passes the deleted record flags.
+func wantStatus(record *marcfilter.Record) bool {
+	switch {
+	case onlyDeleted:
+		return isDeleted(record)
+	case includeDeleted:
+		return true
+	}
+	return !isDeleted(record)
+}
@@ -0,0 +1,204 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Comparing files. -diff old.mrc new.mrc matches the records of the two
+// files by their -diff-key, by default the -id-expr (see ids.go) or
+// the 001, and reports
+//
+//    added    key      a record only in the new file
+//    deleted  key      a record only in the old file, or one the new
+//                      file marks deleted (Leader/05 'd')
+//    changed  key      a record in both, followed by the fields that
+//                      differ: - for the old fields, + for the new ones
+//
+// then the number of each. Fields are compared in the order they are
+// stored, so moving a field shows as a deletion and an addition. The
+// leader is compared without the record length and base address. The
+// old file is held in memory; -s selects the records compared in both.
+
+var errInvalidDiffKey = errors.New("marcdump: invalid diff key field")
+
+// An oldRecord is a record of the old file, kept raw until it is
+// compared.
+type oldRecord struct {
+	raw  []byte
+	seen bool
+}
+
+// getDiffAction returns an action comparing each record with the
+// record of the old file that has the same key.
+func getDiffAction(oldName string, keyField string, selector marcfilter.Selector) (actionFunc, error) {
+	rk, err := parseRecordKey(keyField)
+	if err != nil {
+		return nil, errInvalidDiffKey
+	}
+	key := rk.id
+
+	old := make(map[string]*oldRecord)
+	var keys []string // in the order of the old file
+	noKey := 0
+	in := newInputReader([]string{oldName})
+	for {
+		record, err := in.Next()
+		if record == nil || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		if isDeleted(record) || !selector.Match(record.MarcRecord) {
+			continue
+		}
+		k := key(record)
+		if k == "" {
+			noKey += 1
+			continue
+		}
+		if old[k] != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %s %s occurs more than once; comparing with the first\n", oldName, keyField, k)
+			continue
+		}
+		old[k] = &oldRecord{raw: record.Raw}
+		keys = append(keys, k)
+	}
+
+	added, deleted, changed, unchanged := 0, 0, 0, 0
+	onFinish(func(w *tabwriter.Writer) error {
+		for _, k := range keys {
+			if !old[k].seen {
+				fmt.Fprintf(w, "deleted\t%s\n", k)
+				deleted += 1
+			}
+		}
+		if noKey > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d records without %s were not compared\n", noKey, keyField)
+		}
+		fmt.Fprintf(w, "%d added, %d deleted, %d changed, %d unchanged\n", added, deleted, changed, unchanged)
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		k := key(record)
+		if k == "" {
+			noKey += 1
+			return nil
+		}
+		o := old[k]
+		if o != nil && o.seen {
+			fmt.Fprintf(os.Stderr, "Warning: %s %s occurs more than once in the new records\n", keyField, k)
+		}
+
+		switch {
+		case isDeleted(record):
+			if o != nil && !o.seen {
+				fmt.Fprintf(w, "deleted\t%s\n", k)
+				deleted += 1
+			}
+		case o == nil:
+			fmt.Fprintf(w, "added\t%s\n", k)
+			added += 1
+		default:
+			lines, err := diffRecords(o.raw, record.Raw)
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", keyField, k, err)
+			}
+			if len(lines) == 0 {
+				unchanged += 1
+				break
+			}
+			fmt.Fprintf(w, "changed\t%s\n", k)
+			for _, line := range lines {
+				fmt.Fprintf(w, "\t%s\n", line)
+			}
+			changed += 1
+		}
+		if o != nil {
+			o.seen = true
+		}
+		return w.Flush()
+	}, nil
+}
+
+// diffRecords returns the fields that differ between two raw records,
+// as lines of the form "-\t245\t10$aTitle".
+func diffRecords(oldRaw []byte, newRaw []byte) ([]string, error) {
+	a, err := recordLines(oldRaw)
+	if err != nil {
+		return nil, err
+	}
+	b, err := recordLines(newRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	// the longest common subsequence of the fields, from the end
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i, j = i+1, j+1
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-\t"+a[i])
+			i += 1
+		default:
+			lines = append(lines, "+\t"+b[j])
+			j += 1
+		}
+	}
+	return lines, nil
+}
+
+// recordLines returns the leader and fields of a raw record as they are
+// compared, one line each.
+func recordLines(raw []byte) ([]string, error) {
+	m, err := marcfilter.DecodeRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+	// the record length and base address change with any field
+	leader := "     " + string(m.Leader[5:12]) + "     " + string(m.Leader[17:])
+	lines := []string{"Leader\t" + leader}
+	for _, f := range m.Fields {
+		lines = append(lines, f.Tag+"\t"+strings.Replace(f.Data(), "\x1f", "$", -1))
+	}
+	return lines, nil
+}
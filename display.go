@@ -0,0 +1,158 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marc21"
+	"strings"
+)
+
+// MARC display logic shared by the output formats: the title, heading,
+// imprint and subject strings a catalog would show for a record.
+
+// displayTitle returns the title statement from 245 without the
+// statement of responsibility. If trimNonfiling is set, the number of
+// leading characters given by the second indicator (an initial article
+// such as "The ") is dropped, giving the title as it files, unless the
+// title is no longer than that.
+func displayTitle(record *marc21.MarcRecord, trimNonfiling bool) string {
+	field, _ := record.GetDataField("245")
+	if field.ValueCount() == 0 {
+		return ""
+	}
+
+	var parts []string
+	for _, sf := range field.GetSubfields(0) {
+		if strings.Contains("abfgknps", sf) {
+			parts = append(parts, strings.TrimSpace(field.GetNthSubfield(sf, 0)))
+		}
+	}
+	title := trimISBD(strings.Join(parts, " "))
+
+	if trimNonfiling {
+		ind := field.GetIndicators(0)
+		if len(ind) == 2 && ind[1] > '0' && ind[1] <= '9' {
+			// the indicator counts characters, not bytes
+			n := int(ind[1] - '0')
+			for i := range title {
+				if n == 0 {
+					title = title[i:]
+					break
+				}
+				n--
+			}
+		}
+	}
+	return title
+}
+
+// mainEntry returns the main entry heading from the 1xx field, or "" if
+// the record is entered under title.
+func mainEntry(record *marc21.MarcRecord) string {
+	for _, tag := range []string{"100", "110", "111", "130"} {
+		field, _ := record.GetDataField(tag)
+		if field.ValueCount() > 0 {
+			return heading(&field, 0, "abcdnpqt")
+		}
+	}
+	return ""
+}
+
+// publication returns the publication statement for display, e.g.
+// "New York : Simon & Schuster, 2007."
+func publication(record *marc21.MarcRecord) string {
+	field, _ := record.GetDataField("264")
+	for i := 0; i < field.ValueCount(); i++ {
+		if ind := field.GetIndicators(i); len(ind) == 2 && ind[1] == '1' {
+			return heading(&field, i, "abc")
+		}
+	}
+	field, _ = record.GetDataField("260")
+	if field.ValueCount() > 0 {
+		return heading(&field, 0, "abc")
+	}
+	return ""
+}
+
+// subjectHeadings returns the 6xx subject headings, with subdivisions
+// separated by " -- ".
+func subjectHeadings(record *marc21.MarcRecord) []string {
+	var headings []string
+	for _, tag := range record.GetFieldList() {
+		if tag[0] != '6' || marc21.IsControlFieldTag(tag) {
+			continue
+		}
+		field, _ := record.GetDataField(tag)
+		for i := 0; i < field.ValueCount(); i++ {
+			var parts []string
+			subdivision := false
+			for _, sf := range field.GetSubfields(i) {
+				value := trimISBD(strings.TrimRight(field.GetNthSubfield(sf, i), "."))
+				switch {
+				case value == "":
+				case strings.Contains("vxyz", sf):
+					parts = append(parts, " -- "+value)
+					subdivision = true
+				case strings.Contains("abcdgpqt", sf) && !subdivision:
+					if len(parts) > 0 {
+						parts = append(parts, " ")
+					}
+					parts = append(parts, value)
+				}
+			}
+			if len(parts) > 0 {
+				headings = append(headings, strings.Join(parts, ""))
+			}
+		}
+	}
+	return headings
+}
+
+// heading joins the given subfields of a field instance into a display
+// string without trailing punctuation.
+func heading(field *marc21.VariableField, instance int, codes string) string {
+	var parts []string
+	for _, sf := range field.GetSubfields(instance) {
+		if strings.Contains(codes, sf) {
+			if v := strings.TrimSpace(field.GetNthSubfield(sf, instance)); v != "" {
+				parts = append(parts, v)
+			}
+		}
+	}
+	return trimISBD(strings.Join(parts, " "))
+}
+
+// publicationStatement returns the publisher name and date from the
+// first 264 publication statement (second indicator 1), or from 260 if
+// there is none.
+func publicationStatement(record *marc21.MarcRecord) (string, string) {
+	field, _ := record.GetDataField("264")
+	for i := 0; i < field.ValueCount(); i++ {
+		if ind := field.GetIndicators(i); len(ind) == 2 && ind[1] == '1' {
+			return trimISBD(field.GetNthSubfield("b", i)), field.GetNthSubfield("c", i)
+		}
+	}
+	field, _ = record.GetDataField("260")
+	if field.ValueCount() > 0 {
+		return trimISBD(field.GetNthSubfield("b", 0)), field.GetNthSubfield("c", 0)
+	}
+	return "", ""
+}
+
+// trimISBD removes the trailing ISBD punctuation that catalogers put at
+// the end of a subfield to separate it from the next one.
+func trimISBD(s string) string {
+	return strings.TrimRight(strings.TrimSpace(s), " /:;,=")
+}
@@ -0,0 +1,66 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marcdump/marcfilter"
+	"strings"
+	"testing"
+)
+
+// titleRecord returns a record with a 245 of the given indicators and
+// subfields, written "$aThe title /$cby someone".
+func titleRecord(t *testing.T, indicators string, title string) *marcfilter.Record {
+	f := &marcfilter.Field{Tag: "245", Indicators: indicators}
+	for _, sf := range strings.Split(title, "$")[1:] {
+		f.Subfields = append(f.Subfields, marcfilter.Subfield{Code: sf[:1], Value: sf[1:]})
+	}
+	m := &marcfilter.MutableRecord{
+		Leader: []byte("00000nam a2200000 a 4500"),
+		Fields: []*marcfilter.Field{{Tag: "001", Value: "d1"}, f},
+	}
+	raw, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := marcfilter.ParseRecord(raw, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestDisplayTitle(t *testing.T) {
+	tests := []struct {
+		indicators, title string
+		display, files    string
+	}{
+		{"10", "$aHamlet /$cShakespeare.", "Hamlet", "Hamlet"},
+		{"14", "$aThe tempest :$ba comedy /$cShakespeare.", "The tempest : a comedy", "tempest : a comedy"},
+		{"12", "$aL’été.", "L’été.", "été."},
+		{"13", "$aÜber Alles", "Über Alles", "r Alles"},
+		{"12", "$aL’", "L’", "L’"},
+		{"1 ", "$aThe tempest", "The tempest", "The tempest"},
+	}
+	for _, test := range tests {
+		record := titleRecord(t, test.indicators, test.title)
+		if got := displayTitle(record.MarcRecord, false); got != test.display {
+			t.Errorf("%s: title %q, want %q", test.title, got, test.display)
+		}
+		if got := displayTitle(record.MarcRecord, true); got != test.files {
+			t.Errorf("%s: title as it files %q, want %q", test.title, got, test.files)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// E-book vendor file cleanup (OverDrive and the like). The 856
+// electronic location fields in vendor deliveries come with
+// inconsistent indicators, messy access notes, and the same URL
+// repeated; each selected record is written with its 856s normalized.
+
+var (
+	whitespaceRegexp = regexp.MustCompile(`\s+`)
+	relatedRegexp    = regexp.MustCompile(`(?i)\b(excerpt|sample|preview|cover image|table of contents)\b`)
+)
+
+// getEbookAction returns an action that writes records with normalized
+// 856 fields to the named file.
+func getEbookAction(name string) (actionFunc, error) {
+	out, err := createMarcWriter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	changed, removed := 0, 0
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(os.Stderr, "%d records written to %s, %d 856 fields normalized, %d duplicates removed\n",
+			out.count, name, changed, removed)
+		return out.close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+
+		seen := make(map[string]bool)
+		m.RemoveFields(func(f *marcfilter.Field) bool {
+			if f.Tag != "856" {
+				return false
+			}
+			url := strings.TrimRight(strings.TrimSpace(f.Subfield("u")), "/")
+			if url != "" && seen[url] {
+				removed += 1
+				return true
+			}
+			seen[url] = true
+			if normalizeAccessField(f) {
+				changed += 1
+			}
+			return false
+		})
+
+		raw, err := m.Encode()
+		if err != nil {
+			return err
+		}
+		return out.write(raw)
+	}, nil
+}
+
+// normalizeAccessField tidies the indicators, materials specified ($3)
+// and public notes ($z) of an 856, returning true if anything changed.
+func normalizeAccessField(f *marcfilter.Field) bool {
+	before := f.Data()
+
+	var subfields []marcfilter.Subfield
+	notes := make(map[string]bool)
+	for _, sf := range f.Subfields {
+		switch sf.Code {
+		case "3", "z", "y":
+			sf.Value = strings.TrimSpace(whitespaceRegexp.ReplaceAllString(sf.Value, " "))
+			if sf.Value == "" || notes[sf.Code+sf.Value] {
+				continue
+			}
+			notes[sf.Code+sf.Value] = true
+		case "u":
+			sf.Value = strings.TrimSpace(sf.Value)
+		}
+		subfields = append(subfields, sf)
+	}
+	f.Subfields = subfields
+
+	ind1, ind2 := byte(' '), byte(' ')
+	if len(f.Indicators) == 2 {
+		ind1, ind2 = f.Indicators[0], f.Indicators[1]
+	}
+	url := strings.ToLower(f.Subfield("u"))
+	switch {
+	case strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://"):
+		ind1 = '4'
+	case strings.HasPrefix(url, "ftp://"):
+		ind1 = '1'
+	}
+	if relatedRegexp.MatchString(f.Subfield("3")) {
+		// excerpts, samples, and cover images are related resources
+		ind2 = '2'
+	} else if strings.IndexByte("0128", ind2) < 0 {
+		ind2 = '0'
+	}
+	f.Indicators = string([]byte{ind1, ind2})
+
+	return f.Data() != before
+}
@@ -0,0 +1,296 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Embedded holdings. Some systems load holdings as records of their own
+// (MFHD), linked to their bibliographic record by its 001 in their 004;
+// others want them in the bibliographic record, as 852, 853-855,
+// 863-868 and 876-878 fields. -embed-holdings file writes each
+// bibliographic record with the fields of its holdings records added,
+// each field starting with a $8 numbering the holdings record it came
+// from:
+//
+//    852 0_ $8 1 $a DLC $h QA76 $i .E5
+//    863 40 $8 1 $8 1.1 $a 12 $i 1998
+//    852 0_ $8 2 $a DLC $b Annex
+//
+// The records are written in input order once all have been read, as a
+// holdings record may come before its bibliographic record; holdings
+// whose bibliographic record was not read are written as they are,
+// after the rest. -extract-holdings file does the reverse, writing each
+// bibliographic record without its embedded holdings fields, followed
+// by a holdings record for each holdings number, with the 001 of the
+// record and the number in its 001 and the 001 of the record in its
+// 004. Fields without a $8 number make up a single holdings record.
+
+// isEmbeddedHoldingsTag reports whether a field of a holdings record is
+// carried over into the bibliographic record.
+func isEmbeddedHoldingsTag(tag string) bool {
+	return tag == "852" || (tag >= "853" && tag <= "855") || (tag >= "863" && tag <= "868") || (tag >= "876" && tag <= "878")
+}
+
+// An embedRecord is a record spooled until the holdings have all been
+// read.
+type embedRecord struct {
+	id     string // of the record, or of the record a holdings record is to
+	format string
+	length int
+	offset int64
+}
+
+// getEmbedHoldingsAction returns an action writing the records to the
+// named file with the holdings embedded in their bibliographic records.
+func getEmbedHoldingsAction(name string) (actionFunc, error) {
+	spool, err := ioutil.TempFile("", "marcdump-embed")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(spool.Name())
+	spoolWriter := &marcWriter{file: spool, w: bufio.NewWriter(spool)}
+
+	var records []*embedRecord
+	var spooled int64
+	// the holdings fields of each bibliographic record, by holdings
+	// record
+	holdings := make(map[string][][]*marcfilter.Field)
+	bibs := make(map[string]bool)
+
+	onFinish(func(w *tabwriter.Writer) error {
+		defer spool.Close()
+		if err := spoolWriter.w.Flush(); err != nil {
+			return err
+		}
+		out, err := createMarcWriter(name)
+		if err != nil {
+			return err
+		}
+		read := func(r *embedRecord) ([]byte, error) {
+			raw := make([]byte, r.length)
+			_, err := spool.ReadAt(raw, r.offset)
+			return raw, err
+		}
+
+		embedded, unlinked := 0, 0
+		var rest []*embedRecord
+		for _, r := range records {
+			if r.format == formatHoldings && r.id != "" && bibs[r.id] {
+				continue
+			} else if r.format != formatBibliographic {
+				// holdings whose bibliographic record was not read,
+				// and other kinds of record
+				rest = append(rest, r)
+				continue
+			}
+			raw, err := read(r)
+			if err == nil && len(holdings[r.id]) > 0 {
+				raw, err = embedHoldings(raw, holdings[r.id])
+				embedded += len(holdings[r.id])
+				delete(holdings, r.id)
+			}
+			if err == nil {
+				err = out.write(raw)
+			}
+			if err != nil {
+				out.close()
+				return err
+			}
+		}
+		for _, r := range rest {
+			raw, err := read(r)
+			if err == nil {
+				err = out.write(raw)
+			}
+			if err != nil {
+				out.close()
+				return err
+			}
+			if r.format == formatHoldings {
+				unlinked++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%d records written to %s, %d holdings records embedded, %d without their bibliographic record\n",
+			out.count, name, embedded, unlinked)
+		return out.close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		r := &embedRecord{format: recordFormat(string(m.Leader)), length: len(record.Raw), offset: spooled}
+		switch r.format {
+		case formatBibliographic:
+			r.id = controlNumber(record)
+			bibs[r.id] = true
+		case formatHoldings:
+			if f := m.FieldsByTag("004"); len(f) > 0 && f[0].Value != "" {
+				r.id = f[0].Value
+				var fields []*marcfilter.Field
+				for _, f := range m.Fields {
+					if isEmbeddedHoldingsTag(f.Tag) {
+						fields = append(fields, f)
+					}
+				}
+				holdings[r.id] = append(holdings[r.id], fields)
+			}
+		}
+		records = append(records, r)
+		if err := spoolWriter.write(record.Raw); err != nil {
+			return err
+		}
+		spooled += int64(len(record.Raw))
+		return nil
+	}, nil
+}
+
+// embedHoldings returns a bibliographic record with the fields of its
+// holdings records added, numbered by $8.
+func embedHoldings(raw []byte, holdings [][]*marcfilter.Field) ([]byte, error) {
+	m, err := marcfilter.DecodeRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+	for i, fields := range holdings {
+		link := marcfilter.Subfield{Code: "8", Value: strconv.Itoa(i + 1)}
+		for _, f := range fields {
+			m.AddField(&marcfilter.Field{Tag: f.Tag, Indicators: f.Indicators,
+				Subfields: append([]marcfilter.Subfield{link}, f.Subfields...)})
+		}
+	}
+	return m.Encode()
+}
+
+// getExtractHoldingsAction returns an action writing the records to the
+// named file with the embedded holdings of the bibliographic records
+// made into holdings records.
+func getExtractHoldingsAction(name string) (actionFunc, error) {
+	out, err := createMarcWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	made := 0
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(os.Stderr, "%d records written to %s, %d of them holdings records made from embedded holdings\n", out.count, name, made)
+		return out.close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		if recordFormat(string(m.Leader)) != formatBibliographic {
+			return out.write(record.Raw)
+		}
+
+		// the embedded fields by holdings number, in order
+		var numbers []string
+		fields := make(map[string][]*marcfilter.Field)
+		m.RemoveFields(func(f *marcfilter.Field) bool {
+			if !isEmbeddedHoldingsTag(f.Tag) {
+				return false
+			}
+			n := embeddedHoldingsNumber(f)
+			if _, ok := fields[n]; !ok {
+				numbers = append(numbers, n)
+			}
+			fields[n] = append(fields[n], f)
+			return true
+		})
+		if len(numbers) == 0 {
+			return out.write(record.Raw)
+		}
+
+		raw, err := m.Encode()
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		if err := out.write(raw); err != nil {
+			return err
+		}
+		id := controlNumber(record)
+		for i, n := range numbers {
+			h := holdingsRecordOf(m, id, i+1, fields[n])
+			raw, err := h.Encode()
+			if err != nil {
+				return fmt.Errorf("record at offset %d: holdings %s: %v", record.Offset, n, err)
+			}
+			if err := out.write(raw); err != nil {
+				return err
+			}
+			made++
+		}
+		return nil
+	}, nil
+}
+
+// embeddedHoldingsNumber returns the holdings number of an embedded
+// field, taking its leading $8 off if it is one, or "" if it has none.
+func embeddedHoldingsNumber(f *marcfilter.Field) string {
+	if len(f.Subfields) == 0 || f.Subfields[0].Code != "8" {
+		return ""
+	}
+	n := f.Subfields[0].Value
+	if _, err := strconv.Atoi(n); err != nil {
+		// a link and sequence number, such as 1.1, of the field itself
+		return ""
+	}
+	f.Subfields = f.Subfields[1:]
+	return n
+}
+
+// holdingsRecordOf returns a holdings record of the fields embedded in a
+// bibliographic record.
+func holdingsRecordOf(bib *marcfilter.MutableRecord, id string, number int, fields []*marcfilter.Field) *marcfilter.MutableRecord {
+	// single-part item holdings unless there are enumeration and
+	// chronology fields, with item information if there are item fields
+	leader := []byte("00000nx  a2200000un 4500")
+	leader[9] = bib.Leader[9]
+	for _, f := range fields {
+		switch {
+		case strings.HasPrefix(f.Tag, "86") || (f.Tag >= "853" && f.Tag <= "855"):
+			leader[6] = 'y'
+		case f.Tag >= "876" && f.Tag <= "878":
+			leader[18] = 'i'
+		}
+	}
+
+	h := &marcfilter.MutableRecord{Leader: leader}
+	h.Fields = append(h.Fields,
+		&marcfilter.Field{Tag: "001", Value: fmt.Sprintf("%s-%d", id, number)},
+		&marcfilter.Field{Tag: "004", Value: id})
+	if f := bib.FieldsByTag("005"); len(f) > 0 {
+		h.Fields = append(h.Fields, &marcfilter.Field{Tag: "005", Value: f[0].Value})
+	}
+	// date entered, and nothing known of acquisitions, retention or
+	// lending
+	fixed := time.Now().Format("060102") + "0u    8   0001uu   0000000"
+	h.Fields = append(h.Fields, &marcfilter.Field{Tag: "008", Value: fixed})
+	h.Fields = append(h.Fields, fields...)
+	return h
+}
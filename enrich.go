@@ -0,0 +1,417 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Linked data enrichment. -enrich looks up the name and subject
+// headings of each record with the sources -enrich-with lists and
+// writes the records, with the URIs found added, to a MARC file:
+//
+//    lc         id.loc.gov LCSH and NAF URIs in $0
+//    viaf       VIAF URIs for personal and corporate names in $1
+//    wikidata   Wikidata URIs for personal and corporate names in $1
+//    local      the URIs of the records of a local authority file in $0
+//
+// Headings that already have a URI from a source are left alone, and so
+// are headings matching more than one entity, which are reported.
+
+var errUnknownEnrichSource = errors.New("marcdump: unknown enrichment source")
+
+// Kinds of heading, named as in the id.loc.gov authority URIs.
+const (
+	kindNames    = "names"
+	kindSubjects = "subjects"
+)
+
+// headingKinds gives the kind of the headings in each field. Subject
+// fields are only looked up when their second indicator says LCSH.
+var headingKinds = map[string]string{
+	"100": kindNames, "110": kindNames, "111": kindNames, "130": kindNames,
+	"600": kindNames, "610": kindNames, "611": kindNames, "630": kindNames,
+	"650": kindSubjects, "651": kindSubjects,
+	"700": kindNames, "710": kindNames, "711": kindNames, "730": kindNames,
+	"800": kindNames, "810": kindNames, "811": kindNames, "830": kindNames,
+}
+
+// An enrichHeading is a heading field to look up.
+type enrichHeading struct {
+	kind  string
+	tag   string
+	label string
+	field *marcfilter.Field
+}
+
+// personal and corporate tell the type of name a heading is.
+func (h *enrichHeading) personal() bool  { return h.kind == kindNames && h.tag[1:] == "00" }
+func (h *enrichHeading) corporate() bool { return h.kind == kindNames && h.tag[1:] == "10" }
+
+// A reconciler returns the URIs of the entities a heading might be:
+// none if it knows of none, more than one if it cannot tell which.
+type reconciler interface {
+	reconcile(h *enrichHeading) ([]string, error)
+}
+
+// An enrichSource is a reconciler and where its URIs go.
+type enrichSource struct {
+	name    string
+	code    string // the subfield the URIs are added in
+	prefix  string // that the URIs from the source start with
+	accepts func(h *enrichHeading) bool
+	r       reconciler
+	offline bool // not worth caching
+
+	looked, added, ambiguous int
+}
+
+func isName(h *enrichHeading) bool { return h.personal() || h.corporate() }
+
+// getEnrichSources returns the sources in a comma separated list. The
+// local source reads the named authority file, through the index if
+// one is named.
+func getEnrichSources(list string, rate float64, authorities string, authorityIndex string) ([]*enrichSource, error) {
+	var sources []*enrichSource
+	for _, name := range strings.Split(list, ",") {
+		s := &enrichSource{name: strings.TrimSpace(name), accepts: isName}
+		switch s.name {
+		case "lc":
+			s.code, s.prefix = "0", "http://id.loc.gov/"
+			s.accepts = func(h *enrichHeading) bool { return true }
+			s.r = newIdLocReconciler(rate)
+		case "viaf":
+			s.code, s.prefix = "1", "http://viaf.org/"
+			s.r = newViafReconciler(rate)
+		case "wikidata":
+			s.code, s.prefix = "1", "http://www.wikidata.org/"
+			s.r = newWikidataReconciler(rate)
+		case "local":
+			if authorities == "" {
+				return nil, errNoAuthorities
+			}
+			r, err := newLocalReconciler(authorities, authorityIndex)
+			if err != nil {
+				return nil, err
+			}
+			s.code, s.offline, s.r = "0", true, r
+			s.accepts = func(h *enrichHeading) bool { return true }
+		default:
+			return nil, errUnknownEnrichSource
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// hasURI returns whether a field already has a URI from the source. For
+// $0 any URI will do.
+func (s *enrichSource) hasURI(f *marcfilter.Field) bool {
+	for _, sf := range f.Subfields {
+		if sf.Code == s.code && (s.code == "0" || strings.HasPrefix(strings.Replace(sf.Value, "https:", "http:", 1), s.prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// headingLabel returns a heading in the form authority files label it:
+// the subfields of the heading separated by spaces, subdivisions by
+// "--", without the final punctuation.
+func headingLabel(f *marcfilter.Field) string {
+	var heading []string
+	var subdivisions []string
+	for _, sf := range f.Subfields {
+		v := strings.TrimSpace(sf.Value)
+		switch {
+		case v == "":
+		case strings.Contains("vxyz", sf.Code):
+			subdivisions = append(subdivisions, trimHeading(v))
+		case strings.Contains("abcdfghklmnopqrst", sf.Code):
+			heading = append(heading, v)
+		}
+	}
+	if len(heading) == 0 {
+		return ""
+	}
+	return strings.Join(append([]string{trimHeading(strings.Join(heading, " "))}, subdivisions...), "--")
+}
+
+// trimHeading drops the punctuation ending a heading, keeping the
+// hyphen of an open date such as "1952-" and the period of an initial.
+func trimHeading(s string) string {
+	s = trimISBD(s)
+	if n := len(s); n > 2 && s[n-1] == '.' && !(s[n-3] == ' ' && s[n-2] >= 'A' && s[n-2] <= 'Z') {
+		s = trimISBD(s[:n-1])
+	}
+	return s
+}
+
+// headingKind returns the kind of heading a field holds, or "" if it is
+// not one to look up. Subdivided name subjects are LCSH headings.
+func headingKind(f *marcfilter.Field) string {
+	kind := headingKinds[f.Tag]
+	if kind == "" || f.Tag[0] != '6' {
+		return kind
+	}
+	if len(f.Indicators) != 2 || f.Indicators[1] != '0' {
+		return ""
+	}
+	for _, sf := range f.Subfields {
+		if strings.Contains("vxyz", sf.Code) {
+			return kindSubjects
+		}
+	}
+	return kind
+}
+
+// enrichReportColumns are the columns of the -enrich-report file of
+// ambiguous headings.
+var enrichReportColumns = []string{"record", "001", "tag", "heading", "source", "candidates"}
+
+// getEnrichAction returns an action adding the URIs the sources find to
+// the headings of each record and writing the records to the named
+// file. Ambiguous headings are written to the report file, or warned
+// about if there is none.
+func getEnrichAction(name string, sources []*enrichSource, reportName string) (actionFunc, error) {
+	out, err := createMarcWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	var report *csv.Writer
+	var reportFile *os.File
+	if reportName != "" {
+		if reportFile, err = os.Create(reportName); err != nil {
+			out.close()
+			return nil, err
+		}
+		report = csv.NewWriter(reportFile)
+		report.Write(enrichReportColumns)
+	}
+
+	onFinish(func(w *tabwriter.Writer) error {
+		for _, s := range sources {
+			fmt.Fprintf(os.Stderr, "%s: %d headings looked up, %d URIs added, %d ambiguous\n",
+				s.name, s.looked, s.added, s.ambiguous)
+		}
+		fmt.Fprintf(os.Stderr, "%d records written to %s\n", out.count, name)
+		if report != nil {
+			report.Flush()
+			if err := report.Error(); err != nil {
+				reportFile.Close()
+				out.close()
+				return err
+			}
+			if err := reportFile.Close(); err != nil {
+				out.close()
+				return err
+			}
+		}
+		return out.close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		for _, f := range m.Fields {
+			h := &enrichHeading{kind: headingKind(f), tag: f.Tag, label: headingLabel(f), field: f}
+			if h.kind == "" || h.label == "" {
+				continue
+			}
+			for _, s := range sources {
+				if !s.accepts(h) || s.hasURI(f) {
+					continue
+				}
+				s.looked += 1
+				uris, err := s.r.reconcile(h)
+				if err != nil {
+					return fmt.Errorf("%s %q: %s: %v", f.Tag, h.label, s.name, err)
+				}
+				switch {
+				case len(uris) == 1:
+					f.Subfields = append(f.Subfields, marcfilter.Subfield{Code: s.code, Value: uris[0]})
+					s.added += 1
+				case len(uris) > 1:
+					s.ambiguous += 1
+					if report != nil {
+						report.Write([]string{strconv.Itoa(record.Number), controlNumber(record),
+							f.Tag, h.label, s.name, strings.Join(uris, " ")})
+					} else {
+						fmt.Fprintf(os.Stderr, "Warning: record %d: %s %q is ambiguous in %s: %s\n",
+							record.Number, f.Tag, h.label, s.name, strings.Join(uris, " "))
+					}
+				}
+			}
+		}
+		raw, err := m.Encode()
+		if err != nil {
+			return err
+		}
+		return out.write(raw)
+	}, nil
+}
+
+// An idLocReconciler looks headings up with the id.loc.gov known-label
+// service, which redirects a label to its authority.
+type idLocReconciler struct {
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+const idLocLabelURL = "https://id.loc.gov/authorities/%s/label/%s"
+
+func newIdLocReconciler(rate float64) *idLocReconciler {
+	return &idLocReconciler{
+		client: &http.Client{
+			Timeout: fetchTimeout,
+			// the redirect is the answer; there is no need to follow it
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		limiter: newRateLimiter(rate),
+	}
+}
+
+func (r *idLocReconciler) reconcile(h *enrichHeading) ([]string, error) {
+	r.limiter.wait()
+	req, err := http.NewRequest("HEAD", fmt.Sprintf(idLocLabelURL, h.kind, url.PathEscape(h.label)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fetchUserAgent)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, nil
+	case http.StatusFound, http.StatusSeeOther, http.StatusMovedPermanently:
+		uri := resp.Header.Get("X-Uri")
+		if uri == "" {
+			uri = resp.Header.Get("Location")
+		}
+		return []string{uri}, nil
+	}
+	return nil, fmt.Errorf("id.loc.gov returned %s", resp.Status)
+}
+
+// A rateLimiter spaces out requests to a web service.
+type rateLimiter struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	l := new(rateLimiter)
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+func (l *rateLimiter) wait() {
+	if d := l.interval - time.Since(l.last); d > 0 {
+		time.Sleep(d)
+	}
+	l.last = time.Now()
+}
+
+// A reconcileCache remembers the answers of the sources, including the
+// headings they found nothing for, in a file of tab-separated source,
+// kind, label and candidate URI lines that later runs start from.
+type reconcileCache struct {
+	entries map[string][]string
+	file    *os.File
+}
+
+// A cachedReconciler answers from the cache what it can.
+type cachedReconciler struct {
+	source string
+	r      reconciler
+	cache  *reconcileCache
+}
+
+func openReconcileCache(name string) (*reconcileCache, error) {
+	c := &reconcileCache{entries: make(map[string][]string)}
+	if name == "" {
+		return c, nil
+	}
+
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), "\t")
+		if len(parts) == 4 {
+			c.entries[strings.Join(parts[:3], "\t")] = strings.Fields(parts[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	c.file = file
+	onFinish(func(w *tabwriter.Writer) error {
+		return c.file.Close()
+	})
+	return c, nil
+}
+
+// cached wraps the reconciler of each source with the cache.
+func (c *reconcileCache) cached(sources []*enrichSource) {
+	for _, s := range sources {
+		if s.offline {
+			continue
+		}
+		s.r = &cachedReconciler{source: s.name, r: s.r, cache: c}
+	}
+}
+
+func (c *cachedReconciler) reconcile(h *enrichHeading) ([]string, error) {
+	key := c.source + "\t" + h.kind + "\t" + h.label
+	if uris, ok := c.cache.entries[key]; ok {
+		return uris, nil
+	}
+	uris, err := c.r.reconcile(h)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.entries[key] = uris
+	if c.cache.file != nil {
+		if _, err := fmt.Fprintf(c.cache.file, "%s\t%s\n", key, strings.Join(uris, " ")); err != nil {
+			return nil, err
+		}
+	}
+	return uris, nil
+}
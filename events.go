@@ -0,0 +1,241 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Following the served file. Records appended to the file while it is
+// served, as a harvest or an ILS export adds them, are pushed to the
+// clients of /events as server-sent events:
+//
+//    GET /events?s=650_a=History
+//
+// streams each new record the selector matches as a "record" event
+// whose data is the record in MARC-in-JSON, on one line. The id of an
+// event is the offset just past the record, so a client reconnecting
+// with Last-Event-ID (or asking with ?from=offset) first gets the
+// records it missed. The file is polled for new records every -poll; a
+// record still being written is sent once it is complete. A client
+// that falls too far behind is disconnected, and can catch up by
+// reconnecting.
+
+// followBuffer is the number of records a client can fall behind.
+const followBuffer = 256
+
+// keepaliveInterval is how often an idle event stream gets a comment,
+// so that proxies don't close it.
+const keepaliveInterval = 15 * time.Second
+
+// A follower watches a file for appended records and passes each one
+// to the subscribers whose selectors match it.
+type follower struct {
+	file *os.File
+
+	mu          sync.Mutex
+	end         int64 // where the records not yet seen start
+	subscribers map[*subscriber]bool
+}
+
+type subscriber struct {
+	sel     marcfilter.Selector
+	records chan *marcfilter.Record
+}
+
+func newFollower(file *os.File, end int64) *follower {
+	return &follower{file: file, end: end, subscribers: make(map[*subscriber]bool)}
+}
+
+// follow polls the file for new records until it cannot be read or
+// the context is done.
+func (f *follower) follow(ctx context.Context, interval time.Duration) error {
+	for {
+		if err := f.poll(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// poll passes on the records completed since the last poll.
+func (f *follower) poll() error {
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if info.Size() <= f.end {
+		return nil
+	}
+
+	rr := newRecordReader(io.NewSectionReader(f.file, f.end, info.Size()-f.end))
+	rr.Offset = f.end
+	rr.OnBad = warnBadRecord
+	for {
+		record, err := rr.Next()
+		if record == nil || err != nil {
+			// a record still being written is read again next time
+			if _, ok := err.(*marcfilter.TruncationError); err != nil && !ok {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+			f.end = rr.Offset
+			return nil
+		}
+		for s := range f.subscribers {
+			if !s.sel.Match(record.MarcRecord) {
+				continue
+			}
+			select {
+			case s.records <- record:
+			default:
+				// too slow; the closed channel ends its stream
+				delete(f.subscribers, s)
+				close(s.records)
+			}
+		}
+	}
+}
+
+// warnBadRecord reports a record of the followed file that is skipped.
+func warnBadRecord(offset int64, raw []byte, err error) {
+	fmt.Fprintf(os.Stderr, "Warning: %v; skipped %d bytes\n", err, len(raw))
+}
+
+// subscribe adds a subscriber for the records after those already
+// seen, returning where they start.
+func (f *follower) subscribe(sel marcfilter.Selector) (*subscriber, int64) {
+	s := &subscriber{sel, make(chan *marcfilter.Record, followBuffer)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers[s] = true
+	return s, f.end
+}
+
+func (f *follower) unsubscribe(s *subscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subscribers[s] {
+		delete(f.subscribers, s)
+		close(s.records)
+	}
+}
+
+// serveEvents streams the records appended to the file that match the
+// selector in the request.
+func (h *httpHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if h.follower == nil {
+		http.Error(w, "only a file can be followed for added records", http.StatusNotImplemented)
+		return
+	}
+	sel, err := requestSelector(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from := int64(-1)
+	for _, s := range []string{r.Header.Get("Last-Event-ID"), r.URL.Query().Get("from")} {
+		if s == "" {
+			continue
+		}
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil || from < 0 {
+			http.Error(w, "invalid offset "+s, http.StatusBadRequest)
+			return
+		}
+		break
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s, end := h.follower.subscribe(sel)
+	defer h.follower.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(record *marcfilter.Record) error {
+		next := record.Offset + int64(len(record.Raw))
+		record, err := convertRecord(record)
+		if err != nil {
+			return err
+		}
+		data, err := new(marcfilter.JSONFormatter).Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: record\nid: %d\ndata: %s\n\n", next, data)
+		flusher.Flush()
+		return err
+	}
+
+	// the records missed since from, up to where the subscription starts
+	if from >= 0 && from < end {
+		rr := newRecordReader(io.NewSectionReader(h.follower.file, from, end-from))
+		rr.Offset = from
+		rr.OnBad = warnBadRecord
+		for {
+			record, err := rr.Next()
+			if record == nil || err != nil {
+				if err != nil {
+					fmt.Fprintf(w, "event: error\ndata: %v\n\n", err)
+					return
+				}
+				break
+			}
+			if sel.Match(record.MarcRecord) {
+				if err := send(record); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case record, ok := <-s.records:
+			if !ok {
+				return
+			}
+			if err := send(record); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
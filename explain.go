@@ -0,0 +1,224 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"strings"
+)
+
+// Selector explain mode. -explain prints, as JSON, the tree the selector
+// expression was parsed into and, given a record number, the result of
+// every node of the tree for that record along with each value the
+// selection specs looked at. Being for reading, it is indented by two
+// spaces unless -json-indent says otherwise.
+
+type selectorExplanation struct {
+	Selector string             `json:"selector"`
+	Tree     *selectorNode      `json:"tree"`
+	Record   *recordExplanation `json:"record,omitempty"`
+}
+
+type recordExplanation struct {
+	Number  int    `json:"number"`
+	Offset  int64  `json:"offset"`
+	ID      string `json:"id"`
+	Matched bool   `json:"matched"`
+}
+
+// A selectorNode describes one node of a selector expression.
+type selectorNode struct {
+	Op        string             `json:"op"` // spec, and, or, not
+	Field     string             `json:"field,omitempty"`
+	Subfield  string             `json:"subfield,omitempty"`
+	Criterion string             `json:"criterion,omitempty"`
+	Normalize bool               `json:"normalize,omitempty"`
+	Operands  []*selectorNode    `json:"operands,omitempty"`
+	Matched   *bool              `json:"matched,omitempty"`
+	Reason    string             `json:"reason,omitempty"`
+	Values    []valueExplanation `json:"values,omitempty"`
+}
+
+// A valueExplanation describes one value a selection spec tested.
+type valueExplanation struct {
+	Field    string `json:"field"`
+	Instance int    `json:"instance"`
+	Subfield string `json:"subfield,omitempty"`
+	Value    string `json:"value"`
+	Matched  bool   `json:"matched"`
+}
+
+// explainTree describes a selector, and its evaluation against record
+// if that is not nil.
+func explainTree(sel marcfilter.Selector, record *marcfilter.Record) *selectorNode {
+	var node *selectorNode
+	switch s := sel.(type) {
+	case *marcfilter.And:
+		node = &selectorNode{Op: "and", Operands: []*selectorNode{
+			explainTree(s.Left, record), explainTree(s.Right, record)}}
+	case *marcfilter.Or:
+		node = &selectorNode{Op: "or", Operands: []*selectorNode{
+			explainTree(s.Left, record), explainTree(s.Right, record)}}
+	case *marcfilter.Not:
+		node = &selectorNode{Op: "not", Operands: []*selectorNode{explainTree(s.Operand, record)}}
+	case *marcfilter.Spec:
+		node = &selectorNode{Op: "spec", Field: s.Field, Subfield: s.Subfield}
+		if s.Position != nil {
+			node.Field += "/" + s.Position.String()
+		}
+		if s.Criterion != nil {
+			node.Criterion = s.Criterion.String()
+		}
+		node.Normalize = s.Normalize
+		if record != nil {
+			explainSpec(s, node, record)
+		}
+	case *marcfilter.ValueSet:
+		node = &selectorNode{Op: "idlist", Field: s.Field, Subfield: s.Subfield,
+			Criterion: fmt.Sprintf("%d values", len(s.Values))}
+		if record != nil {
+			for i, v := range marcfilter.FieldValues(record.MarcRecord, s.Field, s.Subfield) {
+				node.Values = append(node.Values, valueExplanation{
+					Field: s.Field, Instance: i, Subfield: s.Subfield, Value: v, Matched: s.Values[v]})
+			}
+		}
+	case *formatSelector:
+		node = &selectorNode{Op: "type", Field: "LDR/06", Criterion: s.String()}
+		if record != nil {
+			format := recordFormat(record.Leader())
+			node.Values = append(node.Values, valueExplanation{
+				Field: "LDR", Value: format, Matched: s.formats[format]})
+		}
+	case *agencySelector:
+		node = &selectorNode{Op: "agency", Field: "040", Criterion: s.String()}
+		if record != nil {
+			for _, code := range agencySubfields {
+				for i, v := range marcfilter.FieldValues(record.MarcRecord, "040", code) {
+					node.Values = append(node.Values, valueExplanation{
+						Field: "040", Instance: i, Subfield: code, Value: v,
+						Matched: s.agencies[normalizeAgency(v)]})
+				}
+			}
+		}
+	}
+	if record != nil {
+		matched := sel.Match(record.MarcRecord)
+		node.Matched = &matched
+	}
+	return node
+}
+
+// explainSpec fills in the values a selection spec tested in a record
+// and why it did or did not match.
+func explainSpec(s *marcfilter.Spec, node *selectorNode, record *marcfilter.Record) {
+	test := func(v valueExplanation) {
+		v.Matched = s.MatchValue(v.Value)
+		node.Values = append(node.Values, v)
+	}
+
+	switch {
+	case s.Field == "":
+		node.Reason = "there is no selector, every record matches"
+		return
+	case s.Position != nil:
+		for _, v := range s.PositionValues(record.MarcRecord) {
+			test(valueExplanation{Field: node.Field, Value: v})
+		}
+		if len(node.Values) == 0 {
+			node.Reason = fmt.Sprintf("the record has no %s", node.Field)
+			return
+		}
+	case marc21.IsControlFieldTag(s.Field):
+		value, err := record.GetControlField(s.Field)
+		if err != nil {
+			node.Reason = "the record has no " + s.Field
+			return
+		}
+		test(valueExplanation{Field: s.Field, Value: value})
+	default:
+		field, _ := record.GetDataField(s.Field)
+		if field.ValueCount() == 0 {
+			node.Reason = "the record has no " + s.Field
+			return
+		}
+		for i := 0; i < field.ValueCount(); i++ {
+			subfields := field.GetSubfields(i)
+			if s.Subfield != "" {
+				subfields = []string{s.Subfield}
+			}
+			for _, sf := range subfields {
+				if v := field.GetNthSubfield(sf, i); v != "" {
+					test(valueExplanation{Field: s.Field, Instance: i, Subfield: sf, Value: v})
+				}
+			}
+		}
+	}
+
+	matched := s.Match(record.MarcRecord)
+	switch {
+	case len(node.Values) == 0:
+		node.Reason = fmt.Sprintf("no instance of %s has subfield %s", s.Field, s.Subfield)
+	case matched && s.Criterion == nil:
+		node.Reason = "the field exists and there is no criterion"
+	case matched:
+		node.Reason = "at least one value matches the criterion"
+	default:
+		node.Reason = "no value matches the criterion"
+	}
+}
+
+// explainSelector writes the explanation of the selector, and of its
+// evaluation against record number n of the source if n is not 0.
+func explainSelector(out io.Writer, sel marcfilter.Selector, source marcfilter.Source, n int) error {
+	e := &selectorExplanation{
+		Selector: strings.Join(selectorOpts, " AND "),
+		Tree:     explainTree(sel, nil),
+	}
+	if n > 0 {
+		for {
+			record, err := source.Next()
+			if err != nil {
+				return err
+			} else if record == nil {
+				return fmt.Errorf("marcdump: there is no record %d", n)
+			}
+			if record.Number == n {
+				e.Tree = explainTree(sel, record)
+				e.Record = &recordExplanation{
+					Number:  record.Number,
+					Offset:  record.Offset,
+					ID:      controlNumber(record),
+					Matched: sel.Match(record.MarcRecord),
+				}
+				break
+			}
+		}
+	}
+
+	indent := "  "
+	if jsonIndent > 0 {
+		indent = strings.Repeat(" ", jsonIndent)
+	}
+	b, err := json.MarshalIndent(e, "", indent)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", b)
+	return err
+}
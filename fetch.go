@@ -0,0 +1,202 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fetching records instead of reading them from files:
+//
+//    marcdump [options] fetch oclc [-key k -secret s] [-numbers file] [ocn...]
+//
+// retrieves the current WorldCat master record for each OCLC number
+// through the WorldCat Metadata API. The fetched records go through the
+// same selection and output as records read from a file. The API key
+// and secret can also be given in the OCLC_KEY and OCLC_SECRET
+// environment variables.
+
+var (
+	errUnknownFetchSource = errors.New("marcdump: unknown fetch source")
+	errNoCredentials      = errors.New("marcdump: the WorldCat Metadata API needs a key and secret")
+	errRecordNotFound     = errors.New("marcdump: record not found")
+)
+
+const (
+	oclcTokenURL   = "https://oauth.oclc.org/token"
+	oclcBibURL     = "https://metadata.api.oclc.org/worldcat/manage/bibs/"
+	oclcScope      = "WorldCatMetadataAPI"
+	fetchTimeout   = 30 * time.Second
+	fetchUserAgent = "marcdump"
+)
+
+// fetchName is the input name of fetched records in messages.
+const fetchName = "oclc"
+
+// getFetchReader parses the arguments following "fetch" and returns
+// the fetched records as a stream of ISO 2709 records.
+func getFetchReader(args []string) (io.ReadCloser, error) {
+	if len(args) == 0 || args[0] != "oclc" {
+		return nil, errUnknownFetchSource
+	}
+
+	flags := flag.NewFlagSet("fetch oclc", flag.ContinueOnError)
+	key := flags.String("key", os.Getenv("OCLC_KEY"), "WorldCat Metadata API key")
+	secret := flags.String("secret", os.Getenv("OCLC_SECRET"), "WorldCat Metadata API secret")
+	numbersFile := flags.String("numbers", "", "File of OCLC numbers, one per line")
+	if err := flags.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+	if *key == "" || *secret == "" {
+		return nil, errNoCredentials
+	}
+
+	numbers := flags.Args()
+	if *numbersFile != "" {
+		list, err := loadKeyList(*numbersFile)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, list...)
+	}
+
+	c := &oclcClient{
+		key:    *key,
+		secret: *secret,
+		client: &http.Client{Timeout: fetchTimeout},
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(c.fetchAll(w, numbers))
+	}()
+	return r, nil
+}
+
+// An oclcClient talks to the WorldCat Metadata API.
+type oclcClient struct {
+	key, secret string
+	client      *http.Client
+
+	token   string
+	expires time.Time
+}
+
+// fetchAll writes the record for each number to w. Numbers WorldCat
+// does not know are reported and skipped.
+func (c *oclcClient) fetchAll(w io.Writer, numbers []string) error {
+	for _, n := range numbers {
+		n = normalizeOCLCNumber(n)
+		if n == "" {
+			continue
+		}
+		raw, err := c.fetch(n)
+		if err == errRecordNotFound {
+			fmt.Fprintf(os.Stderr, "Warning: %s: no WorldCat record %s\n", fetchName, n)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("OCLC number %s: %v", n, err)
+		}
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetch returns the raw MARC record for an OCLC number.
+func (c *oclcClient) fetch(number string) ([]byte, error) {
+	if err := c.authorize(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", oclcBibURL+url.PathEscape(number), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/marc")
+	req.Header.Set("User-Agent", fetchUserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errRecordNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("WorldCat returned %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// authorize gets an access token with the client credentials grant,
+// unless the one it has is still good.
+func (c *oclcClient) authorize() error {
+	if c.token != "" && time.Now().Before(c.expires) {
+		return nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}, "scope": {oclcScope}}
+	req, err := http.NewRequest("POST", oclcTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.key, c.secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", fetchUserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OCLC authorization failed: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	c.token = token.AccessToken
+	// renew a minute early rather than have a request refused
+	c.expires = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second)
+	return nil
+}
+
+// normalizeOCLCNumber strips the prefixes OCLC numbers come with in
+// 035 and 001 ("(OCoLC)ocm00012345") down to the number.
+func normalizeOCLCNumber(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "(OCoLC)")
+	for _, prefix := range []string{"ocm", "ocn", "on"} {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	return strings.TrimLeft(s, "0")
+}
@@ -0,0 +1,34 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marcdump/marcfilter"
+)
+
+// Field filtering. -f 245_a:6xx:856 restricts the output to the given
+// fields: a tag (with x as a wildcard) keeps whole fields, and a tag
+// followed by subfield codes keeps only those subfields. The filter
+// sits between selection and the actions, so every action sees the
+// filtered record.
+
+// getFieldFilter parses the -f option, returning nil if no filter was
+// given.
+func getFieldFilter() (*marcfilter.FieldFilter, error) {
+	if fieldsOpt == "" {
+		return nil, nil
+	}
+	return marcfilter.ParseFieldFilter(fieldsOpt)
+}
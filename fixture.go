@@ -0,0 +1,145 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Test fixtures, the few records that show a problem, to attach to a
+// bug report. -extract-fixture name writes the first selected records,
+// 10 unless -m says otherwise, to name.mrc as they were read and to
+// name.mrk (see mrk.go) to be read alongside. -scrub replaces the
+// local identifiers, the control numbers, system control numbers, item
+// numbers and barcodes, with made-up ones before the records are
+// written. The same value is always replaced by the same made-up one,
+// so that holdings still link to their bibliographic records, but
+// scrubbed records are encoded anew, which loses whatever was odd in
+// their structure.
+
+// defaultFixtureRecords is how many records a fixture has without -m.
+const defaultFixtureRecords = 10
+
+// scrubbedSubfields are the subfields holding local identifiers, by
+// tag; "" is the value of a control field.
+var scrubbedSubfields = map[string]string{
+	"001": "",
+	"004": "",
+	"014": "a",
+	"035": "az",
+	"852": "p",
+	"876": "ap",
+	"877": "ap",
+	"878": "ap",
+}
+
+// A scrubber makes up identifiers for the values it scrubs.
+type scrubber map[string]string
+
+func (s scrubber) replace(value string) string {
+	// the qualifier of a system number, e.g. (OCoLC), is kept
+	prefix := ""
+	if strings.HasPrefix(value, "(") {
+		if i := strings.IndexByte(value, ')'); i > 0 {
+			prefix, value = value[:i+1], value[i+1:]
+		}
+	}
+	made, ok := s[value]
+	if !ok {
+		made = fmt.Sprintf("fixture%d", len(s)+1)
+		s[value] = made
+	}
+	return prefix + made
+}
+
+// scrub returns the record with its local identifiers replaced.
+func (s scrubber) scrub(record *marcfilter.Record) (*marcfilter.Record, error) {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("record at offset %d: %v", record.Offset, err)
+	}
+	for _, f := range m.Fields {
+		codes, ok := scrubbedSubfields[f.Tag]
+		switch {
+		case !ok:
+		case codes == "":
+			f.Value = s.replace(f.Value)
+		default:
+			for i, sf := range f.Subfields {
+				if strings.Contains(codes, sf.Code) {
+					f.Subfields[i].Value = s.replace(sf.Value)
+				}
+			}
+		}
+	}
+	raw, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return marcfilter.ParseRecord(raw, record.Offset, record.Number)
+}
+
+// getFixtureAction returns an action writing the records to name.mrc
+// and name.mrk, scrubbing them first if asked to.
+func getFixtureAction(name string, scrub bool) (actionFunc, error) {
+	if ext := filepath.Ext(name); ext == ".mrc" || ext == ".mrk" {
+		name = strings.TrimSuffix(name, ext)
+	}
+	out, err := createMarcWriter(name + ".mrc")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(name + ".mrk")
+	if err != nil {
+		out.close()
+		return nil, err
+	}
+	text := bufio.NewWriter(file)
+
+	var s scrubber
+	if scrub {
+		s = make(scrubber)
+	}
+	onFinish(func(w *tabwriter.Writer) error {
+		defer file.Close()
+		if err := out.close(); err != nil {
+			return err
+		}
+		if err := text.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d records written to %s.mrc and %s.mrk\n", out.count, name, name)
+		return file.Close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		if s != nil {
+			var err error
+			if record, err = s.scrub(record); err != nil {
+				return err
+			}
+		}
+		if err := out.write(record.Raw); err != nil {
+			return err
+		}
+		return mrkFormatter{}.Record(text, record)
+	}, nil
+}
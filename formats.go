@@ -0,0 +1,297 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"strings"
+)
+
+// Record formats. Leader/06 says which MARC 21 format a record is in:
+// z for authority records, u, v, x and y for holdings records, w and q
+// for classification and community information, and any other type of
+// material for bibliographic records. The same tag means different
+// things in each format, 100 being the main entry of a bibliographic
+// record and the heading of an authority record, so what marcdump knows
+// about the fields of each format is kept here. -type bib,auth,hold
+// selects the records of the formats listed.
+
+var errUnknownRecordFormat = errors.New("marcdump: -type takes a comma separated list of bib, auth, hold, class and comm")
+
+// The record formats.
+const (
+	formatBibliographic  = "bib"
+	formatAuthority      = "auth"
+	formatHoldings       = "hold"
+	formatClassification = "class"
+	formatCommunity      = "comm"
+)
+
+// formatNames names the formats in messages.
+var formatNames = map[string]string{
+	formatBibliographic:  "bibliographic",
+	formatAuthority:      "authority",
+	formatHoldings:       "holdings",
+	formatClassification: "classification",
+	formatCommunity:      "community information",
+}
+
+// marc21RecordTypes are the leader/06 codes of MARC 21 records.
+const marc21RecordTypes = "acdefgijkmopqrtuvwxyz"
+
+// recordFormat returns the format of a record from its leader.
+func recordFormat(leader string) string {
+	if len(leader) < marcfilter.LeaderLength {
+		return formatBibliographic
+	}
+	switch leader[6] {
+	case 'z':
+		return formatAuthority
+	case 'u', 'v', 'x', 'y':
+		return formatHoldings
+	case 'w':
+		return formatClassification
+	case 'q':
+		return formatCommunity
+	}
+	return formatBibliographic
+}
+
+// A formatSelector selects the records in any of its formats.
+type formatSelector struct {
+	formats map[string]bool
+}
+
+func newFormatSelector(list string) (*formatSelector, error) {
+	s := &formatSelector{formats: make(map[string]bool)}
+	for _, format := range strings.Split(list, ",") {
+		switch format = strings.TrimSpace(format); format {
+		case formatBibliographic, formatAuthority, formatHoldings, formatClassification, formatCommunity:
+			s.formats[format] = true
+		default:
+			return nil, errUnknownRecordFormat
+		}
+	}
+	return s, nil
+}
+
+func (s *formatSelector) Match(r *marc21.MarcRecord) bool {
+	return s.formats[recordFormat(fmt.Sprintf("%s", r.GetLeader()))]
+}
+
+// String lists the formats in the form -type takes.
+func (s *formatSelector) String() string {
+	var formats []string
+	for format := range s.formats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return strings.Join(formats, ",")
+}
+
+// authorityTagLabels names the common fields of authority records.
+var authorityTagLabels = map[string]string{
+	"001": "Control number",
+	"003": "Control number identifier",
+	"005": "Latest transaction",
+	"008": "Fixed-length data",
+	"010": "LC control number",
+	"024": "Other standard identifier",
+	"035": "System control number",
+	"040": "Cataloging source",
+	"046": "Special coded dates",
+	"053": "LC classification number",
+	"100": "Heading (personal name)",
+	"110": "Heading (corporate name)",
+	"111": "Heading (meeting name)",
+	"130": "Heading (uniform title)",
+	"148": "Heading (chronological)",
+	"150": "Heading (topical term)",
+	"151": "Heading (geographic name)",
+	"155": "Heading (genre/form)",
+	"180": "Heading (general subdiv.)",
+	"181": "Heading (geographic subdiv.)",
+	"182": "Heading (chronol. subdiv.)",
+	"185": "Heading (form subdiv.)",
+	"260": "Complex see reference",
+	"360": "Complex see also reference",
+	"368": "Other attributes",
+	"370": "Associated place",
+	"372": "Field of activity",
+	"373": "Associated group",
+	"374": "Occupation",
+	"375": "Gender",
+	"377": "Associated language",
+	"400": "See from (personal name)",
+	"410": "See from (corporate name)",
+	"411": "See from (meeting name)",
+	"430": "See from (uniform title)",
+	"450": "See from (topical term)",
+	"451": "See from (geographic name)",
+	"455": "See from (genre/form)",
+	"500": "See also (personal name)",
+	"510": "See also (corporate name)",
+	"511": "See also (meeting name)",
+	"530": "See also (uniform title)",
+	"550": "See also (topical term)",
+	"551": "See also (geographic name)",
+	"555": "See also (genre/form)",
+	"663": "Complex see also note",
+	"664": "Complex see note",
+	"667": "Nonpublic general note",
+	"670": "Source data found",
+	"675": "Source data not found",
+	"678": "Biographical or historical",
+	"680": "Public general note",
+	"681": "Subject example tracing",
+	"682": "Deleted heading",
+	"688": "Application history",
+	"700": "Linked heading (personal)",
+	"710": "Linked heading (corporate)",
+	"750": "Linked heading (topical)",
+	"751": "Linked heading (geographic)",
+}
+
+// holdingsTagLabels names the common fields of holdings records.
+var holdingsTagLabels = map[string]string{
+	"001": "Control number",
+	"003": "Control number identifier",
+	"004": "Bibliographic record",
+	"005": "Latest transaction",
+	"007": "Physical description",
+	"008": "Fixed-length data",
+	"014": "Linkage number",
+	"035": "System control number",
+	"040": "Cataloging source",
+	"541": "Acquisition source",
+	"561": "Ownership history",
+	"583": "Action note",
+	"852": "Location",
+	"853": "Captions (basic unit)",
+	"854": "Captions (supplements)",
+	"855": "Captions (indexes)",
+	"856": "Electronic location",
+	"863": "Enumeration (basic unit)",
+	"864": "Enumeration (supplements)",
+	"865": "Enumeration (indexes)",
+	"866": "Textual holdings (basic)",
+	"867": "Textual holdings (suppl.)",
+	"868": "Textual holdings (indexes)",
+	"876": "Item (basic unit)",
+	"877": "Item (supplements)",
+	"878": "Item (indexes)",
+}
+
+var authorityFixedPositions = []fixedPosition{
+	{0, 6, "Entered", nil},
+	{9, 10, "Kind of record", map[string]string{"a": "established heading", "b": "untraced reference",
+		"c": "traced reference", "d": "subdivision", "e": "node label", "f": "established heading and subdivision",
+		"g": "reference and subdivision"}},
+	{10, 11, "Rules", map[string]string{"a": "earlier rules", "b": "AACR 1", "c": "AACR 2", "d": "AACR 2 compatible",
+		"n": "not applicable", "z": "other"}},
+	{11, 12, "Subject system", map[string]string{"a": "LCSH", "b": "LC children's", "c": "MeSH", "d": "NAL",
+		"k": "Canadian", "n": "not applicable", "r": "AAT", "s": "Sears", "v": "RVM", "z": "other"}},
+	{14, 15, "Main or added entry", map[string]string{"a": "appropriate", "b": "not appropriate"}},
+	{15, 16, "Subject entry", map[string]string{"a": "appropriate", "b": "not appropriate"}},
+	{16, 17, "Series entry", map[string]string{"a": "appropriate", "b": "not appropriate"}},
+	{32, 33, "Personal name", map[string]string{"a": "differentiated", "b": "undifferentiated", "n": "not applicable"}},
+	{33, 34, "Establishment", map[string]string{"a": "fully established", "b": "memorandum", "c": "provisional",
+		"d": "preliminary", "n": "not applicable"}},
+	{39, 40, "Source", map[string]string{" ": "national bibliographic agency", "c": "cooperative cataloging program",
+		"d": "other", "u": "unknown"}},
+}
+
+var holdingsFixedPositions = []fixedPosition{
+	{0, 6, "Entered", nil},
+	{6, 7, "Receipt", map[string]string{"0": "unknown", "1": "other", "2": "received and complete or ceased",
+		"3": "on order", "4": "currently received", "5": "not currently received"}},
+	{7, 8, "Acquisition", map[string]string{"c": "cooperative", "d": "deposit", "e": "exchange", "f": "free",
+		"g": "gift", "l": "legal deposit", "m": "membership", "n": "non-library purchase", "p": "purchase",
+		"q": "lease", "u": "unknown", "z": "other"}},
+	{12, 13, "Retention", map[string]string{"0": "unknown", "1": "other", "2": "except as replaced by updates",
+		"3": "sample issue", "4": "until replaced by microform", "5": "until replaced by cumulation",
+		"6": "limited", "7": "not retained", "8": "permanently"}},
+	{16, 17, "Completeness", map[string]string{"0": "other", "1": "complete", "2": "incomplete",
+		"3": "scattered", "4": "not applicable"}},
+	{17, 20, "Copies", nil},
+	{20, 21, "Lending", map[string]string{"a": "will lend", "b": "will not lend", "c": "hard copy only",
+		"l": "limited", "u": "unknown"}},
+	{26, 32, "Report date", nil},
+}
+
+// formatTagLabels returns the field names of a format.
+func formatTagLabels(format string) map[string]string {
+	switch format {
+	case formatAuthority:
+		return authorityTagLabels
+	case formatHoldings:
+		return holdingsTagLabels
+	}
+	return tagLabels
+}
+
+// formatFixedPositions returns the 008 positions decoded in a format.
+func formatFixedPositions(format string) []fixedPosition {
+	switch format {
+	case formatAuthority:
+		return authorityFixedPositions
+	case formatHoldings:
+		return holdingsFixedPositions
+	}
+	return fixedDataPositions
+}
+
+// holdingsStatement reads an 863, 864 or 865 enumeration and chronology
+// field with the captions of its 853, 854 or 855 pattern, the one whose
+// $8 link number it starts with, e.g. "v.12:no.1-4 (1998:Jan.-Apr.)".
+// It returns "" if there is no such pattern.
+func holdingsStatement(field *marcfilter.Field, patterns []*marcfilter.Field) string {
+	link := field.Subfield("8")
+	if i := strings.IndexByte(link, '.'); i >= 0 {
+		link = link[:i]
+	}
+	var pattern *marcfilter.Field
+	for _, p := range patterns {
+		if p.Tag[2] == field.Tag[2] && p.Subfield("8") == link {
+			pattern = p
+		}
+	}
+	if pattern == nil || link == "" {
+		return ""
+	}
+
+	var enumeration, chronology []string
+	for _, sf := range field.Subfields {
+		caption := strings.Trim(pattern.Subfield(sf.Code), "()")
+		switch {
+		case sf.Code >= "a" && sf.Code <= "f":
+			enumeration = append(enumeration, caption+sf.Value)
+		case sf.Code >= "i" && sf.Code <= "m":
+			chronology = append(chronology, sf.Value)
+		}
+	}
+	statement := strings.Join(enumeration, ":")
+	if len(chronology) > 0 {
+		if statement != "" {
+			return statement + " (" + strings.Join(chronology, ":") + ")"
+		}
+		return strings.Join(chronology, ":")
+	}
+	return statement
+}
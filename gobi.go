@@ -0,0 +1,169 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// GOBI/YBP order records. Vendor order records carry the order data in
+// local 9xx fields; the order profile says which column of the
+// acquisitions CSV each subfield goes to, one column per line:
+//
+//    price     980_b
+//    fund      981_b
+//    location  981_c
+//
+// The order fields named in the profile are removed from the cleaned
+// bibliographic records.
+
+type orderColumn struct {
+	name     string
+	tag      string
+	subfield string
+}
+
+// Columns used when no order profile is given, following GOBI's usual
+// embedded order data layout. Institutions' templates vary, so check
+// these against yours.
+var defaultOrderColumns = []orderColumn{
+	{"control_number", "001", ""},
+	{"isbn", "020", "a"},
+	{"title", "245", "a"},
+	{"price", "980", "b"},
+	{"fund", "981", "b"},
+	{"location", "981", "c"},
+}
+
+var orderColumnRegexp = regexp.MustCompile(`^(\S+)\s+([0-9]{3})(?:_([0-9a-z]))?$`)
+
+func loadOrderProfile(name string) ([]orderColumn, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var columns []orderColumn
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		m := orderColumnRegexp.FindStringSubmatch(text)
+		if m == nil {
+			return nil, fmt.Errorf("%s:%d: invalid order column %q", name, line, text)
+		}
+		columns = append(columns, orderColumn{m[1], m[2], m[3]})
+	}
+	return columns, scanner.Err()
+}
+
+// getGobiAction returns an action that writes the order data of each
+// record to an acquisitions CSV, and the records without their order
+// fields to a MARC file when bibs is not "".
+func getGobiAction(name string, bibs string, profile string) (actionFunc, error) {
+	columns := defaultOrderColumns
+	if profile != "" {
+		var err error
+		if columns, err = loadOrderProfile(profile); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	out := csv.NewWriter(file)
+
+	var bibOut *marcWriter
+	if bibs != "" {
+		if bibOut, err = createMarcWriter(bibs); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.name
+	}
+	out.Write(header)
+
+	rows := 0
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(os.Stderr, "%d order rows written to %s\n", rows, name)
+		out.Flush()
+		if err := out.Error(); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		if bibOut != nil {
+			return bibOut.close()
+		}
+		return nil
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		row := make([]string, len(columns))
+		for i, c := range columns {
+			row[i] = strings.Join(marcfilter.FieldValues(record.MarcRecord, c.tag, c.subfield), ";")
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+		rows += 1
+
+		if bibOut == nil {
+			return nil
+		}
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		m.RemoveFields(func(f *marcfilter.Field) bool {
+			if f.Tag[0] != '9' {
+				return false
+			}
+			for _, c := range columns {
+				if c.tag == f.Tag {
+					return true
+				}
+			}
+			return false
+		})
+		raw, err := m.Encode()
+		if err != nil {
+			return err
+		}
+		return bibOut.write(raw)
+	}, nil
+}
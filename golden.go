@@ -0,0 +1,192 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Golden files, for catching changes to the output formats when
+// marcdump is upgraded. marcdump [options] golden fixture.mrc dir
+// writes the records of the fixture (see fixture.go) in every -o
+// format and compares each with the golden file for it in dir, such as
+// dir/fixture.marcxml, printing the first line that differs:
+//
+//    marcxml: line 12 differs
+//    - <subfield code="a">Einstein :</subfield>
+//    + <subfield code="a">Einstein</subfield>
+//
+// -update writes the golden files instead, and -formats limits the run
+// to some of the formats. The options are those the output is written
+// with, so the golden files have to be made and checked with the same
+// ones; pretty output is not colored unless -color always is given,
+// and template output needs a -template.
+
+var (
+	errGoldenArgs    = errors.New("marcdump: golden takes a fixture file and a directory of golden files")
+	errGoldenDiffers = errors.New("marcdump: the output differs from the golden files")
+)
+
+// golden parses the arguments following "golden" and checks or updates
+// the golden files.
+func golden(args []string) error {
+	flags := flag.NewFlagSet("golden", flag.ContinueOnError)
+	update := flags.Bool("update", false, "Write the golden files instead of comparing with them")
+	formatList := flags.String("formats", "", "Comma separated `formats` to check; all of them by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errGoldenArgs
+	}
+	fixture, dir := flags.Arg(0), flags.Arg(1)
+
+	var formats []string
+	if *formatList != "" {
+		formats = strings.Split(*formatList, ",")
+	} else {
+		for name := range formatters {
+			if name != "template" || templateFile != "" {
+				formats = append(formats, name)
+			}
+		}
+		sort.Strings(formats)
+	}
+	if colorMode == "auto" {
+		colorMode = "never"
+	}
+
+	base := strings.TrimSuffix(filepath.Base(fixture), filepath.Ext(fixture))
+	differ := 0
+	for _, format := range formats {
+		out, err := renderGolden(fixture, format)
+		if err != nil {
+			return fmt.Errorf("%s: %v", format, err)
+		}
+		name := filepath.Join(dir, base+"."+format)
+		if *update {
+			if err := ioutil.WriteFile(name, out, 0666); err != nil {
+				return err
+			}
+			fmt.Printf("%s: wrote %s\n", format, name)
+			continue
+		}
+
+		want, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			fmt.Printf("%s: no golden file %s; make it with -update\n", format, name)
+			differ++
+			continue
+		} else if err != nil {
+			return err
+		}
+		if d := goldenDifference(want, out); d != "" {
+			fmt.Printf("%s: %s", format, d)
+			differ++
+		}
+	}
+	if !*update {
+		fmt.Printf("%d of %d formats match\n", len(formats)-differ, len(formats))
+	}
+	if differ > 0 {
+		return errGoldenDiffers
+	}
+	return nil
+}
+
+// renderGolden returns the records of a file written in a format, as
+// -o would write them.
+func renderGolden(name string, format string) ([]byte, error) {
+	newFormatter, ok := formatters[format]
+	if !ok {
+		return nil, errUnknownOutputFormat
+	}
+	f, err := newFormatter()
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	var flags uint
+	if alignRight {
+		flags |= tabwriter.AlignRight
+	}
+	if separator != "" || format == "tsv" || format == "template" {
+		flags |= tabwriter.StripEscape
+	}
+	tw := tabwriter.NewWriter(&b, minWidth, tabWidth, padding, ' ', flags)
+	if err := f.Header(tw); err != nil {
+		return nil, err
+	}
+	reader := newInputReader([]string{name})
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			return nil, err
+		} else if record == nil {
+			break
+		}
+		if !rawOutput {
+			if record, err = convertRecord(record); err != nil {
+				return nil, err
+			}
+		}
+		if err := f.Record(tw, record); err != nil {
+			return nil, err
+		}
+		if err := tw.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.Footer(tw); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), tw.Flush()
+}
+
+// goldenDifference describes the first line at which the output
+// differs from the golden file, or returns "" if they are the same.
+func goldenDifference(want, got []byte) string {
+	if bytes.Equal(want, got) {
+		return ""
+	}
+	wantLines := strings.SplitAfter(string(want), "\n")
+	gotLines := strings.SplitAfter(string(got), "\n")
+	for i := 0; ; i++ {
+		switch {
+		case i == len(wantLines) || i == len(gotLines):
+			return fmt.Sprintf("%d lines instead of %d\n", bytes.Count(got, []byte("\n")), bytes.Count(want, []byte("\n")))
+		case wantLines[i] != gotLines[i]:
+			return fmt.Sprintf("line %d differs\n- %s+ %s", i+1, goldenLine(wantLines[i]), goldenLine(gotLines[i]))
+		}
+	}
+}
+
+// goldenLine returns a line ending with a newline.
+func goldenLine(s string) string {
+	if !strings.HasSuffix(s, "\n") {
+		return s + "\n"
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"github.com/TreeRex/marcdump/marcfilter"
+)
+
+// Report grouping. -group-by 040_a makes reports cross-tabulate their
+// counts by the value of a field or subfield, e.g. by cataloging agency.
+
+var errInvalidGroupBy = errors.New("marcdump: invalid group-by field")
+
+// Group name for records without a value in the group-by field.
+const noGroup = "(none)"
+
+// A groupFunc returns the group a record belongs to.
+type groupFunc func(record *marcfilter.Record) string
+
+// getGroupFunction returns the function grouping records by the given
+// field specification, or nil if spec is "".
+func getGroupFunction(spec string) (groupFunc, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	m := marcfilter.SpecRegexp.FindStringSubmatch(spec)
+	if m == nil || m[3] != "" {
+		return nil, errInvalidGroupBy
+	}
+	tag, code := m[1], m[2]
+
+	return func(record *marcfilter.Record) string {
+		values := marcfilter.FieldValues(record.MarcRecord, tag, code)
+		if len(values) == 0 || values[0] == "" {
+			return noGroup
+		}
+		return values[0]
+	}, nil
+}
+
+// sortedGroups returns the keys of a map of per-group values in order,
+// as -collate says.
+func sortedGroups(groups map[string]int) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sortValues(names)
+	return names
+}
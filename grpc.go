@@ -0,0 +1,381 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// The gRPC service. gRPC is HTTP/2 with a fixed framing: each message
+// is a compressed flag byte and a four byte length followed by the
+// message, and the call's status comes back in the grpc-status and
+// grpc-message trailers. That, and the protocol buffer encoding of the
+// handful of small messages in marcdump.proto, is all the service
+// needs, so both are done here rather than with generated code.
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+// grpcMaxMessage is the largest message accepted, the usual gRPC limit.
+const grpcMaxMessage = 4 << 20
+
+// A grpcError is an error with the status to end a call with.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// A grpcStream reads the request messages of a call and writes the
+// response messages.
+type grpcStream struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+// recv returns the next request message, or io.EOF after the last one.
+func (s *grpcStream) recv() ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(s.r.Body, prefix); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message of %d bytes is too long", length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(s.r.Body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// send writes a response message, sending it to the client at once.
+func (s *grpcStream) send(msg []byte) error {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := s.w.Write(append(prefix, msg...)); err != nil {
+		return err
+	}
+	s.w.(http.Flusher).Flush()
+	return nil
+}
+
+type grpcMethod func(store recordStore, s *grpcStream) error
+
+var grpcMethods = map[string]grpcMethod{
+	"/marcdump.Records/SearchRecords": grpcSearchRecords,
+	"/marcdump.Records/GetRecord":     grpcGetRecord,
+	"/marcdump.Records/ConvertStream": grpcConvertStream,
+}
+
+// A grpcHandler serves the Records service from a record store.
+type grpcHandler struct {
+	store recordStore
+	auth  *authenticator
+}
+
+func newGRPCHandler(store recordStore, auth *authenticator) *grpcHandler {
+	return &grpcHandler{store, auth}
+}
+
+func (h *grpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC needs HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "not a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	var err error
+	if !h.auth.allowed(r) {
+		err = grpcErrorf(grpcUnauthenticated, "missing or invalid credentials")
+	} else if method, ok := grpcMethods[r.URL.Path]; ok {
+		err = method(h.store, &grpcStream{w, r})
+	} else {
+		err = grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	code, message := grpcOK, ""
+	if e, ok := err.(*grpcError); ok {
+		code, message = e.code, e.message
+	} else if err != nil {
+		code, message = grpcInternal, err.Error()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(message))
+	}
+}
+
+// grpcEscape percent-encodes a status message as the trailer needs.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcSearchRecords streams the records matching a selector.
+//
+//	rpc SearchRecords(SearchRequest) returns (stream Record)
+func grpcSearchRecords(store recordStore, s *grpcStream) error {
+	msg, err := s.recv()
+	if err == io.EOF {
+		return grpcErrorf(grpcInvalidArgument, "missing request")
+	} else if err != nil {
+		return err
+	}
+	var expr string
+	var limit uint64
+	err = decodeProto(msg, func(field int, v uint64, data []byte) {
+		switch field {
+		case 1:
+			expr = string(data)
+		case 2:
+			limit = v
+		}
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	var sel marcfilter.Selector = new(marcfilter.Spec)
+	if expr != "" {
+		if sel, err = parseSelector(expr); err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+	}
+
+	source, sent := store.search(sel), uint64(0)
+	for limit == 0 || sent < limit {
+		if err := s.r.Context().Err(); err != nil {
+			return err
+		}
+		record, err := source.Next()
+		if err != nil {
+			return err
+		} else if record == nil {
+			break
+		}
+		if !sel.Match(record.MarcRecord) {
+			continue
+		}
+		if err := s.send(encodeRecordMessage(record)); err != nil {
+			return err
+		}
+		sent++
+	}
+	return nil
+}
+
+// grpcGetRecord returns the record with an index value.
+//
+//	rpc GetRecord(GetRequest) returns (Record)
+func grpcGetRecord(store recordStore, s *grpcStream) error {
+	msg, err := s.recv()
+	if err == io.EOF {
+		return grpcErrorf(grpcInvalidArgument, "missing request")
+	} else if err != nil {
+		return err
+	}
+	var id string
+	err = decodeProto(msg, func(field int, v uint64, data []byte) {
+		if field == 1 {
+			id = string(data)
+		}
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	record, err := store.get(id)
+	if err != nil {
+		return err
+	} else if record == nil {
+		return grpcErrorf(grpcNotFound, "no record has %s %s", store.idKey(), id)
+	}
+	return s.send(encodeRecordMessage(record))
+}
+
+// grpcConvertStream converts each record sent to the output format it
+// asks for, answering each request as it comes.
+//
+//	rpc ConvertStream(stream ConvertRequest) returns (stream ConvertResponse)
+func grpcConvertStream(store recordStore, s *grpcStream) error {
+	for {
+		msg, err := s.recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var raw []byte
+		var format string
+		err = decodeProto(msg, func(field int, v uint64, data []byte) {
+			switch field {
+			case 1:
+				raw = data
+			case 2:
+				format = string(data)
+			}
+		})
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+
+		data, err := convertRecordTo(raw, format)
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+		if err := s.send(appendProtoBytes(nil, 1, data)); err != nil {
+			return err
+		}
+	}
+}
+
+// convertRecordTo converts a raw record to UTF-8 and writes it in one
+// of the text, json and marcxml output formats, json by default.
+func convertRecordTo(raw []byte, format string) ([]byte, error) {
+	record, err := marcfilter.ParseRecord(raw, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if record, err = convertRecord(record); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "", "json":
+		return new(marcfilter.JSONFormatter).Marshal(record)
+	case "marcxml":
+		return marcfilter.MarshalMarcXML(record)
+	case "text":
+		var b bytes.Buffer
+		w := tabwriter.NewWriter(&b, minWidth, tabWidth, padding, ' ', 0)
+		err := new(marcfilter.TextFormatter).Record(w, record)
+		return b.Bytes(), err
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// encodeRecordMessage encodes a Record message: the record's 001, its
+// offset in the file and its ISO 2709 bytes.
+func encodeRecordMessage(record *marcfilter.Record) []byte {
+	var b []byte
+	if id, err := record.GetControlField("001"); err == nil {
+		b = appendProtoBytes(b, 1, []byte(id))
+	}
+	b = appendProtoVarint(b, 2, uint64(record.Offset))
+	return appendProtoBytes(b, 3, record.Raw)
+}
+
+//
+// Protocol buffer encoding
+//
+
+var errBadMessage = errors.New("malformed protocol buffer message")
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// decodeProto calls f with each field of a message: the value of a
+// varint field, or the contents of a length delimited one. Fixed width
+// fields are skipped, as no message here has them.
+func decodeProto(b []byte, f func(field int, v uint64, data []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBadMessage
+		}
+		b = b[n:]
+
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errBadMessage
+			}
+			b = b[n:]
+			f(field, v, nil)
+		case 1:
+			if len(b) < 8 {
+				return errBadMessage
+			}
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return errBadMessage
+			}
+			f(field, 0, b[n:n+int(length)])
+			b = b[n+int(length):]
+		case 5:
+			if len(b) < 4 {
+				return errBadMessage
+			}
+			b = b[4:]
+		default:
+			return errBadMessage
+		}
+	}
+	return nil
+}
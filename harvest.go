@@ -0,0 +1,457 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reading records over the network. An input that is an http or https
+// URL is downloaded as it is read, and may be ISO 2709, compressed or
+// not, or MARCXML. -oai harvests the records of an OAI-PMH repository
+// instead of reading inputs:
+//
+//    marcdump -oai https://example.org/oai -set serials -from 2014-01-01 [options]
+//
+// asks the repository for its records (ListRecords) in the -oai-prefix
+// metadata format, marc21 by default, following the resumption tokens
+// until the list is complete. Either way the MARCXML records are
+// converted to ISO 2709 in UTF-8, and go through the same selection and
+// output as records read from a file. Records the repository has
+// deleted have no metadata, and are passed over.
+//
+// -oai-dir writes each harvest's records as they come, a response at a
+// time, to a file in the directory named for when the harvest started,
+// harvest-20141016T120000Z.mrc. -oai-state file keeps where a harvest
+// has got to, saved after each response is written out:
+//
+//    base https://example.org/oai
+//    prefix marc21
+//    set serials
+//    token 4711!2000!marc21
+//    started 2014-10-16T12:00:00Z
+//    file harvests/harvest-20141016T120000Z.mrc
+//    size 10485760
+//    harvested 2014-10-09T12:00:00Z
+//
+// A harvest that was interrupted is resumed with its resumption token,
+// adding to its file what came after the last response saved. Once a
+// harvest is complete the next one is incremental, asking for the
+// records changed since the last one started (harvested), or since the
+// day it started if the repository only keeps dates. Only the file is
+// sure to have every record exactly once; the records of the response
+// being read when a run stops can be output again by the next.
+
+var (
+	errHarvestInputs   = errors.New("marcdump: -oai harvests the records instead of reading input files")
+	errHarvestFlags    = errors.New("marcdump: -set, -from, -until, -oai-dir and -oai-state need -oai")
+	errHarvestState    = errors.New("marcdump: the -oai-state file is of the harvest of another repository, set or format")
+	errBadHarvestState = errors.New("marcdump: invalid -oai-state file")
+)
+
+// harvestRetries is the number of times a request the server is too
+// busy for (503) is made again, after the wait it asks for.
+const harvestRetries = 5
+
+// harvestClient gives up on a server that does not connect or answer
+// within fetchTimeout, but not on a response that takes longer than
+// that to read, as a large URL input can.
+var harvestClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: fetchTimeout}).DialContext,
+	TLSHandshakeTimeout:   fetchTimeout,
+	ResponseHeaderTimeout: fetchTimeout,
+}}
+
+// isURL reports whether an input name is an http or https URL.
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// openURL returns the records at a URL as a stream of ISO 2709
+// records, converting them if they are MARCXML.
+func openURL(name string) (io.ReadCloser, error) {
+	resp, err := harvestGet(name)
+	if err != nil {
+		return nil, err
+	}
+	body := bufio.NewReader(resp.Body)
+	start, _ := body.Peek(512)
+	if !marcfilter.IsMarcXML(start) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{body, resp.Body}, nil
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		defer resp.Body.Close()
+		xr := marcfilter.NewMarcXMLReader(body)
+		for {
+			raw, err := xr.Next()
+			if err == nil && raw == nil {
+				w.Close()
+				return
+			}
+			if err == nil {
+				_, err = w.Write(raw)
+			}
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+// harvestGet makes a GET request, waiting and asking again while the
+// server is too busy.
+func harvestGet(u string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", fetchUserAgent)
+		resp, err := harvestClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable && attempt < harvestRetries {
+			resp.Body.Close()
+			wait := 10 * time.Second
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+				wait = time.Duration(s) * time.Second
+			}
+			time.Sleep(wait)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// An oaiHarvest is a ListRecords request and what it asks for.
+type oaiHarvest struct {
+	base                     string
+	prefix, set, from, until string
+
+	dir       string // for the harvest files, or ""
+	stateFile string // or ""
+	state     harvestState
+	file      *os.File
+}
+
+// A harvestState is where a harvest has got to, or when the last one
+// started.
+type harvestState struct {
+	base, prefix, set string
+	token             string // of the harvest in progress, or ""
+	started           string // the response date of its first response
+	file              string
+	size              int64
+	harvested         string // when the last complete harvest started
+}
+
+// readHarvestState reads a -oai-state file, returning the zero state if
+// there is none.
+func readHarvestState(name string) (harvestState, error) {
+	var st harvestState
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return st, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		i := strings.IndexByte(scanner.Text(), ' ')
+		if i < 0 {
+			return st, errBadHarvestState
+		}
+		key, value := scanner.Text()[:i], scanner.Text()[i+1:]
+		switch key {
+		case "base":
+			st.base = value
+		case "prefix":
+			st.prefix = value
+		case "set":
+			st.set = value
+		case "token":
+			st.token = value
+		case "started":
+			st.started = value
+		case "file":
+			st.file = value
+		case "size":
+			if st.size, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return st, errBadHarvestState
+			}
+		case "harvested":
+			st.harvested = value
+		default:
+			return st, errBadHarvestState
+		}
+	}
+	return st, scanner.Err()
+}
+
+// write writes the state to a file, replacing the file only once it is
+// complete.
+func (st *harvestState) write(name string) error {
+	var b strings.Builder
+	for _, kv := range [][2]string{
+		{"base", st.base}, {"prefix", st.prefix}, {"set", st.set},
+		{"token", st.token}, {"started", st.started}, {"file", st.file},
+		{"size", strconv.FormatInt(st.size, 10)}, {"harvested", st.harvested},
+	} {
+		if kv[1] != "" && (kv[0] != "size" || st.file != "") {
+			fmt.Fprintf(&b, "%s %s\n", kv[0], kv[1])
+		}
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// start picks up the harvest where the state file says the last one
+// got to, and opens the file of the harvest.
+func (h *oaiHarvest) start() error {
+	if h.stateFile != "" {
+		st, err := readHarvestState(h.stateFile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", h.stateFile, err)
+		}
+		if st.base != "" && (st.base != h.base || st.prefix != h.prefix || st.set != h.set) {
+			return errHarvestState
+		}
+		st.base, st.prefix, st.set = h.base, h.prefix, h.set
+		h.state = st
+		if st.token != "" {
+			fmt.Fprintf(os.Stderr, "Resuming the harvest started %s\n", st.started)
+		} else if st.harvested != "" && h.from == "" {
+			if h.from, err = h.datestamp(st.harvested); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Harvesting the records changed since %s\n", h.from)
+		}
+	}
+
+	if h.dir == "" {
+		return nil
+	}
+	if h.state.token != "" && h.state.file != "" {
+		// the records after the last response saved are harvested again
+		file, err := os.OpenFile(h.state.file, os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		if err := file.Truncate(h.state.size); err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Seek(h.state.size, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+		h.file = file
+		return nil
+	}
+	name := filepath.Join(h.dir, "harvest-"+time.Now().UTC().Format("20060102T150405Z")+".mrc")
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	h.file = file
+	h.state.file, h.state.size = name, 0
+	return nil
+}
+
+// datestamp returns a date and time as the repository takes them: a
+// date only if that is all it keeps.
+func (h *oaiHarvest) datestamp(t string) (string, error) {
+	resp, err := harvestGet(h.url(url.Values{"verb": {"Identify"}}))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var identify struct {
+		Granularity string `xml:"Identify>granularity"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&identify); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(identify.Granularity) == "YYYY-MM-DD" && len(t) > 10 {
+		return t[:10], nil
+	}
+	return t, nil
+}
+
+// url returns the URL of a request to the repository.
+func (h *oaiHarvest) url(query url.Values) string {
+	if strings.Contains(h.base, "?") {
+		return h.base + "&" + query.Encode()
+	}
+	return h.base + "?" + query.Encode()
+}
+
+// harvest returns the records of the repository as a stream of ISO 2709
+// records.
+func (h *oaiHarvest) harvest() io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		query := url.Values{"verb": {"ListRecords"}, "metadataPrefix": {h.prefix}}
+		for k, v := range map[string]string{"set": h.set, "from": h.from, "until": h.until} {
+			if v != "" {
+				query.Set(k, v)
+			}
+		}
+		if h.state.token != "" {
+			query = url.Values{"verb": {"ListRecords"}, "resumptionToken": {h.state.token}}
+		}
+		for {
+			var batch bytes.Buffer
+			token, date, err := h.list(&batch, query)
+			if err == nil {
+				err = h.save(batch.Bytes(), token, date)
+			}
+			if err == nil {
+				_, err = w.Write(batch.Bytes())
+			}
+			if err != nil || token == "" {
+				if h.file != nil {
+					h.file.Close()
+				}
+				w.CloseWithError(err)
+				return
+			}
+			// a resumption token stands in for every other argument
+			query = url.Values{"verb": {"ListRecords"}, "resumptionToken": {token}}
+		}
+	}()
+	return r
+}
+
+// save writes the records of a response to the harvest file, and then
+// where the harvest has got to to the state file.
+func (h *oaiHarvest) save(records []byte, token string, date string) error {
+	if h.file != nil {
+		if _, err := h.file.Write(records); err != nil {
+			return err
+		}
+		if err := h.file.Sync(); err != nil {
+			return err
+		}
+		h.state.size += int64(len(records))
+	}
+	if h.stateFile == "" {
+		return nil
+	}
+	if h.state.started == "" {
+		h.state.started = date
+	}
+	h.state.token = token
+	if token == "" {
+		h.state.harvested = h.state.started
+		h.state.started, h.state.file, h.state.size = "", "", 0
+	}
+	return h.state.write(h.stateFile)
+}
+
+// list makes one ListRecords request, writing the records of the
+// response to w, and returns the resumption token for the rest of the
+// list, or "" if the list is complete, and the date of the response.
+func (h *oaiHarvest) list(w io.Writer, query url.Values) (string, string, error) {
+	resp, err := harvestGet(h.url(query))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	d := xml.NewDecoder(resp.Body)
+	token, date := "", ""
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return token, date, nil
+		} else if err != nil {
+			return "", "", err
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case marcfilter.IsMarcXMLRecord(start):
+			m, err := marcfilter.DecodeMarcXMLRecord(d, start)
+			if err != nil {
+				return "", "", err
+			}
+			raw, err := m.Encode()
+			if err != nil {
+				return "", "", err
+			}
+			if _, err := w.Write(raw); err != nil {
+				return "", "", err
+			}
+		case start.Name.Local == "responseDate":
+			if err := d.DecodeElement(&date, &start); err != nil {
+				return "", "", err
+			}
+			date = strings.TrimSpace(date)
+		case start.Name.Local == "resumptionToken":
+			if err := d.DecodeElement(&token, &start); err != nil {
+				return "", "", err
+			}
+			token = strings.TrimSpace(token)
+		case start.Name.Local == "error":
+			var oaiErr struct {
+				Code    string `xml:"code,attr"`
+				Message string `xml:",chardata"`
+			}
+			if err := d.DecodeElement(&oaiErr, &start); err != nil {
+				return "", "", err
+			}
+			if oaiErr.Code == "noRecordsMatch" {
+				return "", date, nil
+			}
+			return "", "", fmt.Errorf("OAI-PMH error %s: %s", oaiErr.Code, strings.TrimSpace(oaiErr.Message))
+		}
+	}
+}
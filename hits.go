@@ -0,0 +1,217 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"strings"
+	"text/tabwriter"
+)
+
+// Selector hits. -hits prints, in place of each record the selector
+// matches, what in the record made it match, like grep -o does:
+//
+//    record  id       spec          field     bytes    text
+//    12      ocm0042  245_a=Hamlet  245#1 $a  214-220  "Hamlet"
+//
+// A hit is a value a spec of the selector matched, in an operand that
+// counted toward the match: both sides of an AND, the sides of an OR
+// that matched, and nothing under a NOT, which matches on what is not
+// there. The field is the tag and which instance of it in the record,
+// counting from 1, and the bytes are where the matched text is in the
+// record, counting from the start of its leader; with a criterion that
+// is the part of the value the regular expression matched, each match
+// on a line of its own, and without one, or with normalization, the
+// whole value.
+
+// A selectorHit is a value of a record that a spec matched.
+type selectorHit struct {
+	spec       string
+	location   string
+	start, end int
+	text       string
+}
+
+// getHitsAction returns an action printing the hits of the selector in
+// each record.
+func getHitsAction(selector marcfilter.Selector) actionFunc {
+	header := false
+	onFinish(func(w *tabwriter.Writer) error {
+		return w.Flush()
+	})
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		if !header {
+			fmt.Fprintln(w, "record\tid\tspec\tfield\tbytes\ttext")
+			header = true
+		}
+		id := controlNumber(record)
+		for _, h := range selectorHits(selector, record, m) {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d-%d\t%q\n", record.Number, id, h.spec, h.location, h.start, h.end, h.text)
+		}
+		return nil
+	}
+}
+
+// selectorHits returns the hits of a selector in a record, in the order
+// of the selector's specs.
+func selectorHits(sel marcfilter.Selector, record *marcfilter.Record, m *marcfilter.MutableRecord) []selectorHit {
+	if !sel.Match(record.MarcRecord) {
+		return nil
+	}
+	switch s := sel.(type) {
+	case *marcfilter.And:
+		return append(selectorHits(s.Left, record, m), selectorHits(s.Right, record, m)...)
+	case *marcfilter.Or:
+		return append(selectorHits(s.Left, record, m), selectorHits(s.Right, record, m)...)
+	case *marcfilter.Spec:
+		return specHits(s, m)
+	case *marcfilter.ValueSet:
+		name := s.Field
+		if s.Subfield != "" {
+			name += "_" + s.Subfield
+		}
+		return valueHits(m, s.Field, s.Subfield, name+" in list", func(v string) [][]int {
+			if s.Values[v] {
+				return [][]int{{0, len(v)}}
+			}
+			return nil
+		})
+	case *formatSelector:
+		return []selectorHit{{spec: "type " + s.String(), location: "LDR/06", start: 6, end: 7, text: string(m.Leader[6:7])}}
+	case *agencySelector:
+		var hits []selectorHit
+		for _, code := range agencySubfields {
+			hits = append(hits, valueHits(m, "040", code, "agency "+s.String(), func(v string) [][]int {
+				if s.agencies[normalizeAgency(v)] {
+					return [][]int{{0, len(v)}}
+				}
+				return nil
+			})...)
+		}
+		return hits
+	}
+	return nil
+}
+
+// specHits returns the hits of a selection spec.
+func specHits(s *marcfilter.Spec, m *marcfilter.MutableRecord) []selectorHit {
+	name := s.Field
+	if s.Position != nil {
+		name += "/" + s.Position.String()
+	} else if s.Subfield != "" {
+		name += "_" + s.Subfield
+	}
+	if s.Criterion != nil {
+		name += "=" + s.Criterion.String()
+	}
+
+	// the ranges of a value the spec matched
+	ranges := func(v string) [][]int {
+		switch {
+		case !s.MatchValue(v):
+			return nil
+		case s.Criterion == nil || s.Normalize:
+			return [][]int{{0, len(v)}}
+		}
+		var matched [][]int
+		for _, r := range s.Criterion.FindAllStringIndex(v, -1) {
+			if r[1] > r[0] {
+				matched = append(matched, r)
+			}
+		}
+		if len(matched) == 0 {
+			// an empty match, of ^ or $, matches the whole value
+			matched = [][]int{{0, len(v)}}
+		}
+		return matched
+	}
+
+	switch {
+	case s.Field == "":
+		return nil
+	case s.Position != nil:
+		return positionHits(s, name, m, ranges)
+	}
+	return valueHits(m, s.Field, s.Subfield, name, ranges)
+}
+
+// positionHits returns the hits of a positional spec.
+func positionHits(s *marcfilter.Spec, name string, m *marcfilter.MutableRecord, ranges func(string) [][]int) []selectorHit {
+	p := s.Position
+	var hits []selectorHit
+	add := func(location string, value string, start int) {
+		for _, r := range ranges(value) {
+			hits = append(hits, selectorHit{name, location, start + r[0], start + r[1], value[r[0]:r[1]]})
+		}
+	}
+
+	if s.Field == marcfilter.LeaderTag {
+		if p.End < len(m.Leader) {
+			add("LDR/"+p.String(), string(m.Leader[p.Start:p.End+1]), p.Start)
+		}
+		return hits
+	}
+	fields := m.FieldsByTag(s.Field)
+	if p.Indicator == 0 && len(fields) > 1 {
+		// the character positions of the first instance, as with
+		// matching
+		fields = fields[:1]
+	}
+	for i, f := range fields {
+		location := fmt.Sprintf("%s#%d", f.Tag, i+1)
+		switch {
+		case p.Indicator != 0:
+			if len(f.Indicators) == 2 {
+				add(location+" "+p.String(), f.Indicators[p.Indicator-1:p.Indicator], f.Offset+p.Indicator-1)
+			}
+		case p.End < len(f.Value):
+			add(location+"/"+p.String(), f.Value[p.Start:p.End+1], f.Offset+p.Start)
+		}
+	}
+	return hits
+}
+
+// valueHits returns the hits in the values of a field, or of its
+// subfields with a code, or of all its subfields if code is "".
+func valueHits(m *marcfilter.MutableRecord, tag string, code string, name string, ranges func(string) [][]int) []selectorHit {
+	var hits []selectorHit
+	for i, f := range m.FieldsByTag(tag) {
+		location := fmt.Sprintf("%s#%d", f.Tag, i+1)
+		if strings.HasPrefix(f.Tag, "00") {
+			for _, r := range ranges(f.Value) {
+				hits = append(hits, selectorHit{name, location, f.Offset + r[0], f.Offset + r[1], f.Value[r[0]:r[1]]})
+			}
+			continue
+		}
+		// the value of a subfield follows the indicators and the
+		// delimiter and code of each subfield up to it
+		start := f.Offset + len(f.Indicators)
+		for _, sf := range f.Subfields {
+			start += 2
+			if code == "" || sf.Code == code {
+				for _, r := range ranges(sf.Value) {
+					hits = append(hits, selectorHit{name, location + " $" + sf.Code, start + r[0], start + r[1], sf.Value[r[0]:r[1]]})
+				}
+			}
+			start += len(sf.Value)
+		}
+	}
+	return hits
+}
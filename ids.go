@@ -0,0 +1,116 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"regexp"
+	"strings"
+)
+
+// Record keys. Which field identifies a record differs from one
+// institution to the next, so the fields that key records are given as
+// an expression of alternatives in order of preference:
+//
+//    035(OCoLC) > 001 > 020
+//
+// keys a record by its OCLC number if it has one, or else its 001, or
+// else its ISBN. Each alternative is a field or field_subfield, with
+// optionally a prefix in parentheses the value has to start with; a
+// data field with a prefix but no subfield means its $a, one without
+// either all its subfields, as elsewhere. The values are taken as
+// recorded, prefix and all.
+//
+// -id-expr sets the key of every keyed operation: -mkindex indexes the
+// records on it, so that serve looks them up by it, -diff matches
+// records by it and -load stores them under it, and -dedupe id
+// clusters them by it. -diff-key, -load-key and -dedupe take an
+// expression of their own too.
+
+var errInvalidKeyExpr = errors.New("marcdump: invalid key expression, e.g. 035(OCoLC) > 001 > 020")
+
+// keyAlternativeRegexp is an alternative of a key expression.
+var keyAlternativeRegexp = regexp.MustCompile(`^([0-9A-Za-z]{3})(?:_([0-9a-z]))?(?:\((.+)\))?$`)
+
+// A recordKey is a parsed key expression.
+type recordKey struct {
+	text         string
+	alternatives []keyAlternative
+}
+
+type keyAlternative struct {
+	tag, code, prefix string
+}
+
+// parseRecordKey parses a key expression.
+func parseRecordKey(expr string) (*recordKey, error) {
+	k := &recordKey{text: strings.TrimSpace(expr)}
+	for _, part := range strings.Split(expr, ">") {
+		m := keyAlternativeRegexp.FindStringSubmatch(strings.TrimSpace(part))
+		if m == nil {
+			return nil, errInvalidKeyExpr
+		}
+		alt := keyAlternative{m[1], m[2], m[3]}
+		if alt.prefix != "" && alt.code == "" && !strings.HasPrefix(alt.tag, "00") {
+			alt.code = "a"
+		}
+		k.alternatives = append(k.alternatives, alt)
+	}
+	return k, nil
+}
+
+// String returns the expression, which also names the key of an index
+// on it.
+func (k *recordKey) String() string {
+	return k.text
+}
+
+// values returns the values of the first alternative a record has, and
+// the tag they are from.
+func (k *recordKey) values(record *marcfilter.Record) ([]string, string) {
+	for _, alt := range k.alternatives {
+		var values []string
+		for _, v := range marcfilter.RawFieldValues(record.Raw, alt.tag, alt.code) {
+			if strings.HasPrefix(v, alt.prefix) {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			return values, alt.tag
+		}
+	}
+	return nil, ""
+}
+
+// id returns the key of a record, or "" if it has none.
+func (k *recordKey) id(record *marcfilter.Record) string {
+	if values, _ := k.values(record); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// keyOption returns the expression of a key option, falling back to
+// -id-expr, and to the 001 without it.
+func keyOption(opt string) string {
+	switch {
+	case opt != "":
+		return opt
+	case idExpr != "":
+		return idExpr
+	}
+	return "001"
+}
@@ -0,0 +1,76 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"text/tabwriter"
+)
+
+// -mkindex writes an offset index (see the marcfilter package) on the
+// field of the selector's first term, or on the -id-expr (see ids.go),
+// and -index reads one to seek straight to the records a selection can
+// match. The key values are taken from the raw record, so that indexing
+// does not need the records parsed (see raw.go). An index holds the
+// offsets of a single file, so it is made from one input.
+//
+// An index is keyed by the text of its expression, and -index plans a
+// selection term through one only where the term names that key: an
+// index on a whole data field is not used for specs on it (see
+// selectEntries), and one on an -id-expr of alternatives or prefixes
+// serves serve's lookups by key but no selection.
+
+var errIndexInputs = errors.New("marcdump: -mkindex indexes a single input file")
+
+// getIndexAction returns an action that adds the key values of each
+// record to an index, writing it to the named file at the end. The
+// index is on the -id-expr, or else the field of the selector's first
+// term, or the 001.
+func getIndexAction(name string, selector marcfilter.Selector) (actionFunc, error) {
+	if flag.NArg() != 1 {
+		return nil, errIndexInputs
+	}
+	term := marcfilter.FirstTerm(selector)
+	if term == nil {
+		term = new(marcfilter.Spec)
+	}
+	expr := marcfilter.IndexKey(term)
+	if idExpr != "" {
+		expr = idExpr
+	}
+	key, err := parseRecordKey(expr)
+	if err != nil {
+		return nil, err
+	}
+	idx := &marcfilter.Index{Key: key.String()}
+
+	onFinish(func(w *tabwriter.Writer) error {
+		idx.Sort()
+		fmt.Fprintf(os.Stderr, "%d keys indexed on %s in %s\n", len(idx.Entries), idx.Key, name)
+		return idx.Write(name)
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		values, _ := key.values(record)
+		for _, value := range values {
+			idx.Entries = append(idx.Entries, marcfilter.IndexEntry{Value: value, Offset: record.Offset, Length: len(record.Raw)})
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An inputReader reads the records of each of the named inputs in turn,
+// "-" being the standard input and URLs being downloaded (see
+// harvest.go). Compressed inputs are decompressed as they are read.
+// Records are numbered across all the inputs; offsets are within the
+// input a record came from.
+type inputReader struct {
+	names []string
+	name  string
+	file  io.ReadCloser
+	rr    *recordReader
+	count int
+
+	// inputs that are already open, such as fetched records, by name
+	readers map[string]io.ReadCloser
+
+	// passed on to the recordReader of each input
+	tee          *marcWriter
+	stripGaps    bool
+	terminators  []byte
+	unterminated bool
+	onGap        func(offset int64, gap []byte)
+	onBad        func(offset int64, raw []byte, err error)
+	skip         int
+	reuse        bool
+
+	// for -trace, how long the last record took to parse
+	timeParse bool
+	parseTime time.Duration
+
+	// where in the first input to start reading, when resuming
+	resumeOffset int64
+
+	// the index of the first of names among the inputs given, and the
+	// number of records before each input opened since, for inputOf
+	first  int
+	mu     sync.Mutex
+	starts []int
+}
+
+func newInputReader(names []string) *inputReader {
+	return &inputReader{names: names}
+}
+
+func (ir *inputReader) Next() (*marcfilter.Record, error) {
+	for {
+		f, err := ir.nextFrame()
+		if f == nil || err != nil {
+			return nil, err
+		}
+		var started time.Time
+		if ir.timeParse {
+			started = time.Now()
+		}
+		record, err := marcfilter.ParseRecord(f.raw, f.offset, f.number)
+		if ir.timeParse {
+			ir.parseTime = time.Since(started)
+		}
+		if err != nil && ir.onBad != nil {
+			ir.onBad(f.offset, f.raw, fmt.Errorf("%s: %v", f.input, err))
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.input, err)
+		}
+		return record, nil
+	}
+}
+
+// nextFrame returns the next record of the inputs without parsing it.
+func (ir *inputReader) nextFrame() (*frame, error) {
+	for {
+		if ir.rr == nil {
+			if len(ir.names) == 0 {
+				return nil, nil
+			}
+			if err := ir.open(ir.names[0]); err != nil {
+				return nil, err
+			}
+			ir.names = ir.names[1:]
+			ir.mu.Lock()
+			ir.starts = append(ir.starts, ir.count)
+			ir.mu.Unlock()
+		}
+
+		f, err := ir.rr.nextFrame()
+		ir.count = ir.rr.Count
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", ir.name, err)
+		}
+		if f != nil {
+			f.input = ir.name
+			return f, nil
+		}
+
+		ir.file.Close()
+		ir.rr = nil
+	}
+}
+
+func (ir *inputReader) open(name string) error {
+	if r, ok := ir.readers[name]; ok {
+		ir.file = r
+	} else if name == "-" {
+		ir.file = os.Stdin
+	} else if isURL(name) {
+		r, err := openURL(name)
+		if err != nil {
+			return err
+		}
+		ir.file = r
+	} else {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		ir.file = file
+	}
+
+	// an uncompressed file can be resumed with a seek, others only by
+	// reading up to where the run stopped
+	offset := ir.resumeOffset
+	ir.resumeOffset = 0
+	if file, ok := ir.file.(*os.File); ok && offset > 0 && !isCompressed(file) {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			ir.file.Close()
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	r, err := decompress(ir.file)
+	if err != nil {
+		ir.file.Close()
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if file, ok := ir.file.(*os.File); ok && offset > 0 && isCompressed(file) {
+		if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+			ir.file.Close()
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	ir.name = name
+	ir.rr = newRecordReader(r)
+	ir.rr.Offset = offset
+	if offset == 0 {
+		ir.rr.sniff()
+	}
+	ir.rr.Count = ir.count
+	ir.rr.tee = ir.tee
+	ir.rr.stripGaps = ir.stripGaps
+	ir.rr.Terminators, ir.rr.Unterminated = ir.terminators, ir.unterminated
+	ir.rr.onGap = ir.onGap
+	if ir.onBad != nil {
+		ir.rr.OnBad = func(offset int64, raw []byte, err error) {
+			ir.onBad(offset, raw, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	ir.rr.skip = ir.skip
+	ir.rr.Reuse = ir.reuse
+	return nil
+}
+
+// inputOf returns the index, among the inputs given, of the input a
+// record came from.
+func (ir *inputReader) inputOf(number int) int {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	i := sort.SearchInts(ir.starts, number) - 1
+	if i < 0 {
+		i = 0
+	}
+	return ir.first + i
+}
@@ -0,0 +1,103 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// normalizeISBN returns the ISBN-13 form of the ISBN at the start of an
+// 020 $a value, ignoring hyphens and any qualifier such as "(pbk.)".
+// It returns "" if the value does not start with a valid ISBN.
+func normalizeISBN(value string) string {
+	isbn := strings.ToUpper(strings.Replace(isbnRegexp.FindString(strings.TrimSpace(value)), "-", "", -1))
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i := 0; i < 10; i++ {
+			d := int(isbn[i] - '0')
+			if isbn[i] == 'X' {
+				if i != 9 {
+					return ""
+				}
+				d = 10
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 != 0 {
+			return ""
+		}
+		isbn = "978" + isbn[:9]
+		return isbn + string(isbn13CheckDigit(isbn))
+	case 13:
+		if strings.ContainsRune(isbn, 'X') || isbn13CheckDigit(isbn[:12]) != isbn[12] {
+			return ""
+		}
+		return isbn
+	}
+	return ""
+}
+
+// isbn13CheckDigit computes the check digit for the first 12 digits of
+// an ISBN-13.
+func isbn13CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(digits[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// getDuplicateISBNAction returns an action collecting the normalized
+// ISBNs of each record, reporting those found on more than one record
+// once all the records have been seen.
+func getDuplicateISBNAction() actionFunc {
+	records := make(map[string][]string)
+	onFinish(func(w *tabwriter.Writer) error {
+		var duplicates []string
+		for isbn, keys := range records {
+			if len(keys) > 1 {
+				duplicates = append(duplicates, isbn)
+			}
+		}
+		sort.Strings(duplicates)
+		for _, isbn := range duplicates {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", isbn, len(records[isbn]), strings.Join(records[isbn], " "))
+		}
+		fmt.Fprintf(w, "%d ISBNs on more than one record\n", len(duplicates))
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		key := controlNumber(record)
+		seen := make(map[string]bool)
+		for _, value := range marcfilter.FieldValues(record.MarcRecord, "020", "a") {
+			isbn := normalizeISBN(value)
+			if isbn != "" && !seen[isbn] {
+				seen[isbn] = true
+				records[isbn] = append(records[isbn], key)
+			}
+		}
+		return nil
+	}
+}
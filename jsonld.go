@@ -0,0 +1,112 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// schema.org crosswalk. Each record is written as a single JSON-LD
+// document on its own line, suitable for embedding in a
+// <script type="application/ld+json"> element, or over several lines
+// with -json-indent.
+
+type schemaThing struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type schemaCreativeWork struct {
+	Context       string        `json:"@context"`
+	Type          string        `json:"@type"`
+	Name          string        `json:"name,omitempty"`
+	Author        []schemaThing `json:"author,omitempty"`
+	ISBN          []string      `json:"isbn,omitempty"`
+	DatePublished string        `json:"datePublished,omitempty"`
+	Publisher     *schemaThing  `json:"publisher,omitempty"`
+}
+
+var (
+	isbnRegexp = regexp.MustCompile(`^[0-9Xx-]{10,17}`)
+	yearRegexp = regexp.MustCompile(`[0-9]{4}`)
+)
+
+func printJSONLD(record *marcfilter.Record, w *tabwriter.Writer) error {
+	doc := schemaCreativeWork{
+		Context: "https://schema.org",
+		Type:    "CreativeWork",
+	}
+
+	leader := record.Leader()
+	if (leader[6] == 'a' || leader[6] == 't') && leader[7] == 'm' {
+		doc.Type = "Book"
+	}
+
+	doc.Name = displayTitle(record.MarcRecord, false)
+
+	for _, tag := range []string{"100", "110", "700", "710"} {
+		field, _ := record.GetDataField(tag)
+		for i := 0; i < field.ValueCount(); i++ {
+			name := trimISBD(field.GetNthSubfield("a", i))
+			if name == "" {
+				continue
+			}
+			kind := "Person"
+			if tag[1] == '1' {
+				kind = "Organization"
+			}
+			doc.Author = append(doc.Author, schemaThing{kind, name})
+		}
+	}
+
+	isbns, _ := record.GetDataField("020")
+	for i := 0; i < isbns.ValueCount(); i++ {
+		isbn := isbnRegexp.FindString(isbns.GetNthSubfield("a", i))
+		if isbn != "" {
+			doc.ISBN = append(doc.ISBN, strings.Replace(isbn, "-", "", -1))
+		}
+	}
+
+	publisher, date := publicationStatement(record.MarcRecord)
+	if publisher != "" {
+		doc.Publisher = &schemaThing{"Organization", publisher}
+	}
+	doc.DatePublished = yearRegexp.FindString(date)
+	if doc.DatePublished == "" {
+		// fall back to Date 1 in the fixed-length data elements
+		fixed, err := record.GetControlField("008")
+		if err == nil && len(fixed) >= 11 {
+			doc.DatePublished = yearRegexp.FindString(fixed[7:11])
+		}
+	}
+
+	var b []byte
+	var err error
+	if jsonIndent > 0 {
+		b, err = json.MarshalIndent(&doc, "", strings.Repeat(" ", jsonIndent))
+	} else {
+		b, err = json.Marshal(&doc)
+	}
+	if err != nil {
+		return err
+	}
+	w.Write(b)
+	_, err = w.Write([]byte("\n"))
+	return err
+}
@@ -0,0 +1,186 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// Koha staged import output.
+//
+// Koha's stage-marc-import expects UTF-8 records with item data in
+// 952. The item profile maps subfields of the local item field onto 952
+// subfields, one mapping per line:
+//
+//    949_b 952_a      # home branch
+//    949_b 952_b      # holding branch
+//    949_p 952_p      # barcode
+//    =BK   952_y      # constant item type
+//
+// Each instance of a source field yields one 952.
+
+type itemMapping struct {
+	source string // tag of the source field, or "" for a constant
+	code   string // source subfield code, or the constant value
+	target string // 952 subfield code
+}
+
+var itemMappingRegexp = regexp.MustCompile(`^(?:([0-9]{3})_([0-9a-z])|=(\S+))\s+952_([0-9a-z])$`)
+
+func loadItemProfile(name string) ([]itemMapping, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mappings []itemMapping
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		m := itemMappingRegexp.FindStringSubmatch(text)
+		if m == nil {
+			return nil, fmt.Errorf("%s:%d: invalid item mapping %q", name, line, text)
+		}
+		if m[1] != "" {
+			mappings = append(mappings, itemMapping{m[1], m[2], m[4]})
+		} else {
+			mappings = append(mappings, itemMapping{"", m[3], m[4]})
+		}
+	}
+	return mappings, scanner.Err()
+}
+
+// getKohaAction returns an action writing Koha-ready records to the named
+// file.
+func getKohaAction(name string, profile string) (actionFunc, error) {
+	var mappings []itemMapping
+	if profile != "" {
+		var err error
+		if mappings, err = loadItemProfile(profile); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := createMarcWriter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	skipped := 0
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(os.Stderr, "%d records written to %s, %d skipped\n", out.count, name, skipped)
+		return out.close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		converted, err := convertRecord(record)
+		var m *marcfilter.MutableRecord
+		if err == nil {
+			m, err = marcfilter.DecodeRecord(converted.Raw)
+		}
+		if err == nil {
+			err = kohaRecord(m, mappings)
+		}
+		var raw []byte
+		if err == nil {
+			raw, err = m.Encode()
+		}
+		if err != nil {
+			skipped += 1
+			fmt.Fprintf(os.Stderr, "Warning: record at offset %d skipped: %v\n", record.Offset, err)
+			return nil
+		}
+		return out.write(raw)
+	}, nil
+}
+
+// kohaRecord makes sure a record is UTF-8 and adds 952 item fields
+// built from the item mappings. MARC-8 records have been converted to
+// UTF-8 by then; a record in any other coding is only accepted when it
+// is plain ASCII, which is the same in all of them.
+func kohaRecord(m *marcfilter.MutableRecord, mappings []itemMapping) error {
+	for _, f := range m.Fields {
+		data := f.Data()
+		if !utf8.ValidString(data) {
+			return fmt.Errorf("field %s contains invalid UTF-8", f.Tag)
+		}
+		if m.Leader[9] != 'a' && !isASCII(data) {
+			return fmt.Errorf("field %s is in unknown character coding %q", f.Tag, m.Leader[9])
+		}
+	}
+	m.Leader[9] = 'a'
+
+	var sources []string
+	for _, mapping := range mappings {
+		if mapping.source != "" && !containsString(sources, mapping.source) {
+			sources = append(sources, mapping.source)
+		}
+	}
+
+	for _, tag := range sources {
+		for _, f := range m.FieldsByTag(tag) {
+			item := &marcfilter.Field{Tag: "952", Indicators: "  "}
+			for _, mapping := range mappings {
+				value := mapping.code
+				if mapping.source != "" {
+					if mapping.source != tag {
+						continue
+					}
+					value = f.Subfield(mapping.code)
+				}
+				if value != "" {
+					item.Subfields = append(item.Subfields, marcfilter.Subfield{Code: mapping.target, Value: value})
+				}
+			}
+			if len(item.Subfields) > 0 {
+				m.AddField(item)
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
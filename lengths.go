@@ -0,0 +1,133 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// Subfield lengths, for sizing the columns of a database or the fields
+// of a discovery index before a migration. -lengths reports, for each
+// tag and subfield of the records read, how many there are and the
+// shortest, median, 90th and 99th percentile and longest value in
+// characters, with the longest in bytes as well:
+//
+//    tag  code  values  min  median  p90  p99   max   max bytes
+//    505  a     1289    12   344     1021 2876  9841  9902
+//    520  a     10433   18   412     866  1450  4977  5003
+//
+// Control fields are reported as a whole, with no code. The lengths
+// are counted, not kept, so a run over a whole catalog takes little
+// memory.
+
+// A lengthKey is a tag and subfield code; the code is "" for a
+// control field.
+type lengthKey struct {
+	tag, code string
+}
+
+// lengthStats counts the values of a subfield by their length.
+type lengthStats struct {
+	values   int
+	lengths  map[int]int
+	maxBytes int
+}
+
+func (s *lengthStats) add(value string) {
+	s.values += 1
+	s.lengths[utf8.RuneCountInString(value)] += 1
+	if len(value) > s.maxBytes {
+		s.maxBytes = len(value)
+	}
+}
+
+// percentiles returns the lengths at each of the points, from 0 to 1,
+// of the values ordered by length.
+func (s *lengthStats) percentiles(points ...float64) []int {
+	lengths := make([]int, 0, len(s.lengths))
+	for n := range s.lengths {
+		lengths = append(lengths, n)
+	}
+	sort.Ints(lengths)
+
+	result := make([]int, len(points))
+	for i, p := range points {
+		// the rank of the value at the point, counting from 1
+		rank := int(p*float64(s.values-1)) + 1
+		seen := 0
+		for _, n := range lengths {
+			seen += s.lengths[n]
+			if seen >= rank {
+				result[i] = n
+				break
+			}
+		}
+	}
+	return result
+}
+
+func getLengthsAction() actionFunc {
+	stats := make(map[lengthKey]*lengthStats)
+	onFinish(func(w *tabwriter.Writer) error {
+		keys := make([]lengthKey, 0, len(stats))
+		for k := range stats {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].tag != keys[j].tag {
+				return keys[i].tag < keys[j].tag
+			}
+			return keys[i].code < keys[j].code
+		})
+
+		fmt.Fprintf(w, "tag\tcode\tvalues\tmin\tmedian\tp90\tp99\tmax\tmax bytes\n")
+		for _, k := range keys {
+			s := stats[k]
+			p := s.percentiles(0, 0.5, 0.9, 0.99, 1)
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", k.tag, k.code, s.values, p[0], p[1], p[2], p[3], p[4], s.maxBytes)
+		}
+		return w.Flush()
+	})
+
+	add := func(k lengthKey, value string) {
+		s := stats[k]
+		if s == nil {
+			s = &lengthStats{lengths: make(map[int]int)}
+			stats[k] = s
+		}
+		s.add(value)
+	}
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		for _, f := range m.Fields {
+			if strings.HasPrefix(f.Tag, "00") {
+				add(lengthKey{f.Tag, ""}, f.Value)
+				continue
+			}
+			for _, sf := range f.Subfields {
+				add(lengthKey{f.Tag, sf.Code}, sf.Value)
+			}
+		}
+		return nil
+	}
+}
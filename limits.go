@@ -0,0 +1,143 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Target system limits. A limits profile declares what the target ILS
+// will accept, one limit per line:
+//
+//    max-record-length  99999
+//    max-field-length   9999
+//    max-repeats        650 40
+//    max-repeats        5xx 100
+//    forbid             9xx
+//
+// Tags may use x as a wildcard for any character. drop lines, which say
+// how -budget cuts a record down to size (see budget.go), are not
+// checked.
+
+var tagPatternRegexp = regexp.MustCompile(`^[0-9A-Za-z]{3}$`)
+
+type repeatLimit struct {
+	pattern string
+	max     int
+}
+
+type limitsProfile struct {
+	maxRecordLength int
+	maxFieldLength  int
+	maxRepeats      []repeatLimit
+	forbidden       []string
+	drops           []dropRule
+}
+
+func loadLimitsProfile(name string) (*limitsProfile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	limits := new(limitsProfile)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		words := strings.Fields(text)
+		if len(words) == 0 {
+			continue
+		}
+
+		valid := false
+		switch {
+		case words[0] == "max-record-length" && len(words) == 2:
+			limits.maxRecordLength, err = strconv.Atoi(words[1])
+			valid = err == nil
+		case words[0] == "max-field-length" && len(words) == 2:
+			limits.maxFieldLength, err = strconv.Atoi(words[1])
+			valid = err == nil
+		case words[0] == "max-repeats" && len(words) == 3:
+			var max int
+			max, err = strconv.Atoi(words[2])
+			valid = err == nil && tagPatternRegexp.MatchString(words[1])
+			limits.maxRepeats = append(limits.maxRepeats, repeatLimit{words[1], max})
+		case words[0] == "drop" && (len(words) == 2 || len(words) == 3):
+			rule := dropRule{pattern: words[1]}
+			if len(words) == 3 {
+				rule.keep, err = strconv.Atoi(words[2])
+			}
+			valid = err == nil && rule.keep >= 0 && tagPatternRegexp.MatchString(words[1])
+			limits.drops = append(limits.drops, rule)
+		case words[0] == "forbid" && len(words) == 2:
+			valid = tagPatternRegexp.MatchString(words[1])
+			limits.forbidden = append(limits.forbidden, words[1])
+		}
+		if !valid {
+			return nil, fmt.Errorf("%s:%d: invalid limit %q", name, line, strings.TrimSpace(text))
+		}
+	}
+	return limits, scanner.Err()
+}
+
+// check returns the violations of the profile's limits by a record.
+func (limits *limitsProfile) check(record *marcfilter.Record) []string {
+	var problems []string
+	if limits.maxRecordLength > 0 && len(record.Raw) > limits.maxRecordLength {
+		problems = append(problems, fmt.Sprintf("record is %d bytes long, limit is %d",
+			len(record.Raw), limits.maxRecordLength))
+	}
+
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+
+	counts := make(map[string]int)
+	for _, f := range m.Fields {
+		counts[f.Tag] += 1
+		if length := len(f.Data()) + 1; limits.maxFieldLength > 0 && length > limits.maxFieldLength {
+			problems = append(problems, fmt.Sprintf("%s is %d bytes long, limit is %d",
+				f.Tag, length, limits.maxFieldLength))
+		}
+	}
+
+	for _, tag := range record.GetFieldList() {
+		for _, pattern := range limits.forbidden {
+			if marcfilter.TagMatches(pattern, tag) {
+				problems = append(problems, fmt.Sprintf("%s is forbidden", tag))
+				break
+			}
+		}
+		for _, limit := range limits.maxRepeats {
+			if marcfilter.TagMatches(limit.pattern, tag) && counts[tag] > limit.max {
+				problems = append(problems, fmt.Sprintf("%s occurs %d times, limit is %d",
+					tag, counts[tag], limit.max))
+				break
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,124 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"text/tabwriter"
+)
+
+// Record links. When bibliographic and holdings records come in one
+// file, a migration has to link them again in the target system.
+// -links writes a CSV table of each parent and child:
+//
+//    bibliographic record  holdings record  by the holdings 004, or by
+//                                           014 (first indicator 1), or
+//                                           by the bibliographic 014
+//                                           (first indicator 0)
+//    holdings record       item             by 876-878 $a, or $p, the
+//                                           barcode, without an $a
+//
+// The found column says whether the record linked to is one of the
+// records read, so that holdings whose bibliographic record is missing
+// stand out. Items are not records of their own, and have no found.
+
+var linkColumns = []string{"parent", "parent_type", "child", "child_type", "via", "found"}
+
+// A recordLink is a row of the links table.
+type recordLink struct {
+	parent, parentType string
+	child, childType   string
+	via                string
+	toChild            bool // the link is made by the parent
+}
+
+// getLinksAction returns an action writing the links between the
+// records to the named CSV file.
+func getLinksAction(name string) (actionFunc, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []recordLink
+	// the control numbers of the records read, by format
+	read := make(map[string]map[string]bool)
+
+	onFinish(func(w *tabwriter.Writer) error {
+		out := csv.NewWriter(file)
+		out.Write(linkColumns)
+		missing := 0
+		for _, l := range links {
+			found := ""
+			if l.childType != "item" {
+				ok := read[l.parentType][l.parent]
+				if l.toChild {
+					ok = read[l.childType][l.child]
+				}
+				if !ok {
+					missing += 1
+				}
+				found = fmt.Sprint(ok)
+			}
+			out.Write([]string{l.parent, l.parentType, l.child, l.childType, l.via, found})
+		}
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "%d links written to %s, %d to records not read\n", len(links), name, missing)
+		if err := out.Error(); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		id := controlNumber(record)
+		format := recordFormat(string(m.Leader))
+		if read[format] == nil {
+			read[format] = make(map[string]bool)
+		}
+		read[format][id] = true
+
+		for _, f := range m.Fields {
+			switch {
+			case format == formatHoldings && f.Tag == "004" && f.Value != "":
+				links = append(links, recordLink{f.Value, formatBibliographic, id, formatHoldings, "004", false})
+			case f.Tag == "014" && len(f.Indicators) == 2 && f.Subfield("a") != "":
+				switch {
+				case format == formatHoldings && f.Indicators[0] == '1':
+					links = append(links, recordLink{f.Subfield("a"), formatBibliographic, id, formatHoldings, "014", false})
+				case format == formatBibliographic && f.Indicators[0] == '0':
+					links = append(links, recordLink{id, formatBibliographic, f.Subfield("a"), formatHoldings, "014", true})
+				}
+			case format == formatHoldings && f.Tag >= "876" && f.Tag <= "878":
+				item, via := f.Subfield("a"), f.Tag+"_a"
+				if item == "" {
+					item, via = f.Subfield("p"), f.Tag+"_p"
+				}
+				if item != "" {
+					links = append(links, recordLink{id, formatHoldings, item, "item", via, true})
+				}
+			}
+		}
+		return nil
+	}, nil
+}
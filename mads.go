@@ -0,0 +1,242 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"os"
+	"strings"
+)
+
+// MADS crosswalk, and the routing of records between the crosswalks.
+// An authority record describes a heading rather than a resource, so
+// the MODS mapping would make it a resource titled by nothing and
+// dated by its 008; it is mapped to MADS instead, following the
+// Library of Congress MARC to MADS mapping: the heading (1xx), its
+// variants (4xx) and related headings (5xx), the notes and the LCCN.
+// A holdings record is mapped to a MODS location (see modsHoldingsOf).
+// Classification and community information records have no mapping.
+// -o mads writes the authority records alone, as a madsCollection.
+
+const madsNamespace = "http://www.loc.gov/mads/v2"
+
+var errNoCrosswalk = errors.New("no MODS or MADS mapping")
+
+type madsRecord struct {
+	XMLName    xml.Name         `xml:"mads"`
+	Namespace  string           `xml:"xmlns,attr,omitempty"`
+	Version    string           `xml:"version,attr"`
+	Authority  madsHeading      `xml:"authority"`
+	Related    []madsHeading    `xml:"related"`
+	Variant    []madsHeading    `xml:"variant"`
+	Note       []madsNote       `xml:"note"`
+	Identifier []modsIdentifier `xml:"identifier"`
+	RecordInfo *modsRecordInfo  `xml:"recordInfo"`
+}
+
+type madsNote struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// A madsHeading is the authorized heading, a variant of it or a
+// related heading.
+type madsHeading struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Terms []modsSubjectTerm
+}
+
+// madsRelationTypes maps the relationship codes of 5xx $w/0 to the
+// MADS related types.
+var madsRelationTypes = map[byte]string{
+	'a': "earlier", 'b': "later", 'g': "broader", 'h': "narrower",
+}
+
+// madsNoteTypes maps the authority note fields to MADS note types.
+var madsNoteTypes = map[string]string{
+	"667": "nonpublic", "670": "source", "675": "source",
+	"678": "history", "680": "",
+}
+
+// madsTermsOf maps the heading of a 1xx, 4xx or 5xx authority field.
+func madsTermsOf(f *marcfilter.Field) []modsSubjectTerm {
+	var terms []modsSubjectTerm
+	term := func(name, value string) {
+		if value = cleanPart(value, parseClean); value != "" {
+			terms = append(terms, modsSubjectTerm{XMLName: xml.Name{Local: name}, Value: value})
+		}
+	}
+
+	switch f.Tag[1:] {
+	case "00", "10", "11":
+		n := modsNameOf(&marcfilter.Field{Tag: "7" + f.Tag[1:], Indicators: f.Indicators, Subfields: f.Subfields})
+		terms = append(terms, modsSubjectTerm{XMLName: xml.Name{Local: "name"}, Type: n.Type, NameParts: n.NamePart})
+		if t := subfieldsOf(f, "tnp"); t != "" {
+			terms = append(terms, modsSubjectTerm{XMLName: xml.Name{Local: "titleInfo"}, Title: t})
+		}
+	case "30":
+		if t := subfieldsOf(f, "anp"); t != "" {
+			terms = append(terms, modsSubjectTerm{XMLName: xml.Name{Local: "titleInfo"}, Title: t})
+		}
+	case "48":
+		term("temporal", f.Subfield("a"))
+	case "50":
+		term("topic", f.Subfield("a"))
+	case "51":
+		term("geographic", f.Subfield("a"))
+	case "55":
+		term("genre", f.Subfield("a"))
+	default:
+		return nil
+	}
+	for _, sf := range f.Subfields {
+		if name, ok := subjectSubdivisions[sf.Code]; ok {
+			term(name, sf.Value)
+		}
+	}
+	return terms
+}
+
+// madsOf maps an authority record to MADS.
+func madsOf(m *marcfilter.MutableRecord) *madsRecord {
+	mads := &madsRecord{Namespace: madsNamespace, Version: "2.1"}
+	info := &modsRecordInfo{Origin: "Converted from MARC 21 by marcdump"}
+
+	for _, f := range m.Fields {
+		if len(f.Tag) != 3 {
+			continue
+		}
+		switch {
+		case f.Tag == "001":
+			info.Identifier = strings.TrimSpace(f.Value)
+		case f.Tag == "003":
+			info.Source = strings.TrimSpace(f.Value)
+		case f.Tag == "010":
+			if v := strings.TrimSpace(f.Subfield("a")); v != "" {
+				mads.Identifier = append(mads.Identifier, modsIdentifier{"lccn", v})
+			}
+		case f.Tag[0] == '1' && mads.Authority.Terms == nil:
+			mads.Authority.Terms = madsTermsOf(f)
+		case f.Tag[0] == '4':
+			if terms := madsTermsOf(f); terms != nil {
+				mads.Variant = append(mads.Variant, madsHeading{"other", terms})
+			}
+		case f.Tag[0] == '5':
+			if terms := madsTermsOf(f); terms != nil {
+				h := madsHeading{Terms: terms}
+				if w := f.Subfield("w"); w != "" {
+					h.Type = madsRelationTypes[w[0]]
+				}
+				if h.Type == "" {
+					h.Type = "other"
+				}
+				mads.Related = append(mads.Related, h)
+			}
+		default:
+			if t, ok := madsNoteTypes[f.Tag]; ok {
+				if v := subfieldsOf(f, "ab"); v != "" {
+					mads.Note = append(mads.Note, madsNote{t, v})
+				}
+			}
+		}
+	}
+	mads.RecordInfo = info
+	return mads
+}
+
+// crosswalkOf returns the crosswalk for a record by its leader: "mods"
+// for bibliographic records, "mads" for authority records and
+// "holdings" for holdings records, or "" if there is none.
+func crosswalkOf(leader string) string {
+	switch recordFormat(leader) {
+	case formatBibliographic:
+		return "mods"
+	case formatAuthority:
+		return "mads"
+	case formatHoldings:
+		return "holdings"
+	}
+	return ""
+}
+
+// marshalCrosswalk returns a record mapped by the crosswalk for its
+// type. The MODS of a record is indented to go in a modsCollection
+// unless it stands alone; a MADS record always declares its namespace,
+// which a modsCollection does not.
+func marshalCrosswalk(record *marcfilter.Record, standalone bool) ([]byte, error) {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("record at offset %d: %v", record.Offset, err)
+	}
+	var v interface{}
+	switch crosswalkOf(string(m.Leader)) {
+	case "mods":
+		v = modsOf(m)
+	case "mads":
+		v = madsOf(m)
+	case "holdings":
+		v = modsHoldingsOf(m)
+	default:
+		return nil, fmt.Errorf("record at offset %d: %v for %s records", record.Offset, errNoCrosswalk, formatNames[recordFormat(string(m.Leader))])
+	}
+	prefix := "  "
+	if standalone {
+		prefix = ""
+		if mods, ok := v.(*modsRecord); ok {
+			mods.Namespace = modsNamespace
+		}
+	}
+	b, err := xml.MarshalIndent(v, prefix, "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// A madsFormatter writes the authority records as a MADS collection.
+type madsFormatter struct{}
+
+func (f madsFormatter) Header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<madsCollection xmlns=\"%s\">\n", madsNamespace)
+	return err
+}
+
+func (f madsFormatter) Record(w io.Writer, record *marcfilter.Record) error {
+	if recordFormat(record.Leader()) != formatAuthority {
+		fmt.Fprintf(os.Stderr, "Warning: record at offset %d skipped: not an authority record\n", record.Offset)
+		return nil
+	}
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+	}
+	mads := madsOf(m)
+	mads.Namespace = ""
+	b, err := xml.MarshalIndent(mads, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func (f madsFormatter) Footer(w io.Writer) error {
+	_, err := w.Write([]byte("</madsCollection>\n"))
+	return err
+}
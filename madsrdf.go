@@ -0,0 +1,209 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// MADS/RDF, for publishing authority files as linked data. -o madsrdf
+// writes the authority records as N-Triples, the form id.loc.gov gives
+// its bulk downloads in, so that the output of several runs can simply
+// be concatenated. A record is the resource of its URI (see
+// authorities.go); one that has neither an LCCN nor a URI in 024 is
+// -mads-base followed by its 001, or without -mads-base a blank node.
+// The heading is typed by its tag, a subdivided one being a
+// ComplexSubject; 4xx are its variants, 5xx the authorities it is
+// related to, by their $0 URI if they have one, and 667, 670, 678 and
+// 680 its notes and sources. Records of other types are skipped with a
+// warning.
+
+const (
+	rdfType       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+	madsRDF       = "http://www.loc.gov/mads/rdf/v1#"
+	lccnPredicate = "http://id.loc.gov/vocabulary/identifiers/lccn"
+)
+
+// madsRDFClasses maps the last two digits of a heading tag to its
+// MADS/RDF class.
+var madsRDFClasses = map[string]string{
+	"00": "PersonalName", "10": "CorporateName", "11": "ConferenceName",
+	"30": "Title", "48": "Temporal", "50": "Topic", "51": "Geographic",
+	"55": "GenreForm",
+}
+
+// madsRDFRelations maps the relationship codes of 5xx $w/0 to MADS/RDF
+// properties.
+var madsRDFRelations = map[byte]string{
+	'a': "hasEarlierEstablishedForm", 'b': "hasLaterEstablishedForm",
+	'g': "hasBroaderAuthority", 'h': "hasNarrowerAuthority",
+}
+
+// madsRDFNotes maps the authority note fields to MADS/RDF properties.
+var madsRDFNotes = map[string]string{
+	"667": "editorialNote", "678": "historyNote", "680": "note",
+}
+
+// madsRDFClass returns the MADS/RDF class of a heading field, or "" if
+// it has none.
+func madsRDFClass(f *marcfilter.Field) string {
+	class := madsRDFClasses[f.Tag[1:]]
+	for _, sf := range f.Subfields {
+		switch {
+		case class == "":
+		case strings.Contains("vxyz", sf.Code):
+			return "ComplexSubject"
+		case sf.Code == "t" && f.Tag[1] != '3':
+			class = "NameTitle"
+		}
+	}
+	return class
+}
+
+// ntLiteral returns a string as an N-Triples literal.
+func ntLiteral(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20:
+			fmt.Fprintf(&b, `\u%04X`, c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// madsRDFSubject returns the node of an authority record.
+func madsRDFSubject(record *marcfilter.Record, m *marcfilter.MutableRecord) string {
+	uri := authorityURI(m)
+	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		return "<" + uri + ">"
+	}
+	if madsBase != "" {
+		if id := controlNumber(record); id != "" {
+			return "<" + madsBase + url.PathEscape(id) + ">"
+		}
+	}
+	return fmt.Sprintf("_:r%d", record.Number)
+}
+
+func printMADSRDF(record *marcfilter.Record, w *tabwriter.Writer) error {
+	if recordFormat(record.Leader()) != formatAuthority {
+		fmt.Fprintf(os.Stderr, "Warning: record at offset %d skipped: not an authority record\n", record.Offset)
+		return nil
+	}
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+	}
+
+	s := madsRDFSubject(record, m)
+	triple := func(subject, predicate, object string) {
+		fmt.Fprintf(w, "%s <%s> %s .\n", subject, predicate, object)
+	}
+	class := func(node, name string) {
+		triple(node, rdfType, "<"+madsRDF+name+">")
+	}
+	triple(s, rdfType, "<"+madsRDF+"Authority>")
+	for _, kind := range []string{kindNames, kindSubjects} {
+		if scheme := fmt.Sprintf(idLocAuthorityURI, kind, ""); strings.HasPrefix(s, "<"+scheme) {
+			triple(s, madsRDF+"isMemberOfMADSScheme", "<"+strings.TrimSuffix(scheme, "/")+">")
+		}
+	}
+
+	nodes := 0
+	blank := func(kind string) string {
+		nodes++
+		return fmt.Sprintf("_:r%d%s%d", record.Number, kind, nodes)
+	}
+	heading := false
+	for _, f := range m.Fields {
+		if len(f.Tag) != 3 {
+			continue
+		}
+		switch {
+		case f.Tag == "010":
+			if v := strings.TrimSpace(f.Subfield("a")); v != "" {
+				triple(s, lccnPredicate, ntLiteral(v))
+			}
+		case f.Tag[0] == '1' && !heading:
+			if c, label := madsRDFClass(f), headingLabel(f); c != "" && label != "" {
+				class(s, c)
+				triple(s, madsRDF+"authoritativeLabel", ntLiteral(label))
+				heading = true
+			}
+		case f.Tag[0] == '4':
+			if c, label := madsRDFClass(f), headingLabel(f); c != "" && label != "" {
+				v := blank("v")
+				triple(s, madsRDF+"hasVariant", v)
+				class(v, "Variant")
+				class(v, c)
+				triple(v, madsRDF+"variantLabel", ntLiteral(label))
+			}
+		case f.Tag[0] == '5':
+			c, label := madsRDFClass(f), headingLabel(f)
+			if c == "" || label == "" {
+				continue
+			}
+			relation := "hasReciprocalAuthority"
+			if w := f.Subfield("w"); w != "" && madsRDFRelations[w[0]] != "" {
+				relation = madsRDFRelations[w[0]]
+			}
+			if uri := f.Subfield("0"); strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+				triple(s, madsRDF+relation, "<"+uri+">")
+				continue
+			}
+			r := blank("a")
+			triple(s, madsRDF+relation, r)
+			class(r, "Authority")
+			class(r, c)
+			triple(r, madsRDF+"authoritativeLabel", ntLiteral(label))
+		case f.Tag == "670":
+			if v := subfieldsOf(f, "a"); v != "" {
+				src := blank("s")
+				triple(s, madsRDF+"hasSource", src)
+				class(src, "Source")
+				triple(src, madsRDF+"citationSource", ntLiteral(v))
+				if note := subfieldsOf(f, "b"); note != "" {
+					triple(src, madsRDF+"citationNote", ntLiteral(note))
+				}
+			}
+		default:
+			if p, ok := madsRDFNotes[f.Tag]; ok {
+				if v := subfieldsOf(f, "a"); v != "" {
+					triple(s, madsRDF+p, ntLiteral(v))
+				}
+			}
+		}
+	}
+	return nil
+}
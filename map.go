@@ -0,0 +1,58 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strings"
+)
+
+// Record transformation. -map rules.txt changes each selected record by
+// the rules in the file (see the marcfilter package), such as
+// "delete 9xx" or "rename 690 to 650", before the -f filter and the
+// actions see it, so the changes reach every output format, MARC
+// extracts included.
+//
+// -map also takes the name of one of the transforms that come with
+// marcdump, which is read instead of a file of that name (-map ./name
+// reads the file):
+//
+//    rda-gmd    delete the GMD (245 $h) and add the 336, 337 and 338
+//               the record lacks, the common edit of records cataloged
+//               before RDA
+
+// cannedTransforms are the rules of the transforms that come with
+// marcdump.
+var cannedTransforms = map[string]string{
+	"rda-gmd": "infer 33x\ndelete gmd\n",
+}
+
+// getTransform reads the -map rules, returning nil if no rules file was
+// given.
+func getTransform() (*marcfilter.Transform, error) {
+	if mapFile == "" {
+		return nil, nil
+	}
+	if rules, ok := cannedTransforms[mapFile]; ok {
+		return marcfilter.ParseTransform(strings.NewReader(rules))
+	}
+	file, err := os.Open(mapFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return marcfilter.ParseTransform(file)
+}
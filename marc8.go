@@ -0,0 +1,438 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strconv"
+	"unicode/utf8"
+)
+
+// MARC-8 is the character encoding of records with a blank Leader/09.
+// It is ASCII in G0 and ANSEL (extended Latin) in G1 until an escape
+// sequence designates another character set into either half. Combining
+// diacritics precede the base character they modify, the reverse of
+// Unicode.
+//
+// The Latin, Greek, Cyrillic, Hebrew and basic Arabic sets are built
+// in. Extended Arabic and the East Asian (EACC) set, which has some
+// 16,000 characters, are read from the Library of Congress
+// codetables.xml file given with -marc8-tables; that file can also
+// replace any of the built-in sets. A record using a set that has not
+// been loaded is not converted, with an error saying which set it
+// needs, rather than have its text turned into replacement characters.
+
+const escape = 0x1b
+
+// Final characters of the escape sequences designating each set.
+const (
+	setBasicLatin       = 'B'
+	setANSEL            = 'E'
+	setBasicGreek       = 'S'
+	setBasicCyrillic    = 'N'
+	setExtendedCyrillic = 'Q'
+	setBasicHebrew      = '2'
+	setBasicArabic      = '3'
+	setExtendedArabic   = '4'
+	setEACC             = '1'
+	setGreekSymbols     = 'g'
+	setSubscripts       = 'b'
+	setSuperscripts     = 'p'
+	setASCIIReset       = 's'
+)
+
+// A marc8Set maps codes, with the high bit cleared, to Unicode.
+type marc8Set struct {
+	width     int // bytes per character
+	chars     map[uint32]rune
+	combining map[uint32]bool
+}
+
+func (s *marc8Set) add(code uint32, r rune, combining bool) {
+	s.chars[code] = r
+	if combining {
+		s.combining[code] = true
+	}
+}
+
+func newMarc8Set(width int, chars map[uint32]rune, combining ...uint32) *marc8Set {
+	s := &marc8Set{width: width, chars: chars, combining: make(map[uint32]bool)}
+	for _, c := range combining {
+		s.combining[c] = true
+	}
+	return s
+}
+
+var marc8Sets = map[byte]*marc8Set{
+	setANSEL: newMarc8Set(1, map[uint32]rune{
+		0x21: 'Ł', 0x22: 'Ø', 0x23: 'Đ', 0x24: 'Þ', 0x25: 'Æ', 0x26: 'Œ',
+		0x27: 'ʹ', 0x28: '·', 0x29: '♭', 0x2a: '®', 0x2b: '±', 0x2c: 'Ơ',
+		0x2d: 'Ư', 0x2e: 'ʼ', 0x30: 'ʻ', 0x31: 'ł', 0x32: 'ø', 0x33: 'đ',
+		0x34: 'þ', 0x35: 'æ', 0x36: 'œ', 0x37: 'ʺ', 0x38: 'ı', 0x39: '£',
+		0x3a: 'ð', 0x3c: 'ơ', 0x3d: 'ư', 0x40: '°', 0x41: 'ℓ', 0x42: '℗',
+		0x43: '©', 0x44: '♯', 0x45: '¿', 0x46: '¡', 0x47: 'ß', 0x48: '€',
+		0x60: '\u0309', 0x61: '\u0300', 0x62: '\u0301', 0x63: '\u0302',
+		0x64: '\u0303', 0x65: '\u0304', 0x66: '\u0306', 0x67: '\u0307',
+		0x68: '\u0308', 0x69: '\u030c', 0x6a: '\u030a', 0x6b: '\ufe20',
+		0x6c: '\ufe21', 0x6d: '\u0315', 0x6e: '\u030b', 0x6f: '\u0310',
+		0x70: '\u0327', 0x71: '\u0328', 0x72: '\u0323', 0x73: '\u0324',
+		0x74: '\u0325', 0x75: '\u0333', 0x76: '\u0332', 0x77: '\u0326',
+		0x78: '\u031c', 0x79: '\u032e', 0x7a: '\ufe22', 0x7b: '\ufe23',
+		0x7e: '\u0313',
+	}, 0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a,
+		0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72, 0x73, 0x74, 0x75,
+		0x76, 0x77, 0x78, 0x79, 0x7a, 0x7b, 0x7e),
+
+	setBasicGreek: newMarc8Set(1, map[uint32]rune{
+		0x21: '\u0300', 0x22: '\u0301', 0x23: '\u0308', 0x24: '\u0342',
+		0x25: '\u0313', 0x26: '\u0314', 0x27: '\u0345',
+		0x30: '«', 0x31: '»', 0x32: '“', 0x33: '”', 0x34: 'ʹ', 0x35: '͵',
+		0x3b: '·', 0x3f: ';',
+		0x41: 'Α', 0x42: 'Β', 0x44: 'Γ', 0x45: 'Δ', 0x46: 'Ε', 0x47: 'Ϛ',
+		0x48: 'Ϝ', 0x49: 'Ζ', 0x4a: 'Η', 0x4b: 'Θ', 0x4c: 'Ι', 0x4d: 'Κ',
+		0x4e: 'Λ', 0x4f: 'Μ', 0x50: 'Ν', 0x51: 'Ξ', 0x52: 'Ο', 0x53: 'Π',
+		0x54: 'Ϟ', 0x55: 'Ρ', 0x56: 'Σ', 0x58: 'Τ', 0x59: 'Υ', 0x5a: 'Φ',
+		0x5b: 'Χ', 0x5c: 'Ψ', 0x5d: 'Ω', 0x5e: 'Ϡ',
+		0x61: 'α', 0x62: 'β', 0x63: 'ϐ', 0x64: 'γ', 0x65: 'δ', 0x66: 'ε',
+		0x67: 'ϛ', 0x68: 'ϝ', 0x69: 'ζ', 0x6a: 'η', 0x6b: 'θ', 0x6c: 'ι',
+		0x6d: 'κ', 0x6e: 'λ', 0x6f: 'μ', 0x70: 'ν', 0x71: 'ξ', 0x72: 'ο',
+		0x73: 'π', 0x74: 'ϟ', 0x75: 'ρ', 0x76: 'σ', 0x77: 'ς', 0x78: 'τ',
+		0x79: 'υ', 0x7a: 'φ', 0x7b: 'χ', 0x7c: 'ψ', 0x7d: 'ω', 0x7e: 'ϡ',
+	}, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27),
+
+	setBasicCyrillic: newMarc8Set(1, map[uint32]rune{
+		0x40: 'ю', 0x41: 'а', 0x42: 'б', 0x43: 'ц', 0x44: 'д', 0x45: 'е',
+		0x46: 'ф', 0x47: 'г', 0x48: 'х', 0x49: 'и', 0x4a: 'й', 0x4b: 'к',
+		0x4c: 'л', 0x4d: 'м', 0x4e: 'н', 0x4f: 'о', 0x50: 'п', 0x51: 'я',
+		0x52: 'р', 0x53: 'с', 0x54: 'т', 0x55: 'у', 0x56: 'ж', 0x57: 'в',
+		0x58: 'ь', 0x59: 'ы', 0x5a: 'з', 0x5b: 'ш', 0x5c: 'э', 0x5d: 'щ',
+		0x5e: 'ч', 0x5f: 'ъ',
+		0x60: 'Ю', 0x61: 'А', 0x62: 'Б', 0x63: 'Ц', 0x64: 'Д', 0x65: 'Е',
+		0x66: 'Ф', 0x67: 'Г', 0x68: 'Х', 0x69: 'И', 0x6a: 'Й', 0x6b: 'К',
+		0x6c: 'Л', 0x6d: 'М', 0x6e: 'Н', 0x6f: 'О', 0x70: 'П', 0x71: 'Я',
+		0x72: 'Р', 0x73: 'С', 0x74: 'Т', 0x75: 'У', 0x76: 'Ж', 0x77: 'В',
+		0x78: 'Ь', 0x79: 'Ы', 0x7a: 'З', 0x7b: 'Ш', 0x7c: 'Э', 0x7d: 'Щ',
+		0x7e: 'Ч',
+	}),
+
+	setExtendedCyrillic: newMarc8Set(1, map[uint32]rune{
+		0x40: 'ґ', 0x41: 'ђ', 0x42: 'ѓ', 0x43: 'є', 0x44: 'ё', 0x45: 'ѕ',
+		0x46: 'і', 0x47: 'ї', 0x48: 'ј', 0x49: 'љ', 0x4a: 'њ', 0x4b: 'ћ',
+		0x4c: 'ќ', 0x4d: 'ў', 0x4e: 'џ', 0x50: 'ѣ', 0x51: 'ѳ', 0x52: 'ѵ',
+		0x53: 'ѫ', 0x5b: '[', 0x5d: ']', 0x5f: '_',
+		0x60: 'Ґ', 0x61: 'Ђ', 0x62: 'Ѓ', 0x63: 'Є', 0x64: 'Ё', 0x65: 'Ѕ',
+		0x66: 'І', 0x67: 'Ї', 0x68: 'Ј', 0x69: 'Љ', 0x6a: 'Њ', 0x6b: 'Ћ',
+		0x6c: 'Ќ', 0x6d: 'Ў', 0x6e: 'Џ', 0x6f: 'Ъ', 0x70: 'Ѣ', 0x71: 'Ѳ',
+		0x72: 'Ѵ', 0x73: 'Ѫ',
+	}),
+
+	setBasicHebrew: newMarc8Set(1, map[uint32]rune{
+		0x60: 'א', 0x61: 'ב', 0x62: 'ג', 0x63: 'ד', 0x64: 'ה', 0x65: 'ו',
+		0x66: 'ז', 0x67: 'ח', 0x68: 'ט', 0x69: 'י', 0x6a: 'ך', 0x6b: 'כ',
+		0x6c: 'ל', 0x6d: 'ם', 0x6e: 'מ', 0x6f: 'ן', 0x70: 'נ', 0x71: 'ס',
+		0x72: 'ע', 0x73: 'ף', 0x74: 'פ', 0x75: 'ץ', 0x76: 'צ', 0x77: 'ק',
+		0x78: 'ר', 0x79: 'ש', 0x7a: 'ת',
+	}),
+
+	setBasicArabic: newMarc8Set(1, map[uint32]rune{
+		0x2c: '،', 0x3b: '؛', 0x3f: '؟',
+		0x30: '٠', 0x31: '١', 0x32: '٢', 0x33: '٣', 0x34: '٤', 0x35: '٥',
+		0x36: '٦', 0x37: '٧', 0x38: '٨', 0x39: '٩',
+		0x41: 'ء', 0x42: 'آ', 0x43: 'أ', 0x44: 'ؤ', 0x45: 'إ', 0x46: 'ئ',
+		0x47: 'ا', 0x48: 'ب', 0x49: 'ة', 0x4a: 'ت', 0x4b: 'ث', 0x4c: 'ج',
+		0x4d: 'ح', 0x4e: 'خ', 0x4f: 'د', 0x50: 'ذ', 0x51: 'ر', 0x52: 'ز',
+		0x53: 'س', 0x54: 'ش', 0x55: 'ص', 0x56: 'ض', 0x57: 'ط', 0x58: 'ظ',
+		0x59: 'ع', 0x5a: 'غ',
+		0x60: 'ـ', 0x61: 'ف', 0x62: 'ق', 0x63: 'ك', 0x64: 'ل', 0x65: 'م',
+		0x66: 'ن', 0x67: 'ه', 0x68: 'و', 0x69: 'ى', 0x6a: 'ي',
+		0x6b: '\u064b', 0x6c: '\u064c', 0x6d: '\u064d', 0x6e: '\u064e',
+		0x6f: '\u064f', 0x70: '\u0650', 0x71: '\u0651', 0x72: '\u0652',
+		0x73: 'ٱ', 0x74: '\u0670',
+	}, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72, 0x74),
+
+	setGreekSymbols: newMarc8Set(1, map[uint32]rune{
+		0x61: 'α', 0x62: 'β', 0x63: 'γ',
+	}),
+
+	setSubscripts: newMarc8Set(1, map[uint32]rune{
+		0x28: '₍', 0x29: '₎', 0x2b: '₊', 0x2d: '₋',
+		0x30: '₀', 0x31: '₁', 0x32: '₂', 0x33: '₃', 0x34: '₄', 0x35: '₅',
+		0x36: '₆', 0x37: '₇', 0x38: '₈', 0x39: '₉',
+	}),
+
+	setSuperscripts: newMarc8Set(1, map[uint32]rune{
+		0x28: '⁽', 0x29: '⁾', 0x2b: '⁺', 0x2d: '⁻',
+		0x30: '⁰', 0x31: '¹', 0x32: '²', 0x33: '³', 0x34: '⁴', 0x35: '⁵',
+		0x36: '⁶', 0x37: '⁷', 0x38: '⁸', 0x39: '⁹',
+	}),
+
+	setEACC: newMarc8Set(3, map[uint32]rune{}),
+}
+
+// codeTables is the layout of the Library of Congress codetables.xml.
+type codeTables struct {
+	Sets []struct {
+		ISOCode string `xml:"ISOcode,attr"`
+		Codes   []struct {
+			Combining bool   `xml:"isCombining"`
+			MARC      string `xml:"marc"`
+			UCS       string `xml:"ucs"`
+			Alt       string `xml:"alt"`
+		} `xml:"code"`
+	} `xml:"codeTable>characterSet"`
+}
+
+// loadCodeTables adds the character sets in an LC codetables.xml file to
+// the built-in ones.
+func loadCodeTables(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var tables codeTables
+	if err := xml.NewDecoder(file).Decode(&tables); err != nil {
+		return err
+	}
+
+	for _, cs := range tables.Sets {
+		final, err := strconv.ParseUint(cs.ISOCode, 16, 8)
+		if err != nil {
+			continue
+		}
+		set := marc8Sets[byte(final)]
+		if set == nil {
+			set = newMarc8Set(1, make(map[uint32]rune))
+			marc8Sets[byte(final)] = set
+		}
+		for _, c := range cs.Codes {
+			ucs := c.UCS
+			if ucs == "" {
+				ucs = c.Alt
+			}
+			code, err1 := strconv.ParseUint(c.MARC, 16, 32)
+			r, err2 := strconv.ParseUint(ucs, 16, 32)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			set.width = len(c.MARC) / 2
+			set.add(uint32(code)&0x7f7f7f, rune(r), c.Combining)
+		}
+	}
+	return nil
+}
+
+// marc8SetNames are the names of the sets that are only available from
+// codetables.xml.
+var marc8SetNames = map[byte]string{
+	setEACC:           "East Asian (EACC)",
+	setExtendedArabic: "extended Arabic",
+}
+
+// A missingSetError is the error converting text in a character set
+// whose table has not been loaded.
+type missingSetError struct {
+	final byte
+}
+
+func (e missingSetError) Error() string {
+	name, ok := marc8SetNames[e.final]
+	if !ok {
+		name = fmt.Sprintf("%q", e.final)
+	}
+	return fmt.Sprintf("uses the MARC-8 %s character set; give the LC codetables.xml with -marc8-tables to convert it", name)
+}
+
+// marc8Decoder holds the character sets designated into G0 and G1.
+type marc8Decoder struct {
+	g0, g1 byte
+
+	// missing is the first set used that has no table, or 0
+	missing byte
+}
+
+// decodeMarc8 converts a MARC-8 string to UTF-8. Codes missing from the
+// tables become U+FFFD.
+func decodeMarc8(s string) string {
+	out, _ := convertMarc8(s)
+	return out
+}
+
+// convertMarc8 converts a MARC-8 string to UTF-8 like decodeMarc8, and
+// returns an error if it uses a character set whose table has not been
+// loaded.
+func convertMarc8(s string) (string, error) {
+	d := marc8Decoder{g0: setBasicLatin, g1: setANSEL}
+	var out bytes.Buffer
+	var pending []rune // combining marks waiting for their base character
+
+	emit := func(r rune, combining bool) {
+		if combining {
+			pending = append(pending, r)
+			return
+		}
+		out.WriteRune(r)
+		for _, c := range pending {
+			out.WriteRune(c)
+		}
+		pending = pending[:0]
+	}
+
+	for i := 0; i < len(s); {
+		b := s[i]
+		switch {
+		case b == escape:
+			i += d.designate(s[i:])
+			continue
+		case b == 0x8d:
+			emit('\u200d', false)
+		case b == 0x8e:
+			emit('\u200c', false)
+		case b == 0x88 || b == 0x89:
+			// non-sort markers, which have no place in the output
+		case b <= 0x20 || b == 0x7f || (b >= 0x80 && b <= 0xa0) || b == 0xff:
+			emit(rune(b), false)
+		default:
+			final := d.g0
+			if b >= 0x80 {
+				final = d.g1
+			}
+			r, combining, n := d.lookup(final, s[i:])
+			emit(r, combining)
+			i += n
+			continue
+		}
+		i++
+	}
+	for _, c := range pending {
+		out.WriteRune(c)
+	}
+	if d.missing != 0 {
+		return out.String(), missingSetError{d.missing}
+	}
+	return out.String(), nil
+}
+
+// lookup decodes the character at the start of s in the given set and
+// returns it with the number of bytes it took.
+func (d *marc8Decoder) lookup(final byte, s string) (rune, bool, int) {
+	if final == setBasicLatin || final == setASCIIReset {
+		if s[0] < 0x80 {
+			return rune(s[0]), false, 1
+		}
+		return utf8.RuneError, false, 1
+	}
+
+	set := marc8Sets[final]
+	if set == nil || len(set.chars) == 0 {
+		if d.missing == 0 {
+			d.missing = final
+		}
+	}
+	if set == nil {
+		return utf8.RuneError, false, 1
+	}
+	if len(s) < set.width {
+		return utf8.RuneError, false, len(s)
+	}
+	var code uint32
+	for i := 0; i < set.width; i++ {
+		code = code<<8 | uint32(s[i]&0x7f)
+	}
+	if r, ok := set.chars[code]; ok {
+		return r, set.combining[code], set.width
+	}
+	// The single-byte sets other than ANSEL share ASCII's digits and
+	// punctuation.
+	if set.width == 1 && final != setANSEL && code < 0x41 {
+		return rune(code), false, 1
+	}
+	return utf8.RuneError, false, set.width
+}
+
+// designate interprets the escape sequence at the start of s and returns
+// its length. An unrecognized escape is skipped by itself.
+func (d *marc8Decoder) designate(s string) int {
+	if len(s) < 2 {
+		return len(s)
+	}
+	switch s[1] {
+	case setGreekSymbols, setSubscripts, setSuperscripts:
+		d.g0 = s[1]
+		return 2
+	case setASCIIReset:
+		d.g0 = setBasicLatin
+		return 2
+	case '(', ',':
+		if len(s) >= 3 {
+			d.g0 = s[2]
+			return 3
+		}
+	case ')', '-':
+		if len(s) >= 3 {
+			d.g1 = s[2]
+			return 3
+		}
+	case '$':
+		if len(s) >= 4 && (s[2] == ',' || s[2] == '(') {
+			d.g0 = s[3]
+			return 4
+		}
+		if len(s) >= 4 && (s[2] == ')' || s[2] == '-') {
+			d.g1 = s[3]
+			return 4
+		}
+		if len(s) >= 3 {
+			d.g0 = s[2]
+			return 3
+		}
+	}
+	return 1
+}
+
+// convertRecord returns a MARC-8 record converted to UTF-8, with its
+// Leader/09 set to 'a'. Records that are already UTF-8 are returned as
+// they are.
+func convertRecord(record *marcfilter.Record) (*marcfilter.Record, error) {
+	if record.Leader()[9] != ' ' {
+		return record, nil
+	}
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range m.Fields {
+		if f.Value, err = convertMarc8(f.Value); err != nil {
+			return nil, fmt.Errorf("record at offset %d: %s %v", record.Offset, f.Tag, err)
+		}
+		for i := range f.Subfields {
+			if f.Subfields[i].Value, err = convertMarc8(f.Subfields[i].Value); err != nil {
+				return nil, fmt.Errorf("record at offset %d: %s %v", record.Offset, f.Tag, err)
+			}
+		}
+	}
+	m.Leader[9] = 'a'
+
+	raw, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return marcfilter.ParseRecord(raw, record.Offset, record.Number)
+}
@@ -0,0 +1,118 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marcdump/marcfilter"
+	"strings"
+	"testing"
+)
+
+func TestConvertMarc8(t *testing.T) {
+	tests := []struct {
+		name, marc8, utf8 string
+		missing           bool
+	}{
+		{"ASCII", "Hamlet /", "Hamlet /", false},
+		{"ANSEL", "\xa5lan \xb1\xe6od\xbaz", "Ælan ło\u0306dðz", false},
+		{"diacritic after its base", "Caf\xe2e", "Cafe\u0301", false},
+		{"two diacritics", "\xe3\xf2a", "a\u0302\u0323", false},
+		{"diacritic at the end", "x\xe2", "x\u0301", false},
+		{"non-sort markers", "\x88The \x89Hamlet", "The Hamlet", false},
+		{"joiners", "a\x8db\x8ec", "a\u200db\u200cc", false},
+		{"Greek in G0", "\x1b(Sabd\x1b(B abc", "αβγ abc", false},
+		{"Cyrillic in G1", "\x1b)N\xcd\xc9\xd2 ok", "мир ok", false},
+		{"Hebrew", "\x1b(2`ab\x1bs.", "אבג.", false},
+		{"Greek punctuation", "\x1b(Sa, b.", "α, β.", false},
+		{"superscripts", "m\x1bp2\x1bs!", "m²!", false},
+		{"EACC", "\x1b$1!0!\x1b(B.", "\ufffd.", true},
+		{"extended Arabic", "\x1b(4a", "\ufffd", true},
+		{"unknown escape", "\x1bZa", "Za", false},
+	}
+	for _, test := range tests {
+		got, err := convertMarc8(test.marc8)
+		if got != test.utf8 {
+			t.Errorf("%s: converted to %q, want %q", test.name, got, test.utf8)
+		}
+		if _, missing := err.(missingSetError); missing != test.missing || (err != nil && !missing) {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+	}
+}
+
+// marc8Record returns a record of a leader with the given Leader/09 and
+// a 245 $a, at offset 50 of its input.
+func marc8Record(t *testing.T, coding byte, title string) *marcfilter.Record {
+	m := &marcfilter.MutableRecord{
+		Leader: []byte("00000nam a2200000 a 4500"),
+		Fields: []*marcfilter.Field{
+			{Tag: "001", Value: "m1"},
+			{Tag: "245", Indicators: "10", Subfields: []marcfilter.Subfield{{Code: "a", Value: title}}},
+		},
+	}
+	m.Leader[9] = coding
+	raw, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := marcfilter.ParseRecord(raw, 50, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestConvertRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		coding  byte
+		title   string
+		want    string
+		wantErr string
+	}{
+		{"MARC-8", ' ', "Caf\xe2e", "Cafe\u0301", ""},
+		{"UTF-8", 'a', "Caf\xc3\xa9", "Café", ""},
+		// a UTF-8 record is not converted, although its bytes would be
+		// ANSEL
+		{"UTF-8 with ANSEL bytes", 'a', "\xe2e", "\xe2e", ""},
+		{"missing set", ' ', "\x1b$1!0!", "", "record at offset 50: 245 uses the MARC-8 East Asian (EACC) character set"},
+	}
+	for _, test := range tests {
+		record := marc8Record(t, test.coding, test.title)
+		converted, err := convertRecord(record)
+		if test.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if test.coding == 'a' && converted != record {
+			t.Errorf("%s: a UTF-8 record was rewritten", test.name)
+		}
+		if converted.Leader()[9] != 'a' {
+			t.Errorf("%s: Leader/09 is %q", test.name, converted.Leader()[9])
+		}
+		if got := marcfilter.FieldValues(converted.MarcRecord, "245", "a"); len(got) != 1 || got[0] != test.want {
+			t.Errorf("%s: 245 $a is %q, want %q", test.name, got, test.want)
+		}
+		if converted.Offset != 50 || converted.Number != 3 {
+			t.Errorf("%s: at offset %d, number %d", test.name, converted.Offset, converted.Number)
+		}
+	}
+}
@@ -19,42 +19,189 @@ import (
 	"flag"
 	"fmt"
 	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
 	"math"
 	"os"
-	"regexp"
+	"strings"
 	"text/tabwriter"
+	"time"
 )
 
-type selectionSpec struct {
-	field string
-	subfield string
-	criterion *regexp.Regexp
+// An actionFunc is called to display a record
+type actionFunc func(record *marcfilter.Record, w *tabwriter.Writer) error
+
+// Functions run once all the records have been processed, used by
+// actions that need to close files or print a summary.
+var finishers []func(w *tabwriter.Writer) error
+
+func onFinish(f func(w *tabwriter.Writer) error) {
+	finishers = append(finishers, f)
 }
 
-// An actionFunc is called to display a record
-type actionFunc func(record *marc21.MarcRecord, w *tabwriter.Writer) error
+// Functions run on each selected record by the -j workers, ahead of the
+// action, so that the costly part of an action's work is done in
+// parallel. The action still has to do the work itself for a record
+// that was not prepared, as happens without -j.
+var preparers []func(record *marcfilter.Record)
 
-var (
-	errInvalidSelectorSpec = errors.New("marcdump: invalid selector specification")
-)
+func onPrepare(f func(record *marcfilter.Record)) {
+	preparers = append(preparers, f)
+}
 
 var (
-	// Group 1: field
-	// Group 2: subfield, or ""
-	// Group 3: specification, or ""
-	//                                    field           subfield        spec
-	selectionSpecRegexp = regexp.MustCompile("^([0-9A-Za-z]{3})(?:_([0-9a-z]))?(?:=(.+))?$")
+	errUnknownOutputFormat = errors.New("marcdump: unknown output format")
+	errUnknownWrap         = errors.New("marcdump: -wrap is collection or none")
+	errIndentedNDJSON      = errors.New("marcdump: -o ndjson records are one to a line and cannot be indented")
+	errNegativeIndent      = errors.New("marcdump: -json-indent cannot be negative")
 )
 
 // Command-line options
 var (
 	maxRecords uint
+	skipRecords int
+	recordRange string
+	workers int
+	unordered bool
+	skipBad bool
 
 	makeIndex string
-	useIndex string
+	useIndex stringList
 
-	selectorOpt string
+	selectorOpts stringList
+	countOnly bool
+	listOnly bool
+	agencyOpt string
+	typeOpt string
+	idFile string
+	idField string
+	includeDeleted bool
+	onlyDeleted bool
 	fieldsOpt string
+	mapFile string
+
+	outputFormat string
+	columnsOpt string
+	presetName string
+	joinOpt string
+	templateFile string
+	prettyOutput bool
+	colorMode string
+
+	minWidth int
+	tabWidth int
+	padding int
+	alignRight bool
+	maxWidth int
+	separator string
+	rawOutput bool
+	marc8Tables string
+	provenance bool
+	flatJSON bool
+	wrap string
+	jsonIndent int
+	parseMode string
+	extractFile string
+	sinkOpts stringList
+	appendOutput bool
+	fixtureFile string
+	scrubFixture bool
+	convertFile string
+	verifyConvert bool
+
+	kohaFile string
+	kohaItems string
+
+	checkProfile string
+	validateFormat string
+	complianceReport bool
+
+	gobiFile string
+	gobiBibs string
+	gobiProfile string
+
+	ebookFile string
+
+	xrefFile string
+	oaiBase string
+	oaiSet string
+	oaiFrom string
+	oaiUntil string
+	oaiPrefix string
+	oaiDir string
+	oaiState string
+	linksFile string
+	embedHoldingsFile string
+	extractHoldingsFile string
+
+	enrichFile string
+	enrichWith string
+	enrichCache string
+	enrichRate float64
+	enrichReport string
+	enrichAuthorities string
+	enrichIndex string
+
+	limitsFile string
+	budgetFile string
+	budgetLog string
+
+	weedList string
+	weedKey string
+	keepFile string
+	withdrawFile string
+
+	partitionBy string
+	partitionDir string
+
+	groupBy string
+	idExpr string
+	madsBase string
+	configFile string
+	benchRun bool
+	traceRun bool
+
+	duplicateISBNs bool
+	dedupeKey string
+	dedupeKeep string
+	dedupeOut string
+	charFrequency bool
+	cooccurMode string
+	subjectClusters bool
+	publisherReport bool
+	showStats bool
+	showLengths bool
+	showHits bool
+	notifyURL string
+	notifyErrors bool
+
+	recoverFile string
+	stripGaps bool
+	acceptTerminators string
+	acceptUnterminated bool
+	writeTerminatorOpt string
+	omitFinalTerminatorOpt bool
+
+	orderFile string
+	orderKey string
+
+	sortKey string
+	sortNumeric bool
+	sortReverse bool
+	collateLocale string
+
+	showProgress bool
+	checkpointFile string
+	resume bool
+
+	diffFile string
+	diffKey string
+
+	loadStore string
+	loadKey string
+
+	explain bool
+	explainRecord int
 )
 
 // Select the record whose 020$a == 9780743264747, output field 650 value(s) only
@@ -66,178 +213,847 @@ var (
 
 func init() {
 	flag.UintVar(&maxRecords, "m", math.MaxUint32, "Maximum number of records to dump")
-	flag.StringVar(&fieldsOpt, "f", "", "Colon separated field tags to output")
-	flag.StringVar(&selectorOpt, "s", "", "Field selector(s)")
+	flag.IntVar(&skipRecords, "skip", 0, "Skip the first `n` records of the input")
+	flag.StringVar(&recordRange, "records", "", "Read only the records numbered in `range`, e.g. 1000-2000 or 1000-")
+	flag.IntVar(&workers, "j", 1, "Parse and select records with `n` workers")
+	flag.BoolVar(&unordered, "unordered", false, "With -j, output records as they are ready rather than in input order")
+	flag.BoolVar(&skipBad, "skip-bad", false, "Skip records that cannot be read instead of stopping at the first")
+	flag.StringVar(&fieldsOpt, "f", "", "Colon separated field tags to output, e.g. 245_a:6xx:856")
+	flag.StringVar(&mapFile, "map", "", "Change each selected record by the rules in `file`, e.g. rename 690 to 650, or by a canned transform: rda-gmd")
+	flag.Var(&selectorOpts, "s", "Field selector expression, e.g. '020_a=^978 AND NOT 650' (repeatable)")
+	flag.StringVar(&typeOpt, "type", "", "Select records of the comma separated formats: bib, auth, hold, class or comm")
+	flag.StringVar(&agencyOpt, "agency", "", "Select records created or modified by the comma separated 040 agencies, e.g. DLC,OCoLC")
+	flag.StringVar(&idFile, "idfile", "", "Select only the records whose -idfield value is listed in `file`, one per line")
+	flag.StringVar(&idField, "idfield", "001", "Field, or field_subfield, holding the -idfile identifiers, e.g. 020_a")
+	flag.BoolVar(&includeDeleted, "include-deleted", false, "Include deleted records (Leader/05 'd'), which are otherwise skipped")
+	flag.BoolVar(&onlyDeleted, "only-deleted", false, "Select only deleted records (Leader/05 'd')")
+	flag.BoolVar(&countOnly, "count", false, "Print only the number of selected records")
+	flag.BoolVar(&listOnly, "l", false, "Print only the 001 of each selected record")
 	flag.StringVar(&makeIndex, "mkindex", "", "Name of index file to generate")
-	flag.StringVar(&useIndex, "index", "", "Name of index file")
+	flag.Var(&useIndex, "index", "Name of index file (repeatable, for selectors on several indexed fields)")
+	flag.StringVar(&outputFormat, "o", "text", "Output format: text, pretty, json, ndjson, jsonld, marcxml, mods, mads, madsrdf, mrk, csv, tsv, template, sqlite=file")
+	flag.StringVar(&columnsOpt, "columns", "001,245_a", "Comma separated columns of csv and tsv output, e.g. 001,245_a,260_c,020_a")
+	flag.StringVar(&presetName, "preset", "", "Write a ready-made CSV report: serials (check-in list), ebooks (titles and URLs) or av (audiovisual inventory)")
+	flag.StringVar(&joinOpt, "join", ";", "Separator joining the values of repeated fields in a csv or tsv column")
+	flag.StringVar(&templateFile, "template", "", "Write each record with the text/template in `file` (sets -o template)")
+	flag.BoolVar(&prettyOutput, "pretty", false, "Write records for reading, with field names and decoded fixed fields")
+	flag.StringVar(&colorMode, "color", "auto", "Color -pretty output: always, never or auto (when writing to a terminal)")
+	flag.IntVar(&minWidth, "minwidth", 0, "Minimum width of text output columns")
+	flag.IntVar(&tabWidth, "tabwidth", 8, "Width of a tab in text output")
+	flag.IntVar(&padding, "padding", 3, "Padding between text output columns")
+	flag.BoolVar(&alignRight, "align-right", false, "Right-align text output columns")
+	flag.IntVar(&maxWidth, "maxwidth", 0, "Truncate text output values longer than `n` characters")
+	flag.StringVar(&separator, "separator", "", "Text output record separator: blank, formfeed, count, or a string")
+	flag.BoolVar(&rawOutput, "raw", false, "Print MARC-8 records without converting them to UTF-8")
+	flag.StringVar(&marc8Tables, "marc8-tables", "", "LC codetables.xml `file` with additional MARC-8 character sets")
+	flag.StringVar(&extractFile, "extract", "", "Write the selected records to file as binary MARC")
+	flag.Var(&sinkOpts, "sink", "Also write the selected records to `format=file`, e.g. marc=out.mrc, ndjson=- or errors=run.log; can be repeated")
+	flag.BoolVar(&appendOutput, "append", false, "Add to the files written instead of replacing them")
+	flag.StringVar(&fixtureFile, "extract-fixture", "", "Write the first selected records (10, or -m) to `name`.mrc and name.mrk")
+	flag.BoolVar(&scrubFixture, "scrub", false, "Replace the local identifiers of -extract-fixture records with made-up ones")
+	flag.StringVar(&convertFile, "convert-encoding", "", "Write the selected records to file as binary MARC converted to UTF-8")
+	flag.BoolVar(&verifyConvert, "verify", false, "Read back the -convert-encoding file and report records that did not convert cleanly")
+	flag.StringVar(&parseMode, "parse", "", "Add the parts of the title and names to JSON output, punctuation `clean` or as recorded (isbd)")
+	flag.BoolVar(&provenance, "provenance", false, "Include where each record and its fields are in the input in JSON output")
+	flag.StringVar(&wrap, "wrap", "collection", "Write -o json and marcxml records in a collection (array or collection element), or none for bare records")
+	flag.IntVar(&jsonIndent, "json-indent", 0, "Indent JSON output (-o json and jsonld, -explain) by `n` spaces for each level of nesting; 0 writes it compactly, or -explain by two spaces")
+	flag.BoolVar(&flatJSON, "flat", false, "Write -o ndjson records as objects of values keyed by tag and subfield, e.g. \"245a\"")
+	flag.StringVar(&kohaFile, "koha", "", "Write Koha staged import records to file")
+	flag.StringVar(&kohaItems, "koha-items", "", "Item profile mapping local item fields to 952")
+	flag.StringVar(&checkProfile, "check", "", "Check records against an import profile: alma (bibliographic records)")
+	flag.BoolVar(&complianceReport, "compliance", false, "Report how far the records meet the ISO 2709 and MARC 21 exchange requirements, as a Markdown document")
+	flag.StringVar(&validateFormat, "validate", "", "Validate record structure, reporting as `format`: text or json")
+	flag.StringVar(&linksFile, "links", "", "Write the links between bibliographic, holdings and item records to a CSV file")
+	flag.StringVar(&embedHoldingsFile, "embed-holdings", "", "Write the records to `file` with the holdings records embedded in their bibliographic records")
+	flag.StringVar(&extractHoldingsFile, "extract-holdings", "", "Write the records to `file` with the embedded holdings made into holdings records")
+	flag.StringVar(&oaiBase, "oai", "", "Harvest the records of the OAI-PMH repository at `URL` instead of reading input files")
+	flag.StringVar(&oaiSet, "set", "", "With -oai, harvest only the records of a set")
+	flag.StringVar(&oaiFrom, "from", "", "With -oai, harvest only the records changed since a date, e.g. 2014-01-01")
+	flag.StringVar(&oaiUntil, "until", "", "With -oai, harvest only the records changed up to a date")
+	flag.StringVar(&oaiPrefix, "oai-prefix", "marc21", "With -oai, the metadata format of the MARCXML records")
+	flag.StringVar(&oaiDir, "oai-dir", "", "With -oai, also write the records to a file in `dir` named for the time the harvest started")
+	flag.StringVar(&oaiState, "oai-state", "", "With -oai, keep where the harvest got to in `file`, to resume it or harvest what changed since")
+	flag.StringVar(&xrefFile, "xrefs", "", "Write the 4xx/5xx cross references of authority records to a CSV file")
+	flag.StringVar(&enrichFile, "enrich", "", "Write the selected records to file with URIs added to their headings")
+	flag.StringVar(&enrichWith, "enrich-with", "lc", "Comma separated -enrich sources: lc or local ($0), viaf or wikidata ($1)")
+	flag.StringVar(&enrichCache, "enrich-cache", "", "Cache -enrich lookups in `file` across runs")
+	flag.Float64Var(&enrichRate, "enrich-rate", 2, "Most -enrich lookups to make per second to each source")
+	flag.StringVar(&enrichAuthorities, "enrich-authorities", "", "Authority MARC `file` for the local -enrich source")
+	flag.StringVar(&enrichIndex, "enrich-index", "", "Index on the -enrich-authorities file, e.g. on 100_a, to look headings up with")
+	flag.StringVar(&enrichReport, "enrich-report", "", "Write the headings -enrich found ambiguous to a CSV file")
+	flag.StringVar(&gobiFile, "gobi", "", "Write GOBI order data to an acquisitions CSV file")
+	flag.StringVar(&gobiBibs, "gobi-bibs", "", "Write records without their order fields to file")
+	flag.StringVar(&gobiProfile, "gobi-map", "", "Order profile mapping 9xx subfields to CSV columns")
+	flag.StringVar(&ebookFile, "ebook", "", "Write records with normalized 856 access fields to file")
+	flag.StringVar(&limitsFile, "limits", "", "Report violations of the target system limits in file")
+	flag.StringVar(&budgetFile, "budget", "", "Cut the binary MARC records written down to the max-record-length of the limits `file` by its drop lines")
+	flag.StringVar(&budgetLog, "budget-log", "", "Write the fields -budget dropped to a CSV `file`")
+	flag.StringVar(&weedList, "weed", "", "CSV file listing the keys of items to withdraw")
+	flag.StringVar(&weedKey, "weed-key", "001", "Field holding the weed list keys, e.g. 001 or 949_p")
+	flag.StringVar(&keepFile, "keep", "keep.mrc", "Name of the weeding keep file")
+	flag.StringVar(&withdrawFile, "withdraw", "withdraw.mrc", "Name of the weeding withdraw file")
+	flag.StringVar(&partitionBy, "partition-by", "", "Split records into per-year files: year(005) or year(008)")
+	flag.StringVar(&partitionDir, "partition-dir", ".", "Directory for the partition files")
+	flag.BoolVar(&duplicateISBNs, "dup-isbn", false, "Report ISBNs appearing on more than one record")
+	flag.StringVar(&dedupeKey, "dedupe", "", "Report clusters of records sharing a value of a `field`, e.g. 020_a or 035_a, or id for the -id-expr")
+	flag.StringVar(&dedupeKeep, "dedupe-keep", "first", "Record of each -dedupe cluster to keep: first or largest")
+	flag.StringVar(&dedupeOut, "dedupe-out", "", "Write the records kept by -dedupe to `file`")
+	flag.BoolVar(&showStats, "stats", false, "Print statistics about the records instead of the records")
+	flag.BoolVar(&showHits, "hits", false, "Print which fields, subfields and bytes of each record the selector matched instead of the records")
+	flag.BoolVar(&showLengths, "lengths", false, "Print the min, median, percentile and max lengths of each tag and subfield instead of the records")
+	flag.BoolVar(&charFrequency, "charfreq", false, "Report non-ASCII character frequencies and suspicious bytes")
+	flag.BoolVar(&subjectClusters, "subject-clusters", false, "Report subject headings differing only in case, punctuation, diacritics or subdivision order")
+	flag.BoolVar(&publisherReport, "publishers", false, "Report the publishers of the 260 and 264 fields, grouping the forms of each name")
+	flag.StringVar(&cooccurMode, "cooccur", "", "Report the records each pair of tags appears in together, as `pairs` or a matrix")
+	flag.StringVar(&recoverFile, "recover", "", "Copy every complete record read to file, e.g. to salvage a truncated file")
+	flag.BoolVar(&stripGaps, "strip-gaps", false, "Drop stray bytes between records from -recover output")
+	flag.StringVar(&acceptTerminators, "accept-terminators", "", "Also take the `bytes` listed in hex, e.g. 0a,00, as record terminators")
+	flag.BoolVar(&acceptUnterminated, "accept-unterminated", false, "Take a last record one byte short as one missing its record terminator")
+	flag.StringVar(&writeTerminatorOpt, "write-terminator", "", "End the binary MARC records written with `byte`, in hex, instead of 1d")
+	flag.BoolVar(&omitFinalTerminatorOpt, "omit-final-terminator", false, "Leave the record terminator off the last record of each binary MARC file written")
+	flag.StringVar(&orderFile, "order", "", "Output records in the order of the keys listed in file")
+	flag.StringVar(&orderKey, "order-key", "001", "Field holding the -order keys")
+	flag.StringVar(&sortKey, "sort", "", "Output records sorted by the value of a `field`, e.g. 245_a")
+	flag.StringVar(&collateLocale, "collate", "", "Sort values and -sort keys in the order of a `locale`, e.g. sv or de, instead of byte order")
+	flag.BoolVar(&sortNumeric, "sort-numeric", false, "Sort by the first number in the -sort value")
+	flag.BoolVar(&sortReverse, "reverse", false, "Sort from the largest -sort value down")
+	flag.BoolVar(&showProgress, "progress", false, "Report the records read, the rate and the time left on the standard error")
+	flag.StringVar(&checkpointFile, "checkpoint", "", "Record where the run has got to in `file` every few seconds")
+	flag.BoolVar(&resume, "resume", false, "Carry on from where the -checkpoint file says an earlier run stopped")
+	flag.StringVar(&diffFile, "diff", "", "Report the records added, deleted and changed since an older `file`")
+	flag.StringVar(&diffKey, "diff-key", "", "Field matching the records of a -diff, e.g. 001 or 035_a; the -id-expr by default")
+	flag.StringVar(&loadStore, "load", "", "Add the records to the database of a serve connection `string`, e.g. sqlite:records.db")
+	flag.StringVar(&loadKey, "load-key", "", "Field holding the id records are loaded under; the -id-expr by default")
+	flag.BoolVar(&explain, "explain", false, "Print how the selector was parsed as JSON, and exit")
+	flag.IntVar(&explainRecord, "explain-record", 0, "With -explain, also explain the selector's result for record `n`")
+	flag.BoolVar(&traceRun, "trace", false, "Report each record's offset, read, parse and action times and selector result on the standard error")
+	flag.StringVar(&notifyURL, "notify", "", "POST a JSON summary of the run to the webhook at `URL` when it is over")
+	flag.BoolVar(&notifyErrors, "notify-errors", false, "Attach the errors=file -sink report to the -notify summary")
+	flag.BoolVar(&benchRun, "bench", false, "Report the time taken, the read rate and the memory allocated on the standard error")
+	flag.StringVar(&configFile, "config", "", "Configuration `file` of selector macros; ~/.marcdump by default")
+	flag.StringVar(&madsBase, "mads-base", "", "Base `URL` of the -o madsrdf URIs of authority records without an LCCN or a URI in 024, followed by their 001")
+	flag.StringVar(&idExpr, "id-expr", "", "Fields keying records, in order of preference, e.g. '035(OCoLC) > 001 > 020'; 001 by default")
+	flag.StringVar(&groupBy, "group-by", "", "Break report counts down by the value of a field, e.g. 040_a")
 }
 
-func getSelectionSpec() (*selectionSpec, error) {
-	selectionSpec := new(selectionSpec)
 
-	if selectorOpt != "" {
-		spec := selectionSpecRegexp.FindStringSubmatch(selectorOpt)
-		if spec != nil {
-			if spec[3] != "" {
-				re,err := regexp.Compile(spec[3])
-				if err != nil {
-					return nil, err
-				}
-				selectionSpec.criterion = re
-			}
-			selectionSpec.field = spec[1]
-			selectionSpec.subfield = spec[2]
-		} else {
-			return nil, errInvalidSelectorSpec
+
+func getActionFunction(selector marcfilter.Selector) (actionFunc, error) {
+	if countOnly {
+		return getCountAction(), nil
+	}
+	if listOnly {
+		return getListAction(), nil
+	}
+	if makeIndex != "" {
+		return getIndexAction(makeIndex, selector)
+	}
+	if diffFile != "" {
+		return getDiffAction(diffFile, keyOption(diffKey), selector)
+	}
+	if loadStore != "" {
+		return getLoadAction(loadStore, keyOption(loadKey))
+	}
+	if extractFile != "" {
+		return getExtractAction(extractFile)
+	}
+	if fixtureFile != "" {
+		if maxRecords == math.MaxUint32 {
+			maxRecords = defaultFixtureRecords
 		}
+		return getFixtureAction(fixtureFile, scrubFixture)
 	}
-	return selectionSpec, nil
-}
-
-
-func (s *selectionSpec) match(r *marc21.MarcRecord) bool {
-	if s.field == "" {
-		return true
+	if convertFile != "" {
+		return getConvertAction(convertFile, verifyConvert)
 	}
-
-	if marc21.IsControlFieldTag(s.field) {
-		field, err := r.GetControlField(s.field)
+	if enrichFile != "" {
+		sources, err := getEnrichSources(enrichWith, enrichRate, enrichAuthorities, enrichIndex)
 		if err != nil {
-			return false
-		}
-		if s.criterion != nil {
-			return s.criterion.MatchString(field)
-		}
-		return true
-	} else { // Data Field
-		subfields := make([]string, 1)
-
-		field, _ := r.GetDataField(s.field)
-
-		for instance := 0; instance < field.ValueCount(); instance++ {
-			// if no subfield is specified in the spec then
-			// we want to search all of them. since these can
-			// vary per field instance we need to get the list
-			// each time.
-			if s.subfield != "" {
-				subfields[0] = s.subfield
-			} else {
-				subfields = field.GetSubfields(instance)
-			}
-
-			for _, subfield := range subfields {
-				sfv := field.GetNthSubfield(subfield, instance)
-				if sfv != "" {
-					// the subfield exists: need to check because the
-					// user supplied subfield may not exist in this
-					// instance
-					if s.criterion != nil {
-						// and there is a search criterion
-						if s.criterion.MatchString(sfv) {
-							// and it matches
-							return true;
-						}
-					} else {
-						// no search criterion, but the field exists
-						return true;
-					}
-				}
-			}
+			return nil, err
 		}
-		return false;
+		cache, err := openReconcileCache(enrichCache)
+		if err != nil {
+			return nil, err
+		}
+		cache.cached(sources)
+		return getEnrichAction(enrichFile, sources, enrichReport)
+	}
+	if kohaFile != "" {
+		return getKohaAction(kohaFile, kohaItems)
 	}
-}
 
+	group, err := getGroupFunction(groupBy)
+	if err != nil {
+		return nil, err
+	}
+	if checkProfile != "" {
+		return getCheckAction(checkProfile, group)
+	}
+	if validateFormat != "" {
+		return getValidateAction(validateFormat)
+	}
+	if complianceReport {
+		return getComplianceAction(flag.Args()), nil
+	}
+	if limitsFile != "" {
+		limits, err := loadLimitsProfile(limitsFile)
+		if err != nil {
+			return nil, err
+		}
+		return newCheckAction([]checkFunc{limits.check}, group), nil
+	}
+	if gobiFile != "" {
+		return getGobiAction(gobiFile, gobiBibs, gobiProfile)
+	}
+	if ebookFile != "" {
+		return getEbookAction(ebookFile)
+	}
+	if xrefFile != "" {
+		return getXrefAction(xrefFile)
+	}
+	if linksFile != "" {
+		return getLinksAction(linksFile)
+	}
+	if embedHoldingsFile != "" {
+		return getEmbedHoldingsAction(embedHoldingsFile)
+	}
+	if extractHoldingsFile != "" {
+		return getExtractHoldingsAction(extractHoldingsFile)
+	}
+	if weedList != "" {
+		return getWeedAction(weedList, weedKey, keepFile, withdrawFile)
+	}
+	if partitionBy != "" {
+		return getPartitionAction(partitionBy, partitionDir)
+	}
+	if duplicateISBNs {
+		return getDuplicateISBNAction(), nil
+	}
+	if dedupeKey != "" {
+		return getDedupeAction(dedupeKey, dedupeKeep, dedupeOut)
+	}
+	if charFrequency {
+		return getCharFrequencyAction(), nil
+	}
+	if subjectClusters {
+		return getSubjectClusterAction(), nil
+	}
+	if publisherReport {
+		return getPublisherAction(), nil
+	}
+	if cooccurMode != "" {
+		return getCooccurrenceAction(cooccurMode)
+	}
+	if showStats {
+		return getStatsAction(group), nil
+	}
+	if showLengths {
+		return getLengthsAction(), nil
+	}
+	if showHits {
+		return getHitsAction(selector), nil
+	}
 
-func getActionFunction() actionFunc {
-	if makeIndex != "" {
-		return nil
-	} else {
-		return printRecord
+	if err := checkParseMode(parseMode); err != nil {
+		return nil, err
 	}
+	if len(sinkOpts) > 0 {
+		// the sinks take the place of -o
+		return nil, nil
+	}
+	return getFormatAction(outputFormat)
 }
 
 
 func main() {
 	flag.Parse()
+	if err := loadConfig(configFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if collateLocale != "" {
+		if err := setCollation(collateLocale); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if wrap != "collection" && wrap != "none" {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", errUnknownWrap)
+		os.Exit(1)
+	}
+	if jsonIndent < 0 {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", errNegativeIndent)
+		os.Exit(1)
+	}
+	if presetName != "" {
+		if err := usePreset(presetName); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if templateFile != "" {
+		outputFormat = "template"
+	}
+	if prettyOutput {
+		outputFormat = "pretty"
+	}
+	if diffFile != "" && !onlyDeleted {
+		// a new record marked deleted is reported as a deletion
+		includeDeleted = true
+	}
+
+	if explain && explainRecord == 0 && flag.NArg() == 0 {
+		selector, err := getSelector()
+		if err == nil {
+			err = explainSelector(os.Stdout, selector, nil, 0)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	if flag.NArg() != 1 {
+	if flag.NArg() < 1 && oaiBase == "" {
 		usage()
 	}
+	if oaiBase != "" && flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", errHarvestInputs)
+		os.Exit(1)
+	} else if oaiBase == "" && (oaiSet != "" || oaiFrom != "" || oaiUntil != "" || oaiDir != "" || oaiState != "") {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", errHarvestFlags)
+		os.Exit(1)
+	}
 
-	file, err := os.Open(flag.Arg(0))
+	if flag.Arg(0) == "serve" {
+		if err := serve(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var flags uint
+	if alignRight {
+		flags |= tabwriter.AlignRight
+	}
+	if separator != "" || outputFormat == "tsv" || outputFormat == "template" {
+		flags |= tabwriter.StripEscape
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, minWidth, tabWidth, padding, ' ', flags)
+
+	if marc8Tables != "" {
+		if err := loadCodeTables(marc8Tables); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	selector, err := getSelector()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 3, ' ', 0)
 
-	selector, err := getSelectionSpec()
+	if flag.Arg(0) == "conformance" {
+		if err := conformance(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "golden" {
+		if err := golden(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "audit-urls" {
+		if err := auditURLs(flag.Args()[1:], selector); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "stats" && flag.Arg(1) == "diff" {
+		if err := statsDiff(flag.Args()[2:], selector, w); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	transform, err := getTransform()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	action := getActionFunction()
+	filter, err := getFieldFilter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if countOnly || listOnly {
+		// nothing of the record is printed, so don't bother
+		filter = nil
+	}
+
+	var resumeFrom *checkpoint
+	if checkpointFile != "" {
+		stdin := false
+		for _, name := range flag.Args() {
+			stdin = stdin || name == "-" || isURL(name)
+		}
+		if orderFile != "" || sortKey != "" || len(useIndex) > 0 || unordered || flag.Arg(0) == "fetch" || flag.Arg(0) == "cut" || oaiBase != "" || stdin {
+			fmt.Fprintln(os.Stderr, "Error: -checkpoint needs input files read in order, without -order, -sort, -index or -unordered")
+			os.Exit(1)
+		}
+		if resume {
+			if resumeFrom, err = readCheckpoint(checkpointFile); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			appendMarcWriters = resumeFrom != nil
+		}
+	} else if resume {
+		fmt.Fprintln(os.Stderr, "Error: -resume needs a -checkpoint file")
+		os.Exit(1)
+	}
+
+	if appendOutput {
+		appendMarcWriters = true
+	}
+	if budgetFile != "" {
+		if err := setBudget(budgetFile, budgetLog); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else if budgetLog != "" {
+		fmt.Fprintln(os.Stderr, "Error: -budget-log needs a -budget")
+		os.Exit(1)
+	}
+	acceptedTerminators, err := setTerminatorOptions(acceptTerminators, writeTerminatorOpt, omitFinalTerminatorOpt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	action, err := getActionFunction(selector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(sinkOpts) > 0 {
+		if action, err = getSinkAction(sinkOpts, action); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	if action == nil {
 		fmt.Fprintln(os.Stderr, "Internal Error: could not get action function")
+		os.Exit(1)
+	}
+	var notify *notifier
+	if notifyURL != "" {
+		if notify, err = startNotify(notifyURL, notifyErrors, flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else if notifyErrors {
+		fmt.Fprintln(os.Stderr, "Error: -notify-errors needs a -notify URL")
+		os.Exit(1)
 	}
 
 	recordCount := uint(0)
-	
-	reader := marc21.NewReader(file, false)
+
+	// endRun ends the run, posting its summary to any -notify webhook.
+	// The run fails if it stopped at an error or was interrupted.
+	endRun := func(complete bool, err error) {
+		status := 0
+		if err != nil || wasInterrupted() {
+			status = 1
+		}
+		if notify != nil {
+			notify.finish(recordCount, complete, status, err)
+		}
+		os.Exit(status)
+	}
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		endRun(false, err)
+	}
+
+	fileReader := newInputReader(flag.Args())
+	if flag.Arg(0) == "fetch" {
+		fetched, err := getFetchReader(flag.Args()[1:])
+		if err != nil {
+			fail(err)
+		}
+		fileReader = newInputReader([]string{fetchName})
+		fileReader.readers = map[string]io.ReadCloser{fetchName: fetched}
+	}
+	if flag.Arg(0) == "cut" {
+		name, offset, cut, err := getCutReader(flag.Args()[1:])
+		if err != nil {
+			fail(err)
+		}
+		fileReader = newInputReader([]string{name})
+		fileReader.readers = map[string]io.ReadCloser{name: cut}
+		fileReader.resumeOffset = offset
+	}
+	if oaiBase != "" {
+		h := &oaiHarvest{base: oaiBase, prefix: oaiPrefix, set: oaiSet, from: oaiFrom, until: oaiUntil, dir: oaiDir, stateFile: oaiState}
+		if err := h.start(); err != nil {
+			fail(err)
+		}
+		fileReader = newInputReader([]string{oaiBase})
+		fileReader.readers = map[string]io.ReadCloser{oaiBase: h.harvest()}
+	}
+	var reader marcfilter.Source = fileReader
+
+	if resumeFrom != nil {
+		if err := resumeFrom.resume(fileReader); err != nil {
+			fail(err)
+		}
+		recordCount = resumeFrom.count
+		fmt.Fprintf(os.Stderr, "Resuming after record %d, at offset %d of %s\n", resumeFrom.record, resumeFrom.offset, resumeFrom.input)
+	}
+
+	if explain {
+		if err := explainSelector(os.Stdout, selector, fileReader, explainRecord); err != nil {
+			fail(err)
+		}
+		endRun(true, nil)
+	}
+
+	gaps, gapBytes := 0, 0
+	fileReader.stripGaps = stripGaps
+	fileReader.terminators, fileReader.unterminated = acceptedTerminators, acceptUnterminated
+	fileReader.onGap = func(offset int64, gap []byte) {
+		gaps += 1
+		gapBytes += len(gap)
+		fmt.Fprintf(os.Stderr, "Warning: %s: %d stray bytes at offset %d: %q\n", fileReader.name, len(gap), offset, gap)
+	}
+	onFinish(func(w *tabwriter.Writer) error {
+		if gaps > 0 {
+			fmt.Fprintf(os.Stderr, "%d gaps between records, %d stray bytes in all\n", gaps, gapBytes)
+		}
+		return nil
+	})
+	if skipBad {
+		bad := 0
+		fileReader.onBad = func(offset int64, raw []byte, err error) {
+			bad += 1
+			leader := raw
+			if len(leader) > marcfilter.LeaderLength {
+				leader = leader[:marcfilter.LeaderLength]
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %v; skipped %d bytes, leader %q\n", err, len(raw), leader)
+		}
+		onFinish(func(w *tabwriter.Writer) error {
+			if bad > 0 {
+				fmt.Fprintf(os.Stderr, "%d bad records skipped\n", bad)
+			}
+			return nil
+		})
+	}
+	if recoverFile != "" {
+		if fileReader.tee, err = createMarcWriter(recoverFile); err != nil {
+			fail(err)
+		}
+		// the records are salvaged as they were read
+		fileReader.tee.budget = nil
+		fileReader.tee.terminator, fileReader.tee.omitFinal = nil, false
+		onFinish(func(w *tabwriter.Writer) error {
+			fmt.Fprintf(os.Stderr, "%d records recovered to %s\n", fileReader.tee.count, recoverFile)
+			return fileReader.tee.close()
+		})
+	}
+	// idx is the first index, and the one on the -order key if there is
+	// one
+	var idx *marcfilter.Index
+	var indexes []*marcfilter.Index
+	var file *os.File
+	if len(useIndex) > 0 {
+		if flag.NArg() != 1 || flag.Arg(0) == "-" {
+			fail(errors.New("an index can only be used with a single input file"))
+		}
+		for _, name := range useIndex {
+			i, err := marcfilter.ReadIndex(name)
+			if err != nil {
+				fail(err)
+			}
+			if idx == nil || (i.Key == orderKey && idx.Key != orderKey && orderFile != "") {
+				idx = i
+			}
+			indexes = append(indexes, i)
+		}
+		if file, err = os.Open(flag.Arg(0)); err != nil {
+			fail(err)
+		}
+		if isCompressed(file) {
+			fail(errors.New("an index cannot be used with a compressed input file"))
+		}
+	}
+	window, err := getRecordWindow(skipRecords, recordRange)
+	if err != nil {
+		fail(err)
+	}
+	windowed := window != recordWindow{first: 1}
+	if windowed && orderFile != "" {
+		fail(errors.New("-skip and -records cannot be used with -order"))
+	}
+
+	if sortKey != "" && orderFile != "" {
+		fail(errors.New("-sort cannot be used with -order"))
+	}
+
+	if workers > 1 && (orderFile != "" || idx != nil) {
+		fail(errors.New("-j cannot be used with -order or -index"))
+	}
+
+	if orderFile != "" {
+		if reader, err = getOrderedSource(orderFile, orderKey, reader, file, idx); err != nil {
+			fail(err)
+		}
+	} else if windowed {
+		// the index can find where the window starts, but not which
+		// records in it to read
+		fileReader.skip = window.first - 1
+		if idx != nil && window.first > 1 {
+			if offset, ok := idx.RecordOffset(window.first); ok {
+				if _, err := file.Seek(offset, io.SeekStart); err != nil {
+					fail(err)
+				}
+				rr := newRecordReader(file)
+				rr.Offset, rr.Count = offset, window.first-1
+				rr.tee, rr.stripGaps, rr.onGap = fileReader.tee, fileReader.stripGaps, fileReader.onGap
+				rr.Terminators, rr.Unterminated = fileReader.terminators, fileReader.unterminated
+				rr.OnBad = fileReader.onBad
+				fileReader.name = flag.Arg(0)
+				reader = rr
+			}
+		}
+	} else if idx != nil {
+		if indexed := marcfilter.NewMultiIndexedReader(file, indexes, selector); indexed != nil {
+			reader = indexed
+		} else {
+			var keys []string
+			for _, i := range indexes {
+				keys = append(keys, i.Key)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: the indexes are on %s, not the selector fields; reading the whole file\n", strings.Join(keys, ", "))
+		}
+	}
+
+	match := func(rec *marcfilter.Record) bool {
+		return wantStatus(rec) && selector.Match(rec.MarcRecord)
+	}
+	rawMatch, raw := rawFraming(selector)
+	if raw {
+		reader = newRawSource(fileReader)
+		match = func(rec *marcfilter.Record) bool {
+			return wantStatus(rec) && rawMatch(rec.Raw)
+		}
+	}
+	var bench *benchmark
+	if benchRun {
+		bench = startBench(raw)
+	}
+	var parallel *parallelSource
+
+	if workers > 1 {
+		var prepare func(rec *marcfilter.Record)
+		if len(preparers) > 0 && transform == nil && filter == nil && sortKey == "" {
+			// the action gets the very records the workers prepared
+			prepare = func(rec *marcfilter.Record) {
+				for _, f := range preparers {
+					f(rec)
+				}
+			}
+		}
+		parallel = newParallelSource(fileReader, workers, match, prepare, window, unordered)
+		reader = parallel
+		// the workers have done the selecting
+		match = func(rec *marcfilter.Record) bool { return true }
+	}
+
+	// signals are caught before -sort reads the input, so that it can
+	// stop and remove its runs
+	catchSignals()
+
+	var sorted *sortedSource
+	if sortKey != "" {
+		if sorted, err = newSortedSource(reader, sortKey, sortNumeric, sortReverse, match, window); err != nil {
+			fail(err)
+		}
+		reader = sorted
+		match = func(rec *marcfilter.Record) bool { return true }
+	}
+
+	var progress *progressReporter
+	var reached *checkpoint
+	if resumeFrom != nil {
+		reached = resumeFrom
+	}
+	if showProgress {
+		if reached != nil {
+			progress = startProgress(flag.Args(), reached.record, reached.index, reached.offset)
+		} else {
+			progress = startProgress(flag.Args(), 0, 0, 0)
+		}
+	}
+	var trace *tracer
+	if traceRun {
+		if reader == marcfilter.Source(fileReader) {
+			trace = newTracer(os.Stderr, fileReader)
+		} else {
+			trace = newTracer(os.Stderr, nil)
+		}
+	}
+	checkpointed := time.Now()
+	// complete is set when the run gets to the end rather than being
+	// interrupted or stopped by an error
+	complete := false
+
+	// runErr is the error that stopped the run, if one did
+	var runErr error
+
 	for {
-		rec,err := reader.Next()
+		if wasInterrupted() {
+			break
+		}
+		if trace != nil {
+			trace.begin()
+		}
+		rec, err := reader.Next()
 
 		if rec == nil && err == nil {
+			complete = true
 			break
 		} else if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			runErr = err
+			break
+		}
+		if window.past(rec.Number) {
+			complete = true
 			break
 		}
+		number, end := rec.Number, rec.Offset+int64(len(rec.Raw))
+		if notify != nil {
+			notify.read(number)
+		}
+		if bench != nil {
+			bench.add(rec)
+		}
+		if trace != nil {
+			trace.read(number, rec.Offset, len(rec.Raw), controlNumber(rec))
+		}
 
-		if selector.match(rec) {
-			action(rec, w)
-			recordCount += 1
-			if recordCount == maxRecords {
+		matched := match(rec)
+		if trace != nil {
+			trace.selected(matched)
+		}
+		if matched {
+			if transform != nil {
+				if rec, err = transform.Apply(rec); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					runErr = err
+					break
+				}
+			}
+			if filter != nil {
+				if rec, err = filter.Apply(rec); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					runErr = err
+					break
+				}
+			}
+			if trace != nil && (transform != nil || filter != nil) {
+				trace.stage("map")
+			}
+			if err := action(rec, w); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				runErr = err
 				break
 			}
+			if trace != nil {
+				trace.stage("action")
+			}
+			recordCount += 1
+		}
+		if trace != nil {
+			trace.end()
+		}
+
+		if progress != nil || checkpointFile != "" {
+			index := fileReader.inputOf(number)
+			if progress != nil {
+				progress.update(number, index, end)
+			}
+			if checkpointFile != "" {
+				reached = &checkpoint{flag.Arg(index), index, end, number, recordCount}
+				if time.Since(checkpointed) >= checkpointInterval {
+					if err := reached.save(checkpointFile, w); err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+						runErr = err
+						break
+					}
+					checkpointed = time.Now()
+				}
+			}
+		}
+		if recordCount == maxRecords {
+			complete = true
+			break
 		}
 	}
-}
 
-//
-// Record Printing Functions
-//
+	if progress != nil {
+		progress.stop()
+	}
+	if parallel != nil {
+		parallel.stop()
+	}
+	if sorted != nil {
+		sorted.close()
+	}
 
-func printRecord(record *marc21.MarcRecord, w *tabwriter.Writer) error {
-	fmt.Fprintf(w, "Leader\t%s\n", record.GetLeader())
-	fields := record.GetFieldList()
-	for _,f := range fields {
-		if marc21.IsControlFieldTag(f) {
-			v,_ := record.GetControlField(f)
-			fmt.Fprintf(w, "%s\t%s\n", f, v)
-		} else {
-			v,_ := record.GetDataField(f)
-			printDataField(w, v)
+	// every finisher runs, so that each output is closed, and the run
+	// fails with the first error
+	var finishErr error
+	for _, f := range finishers {
+		if err := f(w); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if finishErr == nil {
+				finishErr = err
+			}
 		}
 	}
-	w.Flush()
-	return nil
-}
-
-func printDataField(w *tabwriter.Writer, field marc21.VariableField) {
-	for i := 0; i < field.ValueCount(); i++ {
-		value := field.GetIndicators(i)
-		for _,sf := range field.GetSubfields(i) {
-			value += fmt.Sprintf("$%s%s", sf, field.GetNthSubfield(sf, i))
+	if finishErr != nil {
+		endRun(false, finishErr)
+	}
+	if checkpointFile != "" {
+		if complete {
+			os.Remove(checkpointFile)
+		} else if reached != nil {
+			// the outputs are closed, so this is where the run stopped
+			if err := reached.write(checkpointFile); err != nil {
+				fail(err)
+			}
+			fmt.Fprintf(os.Stderr, "Stopped after record %d; carry on with -resume\n", reached.record)
 		}
-		fmt.Fprintf(w, "%s\t%s\n", field.Tag, value)
 	}
+	endRun(complete, runErr)
 }
 
+//
+// Record Printing Functions
+//
+
 //
 // Record Selection Functions
 //
@@ -248,7 +1064,15 @@ func selectAll(record *marc21.MarcRecord) bool {
 
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: marcdump [-m max] marcfile\n")
+	fmt.Fprintf(os.Stderr, "usage: marcdump [-m max] [-o format] [-s selector] [-f fields] [-mkindex file | -index file] marcfile...\n")
+	fmt.Fprintf(os.Stderr, "       marcdump [options] fetch oclc [-key key -secret secret] [-numbers file] [ocn...]\n")
+	fmt.Fprintf(os.Stderr, "       marcdump -diff old.mrc [-diff-key field] new.mrc\n")
+	fmt.Fprintf(os.Stderr, "       marcdump [-s selector] stats diff [-shift points] old.mrc new.mrc\n")
+	fmt.Fprintf(os.Stderr, "       marcdump [-s selector] audit-urls [-cache file] [-workers n] [-delay d] [-out report.csv] marcfile...\n")
+	fmt.Fprintf(os.Stderr, "       marcdump [options] cut -offset n [-length bytes] marcfile\n")
+	fmt.Fprintf(os.Stderr, "       marcdump [options] conformance [-selectors file] marcfile\n")
+	fmt.Fprintf(os.Stderr, "       marcdump [options] golden [-update] [-formats list] fixture.mrc dir\n")
+	fmt.Fprintf(os.Stderr, "       marcdump serve grpc|http [-listen addr] [-index file] [-cert file -key file] marcfile|conn\n")
 	os.Exit(1)
 }
 
@@ -0,0 +1,280 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"strings"
+)
+
+// Content, media and carrier types. The rule "infer 33x" gives a
+// bibliographic record cataloged before RDA the 336, 337 and 338 it
+// lacks, as the RDA content, media and carrier terms and codes that
+// its leader/06, first 007 and 008 call for, following the Library of
+// Congress mapping:
+//
+//    336 __ $a text $b txt $2 rdacontent
+//    337 __ $a unmediated $b n $2 rdamedia
+//    338 __ $a volume $b nc $2 rdacarrier
+//
+// A GMD, the AACR2 general material designation in 245 $h, says what
+// the record is in so many words, so the types its term calls for come
+// before those of the codes, which catalogers often left blank: an
+// "[electronic resource]" with a blank 008 form of item is a computer
+// resource, not a volume. The codes fill in what the GMD does not say,
+// a carrier only when it is one of the media type chosen. Each of the
+// three is added only if the record has none, and only when the GMD or
+// the codes say what it is: a sound recording without a 007 gets no
+// 338, since nothing says whether it is a disc or a cassette.
+
+// An rdaTerm is a term of an RDA vocabulary and its code.
+type rdaTerm struct {
+	term, code string
+}
+
+// rdaContentTypes maps leader/06 to the content type.
+var rdaContentTypes = map[byte]rdaTerm{
+	'a': {"text", "txt"}, 't': {"text", "txt"},
+	'c': {"notated music", "ntm"}, 'd': {"notated music", "ntm"},
+	'e': {"cartographic image", "cri"}, 'f': {"cartographic image", "cri"},
+	'g': {"two-dimensional moving image", "tdi"},
+	'i': {"spoken word", "spw"}, 'j': {"performed music", "prm"},
+	'k': {"still image", "sti"}, 'm': {"computer program", "cop"},
+	'r': {"three-dimensional form", "tdf"},
+}
+
+// rdaMediaTypes maps 007/00 to the media type.
+var rdaMediaTypes = map[byte]rdaTerm{
+	'c': {"computer", "c"}, 'h': {"microform", "h"},
+	's': {"audio", "s"}, 'v': {"video", "v"},
+	'g': {"projected", "g"}, 'm': {"projected", "g"},
+	'a': {"unmediated", "n"}, 'd': {"unmediated", "n"}, 'f': {"unmediated", "n"},
+	'k': {"unmediated", "n"}, 'q': {"unmediated", "n"}, 't': {"unmediated", "n"},
+}
+
+// rdaCarrierTypes maps 007/00-01 to the carrier type.
+var rdaCarrierTypes = map[string]rdaTerm{
+	"ca": {"computer tape cartridge", "ca"}, "cb": {"computer chip cartridge", "cb"},
+	"cd": {"computer disc", "cd"}, "cj": {"computer disc", "cd"},
+	"cm": {"computer disc", "cd"}, "co": {"computer disc", "cd"},
+	"ce": {"computer disc cartridge", "ce"}, "cf": {"computer tape cassette", "cf"},
+	"ch": {"computer tape reel", "ch"}, "ck": {"computer card", "ck"},
+	"cr": {"online resource", "cr"},
+
+	"ha": {"aperture card", "ha"}, "hb": {"microfilm cartridge", "hb"},
+	"hc": {"microfilm cassette", "hc"}, "hd": {"microfilm reel", "hd"},
+	"he": {"microfiche", "he"}, "hf": {"microfiche cassette", "hf"},
+	"hg": {"microopaque", "hg"}, "hh": {"microfilm slip", "hh"},
+	"hj": {"microfilm roll", "hj"},
+
+	"sd": {"audio disc", "sd"}, "se": {"audio cylinder", "se"},
+	"sg": {"audio cartridge", "sg"}, "si": {"sound-track reel", "si"},
+	"sq": {"audio roll", "sq"}, "ss": {"audiocassette", "ss"},
+	"st": {"audiotape reel", "st"}, "sw": {"audio wire reel", "sw"},
+
+	"vc": {"video cartridge", "vc"}, "vd": {"videodisc", "vd"},
+	"vf": {"videocassette", "vf"}, "vr": {"videotape reel", "vr"},
+
+	"gc": {"filmstrip cartridge", "gc"}, "gd": {"filmslip", "gd"},
+	"gf": {"filmstrip", "gf"}, "go": {"filmstrip roll", "go"},
+	"gs": {"slide", "gs"}, "gt": {"overhead transparency", "gt"},
+
+	"mc": {"film cartridge", "mc"}, "mf": {"film cassette", "mf"},
+	"mo": {"film roll", "mo"}, "mr": {"film reel", "mr"},
+
+	"ad": {"volume", "nc"}, "aj": {"sheet", "nb"},
+	"kf": {"sheet", "nb"}, "kh": {"sheet", "nb"}, "kj": {"sheet", "nb"},
+	"ko": {"card", "no"}, "ta": {"volume", "nc"}, "tb": {"volume", "nc"},
+	"tc": {"volume", "nc"}, "td": {"volume", "nc"},
+}
+
+// gmdTypes maps the terms of GMDs to the content, media and carrier
+// types they call for, those they say nothing about left empty.
+var gmdTypes = map[string]struct{ content, media, carrier rdaTerm }{
+	"activity card":       {rdaTerm{"text", "txt"}, rdaTerm{"unmediated", "n"}, rdaTerm{"card", "no"}},
+	"art original":        {rdaTerm{"still image", "sti"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"art reproduction":    {rdaTerm{"still image", "sti"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"braille":             {rdaTerm{"tactile text", "tct"}, rdaTerm{"unmediated", "n"}, rdaTerm{"volume", "nc"}},
+	"chart":               {rdaTerm{"still image", "sti"}, rdaTerm{"unmediated", "n"}, rdaTerm{"sheet", "nb"}},
+	"computer file":       {rdaTerm{}, rdaTerm{"computer", "c"}, rdaTerm{}},
+	"diorama":             {rdaTerm{"three-dimensional form", "tdf"}, rdaTerm{"unmediated", "n"}, rdaTerm{"object", "nr"}},
+	"electronic resource": {rdaTerm{}, rdaTerm{"computer", "c"}, rdaTerm{}},
+	"filmstrip":           {rdaTerm{"still image", "sti"}, rdaTerm{"projected", "g"}, rdaTerm{"filmstrip", "gf"}},
+	"flash card":          {rdaTerm{"still image", "sti"}, rdaTerm{"unmediated", "n"}, rdaTerm{"card", "no"}},
+	"game":                {rdaTerm{"three-dimensional form", "tdf"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"globe":               {rdaTerm{"cartographic three-dimensional form", "crf"}, rdaTerm{"unmediated", "n"}, rdaTerm{"object", "nr"}},
+	"manuscript":          {rdaTerm{"text", "txt"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"map":                 {rdaTerm{"cartographic image", "cri"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"microform":           {rdaTerm{}, rdaTerm{"microform", "h"}, rdaTerm{}},
+	"model":               {rdaTerm{"three-dimensional form", "tdf"}, rdaTerm{"unmediated", "n"}, rdaTerm{"object", "nr"}},
+	"motion picture":      {rdaTerm{"two-dimensional moving image", "tdi"}, rdaTerm{"projected", "g"}, rdaTerm{}},
+	"music":               {rdaTerm{"notated music", "ntm"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"picture":             {rdaTerm{"still image", "sti"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"realia":              {rdaTerm{"three-dimensional form", "tdf"}, rdaTerm{"unmediated", "n"}, rdaTerm{"object", "nr"}},
+	"slide":               {rdaTerm{"still image", "sti"}, rdaTerm{"projected", "g"}, rdaTerm{"slide", "gs"}},
+	"sound recording":     {rdaTerm{}, rdaTerm{"audio", "s"}, rdaTerm{}},
+	"technical drawing":   {rdaTerm{"still image", "sti"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"text":                {rdaTerm{"text", "txt"}, rdaTerm{"unmediated", "n"}, rdaTerm{}},
+	"toy":                 {rdaTerm{"three-dimensional form", "tdf"}, rdaTerm{"unmediated", "n"}, rdaTerm{"object", "nr"}},
+	"transparency":        {rdaTerm{"still image", "sti"}, rdaTerm{"projected", "g"}, rdaTerm{"overhead transparency", "gt"}},
+	"videorecording":      {rdaTerm{"two-dimensional moving image", "tdi"}, rdaTerm{"video", "v"}, rdaTerm{}},
+}
+
+// gmdTerm returns the term of a GMD, such as "electronic resource" for
+// "[electronic resource (DVD)] :", lower cased.
+func gmdTerm(gmd string) string {
+	term := strings.TrimRight(gmd, isbdPunctuation)
+	if i := strings.IndexByte(term, '['); i >= 0 {
+		term = term[i+1:]
+	}
+	if i := strings.IndexAny(term, "]("); i >= 0 {
+		term = term[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(term))
+}
+
+// formOfItemPosition returns the position of the form of item in the
+// 008 of a record with the given leader/06.
+func formOfItemPosition(recordType byte) int {
+	switch recordType {
+	case 'e', 'f', 'g', 'k', 'o', 'r':
+		return 29
+	}
+	return 23
+}
+
+// inferredTypes returns the content, media and carrier type of a
+// record, by its GMD and then its codes, each of them nil when it
+// cannot be told.
+func inferredTypes(m *MutableRecord) (content, media, carrier *rdaTerm) {
+	if len(m.Leader) < LeaderLength {
+		return nil, nil, nil
+	}
+	content, media, carrier = codedTypes(m)
+	var gmd string
+	if f := m.FieldsByTag("245"); len(f) > 0 {
+		gmd = f[0].Subfield("h")
+	}
+	t, ok := gmdTypes[gmdTerm(gmd)]
+	if !ok {
+		return content, media, carrier
+	}
+	if t.content.code != "" {
+		content = &t.content
+	}
+	if t.media.code != "" {
+		media = &t.media
+	}
+	if t.carrier.code != "" {
+		carrier = &t.carrier
+	} else if carrier != nil && (media == nil || carrier.code[:1] != media.code) {
+		carrier = nil
+	}
+	return content, media, carrier
+}
+
+// codedTypes returns the content, media and carrier type a record's
+// leader/06, first 007 and 008 call for, each of them nil when they do
+// not tell.
+func codedTypes(m *MutableRecord) (content, media, carrier *rdaTerm) {
+	recordType := m.Leader[6]
+	var fixed, physical string
+	if f := m.FieldsByTag("008"); len(f) > 0 {
+		fixed = f[0].Value
+	}
+	if f := m.FieldsByTag("007"); len(f) > 0 {
+		physical = f[0].Value
+	}
+
+	if t, ok := rdaContentTypes[recordType]; ok {
+		switch {
+		case recordType == 'g' && len(fixed) > 33 && (fixed[33] == 'f' || fixed[33] == 's' || fixed[33] == 't'):
+			// filmstrips, slides and transparencies
+			t = rdaTerm{"still image", "sti"}
+		case recordType == 'm' && len(fixed) > 26 && fixed[26] == 'a':
+			t = rdaTerm{"computer dataset", "cod"}
+		}
+		content = &t
+	}
+
+	if len(physical) >= 2 {
+		if t, ok := rdaMediaTypes[physical[0]]; ok {
+			media = &t
+		}
+		if t, ok := rdaCarrierTypes[physical[:2]]; ok {
+			carrier = &t
+		}
+		return content, media, carrier
+	}
+
+	var form byte = ' '
+	if p := formOfItemPosition(recordType); len(fixed) > p {
+		form = fixed[p]
+	}
+	switch {
+	case form == 'o':
+		media, carrier = &rdaTerm{"computer", "c"}, &rdaTerm{"online resource", "cr"}
+	case form == 'q' || form == 's' || recordType == 'm':
+		media = &rdaTerm{"computer", "c"}
+	case form == 'b':
+		media, carrier = &rdaTerm{"microform", "h"}, &rdaTerm{"microfiche", "he"}
+	case form == 'a' || form == 'c':
+		media = &rdaTerm{"microform", "h"}
+	case recordType == 'i' || recordType == 'j':
+		media = &rdaTerm{"audio", "s"}
+	case form != ' ' && form != 'r' && form != 'd' && form != 'f' && form != '|':
+	case recordType == 'a' || recordType == 't' || recordType == 'c' || recordType == 'd':
+		media, carrier = &rdaTerm{"unmediated", "n"}, &rdaTerm{"volume", "nc"}
+	case recordType == 'e' || recordType == 'f' || recordType == 'k':
+		media, carrier = &rdaTerm{"unmediated", "n"}, &rdaTerm{"sheet", "nb"}
+	}
+	return content, media, carrier
+}
+
+type inferRule struct{}
+
+func (r inferRule) apply(m *MutableRecord) {
+	if len(m.Leader) < LeaderLength || !isBibliographicType(m.Leader[6]) {
+		return
+	}
+	content, media, carrier := inferredTypes(m)
+	for _, t := range []struct {
+		tag    string
+		term   *rdaTerm
+		source string
+	}{
+		{"336", content, "rdacontent"},
+		{"337", media, "rdamedia"},
+		{"338", carrier, "rdacarrier"},
+	} {
+		if t.term == nil || len(m.FieldsByTag(t.tag)) > 0 {
+			continue
+		}
+		m.AddField(&Field{Tag: t.tag, Indicators: "  ", Subfields: []Subfield{
+			{Code: "a", Value: t.term.term},
+			{Code: "b", Value: t.term.code},
+			{Code: "2", Value: t.source},
+		}})
+	}
+}
+
+// isBibliographicType reports whether leader/06 is that of a
+// bibliographic record.
+func isBibliographicType(recordType byte) bool {
+	switch recordType {
+	case 'a', 'c', 'd', 'e', 'f', 'g', 'i', 'j', 'k', 'm', 'o', 'p', 'r', 't':
+		return true
+	}
+	return false
+}
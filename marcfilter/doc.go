@@ -0,0 +1,40 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package marcfilter selects, filters and formats MARC 21 records, as
+// marcdump does, for programs that want to do so without running it.
+//
+// A Source supplies Records. A Selector, usually parsed from an
+// expression with ParseSelector, decides which of them are wanted; an
+// Index written for a file lets an IndexedReader read only the records
+// a selector can match. A FieldFilter cuts a record down to some of its
+// fields, and a Formatter writes records as text, MARC-in-JSON or
+// MARCXML. A Pipeline puts them together, reading a Source through
+// Filters into a Sink. A Rule registered with RegisterRule adds a check
+// to those marcdump -validate runs.
+//
+//	sel, err := marcfilter.ParseSelector(`650_a=History AND NOT ldr/06=m`)
+//	if err != nil {
+//		return err
+//	}
+//	for {
+//		record, err := source.Next()
+//		if record == nil || err != nil {
+//			return err
+//		}
+//		if sel.Match(record.MarcRecord) {
+//			...
+//		}
+//	}
+package marcfilter
@@ -0,0 +1,120 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Field filtering. A filter such as 245_a:6xx:856 restricts a record to
+// the given fields: a tag (with x as a wildcard) keeps whole fields, and
+// a tag followed by subfield codes keeps only those subfields.
+
+var ErrInvalidFieldSpec = errors.New("marcdump: invalid field specification")
+
+// Group 1: tag pattern
+// Group 2: subfield codes, or ""
+var fieldSpecRegexp = regexp.MustCompile("^([0-9A-Za-z]{3})(?:_([0-9a-z]+))?$")
+
+type fieldSpec struct {
+	pattern   string
+	subfields string
+}
+
+// A FieldFilter keeps the fields and subfields of a record that match
+// one of its specs.
+type FieldFilter struct {
+	specs []fieldSpec
+}
+
+// ParseFieldFilter parses a colon separated list of field specs.
+func ParseFieldFilter(spec string) (*FieldFilter, error) {
+	filter := new(FieldFilter)
+	for _, s := range strings.Split(spec, ":") {
+		m := fieldSpecRegexp.FindStringSubmatch(s)
+		if m == nil {
+			return nil, ErrInvalidFieldSpec
+		}
+		filter.specs = append(filter.specs, fieldSpec{m[1], m[2]})
+	}
+	return filter, nil
+}
+
+// Keep returns whether a field is kept, and which of its subfields are
+// kept ("" for all of them).
+func (ff *FieldFilter) Keep(tag string) (bool, string) {
+	kept, codes := false, ""
+	for _, spec := range ff.specs {
+		if TagMatches(spec.pattern, tag) {
+			if spec.subfields == "" {
+				return true, ""
+			}
+			kept = true
+			codes += spec.subfields
+		}
+	}
+	return kept, codes
+}
+
+// Apply returns a copy of the record holding only the fields and
+// subfields the filter keeps.
+func (ff *FieldFilter) Apply(record *Record) (*Record, error) {
+	m, err := DecodeRecord(record.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	m.RemoveFields(func(f *Field) bool {
+		kept, codes := ff.Keep(f.Tag)
+		if !kept {
+			return true
+		}
+		if codes != "" && f.Value == "" {
+			var subfields []Subfield
+			for _, sf := range f.Subfields {
+				if strings.Contains(codes, sf.Code) {
+					subfields = append(subfields, sf)
+				}
+			}
+			if len(subfields) == 0 {
+				return true
+			}
+			f.Subfields = subfields
+		}
+		return false
+	})
+
+	raw, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return ParseRecord(raw, record.Offset, record.Number)
+}
+
+// TagMatches reports whether tag matches a tag pattern such as 650 or
+// 6xx.
+func TagMatches(pattern string, tag string) bool {
+	if len(pattern) != len(tag) {
+		return false
+	}
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != 'x' && pattern[i] != 'X' && pattern[i] != tag[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// Output formats. Each format is a Formatter writing records to an
+// io.Writer. The text format lines its tags and values up in columns
+// when it writes to a tabwriter.
+
+// A Formatter writes records to the output in one format. Header is
+// called before the first record and Footer after the last one, for
+// formats that wrap the records in a collection.
+type Formatter interface {
+	Header(w io.Writer) error
+	Record(w io.Writer, record *Record) error
+	Footer(w io.Writer) error
+}
+
+// A TextFormatter prints records as tag/value lines, one per field,
+// separated by a tab.
+type TextFormatter struct {
+	// MaxWidth truncates values to that many characters, if it is
+	// greater than zero.
+	MaxWidth int
+
+	// Separator is written between records: "blank" for an empty line,
+	// "formfeed", "count" for a comment line numbering each record, or
+	// a string, which may use Go escapes.
+	Separator string
+
+	// AlignRight is set when the tabwriter right-aligns its cells. The
+	// tag is then followed by a blank cell, as right-aligning pads the
+	// tag on the left and would leave the value against it.
+	AlignRight bool
+
+	count int
+}
+
+func (f *TextFormatter) Header(w io.Writer) error {
+	return nil
+}
+
+func (f *TextFormatter) Record(w io.Writer, record *Record) error {
+	f.count++
+	switch f.Separator {
+	case "":
+	case "count":
+		fmt.Fprintf(w, "# Record %d (input record %d, offset %d)\n", f.count, record.Number, record.Offset)
+	default:
+		if f.count > 1 {
+			writeSeparator(w, f.Separator)
+		}
+	}
+
+	sep := "\t"
+	if f.AlignRight {
+		sep = "\t \t"
+	}
+	fmt.Fprintf(w, "Leader%s%s\n", sep, record.GetLeader())
+	for _, tag := range record.GetFieldList() {
+		if marc21.IsControlFieldTag(tag) {
+			v, _ := record.GetControlField(tag)
+			fmt.Fprintf(w, "%s%s%s\n", tag, sep, f.truncate(v))
+			continue
+		}
+		field, _ := record.GetDataField(tag)
+		for i := 0; i < field.ValueCount(); i++ {
+			value := field.GetIndicators(i)
+			for _, sf := range field.GetSubfields(i) {
+				value += fmt.Sprintf("$%s%s", sf, field.GetNthSubfield(sf, i))
+			}
+			fmt.Fprintf(w, "%s%s%s\n", field.Tag, sep, f.truncate(value))
+		}
+	}
+
+	// each record is lined up on its own
+	if tw, ok := w.(*tabwriter.Writer); ok {
+		return tw.Flush()
+	}
+	return nil
+}
+
+func (f *TextFormatter) Footer(w io.Writer) error {
+	return nil
+}
+
+// truncate shortens a value to MaxWidth characters, ending it with an
+// ellipsis when it was cut.
+func (f *TextFormatter) truncate(value string) string {
+	if f.MaxWidth <= 0 || utf8.RuneCountInString(value) <= f.MaxWidth {
+		return value
+	}
+	runes := []rune(value)
+	return string(runes[:f.MaxWidth-1]) + "…"
+}
+
+// writeSeparator writes the separator between two records. A tabwriter
+// turns form feeds into newlines, so the separator is escaped to reach
+// the output unchanged.
+func writeSeparator(w io.Writer, sep string) {
+	switch sep {
+	case "blank":
+		sep = "\n"
+	case "formfeed", "ff":
+		sep = "\f\n"
+	default:
+		if s, err := strconv.Unquote(`"` + sep + `"`); err == nil {
+			sep = s
+		}
+		sep += "\n"
+	}
+	if _, ok := w.(*tabwriter.Writer); !ok {
+		io.WriteString(w, sep)
+		return
+	}
+	escape := []byte{tabwriter.Escape}
+	w.Write(escape)
+	w.Write([]byte(sep))
+	w.Write(escape)
+}
@@ -0,0 +1,270 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Framing. A Framer splits an ISO 2709 stream into the raw bytes of its
+// records using the record length at the start of each leader, keeping
+// track of where in the stream each record starts. It copes with the
+// files real systems write: stray bytes between records are skipped,
+// other bytes can be taken as record terminators, the last record may
+// be allowed to miss its terminator, and with OnBad a record whose
+// length is wrong is skipped by scanning to the next record terminator
+// instead of ending the stream. Both marcdump and the Reader of a
+// Pipeline frame their records with it.
+
+// MaxRecordSize is the size of the largest record the five digit
+// record length allows.
+const MaxRecordSize = 99999
+
+// A TruncationError reports a stream that ends part way through a
+// record.
+type TruncationError struct {
+	Offset    int64 // where the incomplete record starts
+	Recovered int   // number of complete records before it
+}
+
+func (e *TruncationError) Error() string {
+	return fmt.Sprintf("input truncated in the record at offset %d: %d complete records recovered",
+		e.Offset, e.Recovered)
+}
+
+// A Framer reads the raw bytes of the records of a stream.
+type Framer struct {
+	r *bufio.Reader
+
+	// Offset is where in the stream the next record starts, and Count
+	// the number of records framed, those skipped as bad included.
+	Offset int64
+	Count  int
+
+	// OnGap, if not nil, is called with the offset and contents of any
+	// stray bytes found between records; an error from it ends the
+	// stream.
+	OnGap func(offset int64, gap []byte) error
+
+	// Terminators are bytes also taken as record terminators, and
+	// Unterminated allows the last record to be missing its terminator.
+	// The records framed end with the standard terminator either way.
+	Terminators  []byte
+	Unterminated bool
+
+	// OnBad, if not nil, is passed the offset and bytes of each record
+	// that cannot be framed, which is then skipped instead of ending the
+	// stream.
+	OnBad func(offset int64, raw []byte, err error)
+
+	// Reuse reads each record into the same buffer, so that the bytes
+	// of a frame are only good until the next is read.
+	Reuse  bool
+	buffer []byte
+
+	start int64
+}
+
+// NewFramer returns a framer of the records in r.
+func NewFramer(r io.Reader) *Framer {
+	return &Framer{r: bufio.NewReader(r)}
+}
+
+// Reader returns the buffered reader the framer reads from, for looking
+// at what comes next.
+func (f *Framer) Reader() *bufio.Reader {
+	return f.r
+}
+
+// Start returns where the record last framed started.
+func (f *Framer) Start() int64 {
+	return f.start
+}
+
+// Next returns the raw bytes of the next record, or nil at the end of
+// the stream.
+func (f *Framer) Next() ([]byte, error) {
+	var raw []byte
+	var err error
+	if f.OnBad != nil {
+		raw, err = f.nextChecked()
+	} else {
+		raw, err = f.next()
+	}
+	if raw != nil && err == nil {
+		f.Count++
+	}
+	return raw, err
+}
+
+// skipGap skips over any bytes before the start of the next record.
+// Records should follow each other directly, but broken transfers
+// leave padding or line ends between them.
+func (f *Framer) skipGap() error {
+	var gap []byte
+	for {
+		b, err := f.r.Peek(1)
+		if err == io.EOF || (err == nil && b[0] >= '0' && b[0] <= '9') {
+			break
+		} else if err != nil {
+			return err
+		}
+		f.r.ReadByte()
+		gap = append(gap, b[0])
+	}
+	if len(gap) == 0 {
+		return nil
+	}
+
+	offset := f.Offset
+	f.Offset += int64(len(gap))
+	if f.OnGap != nil {
+		return f.OnGap(offset, gap)
+	}
+	return nil
+}
+
+// next reads the raw bytes of the next record.
+func (f *Framer) next() ([]byte, error) {
+	if err := f.skipGap(); err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 5)
+	n, err := io.ReadFull(f.r, prefix)
+	if n == 0 && err == io.EOF {
+		return nil, nil
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, &TruncationError{f.Offset, f.Count}
+	} else if err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.Atoi(string(prefix))
+	if err != nil || length < LeaderLength+1 {
+		return nil, fmt.Errorf("record at offset %d: %v", f.Offset, ErrBadRecordLength)
+	}
+
+	raw := f.frameBuffer(length)
+	copy(raw, prefix)
+	read := length
+	if n, err := io.ReadFull(f.r, raw[5:]); (err == io.ErrUnexpectedEOF || err == io.EOF) && f.Unterminated && n == length-6 {
+		raw[length-1] = RecordTerminator
+		read--
+	} else if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, &TruncationError{f.Offset, f.Count}
+	} else if err != nil {
+		return nil, err
+	}
+	f.terminate(raw)
+	f.start = f.Offset
+	f.Offset += int64(read)
+	return raw, nil
+}
+
+// isTerminator reports whether a byte ends a record.
+func (f *Framer) isTerminator(b byte) bool {
+	return b == RecordTerminator || bytes.IndexByte(f.Terminators, b) >= 0
+}
+
+// terminate gives a record ending with one of the terminators accepted
+// the standard one.
+func (f *Framer) terminate(raw []byte) {
+	if end := raw[len(raw)-1]; end != RecordTerminator && f.isTerminator(end) {
+		raw[len(raw)-1] = RecordTerminator
+	}
+}
+
+// frameBuffer returns a buffer of n bytes for a record.
+func (f *Framer) frameBuffer(n int) []byte {
+	if !f.Reuse {
+		return make([]byte, n)
+	}
+	if cap(f.buffer) < n {
+		f.buffer = make([]byte, n, MaxRecordSize)
+	}
+	return f.buffer[:n]
+}
+
+// nextChecked reads the raw bytes of the next record, looking at them
+// before taking them so that a record whose length is wrong can be
+// skipped by scanning to the next record terminator instead.
+func (f *Framer) nextChecked() ([]byte, error) {
+	f.r = bufio.NewReaderSize(f.r, MaxRecordSize)
+	for {
+		if err := f.skipGap(); err != nil {
+			return nil, err
+		}
+
+		prefix, err := f.r.Peek(5)
+		if len(prefix) == 0 && err == io.EOF {
+			return nil, nil
+		} else if err == io.EOF {
+			return nil, &TruncationError{f.Offset, f.Count}
+		} else if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(string(prefix))
+		if err != nil || length < LeaderLength+1 {
+			if err := f.resync(ErrBadRecordLength); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		raw, err := f.r.Peek(length)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		read := length
+		if len(raw) == length-1 && f.Unterminated && bytes.IndexByte(raw, RecordTerminator) < 0 {
+			raw = append(append(f.frameBuffer(length)[:0], raw...), RecordTerminator)
+			read--
+		} else if len(raw) < length && bytes.IndexByte(raw, RecordTerminator) < 0 {
+			return nil, &TruncationError{f.Offset, f.Count}
+		} else if len(raw) < length || !f.isTerminator(raw[length-1]) {
+			if err := f.resync(ErrBadRecordLength); err != nil {
+				return nil, err
+			}
+			continue
+		} else {
+			raw = append(f.frameBuffer(length)[:0], raw...)
+		}
+
+		f.r.Discard(read)
+		f.terminate(raw)
+		f.start = f.Offset
+		f.Offset += int64(read)
+		return raw, nil
+	}
+}
+
+// resync skips the bytes up to and including the next record
+// terminator, passing them to OnBad. They still count as a record, so
+// that the records after them keep their numbers.
+func (f *Framer) resync(cause error) error {
+	bad, err := f.r.ReadBytes(RecordTerminator)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	f.OnBad(f.Offset, bad, fmt.Errorf("record at offset %d: %v", f.Offset, cause))
+	f.Offset += int64(len(bad))
+	f.Count++
+	return nil
+}
@@ -0,0 +1,370 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/TreeRex/marc21"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Offset indexes. An index maps the values of one field or subfield
+// (the index key, e.g. 020_a) to the byte offset and length of the
+// records containing them, so that selections on that key can seek
+// straight to the matching records instead of reading the whole file.
+//
+// On disk an index is
+//
+//    "MDIX" version(1 byte) key(string) count(uvarint) entry*
+//
+// where each entry is value(string) offset(uvarint) length(uvarint),
+// strings are a uvarint length followed by the bytes, and the entries
+// are sorted by value and then offset.
+
+const (
+	indexMagic   = "MDIX"
+	indexVersion = 1
+)
+
+var (
+	ErrBadIndex     = errors.New("marcdump: not a marcdump index file")
+	ErrIndexVersion = errors.New("marcdump: unsupported index version")
+)
+
+// An IndexEntry locates a record holding a value of the index key.
+type IndexEntry struct {
+	Value  string
+	Offset int64
+	Length int
+}
+
+// An Index holds the entries of an index file.
+type Index struct {
+	Key     string // field or field_subfield
+	Entries []IndexEntry
+}
+
+// IndexKey returns the index key for the field and subfield of a
+// selection spec, defaulting to the 001.
+func IndexKey(s *Spec) string {
+	switch {
+	case s.Field == "":
+		return "001"
+	case s.Subfield == "":
+		return s.Field
+	}
+	return s.Field + "_" + s.Subfield
+}
+
+// Lookup returns the entries whose value is exactly key.
+func (idx *Index) Lookup(key string) []IndexEntry {
+	i := sort.Search(len(idx.Entries), func(i int) bool { return idx.Entries[i].Value >= key })
+	j := i
+	for j < len(idx.Entries) && idx.Entries[j].Value == key {
+		j++
+	}
+	return idx.Entries[i:j]
+}
+
+// Sort puts the entries in the order they are written in.
+func (idx *Index) Sort() {
+	sort.Slice(idx.Entries, func(i, j int) bool {
+		a, b := &idx.Entries[i], &idx.Entries[j]
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Offset < b.Offset
+	})
+}
+
+// Write writes the index to the named file.
+func (idx *Index) Write(name string) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		w.Write(buf[:binary.PutUvarint(buf, v)])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		w.WriteString(s)
+	}
+
+	w.WriteString(indexMagic)
+	w.WriteByte(indexVersion)
+	putString(idx.Key)
+	putUvarint(uint64(len(idx.Entries)))
+	for _, e := range idx.Entries {
+		putString(e.Value)
+		putUvarint(uint64(e.Offset))
+		putUvarint(uint64(e.Length))
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadIndex reads the named index file. The sizes in it are checked
+// against the file's before anything is allocated, so that a damaged
+// file, or one that is not an index, is reported as such.
+func ReadIndex(name string) (*Index, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+
+	magic := make([]byte, len(indexMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic[:len(indexMagic)]) != indexMagic {
+		return nil, ErrBadIndex
+	}
+	if magic[len(indexMagic)] != indexVersion {
+		return nil, ErrIndexVersion
+	}
+
+	getString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		} else if n > MaxRecordSize {
+			return "", ErrBadIndex
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+
+	idx := new(Index)
+	if idx.Key, err = getString(); err != nil {
+		return nil, ErrBadIndex
+	}
+	// an entry takes at least three bytes
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(info.Size())/3 {
+		return nil, ErrBadIndex
+	}
+	idx.Entries = make([]IndexEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var e IndexEntry
+		var offset, length uint64
+		e.Value, err = getString()
+		if err == nil {
+			offset, err = binary.ReadUvarint(r)
+		}
+		if err == nil {
+			length, err = binary.ReadUvarint(r)
+		}
+		if err != nil || offset > math.MaxInt64 || length > MaxRecordSize {
+			return nil, ErrBadIndex
+		}
+		e.Offset, e.Length = int64(offset), int(length)
+		idx.Entries = append(idx.Entries, e)
+	}
+	return idx, nil
+}
+
+// RecordOffset returns where record n starts, counting the distinct
+// records in the index in file order. This only gives the right record
+// when every record has a value in the indexed field, as with an index
+// on 001.
+func (idx *Index) RecordOffset(n int) (int64, bool) {
+	offsets := make([]int64, 0, len(idx.Entries))
+	for _, e := range idx.Entries {
+		offsets = append(offsets, e.Offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	count := 0
+	for i, offset := range offsets {
+		if i > 0 && offset == offsets[i-1] {
+			continue
+		}
+		count++
+		if count == n {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// An IndexedReader reads only the records of a file whose index values
+// can match a selector, in file order.
+type IndexedReader struct {
+	file    io.ReaderAt
+	entries []IndexEntry
+}
+
+// NewIndexedReader returns a reader for the records of file that the
+// index says can match the selector. It returns nil if the index cannot
+// narrow down the records the selector matches. The selector must still
+// be applied to the records read.
+func NewIndexedReader(file io.ReaderAt, idx *Index, selector Selector) *IndexedReader {
+	return NewMultiIndexedReader(file, []*Index{idx}, selector)
+}
+
+// NewMultiIndexedReader is NewIndexedReader with several indexes on the
+// file, each spec of the selector being looked up in the index on its
+// key, if there is one. The lookups of the operands of an AND are
+// intersected, so that with indexes on 020_a and 650_a
+//
+//	020_a=^978 AND 650_a=History AND 245_a=Rome
+//
+// reads only the records in both lookups, 245_a being tested against
+// them when they are read, like the rest of the selector.
+func NewMultiIndexedReader(file io.ReaderAt, indexes []*Index, selector Selector) *IndexedReader {
+	entries, ok := selectEntries(indexes, selector)
+	if !ok {
+		return nil
+	}
+	return &IndexedReader{file, uniqueEntries(entries)}
+}
+
+// uniqueEntries sorts entries into file order, keeping one entry for
+// each record, so that a record with several matching values is only
+// read once.
+func uniqueEntries(entries []IndexEntry) []IndexEntry {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	unique := entries[:0]
+	for i, e := range entries {
+		if i == 0 || e.Offset != entries[i-1].Offset {
+			unique = append(unique, e)
+		}
+	}
+	return unique
+}
+
+// indexOn returns the index on a key, or nil.
+func indexOn(indexes []*Index, key string) *Index {
+	for _, idx := range indexes {
+		if key != "" && idx.Key == key {
+			return idx
+		}
+	}
+	return nil
+}
+
+// plannedKey returns the key of the index a spec can be tested against,
+// or "" if there is none.
+func plannedKey(s *Spec) string {
+	if s.Subfield == "" && !marc21.IsControlFieldTag(s.Field) {
+		return ""
+	}
+	return IndexKey(s)
+}
+
+// selectEntries plans the use of the indexes to evaluate a selector. It
+// returns entries such that every record the selector matches has one
+// of them, or false if the indexes cannot narrow down the records. The
+// values of a ValueSet are looked up; the criteria of selection specs
+// are tested against every value.
+//
+// A spec on a whole data field matches any of its subfields on its own,
+// while the index holds their values joined, so only specs on a control
+// field or a field_subfield are planned through an index, the rest
+// being left to the scan. An index on a key expression such as
+// 035(OCoLC) > 001 is keyed by the expression, which no term names, and
+// is never used.
+func selectEntries(indexes []*Index, sel Selector) ([]IndexEntry, bool) {
+	switch s := sel.(type) {
+	case *Spec:
+		if s.Field == "" || s.Position != nil {
+			break
+		}
+		idx := indexOn(indexes, plannedKey(s))
+		if idx == nil {
+			break
+		}
+		var entries []IndexEntry
+		for _, e := range idx.Entries {
+			if s.MatchValue(e.Value) {
+				entries = append(entries, e)
+			}
+		}
+		return entries, true
+	case *ValueSet:
+		// a value set tests whole values, as the index holds them
+		idx := indexOn(indexes, IndexKey(&Spec{Field: s.Field, Subfield: s.Subfield}))
+		if idx == nil {
+			break
+		}
+		var entries []IndexEntry
+		for v := range s.Values {
+			entries = append(entries, idx.Lookup(v)...)
+		}
+		return entries, true
+	case *And:
+		// either side narrows down the records on its own, and both
+		// together to the records in each
+		left, ok1 := selectEntries(indexes, s.Left)
+		right, ok2 := selectEntries(indexes, s.Right)
+		switch {
+		case ok1 && ok2:
+			return intersectEntries(left, right), true
+		case ok1:
+			return left, true
+		case ok2:
+			return right, true
+		}
+	case *Or:
+		left, ok1 := selectEntries(indexes, s.Left)
+		right, ok2 := selectEntries(indexes, s.Right)
+		if ok1 && ok2 {
+			return append(left, right...), true
+		}
+	}
+	return nil, false
+}
+
+// intersectEntries returns the entries of a for the records that also
+// have an entry in b.
+func intersectEntries(a, b []IndexEntry) []IndexEntry {
+	offsets := make(map[int64]bool, len(b))
+	for _, e := range b {
+		offsets[e.Offset] = true
+	}
+	var entries []IndexEntry
+	for _, e := range a {
+		if offsets[e.Offset] {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (ir *IndexedReader) Next() (*Record, error) {
+	if len(ir.entries) == 0 {
+		return nil, nil
+	}
+	e := ir.entries[0]
+	ir.entries = ir.entries[1:]
+	return ReadRecordAt(ir.file, e.Offset, e.Length)
+}
@@ -0,0 +1,171 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tempIndex writes data to an index file in a temporary directory,
+// returning its name.
+func tempIndex(t *testing.T, data []byte) string {
+	dir, err := ioutil.TempDir("", "marcfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	name := filepath.Join(dir, "test.idx")
+	if err := ioutil.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReadIndex(t *testing.T) {
+	idx := &Index{Key: "020_a", Entries: []IndexEntry{
+		{"9780743264747", 0, 330},
+		{"9780743264747", 660, 271},
+		{"2070360024", 330, 330},
+	}}
+	idx.Sort()
+	name := tempIndex(t, nil)
+	if err := idx.Write(name); err != nil {
+		t.Fatal(err)
+	}
+	good, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadIndex(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, idx) {
+		t.Errorf("read %+v, want %+v", read, idx)
+	}
+
+	// the count follows "MDIX", the version and the key "\x05020_a"
+	header := len(indexMagic) + 1 + 1 + len(idx.Key)
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"not an index", []byte("00330nam a2200109 a 4500"), ErrBadIndex},
+		{"new version", append([]byte("MDIX\x02"), good[5:]...), ErrIndexVersion},
+		{"truncated", good[:len(good)-3], ErrBadIndex},
+		{"huge count", append(append(append([]byte{}, good[:header]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f), good[header+1:]...), ErrBadIndex},
+		{"count past the end", append(append(append([]byte{}, good[:header]...), 4), good[header+1:]...), ErrBadIndex},
+		{"huge key", []byte("MDIX\x01\xff\xff\xff\xff\x0f"), ErrBadIndex},
+		{"huge length", append(append([]byte{}, good[:header]...), 1, 1, 'x', 0, 0xff, 0xff, 0x7f), ErrBadIndex},
+	}
+	for _, test := range tests {
+		if _, err := ReadIndex(tempIndex(t, test.data)); err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+// fixtureIndex indexes the fixture on a field or field_subfield the way
+// -mkindex does.
+func fixtureIndex(records []*Record, key string) *Index {
+	tag, code := key, ""
+	if len(key) > 3 {
+		tag, code = key[:3], key[4:]
+	}
+	idx := &Index{Key: key}
+	for _, r := range records {
+		for _, v := range RawFieldValues(r.Raw, tag, code) {
+			idx.Entries = append(idx.Entries, IndexEntry{v, r.Offset, len(r.Raw)})
+		}
+	}
+	idx.Sort()
+	return idx
+}
+
+// idOf returns the 001 of a fixture record.
+func idOf(r *Record) string {
+	return strings.Join(FieldValues(r.MarcRecord, "001", ""), ",")
+}
+
+func TestIndexPlanning(t *testing.T) {
+	records := readFixture(t, "selectors.mrc")
+	var indexes []*Index
+	for _, key := range []string{"001", "245", "245_a", "650", "650_x", "020_a"} {
+		indexes = append(indexes, fixtureIndex(records, key))
+	}
+	f, err := os.Open(filepath.Join("testdata", "selectors.mrc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tests := []struct {
+		selector string
+		planned  bool
+	}{
+		{"001=^fx00[12]", true},
+		{"245_a=history", true},
+		{"650_x=History OR 001=5$", true},
+		{"020_a AND 245_a=^Le", true},
+		{"245_a=^Le OR 100_a", false},
+		// the indexes on whole fields hold the subfields joined, which
+		// a spec does not test
+		{"245=^Hans", false},
+		{"650=^Fiction", false},
+		{"245=^Hans AND 001=fx00", true},
+		{"NOT 001=fx001", false},
+		{"ldr/06=a", false},
+	}
+	for _, test := range tests {
+		sel, err := ParseSelector(test.selector)
+		if err != nil {
+			t.Fatalf("%s: %v", test.selector, err)
+		}
+		var want []string
+		for _, r := range records {
+			if sel.Match(r.MarcRecord) {
+				want = append(want, idOf(r))
+			}
+		}
+		ir := NewMultiIndexedReader(f, indexes, sel)
+		if planned := ir != nil; planned != test.planned {
+			t.Errorf("%s: planned is %v, want %v", test.selector, planned, test.planned)
+		}
+		if ir == nil {
+			continue
+		}
+		var got []string
+		for {
+			r, err := ir.Next()
+			if err != nil {
+				t.Fatalf("%s: %v", test.selector, err)
+			} else if r == nil {
+				break
+			}
+			if sel.Match(r.MarcRecord) {
+				got = append(got, idOf(r))
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: the index selects %v, a scan %v", test.selector, got, want)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"io"
+)
+
+// MARC-in-JSON output: a JSON array of records, each
+//
+//    {"leader": "...",
+//     "fields": [{"001": "..."},
+//                {"245": {"ind1": "1", "ind2": "0",
+//                         "subfields": [{"a": "..."}, {"c": "..."}]}}]}
+//
+// The output is the same from run to run, so that two runs can be
+// diffed: the members of a record are always leader, fields, provenance
+// and parsed, in that order, those of a data field's value ind1, ind2
+// and subfields, and the fields and subfields keep their order in the
+// record. With Provenance the record gets a "provenance" member, beside
+// the MARC-in-JSON ones so as not to change them, giving where the
+// record is in the input and where each of its fields, in the same
+// order, is within the raw record, terminator included:
+//
+//    "provenance": {"offset": 1234, "fields": [{"offset": 61, "length": 9}, ...]}
+//
+// so that the original binary can be patched in place. A record to be
+// converted to UTF-8 is converted here, with Convert, so that the
+// positions are those of the record as read; they only match the input
+// when the record was not otherwise changed, by filtering or mapping.
+// With a Parse function the record also gets a "parsed" member holding
+// what it returns. Bare output leaves out the array, writing the record
+// objects one after another, each on a line of its own. With an Indent
+// each record is written over several lines, nested members indented.
+
+// A JSONFormatter writes records as a MARC-in-JSON array.
+type JSONFormatter struct {
+	// Provenance adds the offsets of the record and its fields.
+	Provenance bool
+
+	// Convert, if set, converts the values of a MARC-8 record, one with
+	// a blank leader/09, to UTF-8.
+	Convert func(s string) (string, error)
+
+	// Parse, if set, returns the "parsed" member of a record.
+	Parse func(m *MutableRecord) interface{}
+
+	// Bare writes the records without the array around them.
+	Bare bool
+
+	// Indent, if not empty, is written for each level of nesting, as
+	// with json.Indent; otherwise records are written compactly.
+	Indent string
+
+	count int
+}
+
+func (f *JSONFormatter) Header(w io.Writer) error {
+	if f.Bare {
+		return nil
+	}
+	_, err := w.Write([]byte("["))
+	return err
+}
+
+func (f *JSONFormatter) Record(w io.Writer, record *Record) error {
+	b, err := f.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if f.Indent != "" {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, b, "", f.Indent); err != nil {
+			return err
+		}
+		b = indented.Bytes()
+	}
+	if f.Bare {
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	if f.count > 0 {
+		w.Write([]byte(","))
+	}
+	f.count += 1
+	w.Write([]byte("\n"))
+	_, err = w.Write(b)
+	return err
+}
+
+func (f *JSONFormatter) Footer(w io.Writer) error {
+	if f.Bare {
+		return nil
+	}
+	_, err := w.Write([]byte("\n]\n"))
+	return err
+}
+
+// decode decodes a record, converting it to UTF-8 with Convert. The
+// fields keep the positions they have in the raw record.
+func (f *JSONFormatter) decode(record *Record) (*MutableRecord, error) {
+	m, err := DecodeRecord(record.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("record at offset %d: %v", record.Offset, err)
+	}
+	if f.Convert == nil || m.Leader[9] != ' ' {
+		return m, nil
+	}
+	for _, field := range m.Fields {
+		if field.Value, err = f.Convert(field.Value); err != nil {
+			return nil, fmt.Errorf("record at offset %d: %s %v", record.Offset, field.Tag, err)
+		}
+		for i := range field.Subfields {
+			if field.Subfields[i].Value, err = f.Convert(field.Subfields[i].Value); err != nil {
+				return nil, fmt.Errorf("record at offset %d: %s %v", record.Offset, field.Tag, err)
+			}
+		}
+	}
+	m.Leader[9] = 'a'
+	return m, nil
+}
+
+// Marshal returns the MARC-in-JSON encoding of a record.
+func (f *JSONFormatter) Marshal(record *Record) ([]byte, error) {
+	m, err := f.decode(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	str := func(s string) {
+		v, _ := json.Marshal(s)
+		b.Write(v)
+	}
+
+	b.WriteString(`{"leader":`)
+	str(string(m.Leader))
+	b.WriteString(`,"fields":[`)
+	for i, field := range m.Fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('{')
+		str(field.Tag)
+		b.WriteByte(':')
+		if marc21.IsControlFieldTag(field.Tag) {
+			str(field.Value)
+		} else {
+			ind1, ind2 := " ", " "
+			if len(field.Indicators) == 2 {
+				ind1, ind2 = field.Indicators[:1], field.Indicators[1:]
+			}
+			b.WriteString(`{"ind1":`)
+			str(ind1)
+			b.WriteString(`,"ind2":`)
+			str(ind2)
+			b.WriteString(`,"subfields":[`)
+			for j, sf := range field.Subfields {
+				if j > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteByte('{')
+				str(sf.Code)
+				b.WriteByte(':')
+				str(sf.Value)
+				b.WriteByte('}')
+			}
+			b.WriteString("]}")
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(']')
+	if f.Provenance {
+		fmt.Fprintf(&b, `,"provenance":{"offset":%d,"fields":[`, record.Offset)
+		for i, field := range m.Fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `{"offset":%d,"length":%d}`, field.Offset, field.Length)
+		}
+		b.WriteString("]}")
+	}
+	if f.Parse != nil {
+		v, err := json.Marshal(f.Parse(m))
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(`,"parsed":`)
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// JSON Lines output: each record as a compact JSON object on a line of
+// its own, with nothing before or after, for tools that read a record
+// at a time. A Flat record is an object of the record's values keyed
+// by tag, or tag and subfield code:
+//
+//    {"leader": "...", "001": "...", "245a": "...", "650a": ["...", "..."]}
+//
+// A key repeated in the record has an array of its values, in order.
+// The keys are in the order they first occur in the record. With
+// Provenance the record ends with a "provenance" member giving its
+// offset in the input.
+
+// An NDJSONFormatter writes records as JSON Lines.
+type NDJSONFormatter struct {
+	JSONFormatter
+
+	// Flat writes each record as an object of its values.
+	Flat bool
+}
+
+func (f *NDJSONFormatter) Header(w io.Writer) error {
+	return nil
+}
+
+func (f *NDJSONFormatter) Record(w io.Writer, record *Record) error {
+	var b []byte
+	var err error
+	if f.Flat {
+		b, err = f.MarshalFlat(record)
+	} else {
+		b, err = f.Marshal(record)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func (f *NDJSONFormatter) Footer(w io.Writer) error {
+	return nil
+}
+
+// MarshalFlat returns the flat JSON encoding of a record.
+func (f *NDJSONFormatter) MarshalFlat(record *Record) ([]byte, error) {
+	m, err := f.decode(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	values := make(map[string][]string)
+	add := func(key string, value string) {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = append(values[key], value)
+	}
+	for _, field := range m.Fields {
+		if marc21.IsControlFieldTag(field.Tag) {
+			add(field.Tag, field.Value)
+			continue
+		}
+		for _, sf := range field.Subfields {
+			add(field.Tag+sf.Code, sf.Value)
+		}
+	}
+
+	var b bytes.Buffer
+	put := func(v interface{}) {
+		s, _ := json.Marshal(v)
+		b.Write(s)
+	}
+
+	b.WriteString(`{"leader":`)
+	put(string(m.Leader))
+	for _, key := range keys {
+		b.WriteByte(',')
+		put(key)
+		b.WriteByte(':')
+		if v := values[key]; len(v) == 1 {
+			put(v[0])
+		} else {
+			put(v)
+		}
+	}
+	if f.Provenance {
+		fmt.Fprintf(&b, `,"provenance":{"offset":%d}`, record.Offset)
+	}
+	if f.Parse != nil {
+		v, err := json.Marshal(f.Parse(m))
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(`,"parsed":`)
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// jsonTestRecord returns a record at offset 100 of its input, with a
+// 245 whose $a is "Caf" and a MARC-8 acute before the "e" if marc8.
+func jsonTestRecord(t *testing.T, marc8 bool) *Record {
+	m := &MutableRecord{
+		Leader: []byte("00000nam a2200000 a 4500"),
+		Fields: []*Field{
+			{Tag: "001", Value: "j1"},
+			{Tag: "245", Indicators: "10", Subfields: []Subfield{{"a", "Café"}}},
+		},
+	}
+	if marc8 {
+		m.Leader[9] = ' '
+		m.Fields[1].Subfields[0].Value = "Caf\xe2e"
+	}
+	raw, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := ParseRecord(raw, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// convertAcute stands in for MARC-8 conversion, which makes the
+// record a byte longer.
+func convertAcute(s string) (string, error) {
+	return strings.Replace(s, "\xe2e", "e\u0301", -1), nil
+}
+
+func TestJSONFormatter(t *testing.T) {
+	// the directory has two entries, so the fields start at 24+2*12+1,
+	// and the 245 is the indicators, "\x1faCafé" and its terminator
+	tests := []struct {
+		name   string
+		f      *JSONFormatter
+		marc8  bool
+		output string
+	}{
+		{"plain", &JSONFormatter{}, false,
+			`[` + "\n" + `{"leader":"00063nam a2200049 a 4500","fields":[{"001":"j1"},{"245":{"ind1":"1","ind2":"0","subfields":[{"a":"Café"}]}}]}` + "\n]\n"},
+		{"bare", &JSONFormatter{Bare: true}, false,
+			`{"leader":"00063nam a2200049 a 4500","fields":[{"001":"j1"},{"245":{"ind1":"1","ind2":"0","subfields":[{"a":"Café"}]}}]}` + "\n"},
+		{"provenance", &JSONFormatter{Bare: true, Provenance: true}, false,
+			`{"leader":"00063nam a2200049 a 4500","fields":[{"001":"j1"},{"245":{"ind1":"1","ind2":"0","subfields":[{"a":"Café"}]}}],` +
+				`"provenance":{"offset":100,"fields":[{"offset":49,"length":3},{"offset":52,"length":10}]}}` + "\n"},
+		// the positions are those of the MARC-8 record, not of the
+		// converted one
+		{"converted provenance", &JSONFormatter{Bare: true, Provenance: true, Convert: convertAcute}, true,
+			`{"leader":"00063nam a2200049 a 4500","fields":[{"001":"j1"},{"245":{"ind1":"1","ind2":"0","subfields":[{"a":"Cafe` + "\u0301" + `"}]}}],` +
+				`"provenance":{"offset":100,"fields":[{"offset":49,"length":3},{"offset":52,"length":10}]}}` + "\n"},
+		{"parsed", &JSONFormatter{Bare: true, Parse: func(m *MutableRecord) interface{} { return len(m.Fields) }}, false,
+			`{"leader":"00063nam a2200049 a 4500","fields":[{"001":"j1"},{"245":{"ind1":"1","ind2":"0","subfields":[{"a":"Café"}]}}],"parsed":2}` + "\n"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		record := jsonTestRecord(t, test.marc8)
+		if err := test.f.Header(&b); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.f.Record(&b, record); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if err := test.f.Footer(&b); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.String(); got != test.output {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.output)
+		}
+		if !test.f.Bare && !json.Valid(b.Bytes()) {
+			t.Errorf("%s: invalid JSON", test.name)
+		}
+	}
+}
+
+func TestJSONFormatterIndent(t *testing.T) {
+	f := &JSONFormatter{Indent: "  "}
+	var b bytes.Buffer
+	f.Header(&b)
+	for i := 0; i < 2; i++ {
+		if err := f.Record(&b, jsonTestRecord(t, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Footer(&b)
+	var records []struct {
+		Leader string
+		Fields []map[string]interface{}
+	}
+	if err := json.Unmarshal(b.Bytes(), &records); err != nil {
+		t.Fatalf("%v in\n%s", err, b.String())
+	}
+	if len(records) != 2 || len(records[1].Fields) != 2 {
+		t.Errorf("read back %+v", records)
+	}
+	if !strings.Contains(b.String(), "\n  \"fields\": [\n") {
+		t.Errorf("not indented:\n%s", b.String())
+	}
+}
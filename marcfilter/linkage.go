@@ -0,0 +1,133 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Alternate graphic representation linkage. A field with a version in
+// another script has a $6 naming its 880 and an occurrence number, and
+// the 880 a $6 naming the field back with the same number:
+//
+//    245 10 $6 880-02 $a Sanguo yan yi
+//    880 10 $6 245-02/$1 $a 三國演義
+//
+// The occurrence number is unique in the record; an 880 with no field
+// to go with it has 00. The rule "renumber 880" numbers the linkages of
+// a record afresh, 01 on, in the order of the fields linked: each field
+// is paired with the first 880 naming it with its number, an 880 left
+// without one gets 00, and a $6 naming an 880 that is not there is
+// deleted.
+
+// linkageRegexp matches a $6: the tag, the occurrence number and the
+// script and orientation codes, if any.
+var linkageRegexp = regexp.MustCompile(`^([0-9]{3})-([0-9]{2,})(.*)$`)
+
+// A Linkage is a parsed $6.
+type Linkage struct {
+	Tag, Occurrence string
+	Rest            string // the script and orientation, e.g. "/$1"
+}
+
+func (l Linkage) String() string {
+	return l.Tag + "-" + l.Occurrence + l.Rest
+}
+
+// ParseLinkage parses the value of a $6.
+func ParseLinkage(s string) (Linkage, bool) {
+	m := linkageRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return Linkage{}, false
+	}
+	return Linkage{m[1], m[2], m[3]}, true
+}
+
+// linkageSubfield returns the index of the $6 of a field, or -1.
+func linkageSubfield(f *Field) int {
+	for i, sf := range f.Subfields {
+		if sf.Code == "6" {
+			return i
+		}
+	}
+	return -1
+}
+
+type renumberRule struct{}
+
+func (r renumberRule) apply(m *MutableRecord) {
+	// the 880s by the tag and number they name
+	alternates := make(map[string][]*Field)
+	for _, f := range m.Fields {
+		if f.Tag != "880" {
+			continue
+		}
+		if i := linkageSubfield(f); i >= 0 {
+			if l, ok := ParseLinkage(f.Subfields[i].Value); ok {
+				key := l.Tag + "-" + l.Occurrence
+				alternates[key] = append(alternates[key], f)
+			}
+		}
+	}
+
+	paired := make(map[*Field]bool)
+	n := 0
+	var orphans []*Field
+	for _, f := range m.Fields {
+		i := linkageSubfield(f)
+		if f.Tag == "880" || i < 0 {
+			continue
+		}
+		l, ok := ParseLinkage(f.Subfields[i].Value)
+		if !ok || l.Tag != "880" {
+			continue
+		}
+		var alt *Field
+		for _, a := range alternates[f.Tag+"-"+l.Occurrence] {
+			if !paired[a] {
+				alt = a
+				break
+			}
+		}
+		if alt == nil {
+			orphans = append(orphans, f)
+			continue
+		}
+		paired[alt] = true
+		n++
+		l.Occurrence = fmt.Sprintf("%02d", n)
+		f.Subfields[i].Value = l.String()
+		j := linkageSubfield(alt)
+		back, _ := ParseLinkage(alt.Subfields[j].Value)
+		back.Occurrence = l.Occurrence
+		alt.Subfields[j].Value = back.String()
+	}
+
+	for _, f := range orphans {
+		f.RemoveSubfields("6")
+	}
+	for _, f := range m.Fields {
+		if f.Tag != "880" || paired[f] {
+			continue
+		}
+		if j := linkageSubfield(f); j >= 0 {
+			if l, ok := ParseLinkage(f.Subfields[j].Value); ok && l.Occurrence != "00" {
+				l.Occurrence = "00"
+				f.Subfields[j].Value = l.String()
+			}
+		}
+	}
+}
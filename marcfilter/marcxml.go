@@ -0,0 +1,209 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"io"
+	"strings"
+)
+
+// MARCXML output and input. Records are written as they are selected,
+// inside a single collection element, so the whole file is never held
+// in memory. They are read back one record element at a time in the
+// same way. Bare output leaves out the XML declaration and the
+// collection, writing each record element with the namespace on it,
+// for consumers that take records one at a time or wrap them
+// themselves.
+
+const marcxmlNamespace = "http://www.loc.gov/MARC21/slim"
+
+// A MARCXMLFormatter writes records as a MARCXML collection.
+type MARCXMLFormatter struct {
+	// Bare writes the record elements without the collection.
+	Bare bool
+}
+
+func (f MARCXMLFormatter) Header(w io.Writer) error {
+	if f.Bare {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<collection xmlns=\"%s\">\n", marcxmlNamespace)
+	return err
+}
+
+func (f MARCXMLFormatter) Record(w io.Writer, record *Record) error {
+	b, err := MarshalMarcXML(record)
+	if err != nil {
+		return err
+	}
+	if f.Bare {
+		b = bytes.Replace(b, []byte("<record>"), []byte(`<record xmlns="`+marcxmlNamespace+`">`), 1)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (f MARCXMLFormatter) Footer(w io.Writer) error {
+	if f.Bare {
+		return nil
+	}
+	_, err := w.Write([]byte("</collection>\n"))
+	return err
+}
+
+// MarshalMarcXML returns the MARCXML record element for a record.
+func MarshalMarcXML(record *Record) ([]byte, error) {
+	m, err := DecodeRecord(record.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("record at offset %d: %v", record.Offset, err)
+	}
+
+	var b bytes.Buffer
+	text := func(s string) {
+		xml.EscapeText(&b, []byte(s))
+	}
+
+	b.WriteString("  <record>\n    <leader>")
+	text(string(m.Leader))
+	b.WriteString("</leader>\n")
+	for _, f := range m.Fields {
+		if marc21.IsControlFieldTag(f.Tag) {
+			b.WriteString(`    <controlfield tag="`)
+			text(f.Tag)
+			b.WriteString(`">`)
+			text(f.Value)
+			b.WriteString("</controlfield>\n")
+			continue
+		}
+
+		ind1, ind2 := " ", " "
+		if len(f.Indicators) == 2 {
+			ind1, ind2 = f.Indicators[:1], f.Indicators[1:]
+		}
+		b.WriteString(`    <datafield tag="`)
+		text(f.Tag)
+		b.WriteString(`" ind1="`)
+		text(ind1)
+		b.WriteString(`" ind2="`)
+		text(ind2)
+		b.WriteString("\">\n")
+		for _, sf := range f.Subfields {
+			b.WriteString(`      <subfield code="`)
+			text(sf.Code)
+			b.WriteString(`">`)
+			text(sf.Value)
+			b.WriteString("</subfield>\n")
+		}
+		b.WriteString("    </datafield>\n")
+	}
+	b.WriteString("  </record>\n")
+	return b.Bytes(), nil
+}
+
+// The elements of a MARCXML record, as read.
+type marcxmlRecord struct {
+	Leader        string `xml:"leader"`
+	ControlFields []struct {
+		Tag   string `xml:"tag,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"controlfield"`
+	DataFields []struct {
+		Tag       string `xml:"tag,attr"`
+		Ind1      string `xml:"ind1,attr"`
+		Ind2      string `xml:"ind2,attr"`
+		Subfields []struct {
+			Code  string `xml:"code,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"subfield"`
+	} `xml:"datafield"`
+}
+
+// IsMarcXMLRecord reports whether an element is a MARCXML record: a
+// record element in the MARCXML namespace, or in none.
+func IsMarcXMLRecord(start xml.StartElement) bool {
+	return start.Name.Local == "record" && (start.Name.Space == marcxmlNamespace || start.Name.Space == "")
+}
+
+// DecodeMarcXMLRecord decodes the MARCXML record element that starts
+// with start. The record is in UTF-8, which its leader is changed to
+// say; the control fields come before the data fields.
+func DecodeMarcXMLRecord(d *xml.Decoder, start xml.StartElement) (*MutableRecord, error) {
+	var x marcxmlRecord
+	if err := d.DecodeElement(&x, &start); err != nil {
+		return nil, err
+	}
+	leader := []byte(fmt.Sprintf("%-24.24s", x.Leader))
+	leader[9] = 'a'
+	m := &MutableRecord{Leader: leader}
+	for _, cf := range x.ControlFields {
+		m.Fields = append(m.Fields, &Field{Tag: cf.Tag, Value: cf.Value})
+	}
+	for _, df := range x.DataFields {
+		f := &Field{Tag: df.Tag, Indicators: fmt.Sprintf("%1.1s%1.1s", df.Ind1, df.Ind2)}
+		for _, sf := range df.Subfields {
+			f.Subfields = append(f.Subfields, Subfield{sf.Code, sf.Value})
+		}
+		m.Fields = append(m.Fields, f)
+	}
+	return m, nil
+}
+
+// A MarcXMLReader reads the MARCXML records of a document, wherever
+// they are in it, as ISO 2709 records.
+type MarcXMLReader struct {
+	d      *xml.Decoder
+	offset int64
+}
+
+func NewMarcXMLReader(r io.Reader) *MarcXMLReader {
+	return &MarcXMLReader{d: xml.NewDecoder(r)}
+}
+
+// Offset returns where in the document the record element of the last
+// record read starts.
+func (r *MarcXMLReader) Offset() int64 {
+	return r.offset
+}
+
+// Next returns the next record of the document, or nil at its end.
+func (r *MarcXMLReader) Next() ([]byte, error) {
+	for {
+		offset := r.d.InputOffset()
+		t, err := r.d.Token()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if start, ok := t.(xml.StartElement); ok && IsMarcXMLRecord(start) {
+			r.offset = offset
+			m, err := DecodeMarcXMLRecord(r.d, start)
+			if err != nil {
+				return nil, err
+			}
+			return m.Encode()
+		}
+	}
+}
+
+// IsMarcXML reports whether data, the start of a document, is XML
+// rather than ISO 2709.
+func IsMarcXML(data []byte) bool {
+	return strings.HasPrefix(strings.TrimLeft(string(data), " \t\r\n\ufeff"), "<")
+}
@@ -0,0 +1,137 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"io"
+	"strings"
+)
+
+// MarcEdit mnemonic input. An MRKReader reads records in the format
+// marcdump -o mrk writes, one line per field and a blank line after
+// each record:
+//
+//    =LDR  00517nam\a2200169\i\4500
+//    =001  ocm001
+//    =245  10$aTitle :$bsubtitle /$cby someone.
+//
+// Backslashes in the leader, control fields and indicators are blanks,
+// and {dollar}, {lcub}, {rcub} and {bsol} in the data are the
+// characters they name. Other mnemonics are left as they are.
+
+var ErrBadMRK = errors.New("marcdump: invalid mnemonic (.mrk) line")
+
+var mrkUnescaper = strings.NewReplacer("{dollar}", "$", "{lcub}", "{", "{rcub}", "}", "{bsol}", "\\")
+
+// An MRKReader reads the records of a mnemonic file as ISO 2709
+// records.
+type MRKReader struct {
+	r      *bufio.Reader
+	pos    int64
+	line   int
+	offset int64
+}
+
+func NewMRKReader(r io.Reader) *MRKReader {
+	return &MRKReader{r: bufio.NewReader(r)}
+}
+
+// Offset returns where in the file the =LDR line of the last record read
+// starts.
+func (r *MRKReader) Offset() int64 {
+	return r.offset
+}
+
+// Next returns the next record of the file, or nil at its end.
+func (r *MRKReader) Next() ([]byte, error) {
+	var m *MutableRecord
+	for {
+		start := r.pos
+		line, err := r.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		r.pos += int64(len(line))
+		if line != "" {
+			r.line++
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if m != nil {
+				return m.Encode()
+			} else if err == io.EOF {
+				return nil, nil
+			}
+			continue
+		}
+		if len(line) < 4 || line[0] != '=' {
+			return nil, fmt.Errorf("line %d: %v", r.line, ErrBadMRK)
+		}
+		tag, data := line[1:4], ""
+		if len(line) > 6 {
+			data = line[6:]
+		}
+
+		if tag == "LDR" {
+			if m != nil {
+				return nil, fmt.Errorf("line %d: %v", r.line, ErrBadMRK)
+			}
+			r.offset = start
+			m = &MutableRecord{Leader: []byte(fmt.Sprintf("%-24.24s", mrkBlanks(data)))}
+		} else if m == nil {
+			return nil, fmt.Errorf("line %d: a field before the leader: %v", r.line, ErrBadMRK)
+		} else if marc21.IsControlFieldTag(tag) {
+			m.Fields = append(m.Fields, &Field{Tag: tag, Value: mrkUnescaper.Replace(mrkBlanks(data))})
+		} else {
+			m.Fields = append(m.Fields, mrkDataField(tag, data))
+		}
+
+		if err == io.EOF {
+			return m.Encode()
+		}
+	}
+}
+
+// mrkBlanks turns the backslashes of fixed data back into blanks.
+func mrkBlanks(s string) string {
+	return strings.Replace(s, "\\", " ", -1)
+}
+
+// mrkDataField decodes the indicators and subfields of a data field.
+func mrkDataField(tag string, data string) *Field {
+	f := &Field{Tag: tag, Indicators: "  "}
+	if len(data) >= 2 {
+		f.Indicators = mrkBlanks(data[:2])
+		data = data[2:]
+	}
+	for _, part := range strings.Split(data, "$") {
+		if part == "" {
+			continue
+		}
+		f.Subfields = append(f.Subfields, Subfield{part[:1], mrkUnescaper.Replace(part[1:])})
+	}
+	return f
+}
+
+// IsMRK reports whether data, the start of a file, is in the mnemonic
+// format rather than ISO 2709.
+func IsMRK(data []byte) bool {
+	return strings.HasPrefix(strings.TrimLeft(string(data), " \t\r\n\ufeff"), "=LDR")
+}
@@ -0,0 +1,44 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+// Value normalization, for comparing values as a cataloger reads them
+// rather than byte for byte.
+
+// StripDiacritics drops the accents from letters, whether they were
+// recorded as combining marks or as letters with accents, and returns
+// the rest in NFC.
+func StripDiacritics(s string) string {
+	return norm.NFC.String(strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, norm.NFD.String(s)))
+}
+
+// NormalizeValue returns a value without diacritics, with single spaces
+// between its words and without the ISBD punctuation ending it, so that
+// "Einstein :" and "Einstein" compare equal.
+func NormalizeValue(s string) string {
+	s = strings.Join(strings.Fields(StripDiacritics(s)), " ")
+	return strings.TrimRight(s, " /:;,.=")
+}
@@ -0,0 +1,216 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Pipelines. A Pipeline reads the records of a Source through its
+// Filters into a Sink, as marcdump reads its inputs through the
+// selector, -map and -f into an output:
+//
+//	p := &marcfilter.Pipeline{
+//		Source:  marcfilter.NewReader(file),
+//		Filters: []marcfilter.Filter{marcfilter.Select(sel), transform, fieldFilter},
+//		Sink:    marcfilter.NewFormatterSink(os.Stdout, marcfilter.MARCXMLFormatter{}),
+//	}
+//	n, err := p.Run(ctx)
+//
+// A Transform and a FieldFilter are Filters as they are. Run stops at
+// the first error, which for a record is a *RecordError, or when the
+// context is done, and closes the sink either way.
+
+// A Filter is a stage of a pipeline. It returns the record, or a
+// changed copy of it, or nil to drop it.
+type Filter interface {
+	Apply(record *Record) (*Record, error)
+}
+
+// A FilterFunc is a function used as a Filter.
+type FilterFunc func(record *Record) (*Record, error)
+
+func (f FilterFunc) Apply(record *Record) (*Record, error) {
+	return f(record)
+}
+
+// Select returns a Filter dropping the records a selector does not
+// match.
+func Select(sel Selector) Filter {
+	return FilterFunc(func(record *Record) (*Record, error) {
+		if !sel.Match(record.MarcRecord) {
+			return nil, nil
+		}
+		return record, nil
+	})
+}
+
+// A Sink is where the records coming out of a pipeline go.
+type Sink interface {
+	Write(record *Record) error
+	Close() error
+}
+
+// A FormatterSink writes records to a writer with a Formatter, with the
+// formatter's header before the first and its footer on Close.
+type FormatterSink struct {
+	w       io.Writer
+	f       Formatter
+	started bool
+}
+
+// NewFormatterSink returns a sink writing records to w with f.
+func NewFormatterSink(w io.Writer, f Formatter) *FormatterSink {
+	return &FormatterSink{w: w, f: f}
+}
+
+func (s *FormatterSink) Write(record *Record) error {
+	if !s.started {
+		s.started = true
+		if err := s.f.Header(s.w); err != nil {
+			return err
+		}
+	}
+	return s.f.Record(s.w, record)
+}
+
+// Close writes the footer, and the header if no record was written.
+func (s *FormatterSink) Close() error {
+	if !s.started {
+		s.started = true
+		if err := s.f.Header(s.w); err != nil {
+			return err
+		}
+	}
+	return s.f.Footer(s.w)
+}
+
+// A MARCSink writes records to a writer as ISO 2709.
+type MARCSink struct {
+	w io.Writer
+}
+
+// NewMARCSink returns a sink writing the raw bytes of records to w.
+func NewMARCSink(w io.Writer) *MARCSink {
+	return &MARCSink{w: w}
+}
+
+func (s *MARCSink) Write(record *Record) error {
+	_, err := s.w.Write(record.Raw)
+	return err
+}
+
+// Close does nothing; the writer is the caller's to close.
+func (s *MARCSink) Close() error {
+	return nil
+}
+
+// A RecordError is an error a filter or the sink of a pipeline
+// returned for a record.
+type RecordError struct {
+	Number int
+	Offset int64
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d at offset %d: %v", e.Number, e.Offset, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// A Pipeline reads the records of a source through filters into a
+// sink.
+type Pipeline struct {
+	Source  Source
+	Filters []Filter
+	Sink    Sink
+}
+
+// Run passes the records of the source through the filters into the
+// sink until the source ends, one of them fails or the context is done,
+// and returns the number of records written to the sink.
+func (p *Pipeline) Run(ctx context.Context) (int, error) {
+	n, err := p.run(ctx)
+	if cerr := p.Sink.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (p *Pipeline) run(ctx context.Context) (int, error) {
+	n := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		record, err := p.Source.Next()
+		if record == nil || err != nil {
+			return n, err
+		}
+		number, offset := record.Number, record.Offset
+		for _, f := range p.Filters {
+			if record, err = f.Apply(record); err != nil {
+				return n, &RecordError{number, offset, err}
+			} else if record == nil {
+				break
+			}
+		}
+		if record == nil {
+			continue
+		}
+		if err := p.Sink.Write(record); err != nil {
+			return n, &RecordError{number, offset, err}
+		}
+		n++
+	}
+}
+
+// A Reader is a Source reading ISO 2709 records from a stream with a
+// Framer, which can be set up as marcdump sets up its own, e.g.
+//
+//	r := marcfilter.NewReader(file)
+//	r.Terminators = []byte{'\n'}
+//	r.OnBad = func(offset int64, raw []byte, err error) { log.Print(err) }
+//
+// A record that is framed but cannot be parsed is passed to OnBad and
+// skipped too, if OnBad is set.
+type Reader struct {
+	*Framer
+}
+
+// NewReader returns a reader of the records in r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{NewFramer(r)}
+}
+
+func (r *Reader) Next() (*Record, error) {
+	for {
+		raw, err := r.Framer.Next()
+		if raw == nil || err != nil {
+			return nil, err
+		}
+		record, err := ParseRecord(raw, r.Start(), r.Count)
+		if err != nil && r.OnBad != nil {
+			r.OnBad(r.Start(), raw, err)
+			continue
+		}
+		return record, err
+	}
+}
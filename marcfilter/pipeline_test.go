@@ -0,0 +1,115 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A testSink records the ids of the records written to it, failing on
+// the record with the id failOn.
+type testSink struct {
+	ids    []string
+	failOn string
+	closed bool
+}
+
+var errSink = errors.New("sink failed")
+
+func (s *testSink) Write(record *Record) error {
+	if idOf(record) == s.failOn {
+		return errSink
+	}
+	s.ids = append(s.ids, idOf(record))
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+var errFilter = errors.New("filter failed")
+
+// failOn returns a filter failing on the record with the given id.
+func failOn(id string) Filter {
+	return FilterFunc(func(record *Record) (*Record, error) {
+		if idOf(record) == id {
+			return nil, errFilter
+		}
+		return record, nil
+	})
+}
+
+func TestPipeline(t *testing.T) {
+	history, err := ParseSelector("650_x=History OR 650_a=History")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		filters []Filter
+		failOn  string // in the sink
+		ids     []string
+		err     error
+		number  int // of the record failing
+	}{
+		{"no filters", context.Background(), nil, "",
+			[]string{"fx001", "fx002", "fx003", "fx004", "ocm005"}, nil, 0},
+		{"select", context.Background(), []Filter{Select(history)}, "",
+			[]string{"fx001", "fx004", "ocm005"}, nil, 0},
+		// a record dropped by the selector never reaches the next filter
+		{"select then fail", context.Background(), []Filter{Select(history), failOn("fx002")}, "",
+			[]string{"fx001", "fx004", "ocm005"}, nil, 0},
+		{"filter error", context.Background(), []Filter{failOn("fx003")}, "",
+			[]string{"fx001", "fx002"}, errFilter, 3},
+		{"sink error", context.Background(), []Filter{Select(history)}, "fx004",
+			[]string{"fx001"}, errSink, 4},
+		{"cancelled", cancelled, nil, "", nil, context.Canceled, 0},
+	}
+	for _, test := range tests {
+		f, err := os.Open(filepath.Join("testdata", "selectors.mrc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink := &testSink{failOn: test.failOn}
+		p := &Pipeline{Source: NewReader(f), Filters: test.filters, Sink: sink}
+		n, err := p.Run(test.ctx)
+		f.Close()
+
+		if !reflect.DeepEqual(sink.ids, test.ids) || n != len(test.ids) {
+			t.Errorf("%s: wrote %d records %v, want %v", test.name, n, sink.ids, test.ids)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+		var re *RecordError
+		if errors.As(err, &re) != (test.number != 0) || (re != nil && re.Number != test.number) {
+			t.Errorf("%s: error %#v, want one for record %d", test.name, err, test.number)
+		}
+		if !sink.closed {
+			t.Errorf("%s: the sink was not closed", test.name)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Positional selection specs test character positions of the leader or
+// of a control field, or the indicators of a data field:
+//
+//    ldr/06=a        record type is language material
+//    008/35-37=eng   language code
+//    856/ind2=0      the resource itself, not a related one
+//    856_1=4         first indicator is 4, the access method HTTP
+//
+// Positions are counted from zero and ranges include both ends, as in
+// the MARC 21 documentation. The modifiers of other specs go after the
+// position, as in 008/35-37/i=ENG.
+//
+// The short form of an indicator, tag_1=v or tag_2=v, tests the
+// indicator when v is a single indicator value, a digit or # for blank,
+// and the tag is of a data field. Any
+// other criterion, or one with modifiers, is taken as one on subfield
+// $1 or $2, so 650_2=lcsh keeps meaning the source of the heading; a
+// one digit subfield value is selected with 856_1/e=4, and an indicator
+// always with ind1 or ind2.
+
+var (
+	positionSpecRegexp  = regexp.MustCompile(`^([0-9A-Za-z]{3})/(?:ind([12])|([0-9]{1,2})(?:-([0-9]{1,2}))?)(?:/([a-z]+))?(?:=(.+))?$`)
+	indicatorSpecRegexp = regexp.MustCompile(`^([0-9A-Za-z]{3})_([12])=([0-9#])$`)
+)
+
+// LeaderTag names the leader in positional specs.
+const LeaderTag = "ldr"
+
+// A Position is an indicator, or a range of character positions.
+type Position struct {
+	Indicator  int // 1 or 2, or 0 for character positions
+	Start, End int
+}
+
+func (p *Position) String() string {
+	switch {
+	case p.Indicator != 0:
+		return fmt.Sprintf("ind%d", p.Indicator)
+	case p.Start == p.End:
+		return fmt.Sprintf("%02d", p.Start)
+	}
+	return fmt.Sprintf("%02d-%02d", p.Start, p.End)
+}
+
+// parsePositionSpec parses a positional selection spec, returning nil
+// if s is not one.
+func parsePositionSpec(s string) (*Spec, error) {
+	if m := indicatorSpecRegexp.FindStringSubmatch(s); m != nil && !marc21.IsControlFieldTag(m[1]) && strings.ToLower(m[1]) != LeaderTag {
+		value := m[3]
+		if value == "#" {
+			value = " "
+		}
+		return &Spec{
+			Field:     m[1],
+			Position:  &Position{Indicator: int(m[2][0] - '0')},
+			Criterion: regexp.MustCompile(regexp.QuoteMeta(value)),
+		}, nil
+	}
+
+	m := positionSpecRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, nil
+	}
+
+	spec := &Spec{Field: m[1], Position: new(Position)}
+	isLeader := strings.ToLower(spec.Field) == LeaderTag
+	if isLeader {
+		spec.Field = LeaderTag
+	}
+	if m[2] != "" {
+		if isLeader || marc21.IsControlFieldTag(spec.Field) {
+			return nil, ErrInvalidSpec
+		}
+		spec.Position.Indicator = int(m[2][0] - '0')
+	} else {
+		if !isLeader && !marc21.IsControlFieldTag(spec.Field) {
+			return nil, ErrInvalidSpec
+		}
+		spec.Position.Start, _ = strconv.Atoi(m[3])
+		spec.Position.End = spec.Position.Start
+		if m[4] != "" {
+			spec.Position.End, _ = strconv.Atoi(m[4])
+		}
+		if spec.Position.End < spec.Position.Start {
+			return nil, ErrInvalidSpec
+		}
+	}
+	if !validModifiers(m[5]) {
+		return nil, ErrInvalidSpec
+	}
+	spec.Normalize = strings.Contains(m[5], "n")
+	if m[6] != "" {
+		re, err := compileCriterion(m[6], m[5])
+		if err != nil {
+			return nil, err
+		}
+		spec.Criterion = re
+	}
+	return spec, nil
+}
+
+// PositionValues returns the values at a spec's position in a record:
+// one for the leader or a control field, one per instance for an
+// indicator.
+func (s *Spec) PositionValues(r *marc21.MarcRecord) []string {
+	p := s.Position
+	if p.Indicator != 0 {
+		var values []string
+		field, _ := r.GetDataField(s.Field)
+		for i := 0; i < field.ValueCount(); i++ {
+			if ind := field.GetIndicators(i); len(ind) == 2 {
+				values = append(values, ind[p.Indicator-1:p.Indicator])
+			}
+		}
+		return values
+	}
+
+	var value string
+	if s.Field == LeaderTag {
+		// printed with %s, like the text output does, whatever type the
+		// marc21 package gives the leader
+		value = fmt.Sprintf("%s", r.GetLeader())
+	} else {
+		v, err := r.GetControlField(s.Field)
+		if err != nil {
+			return nil
+		}
+		value = v
+	}
+	if p.End >= len(value) {
+		return nil
+	}
+	return []string{value[p.Start : p.End+1]}
+}
+
+func (s *Spec) matchPosition(r *marc21.MarcRecord) bool {
+	for _, v := range s.PositionValues(r) {
+		if s.MatchValue(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bytes"
+	"github.com/TreeRex/marc21"
+	"strconv"
+	"strings"
+)
+
+// Working on raw records. Counting records, copying them and indexing
+// them only needs a field or two, which can be found through the
+// directory without parsing the whole record. The values found are
+// the ones FieldValues and the selectors find in a parsed record.
+
+// A RawSelector is a selector that can also test a raw record.
+type RawSelector interface {
+	Selector
+	MatchRaw(raw []byte) bool
+}
+
+// rawFields returns the contents of each instance of a field of a raw
+// record, without their terminators, or nil if the directory cannot be
+// read.
+func rawFields(raw []byte, tag string) [][]byte {
+	if len(raw) < LeaderLength+1 {
+		return nil
+	}
+	base, err := strconv.Atoi(string(raw[12:17]))
+	if err != nil || base <= LeaderLength || base > len(raw) {
+		return nil
+	}
+	var fields [][]byte
+	for i := LeaderLength; i+DirectoryEntryLength < base; i += DirectoryEntryLength {
+		entry := raw[i : i+DirectoryEntryLength]
+		if string(entry[:3]) != tag {
+			continue
+		}
+		length, err1 := strconv.Atoi(string(entry[3:7]))
+		start, err2 := strconv.Atoi(string(entry[7:12]))
+		if err1 != nil || err2 != nil || length == 0 || base+start+length > len(raw) {
+			return nil
+		}
+		fields = append(fields, bytes.TrimRight(raw[base+start:base+start+length], "\x1e"))
+	}
+	return fields
+}
+
+// rawSubfields returns the codes of the subfields of a data field in
+// order, and the value of the first subfield with each code.
+func rawSubfields(data []byte) ([]string, map[string]string) {
+	var codes []string
+	values := make(map[string]string)
+	parts := bytes.Split(data, []byte{SubfieldDelimiter})
+	for _, p := range parts[1:] {
+		if len(p) == 0 {
+			continue
+		}
+		code := string(p[:1])
+		codes = append(codes, code)
+		if _, ok := values[code]; !ok {
+			values[code] = string(p[1:])
+		}
+	}
+	return codes, values
+}
+
+// RawFieldValues is FieldValues for a raw record.
+func RawFieldValues(raw []byte, tag string, code string) []string {
+	var values []string
+	fields := rawFields(raw, tag)
+	if marc21.IsControlFieldTag(tag) {
+		if len(fields) > 0 {
+			values = append(values, string(fields[0]))
+		}
+		return values
+	}
+
+	for _, data := range fields {
+		codes, first := rawSubfields(data)
+		var v string
+		if code != "" {
+			v = first[code]
+		} else {
+			var parts []string
+			for _, c := range codes {
+				parts = append(parts, first[c])
+			}
+			v = strings.Join(parts, " ")
+		}
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// RawMatcher returns a function testing raw records against a
+// selector, or false if the selector needs the records parsed.
+func RawMatcher(sel Selector) (func(raw []byte) bool, bool) {
+	switch s := sel.(type) {
+	case RawSelector:
+		return s.MatchRaw, true
+	case *Spec:
+		if s.Position != nil {
+			break
+		}
+		return s.matchRaw, true
+	case *ValueSet:
+		return func(raw []byte) bool {
+			for _, v := range RawFieldValues(raw, s.Field, s.Subfield) {
+				if s.Values[v] {
+					return true
+				}
+			}
+			return false
+		}, true
+	case *And:
+		left, ok1 := RawMatcher(s.Left)
+		right, ok2 := RawMatcher(s.Right)
+		if ok1 && ok2 {
+			return func(raw []byte) bool { return left(raw) && right(raw) }, true
+		}
+	case *Or:
+		left, ok1 := RawMatcher(s.Left)
+		right, ok2 := RawMatcher(s.Right)
+		if ok1 && ok2 {
+			return func(raw []byte) bool { return left(raw) || right(raw) }, true
+		}
+	case *Not:
+		if operand, ok := RawMatcher(s.Operand); ok {
+			return func(raw []byte) bool { return !operand(raw) }, true
+		}
+	}
+	return nil, false
+}
+
+// matchRaw is Match for a raw record.
+func (s *Spec) matchRaw(raw []byte) bool {
+	if s.Field == "" {
+		return true
+	}
+	if marc21.IsControlFieldTag(s.Field) {
+		values := RawFieldValues(raw, s.Field, "")
+		return len(values) > 0 && s.MatchValue(values[0])
+	}
+	for _, data := range rawFields(raw, s.Field) {
+		codes, first := rawSubfields(data)
+		if s.Subfield != "" {
+			codes = []string{s.Subfield}
+		}
+		for _, code := range codes {
+			if v := first[code]; v != "" && s.MatchValue(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
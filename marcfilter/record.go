@@ -0,0 +1,263 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The marc21 package gives read-only access to a record. Code that
+// rewrites records decodes the raw bytes into a MutableRecord, changes
+// it, and encodes it back into ISO 2709 transmission format.
+
+const (
+	LeaderLength         = 24
+	DirectoryEntryLength = 12
+
+	SubfieldDelimiter = 0x1f
+	FieldTerminator   = 0x1e
+	RecordTerminator  = 0x1d
+)
+
+var (
+	ErrBadRecordLength = errors.New("marcdump: invalid record length in leader")
+	ErrBadDirectory    = errors.New("marcdump: invalid record directory")
+	ErrRecordTooLong   = errors.New("marcdump: record exceeds 99999 bytes")
+)
+
+// A Record is a parsed MARC record together with the raw ISO 2709 bytes
+// it was decoded from, the byte offset of those bytes in the input and
+// the record's position in the input, starting at 1.
+type Record struct {
+	*marc21.MarcRecord
+	Offset int64
+	Raw    []byte
+	Number int
+}
+
+// Leader returns the 24 byte record leader.
+func (r *Record) Leader() string {
+	return string(r.Raw[:LeaderLength])
+}
+
+// A Source supplies records, returning nil at the end.
+type Source interface {
+	Next() (*Record, error)
+}
+
+// ParseRecord parses the raw bytes of a record found at the given
+// offset and position in the input.
+func ParseRecord(raw []byte, offset int64, number int) (*Record, error) {
+	parsed, err := marc21.NewReader(bytes.NewReader(raw), false).Next()
+	if err != nil {
+		return nil, fmt.Errorf("record at offset %d: %v", offset, err)
+	}
+	return &Record{parsed, offset, raw, number}, nil
+}
+
+// ReadRecordAt reads the record of the given length at an offset of r,
+// as found in an index.
+func ReadRecordAt(r io.ReaderAt, offset int64, length int) (*Record, error) {
+	raw := make([]byte, length)
+	if _, err := r.ReadAt(raw, offset); err == io.EOF {
+		return nil, fmt.Errorf("record at offset %d: %v", offset, io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return nil, err
+	}
+	if n, err := strconv.Atoi(string(raw[:5])); err != nil || n != length {
+		return nil, fmt.Errorf("record at offset %d: %v", offset, ErrBadRecordLength)
+	}
+	return ParseRecord(raw, offset, 0)
+}
+
+// A Subfield is a subfield code and its value.
+type Subfield struct {
+	Code  string
+	Value string
+}
+
+// A Field is a control field or a data field of a MutableRecord.
+type Field struct {
+	Tag        string
+	Value      string // control fields only
+	Indicators string // data fields only
+	Subfields  []Subfield
+
+	// where the field was found in the raw record, including its
+	// terminator; zero for fields that were added
+	Offset int
+	Length int
+}
+
+// A MutableRecord is a record decoded into fields that can be changed.
+type MutableRecord struct {
+	Leader []byte
+	Fields []*Field
+}
+
+// DecodeRecord decodes a raw ISO 2709 record.
+func DecodeRecord(raw []byte) (*MutableRecord, error) {
+	if len(raw) < LeaderLength+1 {
+		return nil, ErrBadRecordLength
+	}
+	base, err := strconv.Atoi(string(raw[12:17]))
+	if err != nil || base <= LeaderLength || base > len(raw) {
+		return nil, ErrBadDirectory
+	}
+
+	m := &MutableRecord{Leader: append([]byte(nil), raw[:LeaderLength]...)}
+	directory := raw[LeaderLength : base-1]
+	for len(directory) >= DirectoryEntryLength {
+		entry := directory[:DirectoryEntryLength]
+		directory = directory[DirectoryEntryLength:]
+
+		length, err1 := strconv.Atoi(string(entry[3:7]))
+		start, err2 := strconv.Atoi(string(entry[7:12]))
+		if err1 != nil || err2 != nil || base+start+length > len(raw) || length == 0 {
+			return nil, ErrBadDirectory
+		}
+		data := string(bytes.TrimRight(raw[base+start:base+start+length], "\x1e"))
+		f := newFieldFromData(string(entry[:3]), data)
+		f.Offset, f.Length = base+start, length
+		m.Fields = append(m.Fields, f)
+	}
+	return m, nil
+}
+
+// newFieldFromData builds a field from the contents of a variable field,
+// without its terminator.
+func newFieldFromData(tag string, data string) *Field {
+	f := &Field{Tag: tag}
+	if marc21.IsControlFieldTag(tag) {
+		f.Value = data
+		return f
+	}
+
+	parts := strings.Split(data, "\x1f")
+	f.Indicators = parts[0]
+	for _, p := range parts[1:] {
+		if p != "" {
+			f.Subfields = append(f.Subfields, Subfield{p[:1], p[1:]})
+		}
+	}
+	return f
+}
+
+// Data returns the contents of the field as stored in the record,
+// without the field terminator.
+func (f *Field) Data() string {
+	if marc21.IsControlFieldTag(f.Tag) {
+		return f.Value
+	}
+	var b bytes.Buffer
+	b.WriteString(f.Indicators)
+	for _, sf := range f.Subfields {
+		b.WriteByte(SubfieldDelimiter)
+		b.WriteString(sf.Code)
+		b.WriteString(sf.Value)
+	}
+	return b.String()
+}
+
+// Subfield returns the value of the first subfield with the given
+// code, or "".
+func (f *Field) Subfield(code string) string {
+	for _, sf := range f.Subfields {
+		if sf.Code == code {
+			return sf.Value
+		}
+	}
+	return ""
+}
+
+// RemoveSubfields removes the subfields with the given code.
+func (f *Field) RemoveSubfields(code string) {
+	kept := f.Subfields[:0]
+	for _, sf := range f.Subfields {
+		if sf.Code != code {
+			kept = append(kept, sf)
+		}
+	}
+	f.Subfields = kept
+}
+
+// Encode serializes the record in ISO 2709 transmission format, filling
+// in the record length and base address in the leader.
+func (m *MutableRecord) Encode() ([]byte, error) {
+	var directory, data bytes.Buffer
+	for _, f := range m.Fields {
+		value := f.Data()
+		fmt.Fprintf(&directory, "%3s%04d%05d", f.Tag, len(value)+1, data.Len())
+		data.WriteString(value)
+		data.WriteByte(FieldTerminator)
+	}
+	directory.WriteByte(FieldTerminator)
+
+	base := LeaderLength + directory.Len()
+	length := base + data.Len() + 1
+	if length > 99999 {
+		return nil, ErrRecordTooLong
+	}
+
+	leader := append([]byte(nil), m.Leader...)
+	copy(leader[0:5], fmt.Sprintf("%05d", length))
+	copy(leader[12:17], fmt.Sprintf("%05d", base))
+
+	raw := make([]byte, 0, length)
+	raw = append(raw, leader...)
+	raw = append(raw, directory.Bytes()...)
+	raw = append(raw, data.Bytes()...)
+	return append(raw, RecordTerminator), nil
+}
+
+// FieldsByTag returns all the instances of the given field.
+func (m *MutableRecord) FieldsByTag(tag string) []*Field {
+	var fields []*Field
+	for _, f := range m.Fields {
+		if f.Tag == tag {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// AddField inserts a field after the last field whose tag sorts before
+// it, keeping the fields in tag order.
+func (m *MutableRecord) AddField(f *Field) {
+	i := len(m.Fields)
+	for i > 0 && m.Fields[i-1].Tag > f.Tag {
+		i--
+	}
+	m.Fields = append(m.Fields, nil)
+	copy(m.Fields[i+1:], m.Fields[i:])
+	m.Fields[i] = f
+}
+
+// RemoveFields removes the fields for which remove returns true.
+func (m *MutableRecord) RemoveFields(remove func(f *Field) bool) {
+	kept := m.Fields[:0]
+	for _, f := range m.Fields {
+		if !remove(f) {
+			kept = append(kept, f)
+		}
+	}
+	m.Fields = kept
+}
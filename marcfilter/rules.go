@@ -0,0 +1,108 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"sync"
+)
+
+// Validation rules. marcdump -validate checks each record against its
+// own rules and then against every rule registered here, reporting the
+// problems of both alike. A local policy, such as a field every record
+// of the catalog must have, is compiled in by registering its rule from
+// the init function of a package, and adding a file importing that
+// package to marcdump:
+//
+//	package localrules
+//
+//	func init() {
+//		marcfilter.RegisterRule(marcfilter.RuleFunc("local-590", func(r *marcfilter.Record) []marcfilter.Diagnostic {
+//			if len(marcfilter.FieldValues(r.MarcRecord, "590", "a")) == 0 {
+//				return []marcfilter.Diagnostic{{Tag: "590", Message: "local note is missing"}}
+//			}
+//			return nil
+//		}))
+//	}
+//
+// and in marcdump, a file local.go of
+//
+//	package main
+//
+//	import _ "example.org/localrules"
+
+// A Diagnostic is one problem a rule finds in a record. Offset is the
+// byte offset from the start of the record the problem is at, or 0 for
+// the record as a whole.
+type Diagnostic struct {
+	Tag     string
+	Offset  int64
+	Message string
+}
+
+// A Rule checks one aspect of a record. Name identifies the rule in
+// reports, and must not be that of another rule. Check may be called
+// from several goroutines at once.
+type Rule interface {
+	Name() string
+	Check(record *Record) []Diagnostic
+}
+
+type ruleFunc struct {
+	name  string
+	check func(record *Record) []Diagnostic
+}
+
+// RuleFunc returns a Rule of the given name checking records with a
+// function.
+func RuleFunc(name string, check func(record *Record) []Diagnostic) Rule {
+	return ruleFunc{name, check}
+}
+
+func (r ruleFunc) Name() string {
+	return r.name
+}
+
+func (r ruleFunc) Check(record *Record) []Diagnostic {
+	return r.check(record)
+}
+
+var (
+	rulesMu sync.Mutex
+	rules   []Rule
+)
+
+// RegisterRule adds a rule to those Rules returns. It panics if the
+// rule has no name or the name of a rule already registered.
+func RegisterRule(rule Rule) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	if rule.Name() == "" {
+		panic("marcfilter: RegisterRule of a rule without a name")
+	}
+	for _, r := range rules {
+		if r.Name() == rule.Name() {
+			panic("marcfilter: RegisterRule called twice for rule " + rule.Name())
+		}
+	}
+	rules = append(rules, rule)
+}
+
+// Rules returns the registered rules, in the order they were
+// registered.
+func Rules() []Rule {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	return append([]Rule(nil), rules...)
+}
@@ -0,0 +1,78 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"reflect"
+	"testing"
+)
+
+// needs returns a rule requiring a field.
+func needs(name, tag string) Rule {
+	return RuleFunc(name, func(r *Record) []Diagnostic {
+		if len(FieldValues(r.MarcRecord, tag, "")) == 0 {
+			return []Diagnostic{{Tag: tag, Message: tag + " is missing"}}
+		}
+		return nil
+	})
+}
+
+// registers reports whether RegisterRule panics on a rule.
+func registers(rule Rule) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	RegisterRule(rule)
+	return true
+}
+
+func TestRegisterRule(t *testing.T) {
+	before := len(Rules())
+	tests := []struct {
+		rule Rule
+		ok   bool
+	}{
+		{needs("test-020", "020"), true},
+		{needs("test-650", "650"), true},
+		{needs("test-020", "100"), false},
+		{needs("", "100"), false},
+	}
+	for _, test := range tests {
+		if ok := registers(test.rule); ok != test.ok {
+			t.Errorf("registering %q: %v, want %v", test.rule.Name(), ok, test.ok)
+		}
+	}
+
+	var names []string
+	for _, rule := range Rules()[before:] {
+		names = append(names, rule.Name())
+	}
+	if want := []string{"test-020", "test-650"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("rules %v, want %v", names, want)
+	}
+
+	// fx003 has neither an 020 nor a 650
+	records := readFixture(t, "selectors.mrc")
+	var diags []Diagnostic
+	for _, rule := range Rules()[before:] {
+		diags = append(diags, rule.Check(records[2])...)
+	}
+	want := []Diagnostic{{"020", 0, "020 is missing"}, {"650", 0, "650 is missing"}}
+	if !reflect.DeepEqual(diags, want) {
+		t.Errorf("fx003: %v, want %v", diags, want)
+	}
+}
@@ -0,0 +1,462 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"errors"
+	"github.com/TreeRex/marc21"
+	"regexp"
+	"strings"
+)
+
+// Selector expressions. A selector is a boolean expression over
+// selection specs:
+//
+//    020_a=^978 AND (650_a=History OR 651_a=History) AND NOT 245_a="[Ss]elected works"
+//
+// NOT binds tighter than AND, which binds tighter than OR. A criterion
+// containing spaces must be quoted. Parentheses inside a criterion are
+// part of its regexp as long as they balance.
+//
+// A criterion is a regexp matched anywhere in the value. Modifiers after
+// a slash change how it is compared:
+//
+//    020_a/e=9780743264747       e: the whole value, taken literally
+//    245_a/p=Einstein            p: the start of the value, literally
+//    650_a/i=history             i: ignoring case
+//    100_a/en="Muller, Hans"     n: ignoring diacritics, spacing and
+//                                   the punctuation ending the value
+//
+// e and p cannot be used together; the others combine with any.
+
+var (
+	ErrInvalidSpec      = errors.New("marcdump: invalid selector specification")
+	ErrUnbalancedParens = errors.New("marcdump: unbalanced parentheses in selector")
+	ErrMissingTerm      = errors.New("marcdump: selector expression is missing a term")
+)
+
+var (
+	// Group 1: field
+	// Group 2: subfield, or ""
+	// Group 3: specification, or ""
+	//                                    field           subfield        spec
+	SpecRegexp = regexp.MustCompile("^([0-9A-Za-z]{3})(?:_([0-9a-z]))?(?:=(.+))?$")
+
+	// Group 1: field and subfield
+	// Group 2: modifiers
+	// Group 3: =criterion, or ""
+	modifiedSpecRegexp = regexp.MustCompile("^([0-9A-Za-z]{3}(?:_[0-9a-z])?)/([a-z]+)(=.+)?$")
+)
+
+// A Selector decides whether a record is selected.
+type Selector interface {
+	Match(r *marc21.MarcRecord) bool
+}
+
+// An And selects the records both its operands select.
+type And struct {
+	Left, Right Selector
+}
+
+func (s *And) Match(r *marc21.MarcRecord) bool {
+	return s.Left.Match(r) && s.Right.Match(r)
+}
+
+// An Or selects the records either of its operands selects.
+type Or struct {
+	Left, Right Selector
+}
+
+func (s *Or) Match(r *marc21.MarcRecord) bool {
+	return s.Left.Match(r) || s.Right.Match(r)
+}
+
+// A Not selects the records its operand does not.
+type Not struct {
+	Operand Selector
+}
+
+func (s *Not) Match(r *marc21.MarcRecord) bool {
+	return !s.Operand.Match(r)
+}
+
+// A ValueSet selects the records having a field, or a subfield, with
+// one of a set of values, such as a list of control numbers.
+type ValueSet struct {
+	Field    string
+	Subfield string
+	Values   map[string]bool
+}
+
+// NewValueSet returns a ValueSet on a field, or field_subfield, such as
+// 001 or 020_a.
+func NewValueSet(key string, values []string) (*ValueSet, error) {
+	m := SpecRegexp.FindStringSubmatch(key)
+	if m == nil || m[3] != "" {
+		return nil, ErrInvalidSpec
+	}
+	s := &ValueSet{Field: m[1], Subfield: m[2], Values: make(map[string]bool)}
+	for _, v := range values {
+		s.Values[v] = true
+	}
+	return s, nil
+}
+
+func (s *ValueSet) Match(r *marc21.MarcRecord) bool {
+	for _, v := range FieldValues(r, s.Field, s.Subfield) {
+		if s.Values[v] {
+			return true
+		}
+	}
+	return false
+}
+
+// A Spec selects the records having a field, or a subfield, with a
+// value matching its criterion. The zero Spec selects every record.
+type Spec struct {
+	Field     string
+	Subfield  string
+	Position  *Position
+	Criterion *regexp.Regexp
+
+	// Normalize matches the criterion against the values as
+	// NormalizeValue returns them.
+	Normalize bool
+}
+
+// ParseSpec parses a single field selection such as 020_a=^978.
+func ParseSpec(s string) (*Spec, error) {
+	if spec, err := parsePositionSpec(s); spec != nil || err != nil {
+		return spec, err
+	}
+
+	selectionSpec := new(Spec)
+
+	var modifiers string
+	if m := modifiedSpecRegexp.FindStringSubmatch(s); m != nil {
+		s, modifiers = m[1]+m[3], m[2]
+		if !validModifiers(modifiers) {
+			return nil, ErrInvalidSpec
+		}
+		selectionSpec.Normalize = strings.Contains(modifiers, "n")
+	}
+
+	spec := SpecRegexp.FindStringSubmatch(s)
+	if spec != nil {
+		if spec[3] != "" {
+			re, err := compileCriterion(spec[3], modifiers)
+			if err != nil {
+				return nil, err
+			}
+			selectionSpec.Criterion = re
+		}
+		selectionSpec.Field = spec[1]
+		selectionSpec.Subfield = spec[2]
+	} else {
+		return nil, ErrInvalidSpec
+	}
+	return selectionSpec, nil
+}
+
+// validModifiers reports whether the modifiers of a spec, which may be
+// none, can be used together.
+func validModifiers(modifiers string) bool {
+	return strings.Trim(modifiers, "epin") == "" && !(strings.Contains(modifiers, "e") && strings.Contains(modifiers, "p"))
+}
+
+// compileCriterion compiles a criterion as its modifiers say.
+func compileCriterion(criterion string, modifiers string) (*regexp.Regexp, error) {
+	literal := criterion
+	if strings.Contains(modifiers, "n") {
+		literal = NormalizeValue(literal)
+	}
+	switch {
+	case strings.Contains(modifiers, "e"):
+		criterion = "^" + regexp.QuoteMeta(literal) + "$"
+	case strings.Contains(modifiers, "p"):
+		criterion = "^" + regexp.QuoteMeta(literal)
+	}
+	if strings.Contains(modifiers, "i") {
+		criterion = "(?i)" + criterion
+	}
+	return regexp.Compile(criterion)
+}
+
+// MatchValue reports whether a value meets the spec's criterion.
+func (s *Spec) MatchValue(v string) bool {
+	if s.Criterion == nil {
+		return true
+	}
+	if s.Normalize {
+		v = NormalizeValue(v)
+	}
+	return s.Criterion.MatchString(v)
+}
+
+func (s *Spec) Match(r *marc21.MarcRecord) bool {
+	if s.Field == "" {
+		return true
+	}
+	if s.Position != nil {
+		return s.matchPosition(r)
+	}
+
+	if marc21.IsControlFieldTag(s.Field) {
+		field, err := r.GetControlField(s.Field)
+		if err != nil {
+			return false
+		}
+		return s.MatchValue(field)
+	} else { // Data Field
+		subfields := make([]string, 1)
+
+		field, _ := r.GetDataField(s.Field)
+
+		for instance := 0; instance < field.ValueCount(); instance++ {
+			// if no subfield is specified in the spec then
+			// we want to search all of them. since these can
+			// vary per field instance we need to get the list
+			// each time.
+			if s.Subfield != "" {
+				subfields[0] = s.Subfield
+			} else {
+				subfields = field.GetSubfields(instance)
+			}
+
+			for _, subfield := range subfields {
+				sfv := field.GetNthSubfield(subfield, instance)
+				if sfv != "" {
+					// the subfield exists: need to check because the
+					// user supplied subfield may not exist in this
+					// instance
+					if s.MatchValue(sfv) {
+						// and there is no search criterion, or it
+						// matches
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+// ParseSelector parses a selector expression.
+func ParseSelector(expr string) (Selector, error) {
+	tokens, err := tokenizeSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{tokens: tokens}
+	sel, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.tokens) > 0 {
+		if p.tokens[0] == ")" {
+			return nil, ErrUnbalancedParens
+		}
+		return nil, ErrInvalidSpec
+	}
+	return sel, nil
+}
+
+// tokenizeSelector splits a selector expression into operators,
+// parentheses, and selection specs.
+func tokenizeSelector(expr string) ([]string, error) {
+	var tokens []string
+	for {
+		expr = strings.TrimLeft(expr, " \t")
+		if expr == "" {
+			return tokens, nil
+		}
+		if expr[0] == '(' || expr[0] == ')' {
+			tokens = append(tokens, expr[:1])
+			expr = expr[1:]
+			continue
+		}
+
+		// a spec runs to the next unquoted space
+		var spec []byte
+		quoted := false
+		i := 0
+		for ; i < len(expr) && (quoted || (expr[i] != ' ' && expr[i] != '\t')); i++ {
+			switch {
+			case expr[i] == '"':
+				quoted = !quoted
+			case expr[i] == '\\' && quoted && i+1 < len(expr) && expr[i+1] == '"':
+				i++
+				spec = append(spec, '"')
+			default:
+				spec = append(spec, expr[i])
+			}
+		}
+		if quoted {
+			return nil, ErrInvalidSpec
+		}
+		expr = expr[i:]
+
+		// closing parentheses the criterion doesn't account for end a
+		// group
+		closes := 0
+		for len(spec) > 0 && spec[len(spec)-1] == ')' && parenBalance(spec) < 0 {
+			spec = spec[:len(spec)-1]
+			closes++
+		}
+		tokens = append(tokens, string(spec))
+		for ; closes > 0; closes-- {
+			tokens = append(tokens, ")")
+		}
+	}
+}
+
+// parenBalance returns the number of unescaped opening parentheses in s
+// less the number of closing ones.
+func parenBalance(s []byte) int {
+	balance := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '(':
+			balance++
+		case ')':
+			balance--
+		}
+	}
+	return balance
+}
+
+type selectorParser struct {
+	tokens []string
+}
+
+func (p *selectorParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *selectorParser) parseOr() (Selector, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.tokens = p.tokens[1:]
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseAnd() (Selector, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "AND" {
+		p.tokens = p.tokens[1:]
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseNot() (Selector, error) {
+	if p.peek() == "NOT" {
+		p.tokens = p.tokens[1:]
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{operand}, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *selectorParser) parseTerm() (Selector, error) {
+	switch token := p.peek(); token {
+	case "", ")", "AND", "OR":
+		return nil, ErrMissingTerm
+	case "(":
+		p.tokens = p.tokens[1:]
+		sel, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, ErrUnbalancedParens
+		}
+		p.tokens = p.tokens[1:]
+		return sel, nil
+	default:
+		p.tokens = p.tokens[1:]
+		return ParseSpec(token)
+	}
+}
+
+// FirstTerm returns the leftmost selection spec of the AND chain at the
+// top of a selector, or nil.
+func FirstTerm(sel Selector) *Spec {
+	switch s := sel.(type) {
+	case *Spec:
+		if s.Position == nil {
+			return s
+		}
+	case *And:
+		return FirstTerm(s.Left)
+	}
+	return nil
+}
+
+// FieldValues returns the values of the given subfield in every
+// instance of a field. For control fields the code is ignored. If
+// code is "" the subfields of each instance are joined with
+// spaces.
+func FieldValues(record *marc21.MarcRecord, tag string, code string) []string {
+	var values []string
+	if marc21.IsControlFieldTag(tag) {
+		if v, err := record.GetControlField(tag); err == nil {
+			values = append(values, v)
+		}
+		return values
+	}
+
+	field, _ := record.GetDataField(tag)
+	for i := 0; i < field.ValueCount(); i++ {
+		var v string
+		if code != "" {
+			v = field.GetNthSubfield(code, i)
+		} else {
+			var parts []string
+			for _, sf := range field.GetSubfields(i) {
+				parts = append(parts, field.GetNthSubfield(sf, i))
+			}
+			v = strings.Join(parts, " ")
+		}
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
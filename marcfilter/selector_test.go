@@ -0,0 +1,126 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The fixture is the same five records as ISO 2709, MARCXML and .mrk,
+// in testdata/selectors.*.
+var selectorTests = []struct {
+	selector string
+	ids      []string
+}{
+	{"001", []string{"fx001", "fx002", "fx003", "fx004", "ocm005"}},
+	{"245_a=^[A-M]", []string{"fx004", "ocm005"}},
+	{"245_a=[$]", []string{"fx002"}},
+	{"245_a/i=HISTORY", []string{"fx002", "ocm005"}},
+	{"245_a/p=The", []string{"fx002"}},
+	{"020_a/e=9780743264747", []string{"fx001"}},
+	{`100_a/en="Muller, Hans"`, []string{"fx002"}},
+	{"650_2=gnd", []string{"fx002"}},
+	{"650_x=History OR 651_x=History", []string{"fx001", "fx002"}},
+	{"020_a AND NOT 650_v", []string{"fx001"}},
+	{"(100 OR 110) AND 245_c", []string{"fx001", "fx002"}},
+	{"NOT 001=^fx", []string{"ocm005"}},
+	{"ldr/06=j", []string{"fx003"}},
+	{"ldr/06-07=am", []string{"fx001", "fx002", "fx004"}},
+	{"ldr/07/e=s", []string{"ocm005"}},
+	{"008/35-37=eng", []string{"fx001", "fx003", "ocm005"}},
+	{"008/35-37/i=GER", []string{"fx002"}},
+	{"245/ind1=1", []string{"fx001", "fx002"}},
+	{"245/ind2=0", []string{"fx001", "fx003", "ocm005"}},
+	{"856/ind2=0", []string{"fx001"}},
+	{"856_1=4", []string{"fx001", "fx003", "fx004"}},
+	{"856_2=#", []string{"fx004"}},
+	{"856_1/e=4", []string{"fx004"}},
+	{"ldr/06=a AND 245/ind1=1", []string{"fx001", "fx002"}},
+}
+
+// readFixture reads the records of a serialization of the fixture.
+func readFixture(t *testing.T, name string) []*Record {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var next func() (*Record, error)
+	switch filepath.Ext(name) {
+	case ".mrc":
+		next = NewReader(f).Next
+	case ".xml", ".mrk":
+		var raws interface {
+			Next() ([]byte, error)
+		} = NewMarcXMLReader(f)
+		if filepath.Ext(name) == ".mrk" {
+			raws = NewMRKReader(f)
+		}
+		number := 0
+		next = func() (*Record, error) {
+			raw, err := raws.Next()
+			if raw == nil || err != nil {
+				return nil, err
+			}
+			number++
+			return ParseRecord(raw, 0, number)
+		}
+	}
+
+	var records []*Record
+	for {
+		record, err := next()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		} else if record == nil {
+			return records
+		}
+		records = append(records, record)
+	}
+}
+
+func TestSelectorsAcrossSerializations(t *testing.T) {
+	fixtures := map[string][]*Record{}
+	for _, name := range []string{"selectors.mrc", "selectors.xml", "selectors.mrk"} {
+		fixtures[name] = readFixture(t, name)
+		if n := len(fixtures[name]); n != 5 {
+			t.Fatalf("%s: read %d records, want 5", name, n)
+		}
+	}
+
+	for _, test := range selectorTests {
+		sel, err := ParseSelector(test.selector)
+		if err != nil {
+			t.Errorf("%s: %v", test.selector, err)
+			continue
+		}
+		for name, records := range fixtures {
+			var ids []string
+			for _, r := range records {
+				if sel.Match(r.MarcRecord) {
+					ids = append(ids, strings.Join(FieldValues(r.MarcRecord, "001", ""), ","))
+				}
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("%s: %s selects %v, want %v", name, test.selector, ids, test.ids)
+			}
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"io"
+	"strings"
+)
+
+// Record transformation. A transform is a list of rules, one per line,
+// applied in order to each record:
+//
+//    delete 9xx                       delete the fields (x is a wildcard)
+//    delete 650_x                     delete the subfields of the fields
+//    rename 690 to 650                change the tag of the fields
+//    copy 020_a to 024_a              add a 024 $a for each 020 $a
+//    copy 001 to 035_a                add a 035 $a holding the 001
+//    prefix 856_u with https://proxy?url=
+//    suffix 245_a with  [electronic resource]
+//    infer 33x                        add the missing 336, 337 and 338
+//    delete gmd                       delete the GMD, 245 $h
+//    renumber 880                     renumber the $6 linkages
+//
+// A prefix or suffix is the rest of the line after "with ", spaces
+// included, added to each of the subfields or to a control field.
+// Blank lines and lines starting with # are ignored. Copied and renamed
+// fields go after the fields whose tags sort before theirs; copies have
+// blank indicators. Deleting the GMD moves the punctuation it ends
+// with, which introduces the subfield after it, to the end of the one
+// before it. Renumbering the linkages is described in linkage.go.
+
+var ErrInvalidRule = errors.New("marcdump: invalid transformation rule")
+
+// isbdPunctuation is the punctuation ending a GMD, and the spaces
+// around it.
+const isbdPunctuation = " .,:;/="
+
+// A rule changes a record.
+type rule interface {
+	apply(m *MutableRecord)
+}
+
+// A Transform is a list of rules.
+type Transform struct {
+	rules []rule
+}
+
+// ParseTransform reads a transform's rules.
+func ParseTransform(r io.Reader) (*Transform, error) {
+	t := new(Transform)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if strings.TrimSpace(line) == "" || line[0] == '#' {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%v on line %d: %s", err, n, line)
+		}
+		t.rules = append(t.rules, r)
+	}
+	return t, scanner.Err()
+}
+
+// parseRule parses one line of a transform.
+func parseRule(line string) (rule, error) {
+	words := strings.Fields(line)
+	if len(words) < 2 {
+		return nil, ErrInvalidRule
+	}
+	if len(words) == 2 && words[0] == "delete" && words[1] == "gmd" {
+		return gmdRule{}, nil
+	}
+	if len(words) == 2 && words[0] == "renumber" && words[1] == "880" {
+		return renumberRule{}, nil
+	}
+	tag, code, ok := parseRuleField(words[1])
+	if !ok {
+		return nil, ErrInvalidRule
+	}
+
+	switch words[0] {
+	case "delete":
+		if len(words) == 2 {
+			return deleteRule{tag, code}, nil
+		}
+	case "rename":
+		if len(words) == 4 && words[2] == "to" && code == "" && !strings.ContainsAny(tag, "xX") {
+			to, toCode, ok := parseRuleField(words[3])
+			if ok && toCode == "" && !strings.ContainsAny(to, "xX") && marc21.IsControlFieldTag(to) == marc21.IsControlFieldTag(tag) {
+				return renameRule{tag, to}, nil
+			}
+		}
+	case "copy":
+		if len(words) == 4 && words[2] == "to" && !strings.ContainsAny(tag, "xX") && (code == "") == marc21.IsControlFieldTag(tag) {
+			to, toCode, ok := parseRuleField(words[3])
+			if ok && !strings.ContainsAny(to, "xX") && (toCode == "") == marc21.IsControlFieldTag(to) {
+				return copyRule{tag, code, to, toCode}, nil
+			}
+		}
+	case "infer":
+		if len(words) == 2 && strings.EqualFold(tag, "33x") {
+			return inferRule{}, nil
+		}
+	case "prefix", "suffix":
+		i := strings.Index(line, " with ")
+		if len(words) >= 4 && words[2] == "with" && i >= 0 {
+			return affixRule{tag, code, line[i+len(" with "):], words[0] == "suffix"}, nil
+		}
+	}
+	return nil, ErrInvalidRule
+}
+
+// parseRuleField parses a tag pattern and optional subfield code, such
+// as 9xx or 856_u.
+func parseRuleField(s string) (string, string, bool) {
+	m := fieldSpecRegexp.FindStringSubmatch(s)
+	if m == nil || len(m[2]) > 1 {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// Apply returns a copy of the record changed by each rule in turn.
+func (t *Transform) Apply(record *Record) (*Record, error) {
+	m, err := DecodeRecord(record.Raw)
+	if err != nil {
+		return nil, err
+	}
+	t.ApplyTo(m)
+	raw, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return ParseRecord(raw, record.Offset, record.Number)
+}
+
+// ApplyTo changes a decoded record by each rule in turn.
+func (t *Transform) ApplyTo(m *MutableRecord) {
+	for _, r := range t.rules {
+		r.apply(m)
+	}
+}
+
+type deleteRule struct {
+	pattern, code string
+}
+
+func (r deleteRule) apply(m *MutableRecord) {
+	m.RemoveFields(func(f *Field) bool {
+		if !TagMatches(r.pattern, f.Tag) {
+			return false
+		}
+		if r.code == "" {
+			return true
+		}
+		f.RemoveSubfields(r.code)
+		// a data field needs a subfield
+		return len(f.Subfields) == 0 && !marc21.IsControlFieldTag(f.Tag)
+	})
+}
+
+type gmdRule struct{}
+
+func (r gmdRule) apply(m *MutableRecord) {
+	for _, f := range m.FieldsByTag("245") {
+		var kept []Subfield
+		for _, sf := range f.Subfields {
+			if sf.Code != "h" {
+				kept = append(kept, sf)
+				continue
+			}
+			// "[sound recording] :" leaves " :" to the title before it
+			punct := sf.Value[len(strings.TrimRight(sf.Value, isbdPunctuation)):]
+			if p := strings.TrimSpace(punct); p != "" && len(kept) > 0 {
+				prev := &kept[len(kept)-1]
+				if !strings.HasSuffix(strings.TrimSpace(prev.Value), p) {
+					prev.Value = strings.TrimRight(prev.Value, " ") + punct
+				}
+			}
+		}
+		if len(kept) > 0 {
+			f.Subfields = kept
+		}
+	}
+}
+
+type renameRule struct {
+	from, to string
+}
+
+func (r renameRule) apply(m *MutableRecord) {
+	fields := m.FieldsByTag(r.from)
+	m.RemoveFields(func(f *Field) bool { return f.Tag == r.from })
+	for _, f := range fields {
+		f.Tag = r.to
+		m.AddField(f)
+	}
+}
+
+type copyRule struct {
+	from, fromCode string
+	to, toCode     string
+}
+
+func (r copyRule) apply(m *MutableRecord) {
+	var values []string
+	for _, f := range m.FieldsByTag(r.from) {
+		if r.fromCode == "" {
+			values = append(values, f.Value)
+			continue
+		}
+		for _, sf := range f.Subfields {
+			if sf.Code == r.fromCode {
+				values = append(values, sf.Value)
+			}
+		}
+	}
+	for _, v := range values {
+		if r.toCode == "" {
+			m.AddField(&Field{Tag: r.to, Value: v})
+		} else {
+			m.AddField(&Field{Tag: r.to, Indicators: "  ", Subfields: []Subfield{{Code: r.toCode, Value: v}}})
+		}
+	}
+}
+
+type affixRule struct {
+	pattern, code string
+	text          string
+	suffix        bool
+}
+
+func (r affixRule) apply(m *MutableRecord) {
+	affix := func(v string) string {
+		if r.suffix {
+			return v + r.text
+		}
+		return r.text + v
+	}
+	for _, f := range m.Fields {
+		if !TagMatches(r.pattern, f.Tag) {
+			continue
+		}
+		if r.code == "" {
+			if marc21.IsControlFieldTag(f.Tag) {
+				f.Value = affix(f.Value)
+			}
+			continue
+		}
+		for i := range f.Subfields {
+			if f.Subfields[i].Code == r.code {
+				f.Subfields[i].Value = affix(f.Subfields[i].Value)
+			}
+		}
+	}
+}
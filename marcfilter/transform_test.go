@@ -0,0 +1,95 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marcfilter
+
+import (
+	"strings"
+	"testing"
+)
+
+// testRecord returns a record of the given type with an 008 whose form
+// of item is form and a 245 of the given subfields, written
+// "$aTitle$h[map]".
+func testRecord(recordType byte, form byte, title string) *MutableRecord {
+	fixed := []byte("140302s2014    nyu           000 0 eng d")
+	fixed[formOfItemPosition(recordType)] = form
+	title245 := &Field{Tag: "245", Indicators: "10"}
+	for _, sf := range strings.Split(title, "$")[1:] {
+		title245.Subfields = append(title245.Subfields, Subfield{sf[:1], sf[1:]})
+	}
+	return &MutableRecord{
+		Leader: []byte("00000n" + string(recordType) + "m a2200000 a 4500"),
+		Fields: []*Field{{Tag: "001", Value: "t1"}, {Tag: "008", Value: string(fixed)}, title245},
+	}
+}
+
+// titleOf writes a 245 back the way testRecord takes it.
+func titleOf(m *MutableRecord) string {
+	var b strings.Builder
+	for _, sf := range m.FieldsByTag("245")[0].Subfields {
+		b.WriteString("$" + sf.Code + sf.Value)
+	}
+	return b.String()
+}
+
+// typesOf returns the $b codes of a record's 336, 337 and 338, "-" for
+// one it lacks.
+func typesOf(m *MutableRecord) string {
+	var codes []string
+	for _, tag := range []string{"336", "337", "338"} {
+		code := "-"
+		if f := m.FieldsByTag(tag); len(f) > 0 {
+			code = f[0].Subfield("b")
+		}
+		codes = append(codes, code)
+	}
+	return strings.Join(codes, " ")
+}
+
+func TestRDAGMDTransform(t *testing.T) {
+	transform, err := ParseTransform(strings.NewReader("infer 33x\ndelete gmd\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		recordType, form byte
+		title            string
+		want             string // 245 after the transform
+		types            string // 336, 337 and 338 codes
+	}{
+		{'a', ' ', "$aHamlet", "$aHamlet", "txt n nc"},
+		{'a', ' ', "$aHamlet$h[electronic resource] :$bthe play", "$aHamlet :$bthe play", "txt c -"},
+		{'a', 'o', "$aHamlet$h[electronic resource] /$cShakespeare.", "$aHamlet /$cShakespeare.", "txt c cr"},
+		{'a', ' ', "$aHamlet$helectronic resource :$bthe play", "$aHamlet :$bthe play", "txt c -"},
+		{'a', ' ', "$aHamlet :$h[electronic resource] :$bthe play", "$aHamlet :$bthe play", "txt c -"},
+		{'g', ' ', "$aHamlet$h[videorecording (DVD)] /$cdirected by K. Branagh.", "$aHamlet /$cdirected by K. Branagh.", "tdi v -"},
+		{'j', ' ', "$aSymphonies$h[sound recording].", "$aSymphonies.", "prm s -"},
+		{'a', ' ', "$aHamlet$h[microform]", "$aHamlet", "txt h -"},
+		{'a', 'b', "$aHamlet$h[microform]", "$aHamlet", "txt h he"},
+		{'k', ' ', "$aThe Alps$h[slide]", "$aThe Alps", "sti g gs"},
+		{'e', ' ', "$aThe Alps$h[map] ;$nsheet 2", "$aThe Alps ;$nsheet 2", "cri n nb"},
+		{'o', ' ', "$aHamlet$h[kit]", "$aHamlet", "- - -"},
+	}
+	for _, test := range tests {
+		m := testRecord(test.recordType, test.form, test.title)
+		transform.ApplyTo(m)
+		if got := titleOf(m); got != test.want {
+			t.Errorf("%s: 245 is %s, want %s", test.title, got, test.want)
+		}
+		if got := typesOf(m); got != test.types {
+			t.Errorf("%s: 33x are %s, want %s", test.title, got, test.types)
+		}
+	}
+}
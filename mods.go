@@ -0,0 +1,479 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MODS crosswalk. The commonly used part of the Library of Congress
+// MARC to MODS mapping: titles, names, type of resource, publication,
+// language, extent, notes, subjects, classification, identifiers and
+// links. -o mods writes a modsCollection, in which the records are
+// mapped by their type (see mads.go): the authority records are MADS
+// records, declaring their own namespace, which a consumer validating
+// the collection against the MODS schema has to select out, and the
+// records with no mapping are skipped with a warning.
+
+const modsNamespace = "http://www.loc.gov/mods/v3"
+
+type modsRecord struct {
+	XMLName             xml.Name             `xml:"mods"`
+	Namespace           string               `xml:"xmlns,attr,omitempty"`
+	Version             string               `xml:"version,attr"`
+	TitleInfo           []modsTitleInfo      `xml:"titleInfo"`
+	Name                []modsName           `xml:"name"`
+	TypeOfResource      string               `xml:"typeOfResource,omitempty"`
+	OriginInfo          *modsOriginInfo      `xml:"originInfo"`
+	Language            []modsLanguage       `xml:"language"`
+	PhysicalDescription *modsPhysicalDesc    `xml:"physicalDescription"`
+	Abstract            []string             `xml:"abstract"`
+	Note                []string             `xml:"note"`
+	Subject             []modsSubject        `xml:"subject"`
+	Classification      []modsAuthorityValue `xml:"classification"`
+	Identifier          []modsIdentifier     `xml:"identifier"`
+	Location            []modsLocation       `xml:"location"`
+	RelatedItem         []modsRelatedItem    `xml:"relatedItem"`
+	RecordInfo          *modsRecordInfo      `xml:"recordInfo"`
+}
+
+type modsTitleInfo struct {
+	Type       string `xml:"type,attr,omitempty"`
+	NonSort    string `xml:"nonSort,omitempty"`
+	Title      string `xml:"title"`
+	SubTitle   string `xml:"subTitle,omitempty"`
+	PartNumber string `xml:"partNumber,omitempty"`
+	PartName   string `xml:"partName,omitempty"`
+}
+
+type modsNamePart struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type modsRoleTerm struct {
+	Type      string `xml:"type,attr"`
+	Authority string `xml:"authority,attr,omitempty"`
+	Value     string `xml:",chardata"`
+}
+
+type modsName struct {
+	Type     string         `xml:"type,attr"`
+	Usage    string         `xml:"usage,attr,omitempty"`
+	NamePart []modsNamePart `xml:"namePart"`
+	Role     *modsRole      `xml:"role"`
+}
+
+type modsRole struct {
+	Terms []modsRoleTerm `xml:"roleTerm"`
+}
+
+type modsOriginInfo struct {
+	Place      []modsPlace `xml:"place"`
+	Publisher  []string    `xml:"publisher"`
+	DateIssued string      `xml:"dateIssued,omitempty"`
+	Edition    string      `xml:"edition,omitempty"`
+	Issuance   string      `xml:"issuance,omitempty"`
+}
+
+type modsPlace struct {
+	Term modsRoleTerm `xml:"placeTerm"`
+}
+
+type modsLanguage struct {
+	Term modsRoleTerm `xml:"languageTerm"`
+}
+
+type modsPhysicalDesc struct {
+	Extent []string `xml:"extent"`
+}
+
+type modsSubject struct {
+	Authority string `xml:"authority,attr,omitempty"`
+	Terms     []modsSubjectTerm
+}
+
+// A modsSubjectTerm is a topic, geographic, temporal or genre element,
+// a name element holding its nameParts or a titleInfo element holding
+// a title.
+type modsSubjectTerm struct {
+	XMLName   xml.Name
+	Type      string         `xml:"type,attr,omitempty"`
+	Value     string         `xml:",chardata"`
+	NameParts []modsNamePart `xml:"namePart"`
+	Title     string         `xml:"title,omitempty"`
+}
+
+type modsAuthorityValue struct {
+	Authority string `xml:"authority,attr,omitempty"`
+	Value     string `xml:",chardata"`
+}
+
+type modsIdentifier struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type modsLocation struct {
+	PhysicalLocation string             `xml:"physicalLocation,omitempty"`
+	ShelfLocator     string             `xml:"shelfLocator,omitempty"`
+	URL              string             `xml:"url,omitempty"`
+	HoldingSimple    *modsHoldingSimple `xml:"holdingSimple"`
+}
+
+type modsHoldingSimple struct {
+	Copy modsCopyInformation `xml:"copyInformation"`
+}
+
+type modsCopyInformation struct {
+	SubLocation  string            `xml:"subLocation,omitempty"`
+	ShelfLocator string            `xml:"shelfLocator,omitempty"`
+	Note         []string          `xml:"note"`
+	Enumeration  []modsEnumeration `xml:"enumerationAndChronology"`
+	Item         []modsIdentifier  `xml:"itemIdentifier"`
+}
+
+type modsEnumeration struct {
+	UnitType string `xml:"unitType,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// A modsRelatedItem is the record a holdings record is for.
+type modsRelatedItem struct {
+	Type       string         `xml:"type,attr"`
+	RecordInfo modsRecordInfo `xml:"recordInfo"`
+}
+
+type modsRecordInfo struct {
+	Identifier string `xml:"recordIdentifier,omitempty"`
+	Source     string `xml:"recordContentSource,omitempty"`
+	Origin     string `xml:"recordOrigin,omitempty"`
+}
+
+// modsResourceTypes maps leader/06 to the MODS type of resource.
+var modsResourceTypes = map[byte]string{
+	'a': "text", 't': "text",
+	'c': "notated music", 'd': "notated music",
+	'e': "cartographic", 'f': "cartographic",
+	'g': "moving image", 'k': "still image", 'r': "three dimensional object",
+	'i': "sound recording-nonmusical", 'j': "sound recording-musical",
+	'm': "software, multimedia", 'o': "mixed material", 'p': "mixed material",
+}
+
+// modsIssuance maps leader/07 to the MODS issuance.
+var modsIssuance = map[byte]string{
+	'a': "monographic", 'c': "monographic", 'd': "monographic", 'm': "monographic",
+	'b': "continuing", 's': "serial", 'i': "integrating resource",
+}
+
+// subjectSubdivisions maps the subdivision codes of a 6xx to MODS
+// subject elements.
+var subjectSubdivisions = map[string]string{
+	"v": "genre", "x": "topic", "y": "temporal", "z": "geographic",
+}
+
+// subfieldsOf joins the values of the given subfields of a field.
+func subfieldsOf(f *marcfilter.Field, codes string) string {
+	var parts []string
+	for _, sf := range f.Subfields {
+		if strings.Contains(codes, sf.Code) {
+			parts = append(parts, strings.TrimSpace(sf.Value))
+		}
+	}
+	return trimISBD(strings.Join(parts, " "))
+}
+
+// modsTitle maps a 245 or 246 field.
+func modsTitle(f *marcfilter.Field) modsTitleInfo {
+	t := modsTitleInfo{
+		Title:      subfieldsOf(f, "a"),
+		SubTitle:   subfieldsOf(f, "b"),
+		PartNumber: subfieldsOf(f, "n"),
+		PartName:   subfieldsOf(f, "p"),
+	}
+	if f.Tag == "245" && len(f.Indicators) == 2 {
+		if n, err := strconv.Atoi(f.Indicators[1:]); err == nil && n > 0 && n < len(t.Title) {
+			t.NonSort, t.Title = t.Title[:n], t.Title[n:]
+		}
+	} else if f.Tag == "246" {
+		t.Type = "alternative"
+	}
+	return t
+}
+
+// modsNameOf maps a 1xx or 7xx name field.
+func modsNameOf(f *marcfilter.Field) modsName {
+	n := modsName{Type: "personal"}
+	codes := "abcq"
+	switch f.Tag[1:] {
+	case "10":
+		n.Type, codes = "corporate", "abcdn"
+	case "11":
+		n.Type, codes = "conference", "acdenq"
+	}
+	if f.Tag[0] == '1' {
+		n.Usage = "primary"
+	}
+	n.NamePart = append(n.NamePart, modsNamePart{Value: subfieldsOf(f, codes)})
+	if d := f.Subfield("d"); d != "" && n.Type == "personal" {
+		n.NamePart = append(n.NamePart, modsNamePart{"date", trimISBD(d)})
+	}
+	role := new(modsRole)
+	for _, sf := range f.Subfields {
+		switch {
+		case sf.Code == "e" && n.Type != "conference":
+			role.Terms = append(role.Terms, modsRoleTerm{Type: "text", Value: cleanPart(sf.Value, parseClean)})
+		case sf.Code == "4":
+			role.Terms = append(role.Terms, modsRoleTerm{"code", "marcrelator", sf.Value})
+		}
+	}
+	if len(role.Terms) > 0 {
+		n.Role = role
+	}
+	return n
+}
+
+// modsSubjectOf maps a 6xx field, or returns false for those that have
+// no MODS mapping here.
+func modsSubjectOf(f *marcfilter.Field) (modsSubject, bool) {
+	var s modsSubject
+	if len(f.Indicators) == 2 && f.Indicators[1] == '0' {
+		s.Authority = "lcsh"
+	} else if len(f.Indicators) == 2 && f.Indicators[1] == '7' {
+		s.Authority = f.Subfield("2")
+	}
+	term := func(name, value string) {
+		if value = cleanPart(value, parseClean); value != "" {
+			s.Terms = append(s.Terms, modsSubjectTerm{XMLName: xml.Name{Local: name}, Value: value})
+		}
+	}
+
+	switch f.Tag {
+	case "600", "610", "611":
+		if name := subfieldsOf(f, "abcdq"); name != "" {
+			s.Terms = append(s.Terms, modsSubjectTerm{XMLName: xml.Name{Local: "name"}, NameParts: []modsNamePart{{Value: name}}})
+		}
+	case "650":
+		term("topic", f.Subfield("a"))
+	case "651":
+		term("geographic", f.Subfield("a"))
+	case "655":
+		term("genre", f.Subfield("a"))
+	default:
+		return s, false
+	}
+	for _, sf := range f.Subfields {
+		if name, ok := subjectSubdivisions[sf.Code]; ok {
+			term(name, sf.Value)
+		}
+	}
+	return s, len(s.Terms) > 0
+}
+
+// modsOf maps a record to MODS.
+func modsOf(m *marcfilter.MutableRecord) *modsRecord {
+	mods := &modsRecord{Version: "3.7"}
+	if len(m.Leader) >= marcfilter.LeaderLength {
+		mods.TypeOfResource = modsResourceTypes[m.Leader[6]]
+	}
+	origin := new(modsOriginInfo)
+	if len(m.Leader) >= marcfilter.LeaderLength {
+		origin.Issuance = modsIssuance[m.Leader[7]]
+	}
+	info := &modsRecordInfo{Origin: "Converted from MARC 21 by marcdump"}
+
+	for _, f := range m.Fields {
+		switch {
+		case f.Tag == "001":
+			info.Identifier = strings.TrimSpace(f.Value)
+		case f.Tag == "003":
+			info.Source = strings.TrimSpace(f.Value)
+		case f.Tag == "008":
+			if len(f.Value) >= 38 && strings.TrimSpace(f.Value[35:38]) != "" {
+				mods.Language = append(mods.Language, modsLanguage{modsRoleTerm{"code", "iso639-2b", f.Value[35:38]}})
+			}
+			if origin.DateIssued == "" && len(f.Value) >= 11 {
+				origin.DateIssued = strings.TrimSpace(f.Value[7:11])
+			}
+		case f.Tag == "010":
+			if v := strings.TrimSpace(f.Subfield("a")); v != "" {
+				mods.Identifier = append(mods.Identifier, modsIdentifier{"lccn", v})
+			}
+		case f.Tag == "020":
+			if v := isbnRegexp.FindString(f.Subfield("a")); v != "" {
+				mods.Identifier = append(mods.Identifier, modsIdentifier{"isbn", v})
+			}
+		case f.Tag == "022":
+			if v := trimISBD(f.Subfield("a")); v != "" {
+				mods.Identifier = append(mods.Identifier, modsIdentifier{"issn", v})
+			}
+		case f.Tag == "035":
+			if v := f.Subfield("a"); strings.HasPrefix(v, "(OCoLC)") {
+				mods.Identifier = append(mods.Identifier, modsIdentifier{"oclc", strings.TrimPrefix(v, "(OCoLC)")})
+			}
+		case f.Tag == "050":
+			if v := subfieldsOf(f, "ab"); v != "" {
+				mods.Classification = append(mods.Classification, modsAuthorityValue{"lcc", v})
+			}
+		case f.Tag == "082":
+			if v := subfieldsOf(f, "a"); v != "" {
+				mods.Classification = append(mods.Classification, modsAuthorityValue{"ddc", v})
+			}
+		case f.Tag == "100" || f.Tag == "110" || f.Tag == "111" ||
+			f.Tag == "700" || f.Tag == "710" || f.Tag == "711":
+			mods.Name = append(mods.Name, modsNameOf(f))
+		case f.Tag == "245" || f.Tag == "246":
+			mods.TitleInfo = append(mods.TitleInfo, modsTitle(f))
+		case f.Tag == "250":
+			origin.Edition = subfieldsOf(f, "a")
+		case f.Tag == "260" || f.Tag == "264" && len(f.Indicators) == 2 && f.Indicators[1] == '1':
+			for _, sf := range f.Subfields {
+				switch sf.Code {
+				case "a":
+					origin.Place = append(origin.Place, modsPlace{modsRoleTerm{Type: "text", Value: trimISBD(sf.Value)}})
+				case "b":
+					origin.Publisher = append(origin.Publisher, trimISBD(sf.Value))
+				case "c":
+					if year := yearRegexp.FindString(sf.Value); year != "" {
+						origin.DateIssued = year
+					}
+				}
+			}
+		case f.Tag == "300":
+			if v := subfieldsOf(f, "abc"); v != "" {
+				if mods.PhysicalDescription == nil {
+					mods.PhysicalDescription = new(modsPhysicalDesc)
+				}
+				mods.PhysicalDescription.Extent = append(mods.PhysicalDescription.Extent, v)
+			}
+		case f.Tag == "500":
+			if v := strings.TrimSpace(f.Subfield("a")); v != "" {
+				mods.Note = append(mods.Note, v)
+			}
+		case f.Tag == "520":
+			if v := strings.TrimSpace(f.Subfield("a")); v != "" {
+				mods.Abstract = append(mods.Abstract, v)
+			}
+		case f.Tag[0] == '6':
+			if s, ok := modsSubjectOf(f); ok {
+				mods.Subject = append(mods.Subject, s)
+			}
+		case f.Tag == "856":
+			if u := f.Subfield("u"); u != "" {
+				mods.Location = append(mods.Location, modsLocation{URL: u})
+			}
+		}
+	}
+
+	if origin.DateIssued != "" || len(origin.Place) > 0 || len(origin.Publisher) > 0 || origin.Edition != "" || origin.Issuance != "" {
+		mods.OriginInfo = origin
+	}
+	mods.RecordInfo = info
+	return mods
+}
+
+// modsHoldingsOf maps a holdings record to MODS: each 852 to a location
+// with its shelf location, the summary holdings (866-868) and the item
+// barcodes (876-878) to the copy information of the first, and the
+// bibliographic record (004) to the host item.
+func modsHoldingsOf(m *marcfilter.MutableRecord) *modsRecord {
+	mods := &modsRecord{Version: "3.7"}
+	info := &modsRecordInfo{Origin: "Converted from MARC 21 by marcdump"}
+	var enumeration []modsEnumeration
+	var items []modsIdentifier
+
+	for _, f := range m.Fields {
+		switch f.Tag {
+		case "001":
+			info.Identifier = strings.TrimSpace(f.Value)
+		case "003":
+			info.Source = strings.TrimSpace(f.Value)
+		case "004":
+			if v := strings.TrimSpace(f.Value); v != "" {
+				mods.RelatedItem = append(mods.RelatedItem, modsRelatedItem{"host", modsRecordInfo{Identifier: v}})
+			}
+		case "852":
+			l := modsLocation{
+				PhysicalLocation: subfieldsOf(f, "ab"),
+				ShelfLocator:     subfieldsOf(f, "khim"),
+				HoldingSimple:    new(modsHoldingSimple),
+			}
+			l.HoldingSimple.Copy.SubLocation = subfieldsOf(f, "c")
+			l.HoldingSimple.Copy.ShelfLocator = l.ShelfLocator
+			for _, sf := range f.Subfields {
+				if sf.Code == "z" {
+					l.HoldingSimple.Copy.Note = append(l.HoldingSimple.Copy.Note, strings.TrimSpace(sf.Value))
+				}
+			}
+			mods.Location = append(mods.Location, l)
+		case "866", "867", "868":
+			if v := subfieldsOf(f, "a"); v != "" {
+				// 866 is the basic unit, 867 supplements and 868 indexes
+				enumeration = append(enumeration, modsEnumeration{strconv.Itoa(int(f.Tag[2] - '5')), v})
+			}
+		case "876", "877", "878":
+			if v := strings.TrimSpace(f.Subfield("p")); v != "" {
+				items = append(items, modsIdentifier{"barcode", v})
+			}
+		case "856":
+			if u := f.Subfield("u"); u != "" {
+				mods.Location = append(mods.Location, modsLocation{URL: u})
+			}
+		}
+	}
+
+	if len(enumeration) > 0 || len(items) > 0 {
+		if len(mods.Location) == 0 || mods.Location[0].HoldingSimple == nil {
+			mods.Location = append([]modsLocation{{HoldingSimple: new(modsHoldingSimple)}}, mods.Location...)
+		}
+		c := &mods.Location[0].HoldingSimple.Copy
+		c.Enumeration, c.Item = enumeration, items
+	}
+	mods.RecordInfo = info
+	return mods
+}
+
+// A modsFormatter writes records as a MODS collection.
+type modsFormatter struct{}
+
+func (f modsFormatter) Header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<modsCollection xmlns=\"%s\">\n", modsNamespace)
+	return err
+}
+
+func (f modsFormatter) Record(w io.Writer, record *marcfilter.Record) error {
+	if crosswalkOf(record.Leader()) == "" {
+		fmt.Fprintf(os.Stderr, "Warning: record at offset %d skipped: %v for %s records\n",
+			record.Offset, errNoCrosswalk, formatNames[recordFormat(record.Leader())])
+		return nil
+	}
+	b, err := marshalCrosswalk(record, false)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (f modsFormatter) Footer(w io.Writer) error {
+	_, err := w.Write([]byte("</modsCollection>\n"))
+	return err
+}
@@ -0,0 +1,73 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"strings"
+)
+
+// The MarcEdit mnemonic format, -o mrk, which is how records are
+// usually shown and edited when reporting a problem:
+//
+//    =LDR  00517nam\a2200169\i\4500
+//    =001  ocm001
+//    =245  10$aTitle :$bsubtitle /$cby someone.
+//
+// Blanks in the leader, control fields and indicators are written as
+// backslashes, and a dollar sign or brace in the data as {dollar},
+// {lcub} or {rcub}. The data is written as it is encoded in the record.
+
+var mrkEscaper = strings.NewReplacer("$", "{dollar}", "{", "{lcub}", "}", "{rcub}")
+
+// mrkFixed writes the blanks of fixed data as backslashes.
+func mrkFixed(s string) string {
+	return strings.Replace(s, " ", "\\", -1)
+}
+
+type mrkFormatter struct{}
+
+func (mrkFormatter) Header(w io.Writer) error {
+	return nil
+}
+
+func (mrkFormatter) Record(w io.Writer, record *marcfilter.Record) error {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+	}
+	fmt.Fprintf(w, "=LDR  %s\n", mrkFixed(string(m.Leader)))
+	for _, f := range m.Fields {
+		if marc21.IsControlFieldTag(f.Tag) {
+			fmt.Fprintf(w, "=%s  %s\n", f.Tag, mrkFixed(mrkEscaper.Replace(f.Value)))
+			continue
+		}
+		var b strings.Builder
+		b.WriteString(mrkFixed(f.Indicators))
+		for _, sf := range f.Subfields {
+			b.WriteString("$" + sf.Code + mrkEscaper.Replace(sf.Value))
+		}
+		fmt.Fprintf(w, "=%s  %s\n", f.Tag, b.String())
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+func (mrkFormatter) Footer(w io.Writer) error {
+	return nil
+}
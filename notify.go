@@ -0,0 +1,172 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Run notifications, for scheduled jobs. -notify URL posts a summary
+// of the run as JSON to a webhook once the run is over, whether it got
+// to the end, was interrupted or stopped at an error:
+//
+//    {"command":["marcdump","-validate","text","-sink","errors=run.log","weekly.mrc"],
+//     "inputs":["weekly.mrc"],"started":"2014-03-02T02:00:00Z",
+//     "finished":"2014-03-02T02:41:07Z","seconds":2467.2,
+//     "last_record":481220,"selected":481220,"complete":true,
+//     "interrupted":false,"exit_status":0}
+//
+// with an "error" as well if there was one. -notify-errors attaches the
+// error report of the errors=file -sink, posting a multipart/form-data
+// request of the summary, as the part "summary", and the report, as the
+// file "errors". A notification that cannot be sent is a warning; it
+// does not change how the run ends.
+
+var errNotifyErrors = errors.New("marcdump: -notify-errors needs an errors=file -sink to attach")
+
+// errorSinkName is the file of the errors=file -sink, if there is one.
+var errorSinkName string
+
+// A runSummary is the machine readable summary of a run.
+type runSummary struct {
+	Command     []string  `json:"command"`
+	Inputs      []string  `json:"inputs"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Seconds     float64   `json:"seconds"`
+	LastRecord  int       `json:"last_record"`
+	Selected    uint      `json:"selected"`
+	Complete    bool      `json:"complete"`
+	Interrupted bool      `json:"interrupted"`
+	ExitStatus  int       `json:"exit_status"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// A notifier posts the summary of the run to a webhook.
+type notifier struct {
+	url     string
+	errors  bool
+	summary runSummary
+}
+
+// startNotify starts the summary of the run, to be posted to url when
+// the run is over.
+func startNotify(url string, attachErrors bool, inputs []string) (*notifier, error) {
+	if attachErrors && errorSinkName == "" {
+		return nil, errNotifyErrors
+	}
+	return &notifier{url: url, errors: attachErrors, summary: runSummary{
+		Command: os.Args,
+		Inputs:  inputs,
+		Started: time.Now().UTC(),
+	}}, nil
+}
+
+// read notes a record read.
+func (n *notifier) read(number int) {
+	if number > n.summary.LastRecord {
+		n.summary.LastRecord = number
+	}
+}
+
+// finish posts the summary of the run, warning on the standard error if
+// it could not be.
+func (n *notifier) finish(selected uint, complete bool, exitStatus int, err error) {
+	s := &n.summary
+	s.Finished = time.Now().UTC()
+	s.Seconds = s.Finished.Sub(s.Started).Seconds()
+	s.Selected = selected
+	s.Complete = complete
+	s.Interrupted = wasInterrupted()
+	s.ExitStatus = exitStatus
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if err := n.post(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: -notify: %v\n", err)
+	}
+}
+
+func (n *notifier) post() error {
+	summary, err := json.Marshal(&n.summary)
+	if err != nil {
+		return err
+	}
+	body, contentType := bytes.NewReader(summary), "application/json"
+	if n.errors {
+		var b bytes.Buffer
+		if contentType, err = attachErrorReport(&b, summary); err != nil {
+			return err
+		}
+		body = bytes.NewReader(b.Bytes())
+	}
+
+	req, err := http.NewRequest("POST", n.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", fetchUserAgent)
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+// attachErrorReport writes a multipart form of the summary and the
+// error report, returning its content type.
+func attachErrorReport(w io.Writer, summary []byte) (string, error) {
+	os.Stderr.Sync()
+	report, err := os.Open(errorSinkName)
+	if err != nil {
+		return "", err
+	}
+	defer report.Close()
+
+	form := multipart.NewWriter(w)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="summary"`)
+	header.Set("Content-Type", "application/json")
+	part, err := form.CreatePart(header)
+	if err == nil {
+		_, err = part.Write(summary)
+	}
+	if err == nil {
+		part, err = form.CreateFormFile("errors", filepath.Base(errorSinkName))
+	}
+	if err == nil {
+		_, err = io.Copy(part, report)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	return form.FormDataContentType(), err
+}
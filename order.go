@@ -0,0 +1,151 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strings"
+)
+
+// Record reordering. -order keys.txt processes the records in the order
+// their keys are listed in the file, one key per line, for loaders that
+// need e.g. parent records before their children. Records whose key is
+// not listed are dropped. With an index on the key field the records
+// are read with a seek each; otherwise the listed records are held in
+// memory until the whole input has been read.
+
+var errInvalidOrderKey = errors.New("marcdump: invalid order key field")
+
+func loadKeyList(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// An orderedSource returns records in the order of a key list, using
+// lookup to find the records with a given key.
+type orderedSource struct {
+	keys    []string
+	lookup  func(key string) ([]*marcfilter.Record, error)
+	pending []*marcfilter.Record
+	seen    map[int64]bool
+	missing int
+}
+
+// getOrderedSource returns a source yielding the records of src, or of
+// the indexed file when idx is on the key field, in key list order.
+func getOrderedSource(name string, keyField string, src marcfilter.Source, file *os.File, idx *marcfilter.Index) (*orderedSource, error) {
+	spec := marcfilter.SpecRegexp.FindStringSubmatch(keyField)
+	if spec == nil || spec[3] != "" {
+		return nil, errInvalidOrderKey
+	}
+	tag, code := spec[1], spec[2]
+
+	keys, err := loadKeyList(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &orderedSource{keys: keys, seen: make(map[int64]bool)}
+
+	if idx != nil && idx.Key == keyField {
+		s.lookup = func(key string) ([]*marcfilter.Record, error) {
+			var records []*marcfilter.Record
+			for _, e := range idx.Lookup(key) {
+				record, err := marcfilter.ReadRecordAt(file, e.Offset, e.Length)
+				if err != nil {
+					return nil, err
+				}
+				records = append(records, record)
+			}
+			return records, nil
+		}
+		return s, nil
+	}
+
+	var byKey map[string][]*marcfilter.Record
+	s.lookup = func(key string) ([]*marcfilter.Record, error) {
+		if byKey == nil {
+			byKey = make(map[string][]*marcfilter.Record)
+			listed := make(map[string]bool)
+			for _, k := range keys {
+				listed[k] = true
+			}
+			for {
+				record, err := src.Next()
+				if record == nil || err != nil {
+					if err != nil {
+						return nil, err
+					}
+					break
+				}
+				for _, v := range marcfilter.FieldValues(record.MarcRecord, tag, code) {
+					if listed[v] {
+						byKey[v] = append(byKey[v], record)
+					}
+				}
+			}
+		}
+		return byKey[key], nil
+	}
+	return s, nil
+}
+
+func (s *orderedSource) Next() (*marcfilter.Record, error) {
+	for len(s.pending) == 0 {
+		if len(s.keys) == 0 {
+			if s.missing > 0 {
+				fmt.Fprintf(os.Stderr, "Warning: %d listed keys not found\n", s.missing)
+				s.missing = 0
+			}
+			return nil, nil
+		}
+		key := s.keys[0]
+		s.keys = s.keys[1:]
+
+		records, err := s.lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			s.missing += 1
+		}
+		// a record listed under more than one key is only returned once
+		for _, record := range records {
+			if !s.seen[record.Offset] {
+				s.seen[record.Offset] = true
+				s.pending = append(s.pending, record)
+			}
+		}
+	}
+
+	record := s.pending[0]
+	s.pending = s.pending[1:]
+	return record, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats. Each -o format is a formatter; formats that do not
+// line up columns simply never write tabs to the tabwriter.
+
+var formatters = map[string]func() (marcfilter.Formatter, error){
+	"text":     newTextFormatter,
+	"pretty":   newPrettyFormatter,
+	"json":     newJSONFormatter,
+	"ndjson":   newNDJSONFormatter,
+	"jsonld":   func() (marcfilter.Formatter, error) { return recordFormatter(printJSONLD), nil },
+	"marcxml":  func() (marcfilter.Formatter, error) { return marcfilter.MARCXMLFormatter{Bare: wrap == "none"}, nil },
+	"mods":     func() (marcfilter.Formatter, error) { return modsFormatter{}, nil },
+	"mads":     func() (marcfilter.Formatter, error) { return madsFormatter{}, nil },
+	"madsrdf":  func() (marcfilter.Formatter, error) { return recordFormatter(printMADSRDF), nil },
+	"mrk":      func() (marcfilter.Formatter, error) { return mrkFormatter{}, nil },
+	"csv":      func() (marcfilter.Formatter, error) { return newCSVFormatter(',') },
+	"tsv":      func() (marcfilter.Formatter, error) { return newCSVFormatter('\t') },
+	"template": newTemplateFormatter,
+}
+
+// targetFormatters are the formats that write somewhere else than the
+// standard output, given as -o format=target.
+var targetFormatters = map[string]func(target string) (marcfilter.Formatter, error){
+	"sqlite": newSQLiteFormatter,
+}
+
+// newTextFormatter returns a text formatter set up with -maxwidth,
+// -separator and -align-right.
+func newTextFormatter() (marcfilter.Formatter, error) {
+	return &marcfilter.TextFormatter{MaxWidth: maxWidth, Separator: separator, AlignRight: alignRight}, nil
+}
+
+// newJSONFormatter returns a JSON formatter set up with -provenance,
+// -parse, -wrap and -json-indent.
+func newJSONFormatter() (marcfilter.Formatter, error) {
+	f := &marcfilter.JSONFormatter{Provenance: provenance, Bare: wrap == "none", Indent: strings.Repeat(" ", jsonIndent)}
+	if provenance && !rawOutput {
+		// the positions are those of the record before conversion
+		f.Convert = convertMarc8
+	}
+	if parseMode != "" {
+		f.Parse = func(m *marcfilter.MutableRecord) interface{} {
+			return parseRecordParts(m, parseMode)
+		}
+	}
+	return f, nil
+}
+
+// newNDJSONFormatter returns a JSON Lines formatter set up like the
+// JSON one, and with -flat.
+func newNDJSONFormatter() (marcfilter.Formatter, error) {
+	if jsonIndent > 0 {
+		// a record to a line
+		return nil, errIndentedNDJSON
+	}
+	f, _ := newJSONFormatter()
+	return &marcfilter.NDJSONFormatter{JSONFormatter: *f.(*marcfilter.JSONFormatter), Flat: flatJSON}, nil
+}
+
+// A recordFormatter formats each record on its own, with nothing
+// before or after them.
+type recordFormatter actionFunc
+
+func (f recordFormatter) Header(w io.Writer) error {
+	return nil
+}
+
+func (f recordFormatter) Record(w io.Writer, record *marcfilter.Record) error {
+	tw, ok := w.(*tabwriter.Writer)
+	if !ok {
+		tw = tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	}
+	if err := f(record, tw); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func (f recordFormatter) Footer(w io.Writer) error {
+	return nil
+}
+
+// getFormatAction returns an action writing each record in the named
+// output format. MARC-8 records are converted to UTF-8 first unless
+// -raw is given.
+func getFormatAction(format string) (actionFunc, error) {
+	newFormatter, ok := formatters[format]
+	if i := strings.IndexByte(format, '='); i >= 0 {
+		var newTarget func(string) (marcfilter.Formatter, error)
+		if newTarget, ok = targetFormatters[format[:i]]; ok {
+			newFormatter = func() (marcfilter.Formatter, error) { return newTarget(format[i+1:]) }
+		}
+	}
+	if !ok {
+		return nil, errUnknownOutputFormat
+	}
+	f, err := newFormatter()
+	if err != nil {
+		return nil, err
+	}
+
+	started := false
+	start := func(w *tabwriter.Writer) error {
+		if started {
+			return nil
+		}
+		started = true
+		return f.Header(w)
+	}
+
+	onFinish(func(w *tabwriter.Writer) error {
+		if err := start(w); err != nil {
+			return err
+		}
+		if err := f.Footer(w); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		if err := start(w); err != nil {
+			return err
+		}
+		if !rawOutput && !convertsRecords(f) {
+			var err error
+			if record, err = convertRecord(record); err != nil {
+				return err
+			}
+		}
+		if err := f.Record(w, record); err != nil {
+			return err
+		}
+		return w.Flush()
+	}, nil
+}
+
+// convertsRecords reports whether a formatter converts MARC-8 records
+// to UTF-8 itself, as the JSON ones do with -provenance.
+func convertsRecords(f marcfilter.Formatter) bool {
+	switch f := f.(type) {
+	case *marcfilter.JSONFormatter:
+		return f.Convert != nil
+	case *marcfilter.NDJSONFormatter:
+		return f.Convert != nil
+	}
+	return false
+}
+
+// writeVerbatim writes text that must reach the output as it is, such
+// as tab separated rows, escaping each line from the tabwriter. This
+// needs the tabwriter's StripEscape flag.
+func writeVerbatim(w io.Writer, text []byte) error {
+	if _, ok := w.(*tabwriter.Writer); !ok {
+		_, err := w.Write(text)
+		return err
+	}
+	escape := []byte{tabwriter.Escape}
+	for len(text) > 0 {
+		line := text
+		if i := bytes.IndexByte(text, '\n'); i >= 0 {
+			line = text[:i]
+		}
+		text = text[len(line):]
+		w.Write(escape)
+		w.Write(line)
+		w.Write(escape)
+		if len(text) > 0 {
+			text = text[1:]
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
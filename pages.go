@@ -0,0 +1,251 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Listing the records served. GET /records returns a page of records,
+// or of the records the s parameters select:
+//
+//    GET /records?s=650_a=History&limit=100
+//    {"records": [MARC-in-JSON...], "next": "cursor"}
+//
+// A client crawls the collection by asking again with cursor=next, also
+// given as a Link header, until a page has no next. Records come in the
+// order of their ids: the values of the index for a file served with
+// one (a record with several comes at the first), the ids of a
+// database. A file without an index is listed in file order. Ids do
+// not change as records are added, so a crawl sees every record that
+// was there when it began, and a cursor stays good between requests.
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+var errBadCursor = errors.New("marcdump: invalid cursor")
+
+// encodeCursor returns the cursor for the position following the
+// record with an id at an offset (or database row).
+func encodeCursor(id string, pos int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(pos, 10) + ":" + id))
+}
+
+func decodeCursor(cursor string) (string, int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, errBadCursor
+	}
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return "", 0, errBadCursor
+	}
+	pos, err := strconv.ParseInt(string(b[:i]), 10, 64)
+	if err != nil || pos < 0 {
+		return "", 0, errBadCursor
+	}
+	return string(b[i+1:]), pos, nil
+}
+
+// page returns up to n records of the file matching the selector after
+// a cursor, and the cursor of the next page.
+func (s *fileStore) page(cursor string, sel marcfilter.Selector, n int) ([]*marcfilter.Record, string, error) {
+	id, pos := "", int64(0)
+	if cursor != "" {
+		var err error
+		if id, pos, err = decodeCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	if s.idx == nil {
+		return s.pageByOffset(pos, sel, n)
+	}
+
+	key, err := parseRecordKey(s.idx.Key)
+	if err != nil {
+		return nil, "", err
+	}
+	entries := s.idx.Entries
+	i := 0
+	if cursor != "" {
+		i = sort.Search(len(entries), func(i int) bool {
+			return entries[i].Value > id || entries[i].Value == id && entries[i].Offset > pos
+		})
+	}
+
+	var records []*marcfilter.Record
+	for ; i < len(entries); i++ {
+		if len(records) == n {
+			return records, encodeCursor(entries[i-1].Value, entries[i-1].Offset), nil
+		}
+		e := entries[i]
+		record, err := marcfilter.ReadRecordAt(s.file, e.Offset, e.Length)
+		if err != nil {
+			return nil, "", err
+		}
+		// a record is listed at its first id only
+		first := e.Value
+		values, _ := key.values(record)
+		for _, v := range values {
+			if v < first {
+				first = v
+			}
+		}
+		if first == e.Value && sel.Match(record.MarcRecord) {
+			records = append(records, record)
+		}
+	}
+	return records, "", nil
+}
+
+// pageByOffset pages through the records of a file without an index.
+func (s *fileStore) pageByOffset(pos int64, sel marcfilter.Selector, n int) ([]*marcfilter.Record, string, error) {
+	if pos > s.size {
+		return nil, "", errBadCursor
+	}
+	rr := newRecordReader(io.NewSectionReader(s.file, pos, s.size-pos))
+	rr.Offset = pos
+
+	var records []*marcfilter.Record
+	for {
+		record, err := rr.Next()
+		if err != nil {
+			return nil, "", err
+		} else if record == nil {
+			return records, "", nil
+		}
+		if !sel.Match(record.MarcRecord) {
+			continue
+		}
+		if len(records) == n {
+			// the next page starts with this record
+			return records, encodeCursor("", record.Offset), nil
+		}
+		records = append(records, record)
+	}
+}
+
+// page returns up to n records of the database matching the selector
+// after a cursor, and the cursor of the next page.
+func (s *sqlStore) page(cursor string, sel marcfilter.Selector, n int) ([]*marcfilter.Record, string, error) {
+	id, seq := "", int64(0)
+	if cursor != "" {
+		var err error
+		if id, seq, err = decodeCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var records []*marcfilter.Record
+	for {
+		rows, err := s.db.Query("SELECT seq, id, raw FROM records WHERE id > $1 OR id = $1 AND seq > $2 ORDER BY id, seq LIMIT $3",
+			id, seq, storePageSize)
+		if err != nil {
+			return nil, "", err
+		}
+		read := 0
+		for rows.Next() {
+			var raw []byte
+			if err := rows.Scan(&seq, &id, &raw); err != nil {
+				rows.Close()
+				return nil, "", err
+			}
+			read++
+			record, err := marcfilter.ParseRecord(raw, 0, int(seq))
+			if err != nil {
+				rows.Close()
+				return nil, "", err
+			}
+			if !sel.Match(record.MarcRecord) {
+				continue
+			}
+			records = append(records, record)
+			if len(records) == n {
+				rows.Close()
+				return records, encodeCursor(id, seq), nil
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, "", err
+		}
+		if read < storePageSize {
+			return records, "", nil
+		}
+	}
+}
+
+// serveRecordList returns a page of the records the request selects.
+func (h *httpHandler) serveRecordList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sel, err := requestSelector(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := defaultPageSize
+	if l := query.Get("limit"); l != "" {
+		if n, err = strconv.Atoi(l); err != nil || n < 1 {
+			http.Error(w, "invalid limit "+l, http.StatusBadRequest)
+			return
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+	}
+
+	records, next, err := h.store.page(query.Get("cursor"), sel, n)
+	if err == errBadCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var page struct {
+		Records []json.RawMessage `json:"records"`
+		Next    string            `json:"next,omitempty"`
+	}
+	page.Records = []json.RawMessage{}
+	for _, record := range records {
+		b, err := encodeRecordAs(record, "json")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Records = append(page.Records, b)
+	}
+	page.Next = next
+
+	if next != "" {
+		query.Set("cursor", next)
+		link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		w.Header().Set("Link", "<"+link.String()+`>; rel="next"`)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&page)
+}
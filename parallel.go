@@ -0,0 +1,214 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sync"
+)
+
+// With -j the records are parsed and selected in parallel. One
+// goroutine splits the input into frames using the record lengths,
+// the workers parse them and test them against the selector, and next
+// hands the selected records back in input order, so the output is the
+// same as reading them one at a time. The actions still run one record
+// at a time, though the workers do the work an action can do ahead of
+// time (see onPrepare), such as validating the records. The splitter
+// runs ahead of the output, so -recover can copy records past where -m
+// stops it.
+//
+// -unordered hands the records back as the workers finish them instead,
+// so that a slow record does not hold up the ones after it. The same
+// records are output, in an order that can change from run to run.
+
+// A parallelResult is what a worker made of a frame: the record if it
+// was selected, or the error parsing it. With -skip-bad the error is
+// passed on with the frame, for next to report.
+type parallelResult struct {
+	record *marcfilter.Record
+	err    error
+	bad    *frame
+}
+
+type parallelJob struct {
+	frame  *frame
+	result chan parallelResult
+}
+
+// A parallelSource is a Source returning only the selected
+// records.
+type parallelSource struct {
+	onBad   func(offset int64, raw []byte, err error)
+	queue   chan chan parallelResult // a result per frame, in input order
+	results chan parallelResult      // with -unordered, results as they are made
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newParallelSource starts reading the records of src with the given
+// number of workers, keeping those that match, preparing them if
+// prepare is not nil, and stopping at the end of the window. Unless
+// unordered, the records come back in input order.
+func newParallelSource(src *inputReader, workers int, match func(*marcfilter.Record) bool, prepare func(*marcfilter.Record), window recordWindow, unordered bool) *parallelSource {
+	p := &parallelSource{
+		onBad:   src.onBad,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if unordered {
+		p.results = make(chan parallelResult, 4*workers)
+	} else {
+		p.queue = make(chan chan parallelResult, 4*workers)
+	}
+
+	if p.onBad != nil {
+		// records the splitter skips are queued with the others, so
+		// that they are reported by the one goroutine
+		src.onBad = func(offset int64, raw []byte, err error) {
+			p.put(nil, parallelResult{err: err, bad: &frame{raw: raw, offset: offset}})
+		}
+	}
+
+	var working sync.WaitGroup
+	jobs := make(chan parallelJob, workers)
+	for i := 0; i < workers; i++ {
+		working.Add(1)
+		go func() {
+			defer working.Done()
+			for job := range jobs {
+				r := selectFrame(job.frame, match, p.onBad != nil)
+				if r.record != nil && prepare != nil {
+					prepare(r.record)
+				}
+				if job.result != nil {
+					job.result <- r
+				} else if !p.put(nil, r) {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(p.stopped)
+		defer func() {
+			close(jobs)
+			working.Wait()
+			if unordered {
+				close(p.results)
+			} else {
+				close(p.queue)
+			}
+		}()
+		for {
+			f, err := src.nextFrame()
+			if f == nil && err == nil || f != nil && window.past(f.number) {
+				return
+			}
+			if err != nil {
+				p.put(nil, parallelResult{err: err})
+				return
+			}
+			var result chan parallelResult
+			if !unordered {
+				// results are buffered so that the workers never
+				// wait on next
+				result = make(chan parallelResult, 1)
+			}
+			select {
+			case jobs <- parallelJob{f, result}:
+			case <-p.done:
+				return
+			}
+			if result != nil && !p.put(result, parallelResult{}) {
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// put passes a result on to next: in order, queueing the channel the
+// result will be sent on, or as it is, with r filled in, when
+// unordered. It reports false if the source has been stopped.
+func (p *parallelSource) put(result chan parallelResult, r parallelResult) bool {
+	if p.results != nil {
+		select {
+		case p.results <- r:
+			return true
+		case <-p.done:
+			return false
+		}
+	}
+	if result == nil {
+		result = make(chan parallelResult, 1)
+		result <- r
+	}
+	select {
+	case p.queue <- result:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// selectFrame parses a frame and tests the record.
+func selectFrame(f *frame, match func(*marcfilter.Record) bool, skipBad bool) parallelResult {
+	record, err := marcfilter.ParseRecord(f.raw, f.offset, f.number)
+	if err != nil {
+		result := parallelResult{err: fmt.Errorf("%s: %v", f.input, err)}
+		if skipBad {
+			result.bad = f
+		}
+		return result
+	}
+	if !match(record) {
+		return parallelResult{}
+	}
+	return parallelResult{record: record}
+}
+
+func (p *parallelSource) Next() (*marcfilter.Record, error) {
+	for {
+		var r parallelResult
+		if p.results != nil {
+			var ok bool
+			if r, ok = <-p.results; !ok {
+				return nil, nil
+			}
+		} else {
+			result, ok := <-p.queue
+			if !ok {
+				return nil, nil
+			}
+			r = <-result
+		}
+		if r.bad != nil {
+			p.onBad(r.bad.offset, r.bad.raw, r.err)
+			continue
+		}
+		if r.err != nil || r.record != nil {
+			return r.record, r.err
+		}
+	}
+}
+
+// stop stops reading the input, so that whatever the reader writes
+// (the -recover copy) can be closed.
+func (p *parallelSource) stop() {
+	close(p.done)
+	<-p.stopped
+}
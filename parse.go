@@ -0,0 +1,172 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"strings"
+)
+
+// Structured parsing of the title statement and personal names. The
+// subfields mark the parts where catalogers used them; ISBD punctuation
+// (" : " before the remainder of the title, " / " before the statement
+// of responsibility) finds them where they did not. -parse clean strips
+// the punctuation from the parts, -parse isbd keeps it as recorded.
+
+var errUnknownParseMode = errors.New("marcdump: unknown parse mode")
+
+const (
+	parseClean = "clean"
+	parseISBD  = "isbd"
+)
+
+// titleParts are the parts of a 245 title statement.
+type titleParts struct {
+	Proper         string `json:"proper"`
+	Parallel       string `json:"parallel,omitempty"`
+	Remainder      string `json:"remainder,omitempty"`
+	Part           string `json:"part,omitempty"`
+	Responsibility string `json:"responsibility,omitempty"`
+}
+
+// nameParts are the parts of a personal name in 100 or 700.
+type nameParts struct {
+	Tag        string   `json:"tag"`
+	Name       string   `json:"name"`
+	Numeration string   `json:"numeration,omitempty"`
+	Titles     string   `json:"titles,omitempty"`
+	Dates      string   `json:"dates,omitempty"`
+	FullerForm string   `json:"fullerForm,omitempty"`
+	Relators   []string `json:"relators,omitempty"`
+	Codes      []string `json:"relatorCodes,omitempty"`
+}
+
+// parsedRecord is the "parsed" member -parse adds to JSON records.
+type parsedRecord struct {
+	Title *titleParts `json:"title,omitempty"`
+	Names []nameParts `json:"names,omitempty"`
+}
+
+func checkParseMode(mode string) error {
+	if mode != "" && mode != parseClean && mode != parseISBD {
+		return errUnknownParseMode
+	}
+	return nil
+}
+
+// cleanPart trims a part for the parse mode. In clean mode a final
+// period is dropped unless it ends an initial, and so are enclosing
+// parentheses, as around the fuller form of a name.
+func cleanPart(s string, mode string) string {
+	s = strings.TrimSpace(s)
+	if mode != parseClean {
+		return s
+	}
+	s = trimISBD(s)
+	if n := len(s); n > 2 && s[n-1] == '.' && !(s[n-3] == ' ' && s[n-2] >= 'A' && s[n-2] <= 'Z') {
+		s = trimISBD(s[:n-1])
+	}
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+// splitISBD splits s at the first occurrence of the ISBD separator, so
+// that "Title : subtitle" gives "Title" and "subtitle".
+func splitISBD(s string, sep string) (string, string) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
+	}
+	return s, ""
+}
+
+// parseTitle parses a 245 field.
+func parseTitle(f *marcfilter.Field, mode string) *titleParts {
+	var proper, remainder, part, responsibility string
+	for _, sf := range f.Subfields {
+		switch sf.Code {
+		case "a":
+			proper = sf.Value
+		case "b":
+			remainder = sf.Value
+		case "n", "p":
+			part = strings.TrimSpace(part + " " + sf.Value)
+		case "c":
+			responsibility = sf.Value
+		}
+	}
+
+	// Fall back on the punctuation when the subfields are missing.
+	if responsibility == "" {
+		if remainder != "" {
+			remainder, responsibility = splitISBD(remainder, " / ")
+		} else {
+			proper, responsibility = splitISBD(proper, " / ")
+		}
+	}
+	if remainder == "" {
+		proper, remainder = splitISBD(proper, " : ")
+	}
+	proper, parallel := splitISBD(proper, " = ")
+
+	return &titleParts{
+		Proper:         cleanPart(proper, mode),
+		Parallel:       cleanPart(parallel, mode),
+		Remainder:      cleanPart(remainder, mode),
+		Part:           cleanPart(part, mode),
+		Responsibility: cleanPart(responsibility, mode),
+	}
+}
+
+// parseName parses a personal name field.
+func parseName(f *marcfilter.Field, mode string) nameParts {
+	n := nameParts{Tag: f.Tag}
+	for _, sf := range f.Subfields {
+		v := cleanPart(sf.Value, mode)
+		switch sf.Code {
+		case "a":
+			n.Name = v
+		case "b":
+			n.Numeration = v
+		case "c":
+			n.Titles = strings.TrimSpace(n.Titles + " " + v)
+		case "d":
+			n.Dates = v
+		case "q":
+			n.FullerForm = v
+		case "e":
+			n.Relators = append(n.Relators, v)
+		case "4":
+			n.Codes = append(n.Codes, v)
+		}
+	}
+	return n
+}
+
+// parseRecordParts parses the title and the personal names of a record.
+func parseRecordParts(m *marcfilter.MutableRecord, mode string) *parsedRecord {
+	p := new(parsedRecord)
+	if titles := m.FieldsByTag("245"); len(titles) > 0 {
+		p.Title = parseTitle(titles[0], mode)
+	}
+	for _, f := range m.Fields {
+		if f.Tag == "100" || f.Tag == "700" {
+			p.Names = append(p.Names, parseName(f, mode))
+		}
+	}
+	return p
+}
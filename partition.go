@@ -0,0 +1,129 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Time-sliced output. -partition-by year(005) writes each record to a
+// file named for the year it was last transacted; year(008) uses the
+// date entered on file in 008/00-05 instead. Records without a usable
+// date go to unknown.mrc.
+
+var errInvalidPartition = errors.New("marcdump: invalid partition specification")
+
+var partitionRegexp = regexp.MustCompile(`^year\((005|008)\)$`)
+
+// A partitionFunc returns the name of the partition a record belongs to.
+type partitionFunc func(record *marcfilter.Record) string
+
+func getPartitionFunction(spec string) (partitionFunc, error) {
+	m := partitionRegexp.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, errInvalidPartition
+	}
+	if m[1] == "005" {
+		return yearOf005, nil
+	}
+	return yearOf008, nil
+}
+
+// yearOf005 returns the year of the latest transaction, yyyymmddhhmmss.f
+func yearOf005(record *marcfilter.Record) string {
+	v, err := record.GetControlField("005")
+	if err != nil || len(v) < 4 {
+		return ""
+	}
+	if _, err := strconv.Atoi(v[:4]); err != nil {
+		return ""
+	}
+	return v[:4]
+}
+
+// yearOf008 returns the year the record was entered on file. 008/00-05
+// holds the date as yymmdd, so years after the current one belong to
+// the previous century.
+func yearOf008(record *marcfilter.Record) string {
+	v, err := record.GetControlField("008")
+	if err != nil || len(v) < 6 {
+		return ""
+	}
+	yy, err := strconv.Atoi(v[:2])
+	if err != nil {
+		return ""
+	}
+	year := 2000 + yy
+	if year > time.Now().Year() {
+		year -= 100
+	}
+	return strconv.Itoa(year)
+}
+
+// getPartitionAction returns an action writing each record to a file
+// in dir named for its partition.
+func getPartitionAction(spec string, dir string) (actionFunc, error) {
+	partition, err := getPartitionFunction(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	writers := make(map[string]*marcWriter)
+	onFinish(func(w *tabwriter.Writer) error {
+		var names []string
+		for name := range writers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var firstErr error
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%d\n", name, writers[name].count)
+			if err := writers[name].close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		w.Flush()
+		return firstErr
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		name := partition(record)
+		if name == "" {
+			name = "unknown"
+		}
+		out := writers[name]
+		if out == nil {
+			var err error
+			if out, err = createMarcWriter(filepath.Join(dir, name+".mrc")); err != nil {
+				return err
+			}
+			writers[name] = out
+		}
+		return out.write(record.Raw)
+	}, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"strings"
+)
+
+// Report presets, the CSV extracts asked for again and again, for
+// staff who would rather not learn tags and selectors:
+//
+//    marcdump -preset serials catalog.mrc > checkin.csv
+//
+// A preset selects the records of a kind of material and writes a
+// column for each thing the report needs, headed in words. A column
+// takes the first of its fields that the record has, so that a date
+// comes from the 264 or, in an older record, the 260. -s and -o tsv
+// can be given with a preset, the selector narrowing what it selects.
+
+var errUnknownPreset = errors.New("marcdump: unknown preset; the presets are " + strings.Join(presetNames(), ", "))
+
+// A presetColumn is a column of a preset, with its heading and the
+// fields or title and name parts it is taken from, in order of
+// preference.
+type presetColumn struct {
+	header  string
+	sources []string
+}
+
+// A csvPreset is a kind of material and its report columns.
+type csvPreset struct {
+	selector string
+	columns  []presetColumn
+}
+
+var csvPresets = map[string]*csvPreset{
+	// serials check-in list
+	"serials": {
+		selector: "ldr/07=s",
+		columns: []presetColumn{
+			{"Record", []string{"001"}},
+			{"Title", []string{"title.proper", "245_a"}},
+			{"ISSN", []string{"022_a"}},
+			{"Frequency", []string{"310_a", "321_a"}},
+			{"Publisher", []string{"264_b", "260_b"}},
+			{"Published", []string{"362_a"}},
+			{"Location", []string{"852_b"}},
+			{"Call number", []string{"852_h", "050_a", "090_a"}},
+			{"Holdings", []string{"866_a"}},
+		},
+	},
+	// e-book title list with URLs
+	"ebooks": {
+		selector: "ldr/06=^[at]$ AND 856_u",
+		columns: []presetColumn{
+			{"Record", []string{"001"}},
+			{"Title", []string{"title.proper", "245_a"}},
+			{"Author", []string{"name", "100_a", "110_a"}},
+			{"ISBN", []string{"020_a"}},
+			{"Publisher", []string{"264_b", "260_b"}},
+			{"Date", []string{"264_c", "260_c"}},
+			{"URL", []string{"856_u"}},
+			{"Link note", []string{"856_z", "856_3"}},
+		},
+	},
+	// audiovisual inventory
+	"av": {
+		selector: "ldr/06=^[gijr]$",
+		columns: []presetColumn{
+			{"Record", []string{"001"}},
+			{"Title", []string{"title.proper", "245_a"}},
+			{"Medium", []string{"338_a", "245_h"}},
+			{"Extent", []string{"300_a"}},
+			{"Publisher number", []string{"028_a"}},
+			{"Publisher", []string{"264_b", "260_b"}},
+			{"Date", []string{"264_c", "260_c"}},
+			{"Call number", []string{"852_h", "050_a", "090_a"}},
+			{"Barcode", []string{"876_p", "949_p"}},
+		},
+	},
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(csvPresets))
+	for name := range csvPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// presetColumns are the columns of the -preset, or nil.
+var presetColumns []csvColumn
+
+// usePreset makes the output that of a preset, adding its selector to
+// the -s options.
+func usePreset(name string) error {
+	p, ok := csvPresets[name]
+	if !ok {
+		return errUnknownPreset
+	}
+	for _, c := range p.columns {
+		var sources []csvColumn
+		for _, s := range c.sources {
+			column, err := parseColumns(s)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, column...)
+		}
+		presetColumns = append(presetColumns, csvColumn{c.header, func(record *marcfilter.Record, parts *parsedRecord) string {
+			for _, s := range sources {
+				if v := s.value(record, parts); v != "" {
+					return v
+				}
+			}
+			return ""
+		}})
+	}
+	selectorOpts = append(selectorOpts, p.selector)
+	if outputFormat != "tsv" {
+		outputFormat = "csv"
+	}
+	return nil
+}
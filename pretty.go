@@ -0,0 +1,307 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"os"
+	"strings"
+)
+
+// Pretty output, for reading records rather than processing them.
+// -pretty labels the fields with their names, spells out the coded
+// values of the leader and of the 008 positions common to every type of
+// material, and shows each 880 alternate script field under the field
+// it is linked to by $6. Authority and holdings records get the names
+// and 008 positions of their own formats, the heading of an authority
+// record is shown as it is filed, and each holdings enumeration is read
+// with the captions of its pattern. -color=auto (the default) colors tags,
+// indicators and subfield codes when the output is a terminal and
+// NO_COLOR is not set; -color=always and -color=never force it.
+
+var errInvalidColor = errors.New("marcdump: -color must be always, never or auto")
+
+// ANSI escape sequences
+const (
+	colorReset     = "\x1b[0m"
+	colorTag       = "\x1b[1;34m"
+	colorIndicator = "\x1b[33m"
+	colorSubfield  = "\x1b[35m"
+	colorLabel     = "\x1b[2m"
+)
+
+// prettyLabelWidth is the width of the label column.
+const prettyLabelWidth = 26
+
+// tagLabels names the common fields.
+var tagLabels = map[string]string{
+	"001": "Control number",
+	"003": "Control number identifier",
+	"005": "Latest transaction",
+	"006": "Additional material",
+	"007": "Physical description",
+	"008": "Fixed-length data",
+	"010": "LC control number",
+	"015": "National bibliography no.",
+	"016": "National agency number",
+	"020": "ISBN",
+	"022": "ISSN",
+	"024": "Other standard identifier",
+	"028": "Publisher number",
+	"035": "System control number",
+	"040": "Cataloging source",
+	"041": "Language code",
+	"042": "Authentication code",
+	"043": "Geographic area code",
+	"050": "LC call number",
+	"082": "Dewey class number",
+	"100": "Main entry",
+	"110": "Main entry (corporate)",
+	"111": "Main entry (meeting)",
+	"130": "Main entry (uniform title)",
+	"210": "Abbreviated title",
+	"222": "Key title",
+	"240": "Uniform title",
+	"245": "Title",
+	"246": "Varying form of title",
+	"250": "Edition",
+	"260": "Publication",
+	"264": "Production/publication",
+	"300": "Physical description",
+	"310": "Frequency",
+	"336": "Content type",
+	"337": "Media type",
+	"338": "Carrier type",
+	"362": "Dates of publication",
+	"490": "Series statement",
+	"500": "General note",
+	"504": "Bibliography note",
+	"505": "Contents",
+	"520": "Summary",
+	"533": "Reproduction note",
+	"546": "Language note",
+	"588": "Source of description",
+	"600": "Subject (person)",
+	"610": "Subject (corporate)",
+	"611": "Subject (meeting)",
+	"630": "Subject (uniform title)",
+	"650": "Subject (topic)",
+	"651": "Subject (place)",
+	"655": "Genre/form",
+	"700": "Added entry",
+	"710": "Added entry (corporate)",
+	"711": "Added entry (meeting)",
+	"730": "Added entry (uniform title)",
+	"740": "Added entry (title)",
+	"765": "Original language entry",
+	"775": "Other edition entry",
+	"776": "Additional physical form",
+	"780": "Preceding entry",
+	"785": "Succeeding entry",
+	"800": "Series added entry",
+	"830": "Series added entry (title)",
+	"856": "Electronic location",
+	"880": "Alternate graphic repr.",
+}
+
+// A fixedPosition is a coded value of the leader or of the 008.
+type fixedPosition struct {
+	start, end int
+	name       string
+	codes      map[string]string
+}
+
+var leaderPositions = []fixedPosition{
+	{5, 6, "Status", map[string]string{"a": "increase in level", "c": "corrected", "d": "deleted", "n": "new", "p": "increase from prepublication"}},
+	{6, 7, "Type", map[string]string{"a": "language material", "c": "notated music", "d": "manuscript music",
+		"e": "cartographic", "f": "manuscript cartographic", "g": "projected medium", "i": "nonmusical sound recording",
+		"j": "musical sound recording", "k": "2D graphic", "m": "computer file", "o": "kit", "p": "mixed materials",
+		"r": "3D artifact", "t": "manuscript language material", "u": "unknown holdings", "v": "multipart holdings",
+		"w": "classification", "x": "single-part holdings", "y": "serial holdings", "z": "authority"}},
+	{7, 8, "Level", map[string]string{"a": "monographic component", "b": "serial component", "c": "collection",
+		"d": "subunit", "i": "integrating resource", "m": "monograph", "s": "serial"}},
+	{8, 9, "Control", map[string]string{" ": "none", "a": "archival"}},
+	{9, 10, "Encoding", map[string]string{" ": "MARC-8", "a": "UCS/Unicode"}},
+	{17, 18, "Encoding level", map[string]string{" ": "full", "1": "full, not examined", "2": "less than full",
+		"3": "abbreviated", "4": "core", "5": "partial", "7": "minimal", "8": "prepublication", "u": "unknown",
+		"z": "not applicable", "I": "full (OCLC)", "K": "less than full (OCLC)", "M": "added from a batch (OCLC)"}},
+	{18, 19, "Cataloging form", map[string]string{" ": "non-ISBD", "a": "AACR 2", "c": "ISBD punctuation omitted",
+		"i": "ISBD punctuation included", "n": "non-ISBD punctuation omitted", "u": "unknown"}},
+}
+
+var fixedDataPositions = []fixedPosition{
+	{0, 6, "Entered", nil},
+	{6, 7, "Date type", map[string]string{"b": "B.C.", "c": "continuing", "d": "ceased", "e": "detailed",
+		"i": "inclusive", "k": "bulk", "m": "multiple", "n": "unknown", "p": "distribution/production",
+		"q": "questionable", "r": "reprint/original", "s": "single", "t": "publication/copyright", "u": "status unknown"}},
+	{7, 11, "Date 1", nil},
+	{11, 15, "Date 2", nil},
+	{15, 18, "Place", nil},
+	{35, 38, "Language", nil},
+	{38, 39, "Modified", map[string]string{" ": "not modified", "d": "dashed-on information omitted",
+		"o": "completely romanized", "r": "completely romanized, printed in script", "s": "shortened", "x": "missing characters"}},
+	{39, 40, "Source", map[string]string{" ": "national bibliographic agency", "c": "cooperative cataloging program",
+		"d": "other", "u": "unknown"}},
+}
+
+// A prettyFormatter writes records for reading.
+type prettyFormatter struct {
+	color bool
+}
+
+func newPrettyFormatter() (marcfilter.Formatter, error) {
+	f := new(prettyFormatter)
+	switch colorMode {
+	case "always":
+		f.color = true
+	case "auto":
+		info, err := os.Stdout.Stat()
+		f.color = err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("NO_COLOR") == ""
+	case "never":
+	default:
+		return nil, errInvalidColor
+	}
+	return f, nil
+}
+
+// paint colors text when coloring is on.
+func (f *prettyFormatter) paint(color string, text string) string {
+	if !f.color {
+		return text
+	}
+	return color + text + colorReset
+}
+
+func (f *prettyFormatter) Header(w io.Writer) error {
+	return nil
+}
+
+func (f *prettyFormatter) Record(w io.Writer, record *marcfilter.Record) error {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return err
+	}
+
+	leader := string(m.Leader)
+	format := recordFormat(leader)
+	labels := formatTagLabels(format)
+	f.line(w, "LDR", "", "Leader", leader)
+	f.decoded(w, leader, leaderPositions)
+
+	// the 880s linked to other fields, by the tag and occurrence of
+	// the field they belong to
+	linked := make(map[string][]*marcfilter.Field)
+	for _, field := range m.Fields {
+		if field.Tag == "880" {
+			if link := field.Subfield("6"); len(link) >= 6 && link[4:6] != "00" {
+				linked[link[:6]] = append(linked[link[:6]], field)
+			}
+		}
+	}
+
+	for _, field := range m.Fields {
+		if field.Tag == "880" {
+			if link := field.Subfield("6"); len(link) >= 6 && link[4:6] != "00" {
+				continue
+			}
+		}
+		f.field(w, field, labels, "")
+		switch {
+		case field.Tag == "008":
+			f.decoded(w, field.Value, formatFixedPositions(format))
+		case format == formatAuthority && field.Tag[0] == '1' && field.Value == "":
+			if heading := headingLabel(field); heading != "" {
+				f.note(w, "Heading: "+heading)
+			}
+		case format == formatHoldings && field.Tag >= "863" && field.Tag <= "865":
+			if statement := holdingsStatement(field, m.Fields); statement != "" {
+				f.note(w, "Holdings: "+statement)
+			}
+		}
+		if link := field.Subfield("6"); field.Tag != "880" && strings.HasPrefix(link, "880-") && len(link) >= 6 {
+			for _, alt := range linked[field.Tag+"-"+link[4:6]] {
+				f.field(w, alt, labels, "  ")
+			}
+		}
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+func (f *prettyFormatter) Footer(w io.Writer) error {
+	return nil
+}
+
+// field writes a field on a line, after indent.
+func (f *prettyFormatter) field(w io.Writer, field *marcfilter.Field, labels map[string]string, indent string) {
+	label := labels[field.Tag]
+	if marc21.IsControlFieldTag(field.Tag) {
+		f.line(w, indent+field.Tag, "", label, field.Value)
+		return
+	}
+	var b strings.Builder
+	for i, sf := range field.Subfields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.paint(colorSubfield, "$"+sf.Code))
+		b.WriteByte(' ')
+		b.WriteString(sf.Value)
+	}
+	f.line(w, indent+field.Tag, strings.Replace(field.Indicators, " ", "#", -1), label, b.String())
+}
+
+// line writes a line of the tag, indicators, label and value columns.
+func (f *prettyFormatter) line(w io.Writer, tag string, indicators string, label string, value string) {
+	fmt.Fprintf(w, "%s %s  %s%s\n",
+		f.paint(colorTag, fmt.Sprintf("%-5s", tag)),
+		f.paint(colorIndicator, fmt.Sprintf("%-2s", indicators)),
+		f.paint(colorLabel, fmt.Sprintf("%-*s", prettyLabelWidth, label)),
+		value)
+}
+
+// decoded writes the named values of the positions of a fixed field.
+func (f *prettyFormatter) decoded(w io.Writer, value string, positions []fixedPosition) {
+	var parts []string
+	for _, p := range positions {
+		if p.end > len(value) {
+			continue
+		}
+		code := value[p.start:p.end]
+		part := p.name + ": " + strings.Replace(code, " ", "#", -1)
+		if meaning, ok := p.codes[code]; ok {
+			part += " (" + meaning + ")"
+		}
+		parts = append(parts, part)
+	}
+	for len(parts) > 0 {
+		// a few to a line
+		n := 3
+		if n > len(parts) {
+			n = len(parts)
+		}
+		f.note(w, strings.Join(parts[:n], "; "))
+		parts = parts[n:]
+	}
+}
+
+// note writes a line under the value column.
+func (f *prettyFormatter) note(w io.Writer, text string) {
+	fmt.Fprintf(w, "%s%s\n", strings.Repeat(" ", 10+prettyLabelWidth), f.paint(colorLabel, text))
+}
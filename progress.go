@@ -0,0 +1,279 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Progress and checkpoints, for runs over files that take hours.
+//
+// -progress reports the records read, how far through the input they
+// are, the rate and the time left on the standard error, rewriting the
+// line every second on a terminal and writing a line a minute
+// otherwise. The time left is only known when the inputs are
+// uncompressed files.
+//
+// -checkpoint file records every checkpointInterval where the run has
+// got to: the input, the offset in it past the last record read, and
+// the numbers of the records read and selected. A run that is
+// interrupted, or stops on an error, leaves the checkpoint for
+// -resume to carry on from the next record; one that gets to the end
+// removes it. Resuming, the MARC files written, such as with -extract,
+// are added to; redirect the standard output with >> to add to it too.
+
+var (
+	errBadCheckpoint    = errors.New("marcdump: invalid checkpoint file")
+	errCheckpointInputs = errors.New("marcdump: the inputs do not match the checkpoint")
+)
+
+// checkpointInterval is how often the checkpoint is written.
+const checkpointInterval = 10 * time.Second
+
+const (
+	progressInterval    = time.Second
+	progressLogInterval = time.Minute
+)
+
+// A checkpoint is where a run got to.
+type checkpoint struct {
+	input  string // the input being read
+	index  int    // its position among the inputs given
+	offset int64  // where in it the next record starts
+	record int    // the number of the last record read
+	count  uint   // the number of records selected
+}
+
+// readCheckpoint reads a checkpoint file, returning nil if there is
+// none.
+func readCheckpoint(name string) (*checkpoint, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	c := new(checkpoint)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		i := strings.IndexByte(scanner.Text(), ' ')
+		if i < 0 {
+			return nil, errBadCheckpoint
+		}
+		key, value := scanner.Text()[:i], scanner.Text()[i+1:]
+		var n uint64
+		if key != "input" {
+			if n, err = strconv.ParseUint(value, 10, 63); err != nil {
+				return nil, errBadCheckpoint
+			}
+		}
+		switch key {
+		case "input":
+			c.input = value
+		case "index":
+			c.index = int(n)
+		case "offset":
+			c.offset = int64(n)
+		case "record":
+			c.record = int(n)
+		case "count":
+			c.count = uint(n)
+		default:
+			return nil, errBadCheckpoint
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if c.input == "" {
+		return nil, errBadCheckpoint
+	}
+	return c, nil
+}
+
+// write writes the checkpoint to a file, replacing the file only once
+// it is complete.
+func (c *checkpoint) write(name string) error {
+	tmp := name + ".tmp"
+	text := fmt.Sprintf("input %s\nindex %d\noffset %d\nrecord %d\ncount %d\n",
+		c.input, c.index, c.offset, c.record, c.count)
+	if err := ioutil.WriteFile(tmp, []byte(text), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// save writes the checkpoint once the outputs so far are written out.
+func (c *checkpoint) save(name string, w *tabwriter.Writer) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := flushMarcWriters(); err != nil {
+		return err
+	}
+	return c.write(name)
+}
+
+// resume sets up the input reader to carry on from the checkpoint.
+func (c *checkpoint) resume(ir *inputReader) error {
+	if c.index >= len(ir.names) || ir.names[c.index] != c.input {
+		return errCheckpointInputs
+	}
+	ir.first = c.index
+	ir.names = ir.names[c.index:]
+	ir.count = c.record
+	ir.resumeOffset = c.offset
+	return nil
+}
+
+// A progressReporter writes progress lines while the records are read.
+type progressReporter struct {
+	sizes []int64 // of the inputs, or nil if not all are known
+
+	// the last record read and the position after it in all the
+	// inputs, updated atomically
+	record   int64
+	position int64
+
+	// without the sizes, the input last read, where in it, and the
+	// bytes read of the inputs before it
+	index  int
+	offset int64
+	base   int64
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startProgress starts reporting the progress through the named
+// inputs, from a record ending at an offset in one of them.
+func startProgress(names []string, record int, index int, offset int64) *progressReporter {
+	p := &progressReporter{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil || !info.Mode().IsRegular() {
+			p.sizes = nil
+			break
+		}
+		if file, err := os.Open(name); err == nil {
+			compressed := isCompressed(file)
+			file.Close()
+			if compressed {
+				p.sizes = nil
+				break
+			}
+		}
+		p.sizes = append(p.sizes, info.Size())
+	}
+	p.index = index
+	p.update(record, index, offset)
+
+	info, err := os.Stderr.Stat()
+	terminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+	interval := progressLogInterval
+	if terminal {
+		interval = progressInterval
+	}
+
+	go func() {
+		defer close(p.stopped)
+		start := time.Now()
+		startRecord, startPosition := atomic.LoadInt64(&p.record), atomic.LoadInt64(&p.position)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var last bool
+			select {
+			case <-ticker.C:
+			case <-p.done:
+				last = true
+			}
+			line := p.line(time.Since(start), startRecord, startPosition)
+			switch {
+			case terminal && last:
+				fmt.Fprintf(os.Stderr, "\r%s\x1b[K\n", line)
+			case terminal:
+				fmt.Fprintf(os.Stderr, "\r%s\x1b[K", line)
+			default:
+				fmt.Fprintln(os.Stderr, line)
+			}
+			if last {
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// update records that a record has been read, ending at an offset in
+// an input.
+func (p *progressReporter) update(record int, index int, offset int64) {
+	if index != p.index {
+		p.base += p.offset
+		p.index = index
+	}
+	p.offset = offset
+	position := p.base + offset
+	if p.sizes != nil {
+		position = offset
+		for _, size := range p.sizes[:index] {
+			position += size
+		}
+	}
+	atomic.StoreInt64(&p.record, int64(record))
+	atomic.StoreInt64(&p.position, position)
+}
+
+// line returns a progress line.
+func (p *progressReporter) line(elapsed time.Duration, startRecord int64, startPosition int64) string {
+	record, position := atomic.LoadInt64(&p.record), atomic.LoadInt64(&p.position)
+	seconds := elapsed.Seconds()
+	line := fmt.Sprintf("%d records, %.1f MB", record, float64(position)/1e6)
+	var total int64
+	for _, size := range p.sizes {
+		total += size
+	}
+	if total > 0 {
+		line += fmt.Sprintf(" of %.1f MB (%.1f%%)", float64(total)/1e6, 100*float64(position)/float64(total))
+	}
+	if seconds > 0 {
+		line += fmt.Sprintf(", %.0f records/s", float64(record-startRecord)/seconds)
+	}
+	if rate := float64(position-startPosition) / seconds; total > 0 && rate > 0 && position < total {
+		eta := time.Duration(float64(total-position) / rate * float64(time.Second))
+		line += ", ETA " + eta.Round(time.Second).String()
+	}
+	return line
+}
+
+// stop writes the last progress line.
+func (p *progressReporter) stop() {
+	close(p.done)
+	<-p.stopped
+}
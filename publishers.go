@@ -0,0 +1,118 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"strings"
+	"text/tabwriter"
+)
+
+// Publisher names. -publishers lists the publishers named in 260 $b and
+// in 264 $b of publication statements (second indicator 1), grouping
+// the forms of a name that differ only in case, punctuation, diacritics,
+// abbreviation or legal form: "Penguin Pub.," "Penguin Publishing" and
+// "The Penguin Publishing Co." all become "penguin publishing". Each
+// publisher is listed with its forms and how often each is used, the
+// most used first, for acquisitions reporting and mapping publishers to
+// vendors. "[s.n.]", no publisher known, is left out.
+
+// publisherWords maps the words of a name to the word they are grouped
+// under, "" for words that are dropped.
+var publisherWords = map[string]string{
+	"pub":          "publishing",
+	"pubs":         "publishing",
+	"publ":         "publishing",
+	"publisher":    "publishing",
+	"publishers":   "publishing",
+	"publication":  "publishing",
+	"publications": "publishing",
+	"bk":           "books",
+	"bks":          "books",
+	"book":         "books",
+	"univ":         "university",
+	"pr":           "press",
+	"intl":         "international",
+	"and":          "",
+	"the":          "",
+	"co":           "",
+	"company":      "",
+	"corp":         "",
+	"corporation":  "",
+	"inc":          "",
+	"incorporated": "",
+	"ltd":          "",
+	"limited":      "",
+	"llc":          "",
+	"plc":          "",
+	"gmbh":         "",
+	"verlag":       "publishing",
+}
+
+// publisherKey returns the key forms of a publisher's name are grouped
+// by, or "" if there is no name.
+func publisherKey(name string) string {
+	var words []string
+	for _, word := range strings.Fields(normalizeName(marcfilter.StripDiacritics(name))) {
+		if w, ok := publisherWords[word]; ok {
+			word = w
+		}
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func getPublisherAction() actionFunc {
+	clusters := make(formClusters)
+
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(w, "publisher\tcount\tform\n")
+		for _, key := range clusters.keys(1) {
+			c := clusters[key]
+			for _, form := range c.sortedForms() {
+				fmt.Fprintf(w, "%s\t%d\t%s\n", key, c.forms[form], form)
+			}
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		for _, f := range m.Fields {
+			if f.Tag != "260" && (f.Tag != "264" || len(f.Indicators) != 2 || f.Indicators[1] != '1') {
+				continue
+			}
+			for _, sf := range f.Subfields {
+				if sf.Code != "b" {
+					continue
+				}
+				form := trimISBD(strings.TrimSpace(sf.Value))
+				if strings.EqualFold(strings.Trim(form, "[]"), "s.n.") {
+					continue
+				}
+				if key := publisherKey(form); key != "" {
+					clusters.add(key, form)
+				}
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marcdump/marcfilter"
+)
+
+// Raw framing. Counting, extracting and indexing records do not need
+// them parsed: the record length frames each record, the selection
+// looks its fields up through the directory (see marcfilter/raw.go),
+// and the bytes are copied as they are. When nothing else in the run
+// needs a parsed record, the records are read that way, into a buffer
+// used again for each record, which on large files is several times
+// faster than parsing each one. A record whose directory is broken is
+// then counted or copied like any other rather than stopping the run;
+// -validate finds those.
+
+// rawFraming returns the selection of raw records for the run, or false
+// if the records have to be parsed. It goes by the same options as
+// getActionFunction.
+func rawFraming(selector marcfilter.Selector) (func(raw []byte) bool, bool) {
+	switch {
+	case countOnly:
+	case listOnly:
+		return nil, false
+	case makeIndex != "":
+	case diffFile != "" || loadStore != "":
+		return nil, false
+	case extractFile != "":
+	default:
+		return nil, false
+	}
+	if mapFile != "" || fieldsOpt != "" && !countOnly || groupBy != "" ||
+		workers > 1 || sortKey != "" || orderFile != "" || len(useIndex) > 0 || len(sinkOpts) > 0 || traceRun {
+		return nil, false
+	}
+	return marcfilter.RawMatcher(selector)
+}
+
+// A rawSource returns the records of the inputs unparsed, without their
+// MarcRecord. The record returned, and its bytes, are only good until
+// the next one is asked for.
+type rawSource struct {
+	ir     *inputReader
+	record marcfilter.Record
+}
+
+func newRawSource(ir *inputReader) *rawSource {
+	ir.reuse = true
+	return &rawSource{ir: ir}
+}
+
+func (s *rawSource) Next() (*marcfilter.Record, error) {
+	f, err := s.ir.nextFrame()
+	if f == nil || err != nil {
+		return nil, err
+	}
+	s.record = marcfilter.Record{Offset: f.offset, Raw: f.raw, Number: f.number}
+	return &s.record, nil
+}
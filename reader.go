@@ -0,0 +1,162 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+)
+
+// A recordReader splits an ISO 2709 stream into records with a
+// marcfilter.Framer, keeping track of where in the stream each record
+// starts.
+type recordReader struct {
+	*marcfilter.Framer
+
+	// if not nil every complete record read is also written to tee,
+	// along with any stray bytes before it unless stripGaps is set
+	tee       *marcWriter
+	stripGaps bool
+
+	// if not nil called with the offset and contents of any stray bytes
+	// found between records
+	onGap func(offset int64, gap []byte)
+
+	// records numbered up to skip are framed but not parsed
+	skip int
+
+	// if not nil the records are decoded from MARCXML or the mnemonic
+	// format (see sniff) instead of being framed, starting at base
+	decoder recordDecoder
+	base    int64
+}
+
+// A recordDecoder reads records that are not in ISO 2709 as ISO 2709,
+// saying where each one started.
+type recordDecoder interface {
+	Next() ([]byte, error)
+	Offset() int64
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	rr := &recordReader{Framer: marcfilter.NewFramer(r)}
+	rr.OnGap = rr.gap
+	return rr
+}
+
+// gap passes on the stray bytes found before a record.
+func (rr *recordReader) gap(offset int64, gap []byte) error {
+	if rr.onGap != nil {
+		rr.onGap(offset, gap)
+	}
+	if rr.tee != nil && !rr.stripGaps {
+		return rr.tee.writeBytes(gap)
+	}
+	return nil
+}
+
+// A frame is the raw bytes of a record that has not been parsed yet,
+// with where they were found.
+type frame struct {
+	raw    []byte
+	offset int64
+	number int
+	input  string // set by an inputReader
+}
+
+// Next returns the next record in the stream, or nil at the end of the
+// stream.
+func (rr *recordReader) Next() (*marcfilter.Record, error) {
+	for {
+		f, err := rr.nextFrame()
+		if f == nil || err != nil {
+			return nil, err
+		}
+		record, err := marcfilter.ParseRecord(f.raw, f.offset, f.number)
+		if err != nil && rr.OnBad != nil {
+			rr.OnBad(f.offset, f.raw, err)
+			continue
+		}
+		return record, err
+	}
+}
+
+// sniff looks at the start of the stream, and reads it as MARCXML or
+// the mnemonic format of -o mrk if it is in either. The records are
+// encoded as ISO 2709 as they are read, so that they are framed,
+// selected and written just like those of a binary file; their offsets
+// are those of their record elements or =LDR lines.
+func (rr *recordReader) sniff() {
+	r := rr.Reader()
+	start, _ := r.Peek(512)
+	switch {
+	case marcfilter.IsMarcXML(start):
+		rr.decoder = marcfilter.NewMarcXMLReader(r)
+	case marcfilter.IsMRK(start):
+		rr.decoder = marcfilter.NewMRKReader(r)
+	}
+	rr.base = rr.Offset
+}
+
+// nextFrame returns the next record in the stream without parsing it,
+// or nil at the end of the stream.
+func (rr *recordReader) nextFrame() (*frame, error) {
+	if rr.decoder != nil {
+		return rr.nextDecodedFrame()
+	}
+	for {
+		raw, err := rr.Framer.Next()
+		if raw == nil || err != nil {
+			return nil, err
+		}
+		if err := rr.copyFrame(raw); err != nil {
+			return nil, err
+		}
+		if rr.Count > rr.skip {
+			return &frame{raw: raw, offset: rr.Start(), number: rr.Count}, nil
+		}
+	}
+}
+
+// nextDecodedFrame returns the next record decoded, or nil at the end
+// of the stream.
+func (rr *recordReader) nextDecodedFrame() (*frame, error) {
+	for {
+		raw, err := rr.decoder.Next()
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", rr.Count+1, err)
+		} else if raw == nil {
+			return nil, nil
+		}
+		offset := rr.base + rr.decoder.Offset()
+		rr.Offset = offset + int64(len(raw))
+		rr.Count += 1
+		if err := rr.copyFrame(raw); err != nil {
+			return nil, err
+		}
+		if rr.Count > rr.skip {
+			return &frame{raw: raw, offset: offset, number: rr.Count}, nil
+		}
+	}
+}
+
+// copyFrame writes a record read to the tee, if there is one.
+func (rr *recordReader) copyFrame(raw []byte) error {
+	if rr.tee != nil {
+		return rr.tee.write(raw)
+	}
+	return nil
+}
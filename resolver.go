@@ -0,0 +1,186 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The record resolver. GET /records/{id} returns the record with that
+// value of the index, in the format the Accept header asks for:
+//
+//    application/marc+json, application/json       MARC-in-JSON (the default)
+//    application/marcxml+xml, application/xml      MARCXML
+//    application/mods+xml, application/mads+xml    MODS or MADS
+//    application/marc                              ISO 2709, as stored
+//
+// A format parameter (json, marcxml, mods or marc) overrides the
+// header, for links followed by browsers. MODS and MADS are the one
+// format, the crosswalk of the record's type (see mads.go): an
+// authority record is returned as MADS whichever of them is asked for,
+// and a bibliographic or holdings record as MODS.
+
+// recordTypes are the media types a record can be returned as, in order
+// of preference when the client accepts several.
+var recordTypes = []struct {
+	mediaType string
+	format    string
+}{
+	{"application/marc+json", "json"},
+	{"application/json", "json"},
+	{"application/marcxml+xml", "marcxml"},
+	{"application/xml", "marcxml"},
+	{"text/xml", "marcxml"},
+	{"application/mods+xml", "mods"},
+	{"application/mads+xml", "mods"},
+	{"application/marc", "marc"},
+}
+
+// negotiateRecordType returns the media type and format for an Accept
+// header, or false if none of the types it accepts can be returned.
+func negotiateRecordType(accept string) (string, string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return recordTypes[0].mediaType, recordTypes[0].format, true
+	}
+
+	best, bestQ := -1, 0.0
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			if v := strings.TrimSpace(p); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		for i, t := range recordTypes {
+			major := t.mediaType[:strings.Index(t.mediaType, "/")+1]
+			if mediaType == t.mediaType || mediaType == "*/*" || mediaType == major+"*" {
+				best, bestQ = i, q
+				break
+			}
+		}
+	}
+	if best < 0 {
+		return "", "", false
+	}
+	return recordTypes[best].mediaType, recordTypes[best].format, true
+}
+
+// requestRecordType returns the media type and format a request asks
+// for, by its format parameter or else its Accept header.
+func requestRecordType(r *http.Request) (string, string, bool) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		for _, t := range recordTypes {
+			if t.format == f {
+				return t.mediaType, t.format, true
+			}
+		}
+		return "", "", false
+	}
+	return negotiateRecordType(r.Header.Get("Accept"))
+}
+
+// serveRecord returns a record looked up in the index.
+func (h *httpHandler) serveRecord(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/records/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if h.store.idKey() == "" {
+		http.Error(w, "records can only be looked up with an index (-index)", http.StatusNotImplemented)
+		return
+	}
+
+	mediaType, format, ok := requestRecordType(r)
+	w.Header().Set("Vary", "Accept")
+	if !ok {
+		http.Error(w, "the record is available as MARC-in-JSON, MARCXML, MODS or MARC", http.StatusNotAcceptable)
+		return
+	}
+
+	record, err := h.store.get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if record == nil {
+		http.Error(w, "no record has "+h.store.idKey()+" "+id, http.StatusNotFound)
+		return
+	}
+
+	if format == "mods" {
+		switch crosswalkOf(record.Leader()) {
+		case "":
+			http.Error(w, "the record is available as MARC-in-JSON, MARCXML or MARC", http.StatusNotAcceptable)
+			return
+		case "mads":
+			mediaType = "application/mads+xml"
+		default:
+			mediaType = "application/mods+xml"
+		}
+	}
+
+	body, err := encodeRecordAs(record, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format != "marc" {
+		mediaType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// encodeRecordAs returns a record in one of the resolver's formats,
+// converted to UTF-8 unless it is returned as stored.
+func encodeRecordAs(record *marcfilter.Record, format string) ([]byte, error) {
+	if format == "marc" {
+		return record.Raw, nil
+	}
+	record, err := convertRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "marcxml":
+		var b bytes.Buffer
+		f := marcfilter.MARCXMLFormatter{}
+		f.Header(&b)
+		if err := f.Record(&b, record); err != nil {
+			return nil, err
+		}
+		f.Footer(&b)
+		return b.Bytes(), nil
+	case "mods":
+		b, err := marshalCrosswalk(record, true)
+		return append([]byte(xml.Header), b...), err
+	}
+	b, err := new(marcfilter.JSONFormatter).Marshal(record)
+	return append(b, '\n'), err
+}
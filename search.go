@@ -0,0 +1,142 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"net/http"
+	"strconv"
+)
+
+// Searching by value. GET /search returns the records with a field, or
+// subfield, of exactly a value, such as the records of an ISBN:
+//
+//    GET /search?field=020_a&value=9780262510875&limit=10
+//    {"records": [MARC-in-JSON...], "more": false}
+//
+// s parameters narrow the search down further, as they do for /records.
+// The records come in file order, as MARC-in-JSON, or as a MARCXML
+// collection or ISO 2709 records when the format parameter or the
+// Accept header asks for them (see resolver.go). When the field is the
+// key of the index the records are looked up in it; otherwise every
+// record is read, which on a large file is slow. more is true when
+// there were more records than the limit.
+
+// serveSearch returns the records having a value.
+func (h *httpHandler) serveSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	field, value := query.Get("field"), query.Get("value")
+	if field == "" || value == "" {
+		http.Error(w, "a search needs a field and a value", http.StatusBadRequest)
+		return
+	}
+	values, err := marcfilter.NewValueSet(field, []string{value})
+	if err != nil {
+		http.Error(w, "invalid field "+field, http.StatusBadRequest)
+		return
+	}
+	var sel marcfilter.Selector = values
+	if narrow, err := requestSelector(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(query["s"]) > 0 {
+		sel = &marcfilter.And{Left: sel, Right: narrow}
+	}
+	n := defaultPageSize
+	if l := query.Get("limit"); l != "" {
+		if n, err = strconv.Atoi(l); err != nil || n < 1 {
+			http.Error(w, "invalid limit "+l, http.StatusBadRequest)
+			return
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+	}
+
+	mediaType, format, ok := requestRecordType(r)
+	w.Header().Set("Vary", "Accept")
+	if !ok || format == "mods" {
+		http.Error(w, "search results are available as MARC-in-JSON, MARCXML or MARC", http.StatusNotAcceptable)
+		return
+	}
+
+	var records []*marcfilter.Record
+	more := false
+	src := h.store.search(sel)
+	for {
+		record, err := src.Next()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if record == nil {
+			break
+		}
+		if !sel.Match(record.MarcRecord) {
+			continue
+		}
+		if len(records) == n {
+			more = true
+			break
+		}
+		records = append(records, record)
+	}
+
+	var b bytes.Buffer
+	switch format {
+	case "json":
+		var result struct {
+			Records []json.RawMessage `json:"records"`
+			More    bool              `json:"more"`
+		}
+		result.Records = []json.RawMessage{}
+		for _, record := range records {
+			rb, err := encodeRecordAs(record, "json")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result.Records = append(result.Records, rb)
+		}
+		result.More = more
+		json.NewEncoder(&b).Encode(&result)
+	case "marcxml":
+		f := marcfilter.MARCXMLFormatter{}
+		f.Header(&b)
+		for _, record := range records {
+			record, err := convertRecord(record)
+			if err == nil {
+				err = f.Record(&b, record)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		f.Footer(&b)
+	case "marc":
+		for _, record := range records {
+			b.Write(record.Raw)
+		}
+	}
+
+	if format != "marc" {
+		mediaType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.Write(b.Bytes())
+}
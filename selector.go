@@ -0,0 +1,102 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/TreeRex/marcdump/marcfilter"
+	"strings"
+)
+
+// Selections. Each -s takes a selector expression, as parsed by the
+// marcfilter package, and repeating -s ANDs the expressions together.
+// -idfile selects the records with one of a list of identifiers; with
+// an index on -idfield each listed record is read with a seek instead
+// of scanning the file.
+
+// A stringList is a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseSelector parses a selector expression, calling the macros of
+// the configuration file (see config.go).
+func parseSelector(expr string) (marcfilter.Selector, error) {
+	expr, err := expandMacros(expr, 0)
+	if err != nil {
+		return nil, err
+	}
+	return marcfilter.ParseSelector(expr)
+}
+
+// getSelector parses the -s options into a selector, adding the -agency,
+// -type and -idfile filters. Without any every record is selected.
+func getSelector() (marcfilter.Selector, error) {
+	var sel marcfilter.Selector
+	for _, expr := range selectorOpts {
+		s, err := parseSelector(expr)
+		if err != nil {
+			return nil, err
+		}
+		if sel == nil {
+			sel = s
+		} else {
+			sel = &marcfilter.And{Left: sel, Right: s}
+		}
+	}
+	if agencyOpt != "" {
+		if sel == nil {
+			sel = newAgencySelector(agencyOpt)
+		} else {
+			sel = &marcfilter.And{Left: sel, Right: newAgencySelector(agencyOpt)}
+		}
+	}
+	if typeOpt != "" {
+		s, err := newFormatSelector(typeOpt)
+		if err != nil {
+			return nil, err
+		}
+		if sel == nil {
+			sel = s
+		} else {
+			sel = &marcfilter.And{Left: sel, Right: s}
+		}
+	}
+	if idFile != "" {
+		ids, err := loadKeyList(idFile)
+		if err != nil {
+			return nil, err
+		}
+		s, err := marcfilter.NewValueSet(idField, ids)
+		if err != nil {
+			return nil, err
+		}
+		if sel == nil {
+			sel = s
+		} else {
+			sel = &marcfilter.And{Left: sel, Right: s}
+		}
+	}
+	if sel == nil {
+		sel = new(marcfilter.Spec)
+	}
+	return sel, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Serving a file to other programs:
+//
+//    marcdump serve grpc [-listen addr | -port n] [-index file] [-cert file -key file] [access] store
+//    marcdump serve http [-listen addr | -port n] [-index file] [-cert file -key file] [-poll interval] [access] store
+//
+// The store is a MARC file or a database (see store.go). The grpc mode
+// answers the requests of the Records gRPC service (see marcdump.proto)
+// from it. Records of a file are looked up by the values of the index,
+// which is best made on 001 with -mkindex, and searches with a selector
+// the index can narrow down only read the records it finds. The http
+// mode resolves record URLs (see resolver.go) in the same way, searches
+// by value (see search.go), lists the records a page at a time (see
+// pages.go), and streams the records added to a file (see events.go).
+// -port n is short for -listen :n. The access options are in auth.go.
+// A file is read as requests come in, so it can be bigger than memory,
+// but it must not be compressed.
+
+var (
+	errUnknownServeMode = errors.New("marcdump: unknown serve mode")
+	errServeArgs        = errors.New("marcdump: serve takes a single record store")
+	errServeIndex       = errors.New("marcdump: serving a file over grpc needs an index on it (-index)")
+	errServeCompressed  = errors.New("marcdump: a compressed file cannot be served")
+)
+
+// serve parses the arguments following "serve" and serves the file
+// until the server fails.
+func serve(args []string) error {
+	if len(args) == 0 || args[0] != "grpc" && args[0] != "http" {
+		return errUnknownServeMode
+	}
+	mode := args[0]
+
+	address := ":50051"
+	if mode == "http" {
+		address = ":8080"
+	}
+	flags := flag.NewFlagSet("serve "+mode, flag.ContinueOnError)
+	listen := flags.String("listen", address, "`address` to listen on")
+	port := flags.Int("port", 0, "Port to listen on, on every interface; overrides -listen")
+	defaultIndex := ""
+	if len(useIndex) > 0 {
+		defaultIndex = useIndex[0]
+	}
+	indexName := flags.String("index", defaultIndex, "Index `file` to look records up with")
+	certFile := flags.String("cert", "", "TLS certificate `file`; without one clients connect in plain text")
+	keyFile := flags.String("key", "", "TLS key `file`")
+	keysName := flags.String("api-keys", "", "Accept only requests with one of the API keys listed in `file`")
+	usersName := flags.String("users", "", "Accept only requests from the users listed in `file` as user:bcrypt hash of the password")
+	readOnly := flags.Bool("read-only", true, "Open a database so that it cannot be changed; false opens it as given, for one that refuses read-only connections")
+	cacheSize := flags.Int("cache", 1000, "Number of records looked up by id to keep in memory; 0 for none")
+	var poll *time.Duration
+	if mode == "http" {
+		poll = flags.Duration("poll", time.Second, "How often to look for records added to the file")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errServeArgs
+	}
+	if *port != 0 {
+		*listen = ":" + strconv.Itoa(*port)
+	}
+
+	auth, err := newAuthenticator(*keysName, *usersName)
+	if err != nil {
+		return err
+	}
+	store, err := openRecordStore(flags.Arg(0), *indexName, *readOnly)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+	if *cacheSize > 0 {
+		store = &cachedStore{store, newRecordCache(*cacheSize)}
+	}
+	if mode == "grpc" && store.idKey() == "" {
+		return errServeIndex
+	}
+
+	srv := &http.Server{Addr: *listen}
+	var followed chan error
+	var stopFollowing context.CancelFunc
+	if mode == "grpc" {
+		srv.Handler = newGRPCHandler(store, auth)
+		// gRPC needs HTTP/2, which without TLS has to be asked for
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	} else {
+		h := newHTTPHandler(store, auth)
+		if h.follower != nil {
+			// the follower stops, before the store is closed, when the
+			// server does; if it fails, the server stops with it
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			followed = make(chan error, 1)
+			go func() {
+				err := h.follower.follow(ctx, *poll)
+				if err != nil {
+					srv.Close()
+				}
+				followed <- err
+			}()
+			stopFollowing = cancel
+		}
+		srv.Handler = h
+	}
+
+	fmt.Fprintf(os.Stderr, "Serving %s over %s on %s\n", flags.Arg(0), mode, *listen)
+	shutdown := shutdownOnSignal(srv)
+	if *certFile != "" {
+		err = srv.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	var followErr error
+	if err == http.ErrServerClosed {
+		// closed as soon as the shutdown starts; wait for the requests
+		// in progress, unless it was the follower that closed it
+		err = nil
+		select {
+		case <-shutdown:
+		case followErr = <-followed:
+			followed = nil
+		}
+	}
+	if followed != nil {
+		stopFollowing()
+		followErr = <-followed
+	}
+	if err == nil {
+		err = followErr
+	}
+	return err
+}
+
+// An httpHandler serves the HTTP endpoints.
+type httpHandler struct {
+	store    recordStore
+	auth     *authenticator
+	follower *follower // nil unless the store is a file
+	mux      *http.ServeMux
+}
+
+func newHTTPHandler(store recordStore, auth *authenticator) *httpHandler {
+	h := &httpHandler{store: store, auth: auth, mux: http.NewServeMux()}
+	base := store
+	if cs, ok := store.(*cachedStore); ok {
+		base = cs.recordStore
+	}
+	if fs, ok := base.(*fileStore); ok {
+		h.follower = newFollower(fs.file, fs.size)
+	}
+	h.mux.HandleFunc("/events", h.serveEvents)
+	h.mux.HandleFunc("/records", h.serveRecordList)
+	h.mux.HandleFunc("/records/", h.serveRecord)
+	h.mux.HandleFunc("/search", h.serveSearch)
+	return h
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "the server is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.auth.allowed(r) {
+		h.auth.challenge(w)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// requestSelector returns the selector of a request: its s parameters,
+// ANDed together like -s options, or one selecting every record.
+func requestSelector(r *http.Request) (marcfilter.Selector, error) {
+	var sel marcfilter.Selector
+	for _, expr := range r.URL.Query()["s"] {
+		s, err := parseSelector(expr)
+		if err != nil {
+			return nil, err
+		}
+		if sel == nil {
+			sel = s
+		} else {
+			sel = &marcfilter.And{Left: sel, Right: s}
+		}
+	}
+	if sel == nil {
+		sel = new(marcfilter.Spec)
+	}
+	return sel, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Signals. On SIGINT or SIGTERM marcdump finishes the record it is on
+// and stops reading, then finishes as at the end of the input: output
+// files, extracts and indexes are flushed and closed and the summaries
+// printed, so an interrupted run leaves whole files behind. A second
+// signal, say while waiting on a slow input, stops marcdump at once.
+// serve stops taking connections and gives the requests in progress
+// shutdownGrace to complete.
+
+// shutdownGrace is how long serve waits for requests in progress.
+const shutdownGrace = 5 * time.Second
+
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// interrupted is set to 1 once a signal has been received.
+var interrupted int32
+
+// catchSignals sets interrupted on the first signal, leaving the next
+// one to end the process.
+func catchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	go func() {
+		sig := <-signals
+		signal.Reset(shutdownSignals...)
+		atomic.StoreInt32(&interrupted, 1)
+		fmt.Fprintf(os.Stderr, "Received %v; finishing (again to stop at once)\n", sig)
+	}()
+}
+
+// wasInterrupted reports whether a signal has been received.
+func wasInterrupted() bool {
+	return atomic.LoadInt32(&interrupted) != 0
+}
+
+// shutdownOnSignal shuts the server down on the first signal,
+// returning a channel closed once the shutdown is over.
+func shutdownOnSignal(srv *http.Server) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-signals
+		signal.Reset(shutdownSignals...)
+		fmt.Fprintf(os.Stderr, "Received %v; shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			// streams such as /events do not end by themselves
+			srv.Close()
+		}
+	}()
+	return done
+}
@@ -0,0 +1,185 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Sinks, for feeding several outputs from one pass over a file. Each
+// -sink format=file writes the selected records to the file, "-" being
+// the standard output, in one of the -o formats or as binary MARC:
+//
+//    -sink marc=selected.mrc -sink ndjson=- -sink errors=run.log
+//
+// The sinks take the place of -o, or are written alongside the output
+// of another action such as -validate. errors=file sends the warnings
+// and errors to the file instead of the standard error. -append adds
+// to the files instead of replacing them, as resuming from a
+// checkpoint does; a format with a header and footer, such as
+// marcxml, then gets one of each per run.
+
+var (
+	errInvalidSink = errors.New("marcdump: -sink takes format=file")
+	errSinkStdout  = errors.New("marcdump: only one -sink can write to the standard output")
+)
+
+// A sink is one output of the records.
+type sink struct {
+	out *marcWriter // nil for the standard output
+
+	// a formatter writing to tw, or nil for binary MARC
+	f  marcfilter.Formatter
+	tw *tabwriter.Writer
+}
+
+// openErrorSink sends the standard error to a file.
+func openErrorSink(name string) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendMarcWriters {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(name, flags, 0666)
+	if err != nil {
+		return err
+	}
+	os.Stderr = file
+	errorSinkName = name
+	return nil
+}
+
+// getSinkAction returns an action writing each record to the sinks
+// and then passing it on to next, if it is not nil.
+func getSinkAction(opts []string, next actionFunc) (actionFunc, error) {
+	var sinks []*sink
+	stdout := false
+	for _, opt := range opts {
+		i := strings.IndexByte(opt, '=')
+		if i <= 0 || i == len(opt)-1 {
+			return nil, errInvalidSink
+		}
+		format, name := opt[:i], opt[i+1:]
+		if format == "errors" {
+			if err := openErrorSink(name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		s := new(sink)
+		if format != "marc" {
+			newFormatter, ok := formatters[format]
+			if !ok {
+				return nil, errUnknownOutputFormat
+			}
+			f, err := newFormatter()
+			if err != nil {
+				return nil, err
+			}
+			s.f = f
+		}
+		if name == "-" {
+			if stdout {
+				return nil, errSinkStdout
+			}
+			stdout = true
+		} else {
+			out, err := createMarcWriter(name)
+			if err != nil {
+				return nil, err
+			}
+			s.out = out
+		}
+		if s.f != nil {
+			var flags uint
+			if alignRight {
+				flags |= tabwriter.AlignRight
+			}
+			if separator != "" || format == "tsv" || format == "template" {
+				flags |= tabwriter.StripEscape
+			}
+			s.tw = new(tabwriter.Writer)
+			if s.out != nil {
+				s.tw.Init(s.out.w, minWidth, tabWidth, padding, ' ', flags)
+			} else {
+				s.tw.Init(os.Stdout, minWidth, tabWidth, padding, ' ', flags)
+			}
+			if err := s.f.Header(s.tw); err != nil {
+				return nil, err
+			}
+		}
+		sinks = append(sinks, s)
+	}
+
+	onFinish(func(w *tabwriter.Writer) error {
+		for _, s := range sinks {
+			if s.f != nil {
+				if err := s.f.Footer(s.tw); err != nil {
+					return err
+				}
+				if err := s.tw.Flush(); err != nil {
+					return err
+				}
+			}
+			if s.out != nil {
+				if err := s.out.close(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		converted := record
+		if !rawOutput {
+			var err error
+			if converted, err = convertRecord(record); err != nil {
+				return err
+			}
+		}
+		for _, s := range sinks {
+			if s.f == nil {
+				if s.out == nil {
+					if _, err := os.Stdout.Write(record.Raw); err != nil {
+						return err
+					}
+				} else if err := s.out.write(record.Raw); err != nil {
+					return err
+				}
+				continue
+			}
+			formatted := converted
+			if convertsRecords(s.f) {
+				formatted = record
+			}
+			if err := s.f.Record(s.tw, formatted); err != nil {
+				return fmt.Errorf("-sink: %v", err)
+			}
+			if err := s.tw.Flush(); err != nil {
+				return err
+			}
+		}
+		if next != nil {
+			return next(record, w)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,301 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Record sorting. -sort 245_a outputs the selected records in the order
+// of the first value of a field, or field and subfield; -sort-numeric
+// orders them by the first number in the value, so that "c1998." sorts
+// before "2001", and -reverse from the largest down. Records without the
+// field, or without a number in it, sort first (last with -reverse), and
+// records with the same key keep their input order. Keys are compared
+// as -collate says (see collation.go).
+//
+// The records are sorted in memory in runs of up to sortRunBytes. If the
+// input has more, each run is written to a temporary file and the runs
+// are merged as the records are output, so a file of any size can be
+// sorted with the disk space to hold it once more.
+
+var errInvalidSortKey = errors.New("marcdump: invalid sort key field")
+
+// sortRunBytes is the most record data sorted in memory at once.
+const sortRunBytes = 64 << 20
+
+var sortNumberRegexp = regexp.MustCompile(`[0-9]+(\.[0-9]+)?`)
+
+// A sortEntry is a record and its key. seq is its position among the
+// records sorted, which breaks ties.
+type sortEntry struct {
+	key    string
+	number float64 // -Inf when there is no number
+	seq    int64
+	record *marcfilter.Record
+}
+
+// A sortedSource returns the records of a source sorted by a key.
+type sortedSource struct {
+	entries []*sortEntry // sorted in memory, when nothing was spilled
+	runs    []*sortRun   // the spilled runs, as a heap
+	numeric bool
+	reverse bool
+}
+
+// newSortedSource reads the records of src that match and are within
+// the window, sorting them by the values of keyField.
+func newSortedSource(src marcfilter.Source, keyField string, numeric bool, reverse bool, match func(*marcfilter.Record) bool, window recordWindow) (*sortedSource, error) {
+	spec := marcfilter.SpecRegexp.FindStringSubmatch(keyField)
+	if spec == nil || spec[3] != "" {
+		return nil, errInvalidSortKey
+	}
+	tag, code := spec[1], spec[2]
+	s := &sortedSource{numeric: numeric, reverse: reverse}
+
+	var size int
+	var seq int64
+	for {
+		if wasInterrupted() {
+			// nothing is output, and no runs are left behind
+			s.close()
+			s.entries = nil
+			return s, nil
+		}
+		record, err := src.Next()
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		if record == nil || window.past(record.Number) {
+			break
+		}
+		if !match(record) {
+			continue
+		}
+		e := &sortEntry{number: math.Inf(-1), seq: seq, record: record}
+		seq++
+		if values := marcfilter.FieldValues(record.MarcRecord, tag, code); len(values) > 0 {
+			e.key = values[0]
+			if n := sortNumberRegexp.FindString(e.key); n != "" {
+				e.number, _ = strconv.ParseFloat(n, 64)
+			}
+		}
+		s.entries = append(s.entries, e)
+		if size += len(record.Raw); size >= sortRunBytes {
+			if err := s.spill(); err != nil {
+				s.close()
+				return nil, err
+			}
+			size = 0
+		}
+	}
+
+	if len(s.runs) > 0 {
+		if err := s.spill(); err != nil {
+			s.close()
+			return nil, err
+		}
+		for _, run := range s.runs {
+			if err := run.next(); err != nil {
+				s.close()
+				return nil, err
+			}
+		}
+		heap.Init(s)
+	} else {
+		sort.Slice(s.entries, func(i, j int) bool { return s.less(s.entries[i], s.entries[j]) })
+	}
+	return s, nil
+}
+
+// less reports whether one entry sorts before another.
+func (s *sortedSource) less(a *sortEntry, b *sortEntry) bool {
+	var c int
+	switch {
+	case s.numeric && a.number < b.number:
+		c = -1
+	case s.numeric && a.number > b.number:
+		c = 1
+	case !s.numeric:
+		c = compareValues(a.key, b.key)
+	}
+	if s.reverse {
+		c = -c
+	}
+	if c != 0 {
+		return c < 0
+	}
+	return a.seq < b.seq
+}
+
+// spill sorts the records in memory and writes them to a run file.
+func (s *sortedSource) spill() error {
+	if len(s.entries) == 0 {
+		return nil
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.less(s.entries[i], s.entries[j]) })
+	file, err := ioutil.TempFile("", "marcdump-sort")
+	if err != nil {
+		return err
+	}
+	run := &sortRun{file: file}
+	s.runs = append(s.runs, run)
+
+	w := bufio.NewWriter(file)
+	for _, e := range s.entries {
+		if err := writeSortEntry(w, e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	run.r = bufio.NewReader(file)
+	s.entries = nil
+	return nil
+}
+
+func (s *sortedSource) Next() (*marcfilter.Record, error) {
+	if len(s.runs) == 0 {
+		if len(s.entries) == 0 {
+			return nil, nil
+		}
+		e := s.entries[0]
+		s.entries = s.entries[1:]
+		return e.record, nil
+	}
+
+	run := s.runs[0]
+	record := run.entry.record
+	if err := run.next(); err != nil {
+		return nil, err
+	}
+	if run.entry == nil {
+		heap.Pop(s)
+		run.remove()
+	} else {
+		heap.Fix(s, 0)
+	}
+	return record, nil
+}
+
+// close removes the run files left.
+func (s *sortedSource) close() {
+	for _, run := range s.runs {
+		run.remove()
+	}
+	s.runs = nil
+}
+
+// The runs are merged through a heap of them by their next entries.
+
+func (s *sortedSource) Len() int           { return len(s.runs) }
+func (s *sortedSource) Less(i, j int) bool { return s.less(s.runs[i].entry, s.runs[j].entry) }
+func (s *sortedSource) Swap(i, j int)      { s.runs[i], s.runs[j] = s.runs[j], s.runs[i] }
+func (s *sortedSource) Push(x interface{}) { s.runs = append(s.runs, x.(*sortRun)) }
+
+func (s *sortedSource) Pop() interface{} {
+	run := s.runs[len(s.runs)-1]
+	s.runs = s.runs[:len(s.runs)-1]
+	return run
+}
+
+// A sortRun is a file of sorted entries, and the next one read from it.
+type sortRun struct {
+	file  *os.File
+	r     *bufio.Reader
+	entry *sortEntry
+}
+
+// writeSortEntry writes an entry to a run: the key, number and
+// sequence, then the record's offset, number and data.
+func writeSortEntry(w *bufio.Writer, e *sortEntry) error {
+	var buf [binary.MaxVarintLen64]byte
+	putInt := func(n int64) error {
+		_, err := w.Write(buf[:binary.PutVarint(buf[:], n)])
+		return err
+	}
+	err := putInt(int64(len(e.key)))
+	if err == nil {
+		_, err = w.WriteString(e.key)
+	}
+	if err == nil {
+		err = binary.Write(w, binary.LittleEndian, e.number)
+	}
+	for _, n := range []int64{e.seq, e.record.Offset, int64(e.record.Number), int64(len(e.record.Raw))} {
+		if err == nil {
+			err = putInt(n)
+		}
+	}
+	if err == nil {
+		_, err = w.Write(e.record.Raw)
+	}
+	return err
+}
+
+// next reads the run's next entry, leaving entry nil at the end.
+func (run *sortRun) next() error {
+	run.entry = nil
+	n, err := binary.ReadVarint(run.r)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	key := make([]byte, n)
+	if _, err := io.ReadFull(run.r, key); err != nil {
+		return err
+	}
+	e := &sortEntry{key: string(key)}
+	if err := binary.Read(run.r, binary.LittleEndian, &e.number); err != nil {
+		return err
+	}
+	var offset, number, length int64
+	for _, v := range []*int64{&e.seq, &offset, &number, &length} {
+		if *v, err = binary.ReadVarint(run.r); err != nil {
+			return err
+		}
+	}
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(run.r, raw); err != nil {
+		return err
+	}
+	if e.record, err = marcfilter.ParseRecord(raw, offset, int(number)); err != nil {
+		return err
+	}
+	run.entry = e
+	return nil
+}
+
+// remove closes and deletes the run's file.
+func (run *sortRun) remove() {
+	run.file.Close()
+	os.Remove(run.file.Name())
+}
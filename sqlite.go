@@ -0,0 +1,179 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"os"
+)
+
+// SQLite output. -o sqlite=out.db loads the records into tables for
+// analysis with SQL:
+//
+//    records   (id, number, control_number, leader, raw)
+//    fields    (id, record_id, seq, tag, indicators, value)
+//    subfields (id, field_id, seq, code, value)
+//
+// A control field has its value in fields.value, a data field its
+// subfields in subfields. subfields_fts is a full text index of the
+// subfield values, e.g.
+//
+//    SELECT f.tag, s.value FROM subfields_fts
+//    JOIN subfields s ON s.id = subfields_fts.docid
+//    JOIN fields f ON f.id = s.field_id
+//    WHERE subfields_fts MATCH 'cataloging'
+//
+// Records are added to an existing database. Like a database store for
+// serve, this needs the sqlite build tag.
+
+// sqliteBatchSize is the number of records inserted per transaction.
+const sqliteBatchSize = 1000
+
+var sqliteSchema = []string{
+	"CREATE TABLE IF NOT EXISTS records (id INTEGER PRIMARY KEY, number INTEGER, control_number TEXT, leader TEXT, raw BLOB)",
+	"CREATE TABLE IF NOT EXISTS fields (id INTEGER PRIMARY KEY, record_id INTEGER NOT NULL REFERENCES records, seq INTEGER, tag TEXT, indicators TEXT, value TEXT)",
+	"CREATE TABLE IF NOT EXISTS subfields (id INTEGER PRIMARY KEY, field_id INTEGER NOT NULL REFERENCES fields, seq INTEGER, code TEXT, value TEXT)",
+	"CREATE INDEX IF NOT EXISTS records_control_number ON records (control_number)",
+	"CREATE INDEX IF NOT EXISTS fields_record ON fields (record_id, tag)",
+	"CREATE INDEX IF NOT EXISTS subfields_field ON subfields (field_id)",
+	"CREATE VIRTUAL TABLE IF NOT EXISTS subfields_fts USING fts4(content=\"subfields\", value)",
+}
+
+// An sqliteFormatter inserts records into a database rather than
+// writing them out.
+type sqliteFormatter struct {
+	name string
+	db   *sql.DB
+	tx   *sql.Tx
+
+	insertRecord, insertField, insertSubfield *sql.Stmt
+
+	// the last ids used in each table
+	recordID, fieldID, subfieldID int64
+	count                         int
+}
+
+func newSQLiteFormatter(name string) (marcfilter.Formatter, error) {
+	store, err := openSQLStore("sqlite3", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &sqliteFormatter{name: name, db: store.db}
+	for _, stmt := range sqliteSchema {
+		if _, err := f.db.Exec(stmt); err != nil {
+			f.db.Close()
+			return nil, err
+		}
+	}
+	for table, id := range map[string]*int64{"records": &f.recordID, "fields": &f.fieldID, "subfields": &f.subfieldID} {
+		if err := f.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM " + table).Scan(id); err != nil {
+			f.db.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// begin starts the transaction of a batch of records.
+func (f *sqliteFormatter) begin() error {
+	var err error
+	if f.tx, err = f.db.Begin(); err != nil {
+		return err
+	}
+	prepare := func(query string) *sql.Stmt {
+		stmt, e := f.tx.Prepare(query)
+		if err == nil {
+			err = e
+		}
+		return stmt
+	}
+	f.insertRecord = prepare("INSERT INTO records (id, number, control_number, leader, raw) VALUES (?, ?, ?, ?, ?)")
+	f.insertField = prepare("INSERT INTO fields (id, record_id, seq, tag, indicators, value) VALUES (?, ?, ?, ?, ?, ?)")
+	f.insertSubfield = prepare("INSERT INTO subfields (id, field_id, seq, code, value) VALUES (?, ?, ?, ?, ?)")
+	return err
+}
+
+// commit ends the transaction of a batch.
+func (f *sqliteFormatter) commit() error {
+	if f.tx == nil {
+		return nil
+	}
+	err := f.tx.Commit()
+	f.tx = nil
+	return err
+}
+
+func (f *sqliteFormatter) Header(w io.Writer) error {
+	return nil
+}
+
+func (f *sqliteFormatter) Record(w io.Writer, record *marcfilter.Record) error {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return err
+	}
+	if f.tx == nil {
+		if err := f.begin(); err != nil {
+			return err
+		}
+	}
+
+	f.recordID++
+	if _, err := f.insertRecord.Exec(f.recordID, record.Number, controlNumber(record), string(m.Leader), record.Raw); err != nil {
+		return err
+	}
+	for i, field := range m.Fields {
+		f.fieldID++
+		var indicators, value interface{}
+		if marc21.IsControlFieldTag(field.Tag) {
+			value = field.Value
+		} else {
+			indicators = field.Indicators
+		}
+		if _, err := f.insertField.Exec(f.fieldID, f.recordID, i+1, field.Tag, indicators, value); err != nil {
+			return err
+		}
+		for j, sf := range field.Subfields {
+			f.subfieldID++
+			if _, err := f.insertSubfield.Exec(f.subfieldID, f.fieldID, j+1, sf.Code, sf.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	f.count++
+	if f.count%sqliteBatchSize == 0 {
+		return f.commit()
+	}
+	return nil
+}
+
+// Footer commits the last batch and brings the full text index up to
+// date, which is quicker done once than record by record.
+func (f *sqliteFormatter) Footer(w io.Writer) error {
+	defer f.db.Close()
+	if err := f.commit(); err != nil {
+		return err
+	}
+	if _, err := f.db.Exec("INSERT INTO subfields_fts (subfields_fts) VALUES ('rebuild')"); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d records written to %s\n", f.count, f.name)
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// File statistics: a profile of the records read instead of the
+// records themselves.
+
+type tagStats struct {
+	occurrences int
+	records     int
+	subfields   map[string]int
+}
+
+type fileStats struct {
+	records  int
+	bytes    int64
+	smallest int
+	largest  int
+
+	types     map[string]int // Leader/06
+	levels    map[string]int // Leader/07
+	languages map[string]int // 008/35-37 of bibliographic records
+	tags      map[string]*tagStats
+
+	// by -group-by
+	groupRecords map[string]int
+	groupBytes   map[string]int
+}
+
+func newFileStats() *fileStats {
+	return &fileStats{
+		types:        make(map[string]int),
+		levels:       make(map[string]int),
+		languages:    make(map[string]int),
+		tags:         make(map[string]*tagStats),
+		groupRecords: make(map[string]int),
+		groupBytes:   make(map[string]int),
+	}
+}
+
+func (s *fileStats) add(record *marcfilter.Record, group string) error {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+	}
+
+	size := len(record.Raw)
+	if s.records == 0 || size < s.smallest {
+		s.smallest = size
+	}
+	if size > s.largest {
+		s.largest = size
+	}
+	s.records += 1
+	s.bytes += int64(size)
+	s.types[string(m.Leader[6])] += 1
+	s.levels[string(m.Leader[7])] += 1
+	s.groupRecords[group] += 1
+	s.groupBytes[group] += size
+	if fixed := m.FieldsByTag("008"); len(fixed) > 0 && len(fixed[0].Value) >= 38 && recordFormat(string(m.Leader)) == formatBibliographic {
+		s.languages[fixed[0].Value[35:38]] += 1
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range m.Fields {
+		t := s.tags[f.Tag]
+		if t == nil {
+			t = &tagStats{subfields: make(map[string]int)}
+			s.tags[f.Tag] = t
+		}
+		t.occurrences += 1
+		if !seen[f.Tag] {
+			t.records += 1
+			seen[f.Tag] = true
+		}
+		for _, sf := range f.Subfields {
+			t.subfields[sf.Code] += 1
+		}
+	}
+	return nil
+}
+
+func (s *fileStats) print(w *tabwriter.Writer, grouped bool) {
+	fmt.Fprintf(w, "records\t%d\n", s.records)
+	fmt.Fprintf(w, "bytes\t%d\n", s.bytes)
+	if s.records > 0 {
+		fmt.Fprintf(w, "average size\t%d\n", s.bytes/int64(s.records))
+		fmt.Fprintf(w, "smallest\t%d\n", s.smallest)
+		fmt.Fprintf(w, "largest\t%d\n", s.largest)
+	}
+
+	fmt.Fprintf(w, "\ntype (Leader/06)\trecords\n")
+	for _, v := range sortedGroups(s.types) {
+		fmt.Fprintf(w, "%q\t%d\n", v, s.types[v])
+	}
+	fmt.Fprintf(w, "\nlevel (Leader/07)\trecords\n")
+	for _, v := range sortedGroups(s.levels) {
+		fmt.Fprintf(w, "%q\t%d\n", v, s.levels[v])
+	}
+
+	tags := make([]string, 0, len(s.tags))
+	for tag := range s.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	fmt.Fprintf(w, "\ntag\toccurrences\trecords\tsubfields\n")
+	for _, tag := range tags {
+		t := s.tags[tag]
+		var subfields []string
+		for _, code := range sortedGroups(t.subfields) {
+			subfields = append(subfields, fmt.Sprintf("%s:%d", code, t.subfields[code]))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", tag, t.occurrences, t.records, strings.Join(subfields, " "))
+	}
+
+	if grouped {
+		fmt.Fprintf(w, "\ngroup\trecords\tbytes\taverage size\n")
+		for _, name := range sortedGroups(s.groupRecords) {
+			n := s.groupRecords[name]
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", name, n, s.groupBytes[name], s.groupBytes[name]/n)
+		}
+	}
+}
+
+// getStatsAction returns an action accumulating statistics over the
+// records and printing them at the end. If group is not nil the record
+// counts and sizes are also broken down by group.
+func getStatsAction(group groupFunc) actionFunc {
+	stats := newFileStats()
+	onFinish(func(w *tabwriter.Writer) error {
+		stats.print(w, group != nil)
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		name := ""
+		if group != nil {
+			name = group(record)
+		}
+		return stats.add(record, name)
+	}
+}
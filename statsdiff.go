@@ -0,0 +1,146 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"math"
+	"sort"
+	"text/tabwriter"
+)
+
+// Comparing the statistics of two versions of a file, to catch a
+// vendor's regenerated file that lost a field or relabeled half of its
+// records before it is loaded. stats diff old.mrc new.mrc profiles the
+// selected records of each file (see stats.go) and reports the share of
+// the records with each type, bibliographic level, language and tag in
+// the old and the new file:
+//
+//    tag    old    old %    new    new %    shift
+//    020    2690   99.6     1350   50.0     -49.6 !
+//
+// A shift, in percentage points, of at least -shift (5 by default) is
+// marked with a "!", and the shifts marked are counted at the end.
+
+var errStatsDiffArgs = errors.New("marcdump: stats diff takes an old and a new file")
+
+// statsDiff parses the arguments following "stats diff", and compares
+// the statistics of the two files.
+func statsDiff(args []string, selector marcfilter.Selector, w *tabwriter.Writer) error {
+	flags := flag.NewFlagSet("stats diff", flag.ContinueOnError)
+	threshold := flags.Float64("shift", 5, "Mark shifts of at least `points` percentage points")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errStatsDiffArgs
+	}
+
+	var profiles [2]*fileStats
+	for i, name := range flags.Args() {
+		s, err := readFileStats(name, selector)
+		if err != nil {
+			return err
+		}
+		profiles[i] = s
+	}
+	before, after := profiles[0], profiles[1]
+
+	fmt.Fprintf(w, "records\t%d\t\t%d\n", before.records, after.records)
+	shifts := 0
+	for _, d := range []struct {
+		heading  string
+		old, new map[string]int
+		quote    bool
+	}{
+		{"type (Leader/06)", before.types, after.types, true},
+		{"level (Leader/07)", before.levels, after.levels, true},
+		{"language (008/35-37)", before.languages, after.languages, true},
+		{"tag", tagRecords(before), tagRecords(after), false},
+	} {
+		fmt.Fprintf(w, "\n%s\told\told %%\tnew\tnew %%\tshift\n", d.heading)
+		for _, v := range unionKeys(d.old, d.new) {
+			oldShare := shareOf(d.old[v], before.records)
+			newShare := shareOf(d.new[v], after.records)
+			shift := newShare - oldShare
+			mark := ""
+			if math.Abs(shift) >= *threshold {
+				mark = " !"
+				shifts++
+			}
+			label := v
+			if d.quote {
+				label = fmt.Sprintf("%q", v)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%.1f\t%d\t%.1f\t%+.1f%s\n", label, d.old[v], oldShare, d.new[v], newShare, shift, mark)
+		}
+	}
+	fmt.Fprintf(w, "\n%d shifts of at least %g points\n", shifts, *threshold)
+	return w.Flush()
+}
+
+// readFileStats profiles the records of a file that the selector
+// matches.
+func readFileStats(name string, selector marcfilter.Selector) (*fileStats, error) {
+	s := newFileStats()
+	reader := newInputReader([]string{name})
+	for {
+		record, err := reader.Next()
+		if record == nil || err != nil {
+			return s, err
+		}
+		if !selector.Match(record.MarcRecord) {
+			continue
+		}
+		if err := s.add(record, ""); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// shareOf returns n as a percentage of total.
+func shareOf(n int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// tagRecords returns the number of records with each tag.
+func tagRecords(s *fileStats) map[string]int {
+	records := make(map[string]int)
+	for tag, t := range s.tags {
+		records[tag] = t.records
+	}
+	return records
+}
+
+// unionKeys returns the keys of either map, sorted.
+func unionKeys(a, b map[string]int) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
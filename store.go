@@ -0,0 +1,344 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Record stores. serve reads its records from a store named by a
+// connection string:
+//
+//    path/to/file.mrc, file:path     a MARC file, with its -index if any
+//    sqlite:path/to/records.db       an SQLite database
+//    postgres://user@host/db         a PostgreSQL database
+//
+// A database holds the records in a table
+//
+//    records (seq, id, raw)
+//
+// of their ISO 2709 bytes by id, in the order they were loaded, which
+// -load conn fills from the input, taking the id from -load-key, or the
+// -id-expr (see ids.go). The database drivers are only built in when
+// asked for, with go build -tags sqlite or -tags postgres. Only a file
+// can be followed for added records.
+
+var (
+	errLoadFileStore  = errors.New("marcdump: -load needs a database connection string")
+	errInvalidLoadKey = errors.New("marcdump: invalid load key field")
+)
+
+// A recordStore gives access to the records served. Stores are safe for
+// concurrent use.
+type recordStore interface {
+	// get returns the first record with the given id, or nil.
+	get(id string) (*marcfilter.Record, error)
+
+	// search returns the records that can match the selector, which the
+	// caller still has to test.
+	search(sel marcfilter.Selector) marcfilter.Source
+
+	// page returns up to n of the records matching the selector after
+	// a cursor, "" for the first page, and the cursor of the next page
+	// or "" after the last one.
+	page(cursor string, sel marcfilter.Selector, n int) ([]*marcfilter.Record, string, error)
+
+	// idKey names what get looks records up by, or is "" if the store
+	// cannot look records up.
+	idKey() string
+
+	close() error
+}
+
+// storeDrivers are the database/sql drivers of the connection string
+// prefixes, and what they are given of the connection string.
+var storeDrivers = []struct {
+	prefix string
+	driver string
+	trim   bool
+}{
+	{"sqlite:", "sqlite3", true},
+	{"postgres://", "postgres", false},
+	{"postgresql://", "postgres", false},
+}
+
+// openRecordStore opens the store of a connection string. The index is
+// only used by file stores, which are always read-only.
+func openRecordStore(conn string, indexName string, readOnly bool) (recordStore, error) {
+	if driver, dsn, ok := storeDriver(conn); ok {
+		if readOnly {
+			dsn = readOnlyDSN(driver, dsn)
+		}
+		return openSQLStore(driver, dsn)
+	}
+	return openFileStore(strings.TrimPrefix(conn, "file:"), indexName)
+}
+
+// storeDriver returns the driver and data source name of a database
+// connection string, or false if it does not name a database.
+func storeDriver(conn string) (string, string, bool) {
+	for _, d := range storeDrivers {
+		if !strings.HasPrefix(conn, d.prefix) {
+			continue
+		}
+		if d.trim {
+			conn = strings.TrimPrefix(conn, d.prefix)
+		}
+		return d.driver, conn, true
+	}
+	return "", "", false
+}
+
+// A fileStore is a MARC file, and its index if it has one. Every read
+// is at an offset of the file.
+type fileStore struct {
+	file *os.File
+	size int64
+	idx  *marcfilter.Index
+}
+
+func openFileStore(name string, indexName string) (*fileStore, error) {
+	var idx *marcfilter.Index
+	if indexName != "" {
+		var err error
+		if idx, err = marcfilter.ReadIndex(indexName); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if isCompressed(file) {
+		file.Close()
+		return nil, errServeCompressed
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileStore{file, info.Size(), idx}, nil
+}
+
+// get returns the first record with the given index value, or nil.
+func (s *fileStore) get(id string) (*marcfilter.Record, error) {
+	entries := s.idx.Lookup(id)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return marcfilter.ReadRecordAt(s.file, entries[0].Offset, entries[0].Length)
+}
+
+// search returns the records the index finds, or every record of the
+// file when the index does not help.
+func (s *fileStore) search(sel marcfilter.Selector) marcfilter.Source {
+	if s.idx != nil {
+		if r := marcfilter.NewIndexedReader(s.file, s.idx, sel); r != nil {
+			return r
+		}
+	}
+	return newRecordReader(io.NewSectionReader(s.file, 0, s.size))
+}
+
+func (s *fileStore) idKey() string {
+	if s.idx == nil {
+		return ""
+	}
+	return s.idx.Key
+}
+
+func (s *fileStore) close() error {
+	return s.file.Close()
+}
+
+// storeSchema creates the records table in each database.
+var storeSchema = map[string][]string{
+	"sqlite3": {
+		"CREATE TABLE IF NOT EXISTS records (seq INTEGER PRIMARY KEY, id TEXT NOT NULL, raw BLOB NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS records_id ON records (id)",
+	},
+	"postgres": {
+		"CREATE TABLE IF NOT EXISTS records (seq BIGSERIAL PRIMARY KEY, id TEXT NOT NULL, raw BYTEA NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS records_id ON records (id)",
+	},
+}
+
+// storePageSize is the number of records a search reads per query.
+const storePageSize = 100
+
+// An sqlStore is a database of records.
+type sqlStore struct {
+	driver string
+	db     *sql.DB
+}
+
+func openSQLStore(driver string, dsn string) (*sqlStore, error) {
+	i := sort.SearchStrings(sql.Drivers(), driver)
+	if i == len(sql.Drivers()) || sql.Drivers()[i] != driver {
+		return nil, fmt.Errorf("marcdump: built without the %s driver; build with -tags %s", driver, strings.TrimSuffix(driver, "3"))
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{driver, db}, nil
+}
+
+func (s *sqlStore) get(id string) (*marcfilter.Record, error) {
+	var seq int
+	var raw []byte
+	err := s.db.QueryRow("SELECT seq, raw FROM records WHERE id = $1 ORDER BY seq LIMIT 1", id).Scan(&seq, &raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return marcfilter.ParseRecord(raw, 0, seq)
+}
+
+// search returns every record; the database knows nothing of fields.
+func (s *sqlStore) search(sel marcfilter.Selector) marcfilter.Source {
+	return &sqlSource{db: s.db}
+}
+
+func (s *sqlStore) idKey() string {
+	return "id"
+}
+
+func (s *sqlStore) close() error {
+	return s.db.Close()
+}
+
+// An sqlSource reads the records of a database a page at a time, so
+// that no query is left open when the reader stops early.
+type sqlSource struct {
+	db      *sql.DB
+	last    int
+	pending []*marcfilter.Record
+	done    bool
+}
+
+func (s *sqlSource) Next() (*marcfilter.Record, error) {
+	if len(s.pending) == 0 && !s.done {
+		if err := s.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.pending) == 0 {
+		return nil, nil
+	}
+	record := s.pending[0]
+	s.pending = s.pending[1:]
+	return record, nil
+}
+
+func (s *sqlSource) fill() error {
+	rows, err := s.db.Query("SELECT seq, raw FROM records WHERE seq > $1 ORDER BY seq LIMIT $2", s.last, storePageSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&s.last, &raw); err != nil {
+			return err
+		}
+		record, err := marcfilter.ParseRecord(raw, 0, s.last)
+		if err != nil {
+			return fmt.Errorf("record %d: %v", s.last, err)
+		}
+		s.pending = append(s.pending, record)
+		n++
+	}
+	s.done = n < storePageSize
+	return rows.Err()
+}
+
+// getLoadAction returns an action adding each record to a database, in
+// a single transaction committed once every record is added.
+func getLoadAction(conn string, keyField string) (actionFunc, error) {
+	key, err := parseRecordKey(keyField)
+	if err != nil {
+		return nil, errInvalidLoadKey
+	}
+
+	driver, dsn, ok := storeDriver(conn)
+	if !ok {
+		return nil, errLoadFileStore
+	}
+	db, err := openSQLStore(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range storeSchema[db.driver] {
+		if _, err := db.db.Exec(stmt); err != nil {
+			db.close()
+			return nil, err
+		}
+	}
+	tx, err := db.db.Begin()
+	if err != nil {
+		db.close()
+		return nil, err
+	}
+	insert, err := tx.Prepare("INSERT INTO records (id, raw) VALUES ($1, $2)")
+	if err != nil {
+		tx.Rollback()
+		db.close()
+		return nil, err
+	}
+
+	loaded, noKey := 0, 0
+	onFinish(func(w *tabwriter.Writer) error {
+		defer db.close()
+		insert.Close()
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if noKey > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d records without %s were not loaded\n", noKey, keyField)
+		}
+		fmt.Fprintf(os.Stderr, "%d records loaded\n", loaded)
+		return nil
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		id := key.id(record)
+		if id == "" {
+			noKey += 1
+			return nil
+		}
+		if _, err := insert.Exec(id, record.Raw); err != nil {
+			return err
+		}
+		loaded += 1
+		return nil
+	}, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Subject heading clusters, the worklist of a heading cleanup.
+// -subject-clusters groups the 6xx headings that differ only in case,
+// punctuation, diacritics or the order of their subdivisions, so that
+//
+//    650 Cookery, French--Early works to 1800
+//    650 Cookery, french--early works to 1800.
+//    650 Cookery--Early works to 1800--French
+//
+// end up together, and lists each group with more than one form, the
+// most used form of each first. Headings are only grouped with others
+// in the same tag.
+
+// formClusters groups the forms of values by a key, counting the uses
+// of each form.
+type formClusters map[string]*formCluster
+
+type formCluster struct {
+	forms map[string]int
+	total int
+}
+
+func (clusters formClusters) add(key string, form string) {
+	c := clusters[key]
+	if c == nil {
+		c = &formCluster{forms: make(map[string]int)}
+		clusters[key] = c
+	}
+	c.forms[form] += 1
+	c.total += 1
+}
+
+// keys returns the keys of the clusters with at least min forms, the
+// most used first.
+func (clusters formClusters) keys(min int) []string {
+	var keys []string
+	for key, c := range clusters {
+		if len(c.forms) >= min {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if clusters[keys[i]].total != clusters[keys[j]].total {
+			return clusters[keys[i]].total > clusters[keys[j]].total
+		}
+		return compareValues(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+// sortedForms returns the forms of a cluster, the most used first.
+func (c *formCluster) sortedForms() []string {
+	forms := make([]string, 0, len(c.forms))
+	for form := range c.forms {
+		forms = append(forms, form)
+	}
+	sort.Slice(forms, func(i, j int) bool {
+		if c.forms[forms[i]] != c.forms[forms[j]] {
+			return c.forms[forms[i]] > c.forms[forms[j]]
+		}
+		return compareValues(forms[i], forms[j]) < 0
+	})
+	return forms
+}
+
+// subjectClusterKey returns the key headings are grouped by: the main
+// heading and its subdivisions, sorted, each reduced to lower case
+// letters and digits without diacritics.
+func subjectClusterKey(tag string, label string) string {
+	parts := strings.Split(marcfilter.StripDiacritics(label), "--")
+	for i, part := range parts {
+		parts[i] = normalizeName(part)
+	}
+	sort.Strings(parts[1:])
+	return tag + " " + strings.Join(parts, "--")
+}
+
+func getSubjectClusterAction() actionFunc {
+	clusters := make(formClusters)
+
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(w, "cluster\tcount\ttag\tform\n")
+		for n, key := range clusters.keys(2) {
+			c := clusters[key]
+			for _, form := range c.sortedForms() {
+				fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", n+1, c.forms[form], key[:3], form)
+			}
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		for _, f := range m.Fields {
+			if f.Tag[0] != '6' || f.Value != "" {
+				continue
+			}
+			// the form as recorded, with only the spaces around the
+			// subfields evened out
+			var form []string
+			for _, sf := range f.Subfields {
+				v := strings.TrimSpace(sf.Value)
+				switch {
+				case v == "":
+				case strings.Contains("vxyz", sf.Code):
+					form = append(form, "--"+v)
+				case strings.Contains("abcdfghklmnopqrst", sf.Code):
+					if len(form) > 0 {
+						v = " " + v
+					}
+					form = append(form, v)
+				}
+			}
+			label := headingLabel(f)
+			if label == "" {
+				continue
+			}
+			clusters.add(subjectClusterKey(f.Tag, label), strings.Join(form, ""))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// Template output. -template names a text/template file executed for
+// each record, e.g.
+//
+//    {{field "245" "a"}} / {{field "100" "a"}}
+//    {{join (fields "650" "a") "; "}} ({{slice (controlfield "008") 7 11}})
+//
+// The record is the template's dot, giving {{.Number}} and {{.Offset}}.
+// The helpers all work on the current record:
+//
+//    field tag [code]     first value of a field, or of one subfield
+//    fields tag [code]    the values of every instance
+//    controlfield tag     value of a control field
+//    indicators tag       indicators of the first instance of a field
+//    leader               the record leader
+//    join list sep        the values of a list joined with sep
+//
+// As with -columns, a field without a subfield code is its subfields
+// joined with spaces. Templates named "header" and "footer", made with
+// {{define}}, are executed once before the first record and after the
+// last one.
+
+var errNoTemplate = errors.New("marcdump: -o template needs -template")
+
+// A templateFormatter writes each record with a template.
+type templateFormatter struct {
+	t      *template.Template
+	record *marcfilter.Record // the record the helpers work on
+}
+
+func newTemplateFormatter() (marcfilter.Formatter, error) {
+	if templateFile == "" {
+		return nil, errNoTemplate
+	}
+	text, err := ioutil.ReadFile(templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	f := new(templateFormatter)
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+	f.t, err = template.New(templateFile).Funcs(template.FuncMap{
+		"field": func(tag string, code ...string) string {
+			return first(f.values(tag, code))
+		},
+		"fields": func(tag string, code ...string) []string {
+			return f.values(tag, code)
+		},
+		"controlfield": func(tag string) string {
+			return first(f.values(tag, nil))
+		},
+		"indicators": func(tag string) string {
+			if f.record == nil {
+				return ""
+			}
+			field, _ := f.record.GetDataField(tag)
+			if field.ValueCount() == 0 {
+				return ""
+			}
+			return field.GetIndicators(0)
+		},
+		"leader": func() string {
+			if f.record == nil {
+				return ""
+			}
+			return f.record.Leader()
+		},
+		"join": func(values []string, sep string) string {
+			return strings.Join(values, sep)
+		},
+	}).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *templateFormatter) values(tag string, code []string) []string {
+	if f.record == nil {
+		return nil
+	}
+	return marcfilter.FieldValues(f.record.MarcRecord, tag, strings.Join(code, ""))
+}
+
+// execute executes the named template, writing what it makes verbatim.
+func (f *templateFormatter) execute(w io.Writer, name string, record *marcfilter.Record) error {
+	var b bytes.Buffer
+	f.record = record
+	if err := f.t.ExecuteTemplate(&b, name, record); err != nil {
+		return err
+	}
+	return writeVerbatim(w, b.Bytes())
+}
+
+func (f *templateFormatter) Header(w io.Writer) error {
+	if f.t.Lookup("header") == nil {
+		return nil
+	}
+	return f.execute(w, "header", nil)
+}
+
+func (f *templateFormatter) Record(w io.Writer, record *marcfilter.Record) error {
+	return f.execute(w, f.t.Name(), record)
+}
+
+func (f *templateFormatter) Footer(w io.Writer) error {
+	if f.t.Lookup("footer") == nil {
+		return nil
+	}
+	return f.execute(w, "footer", nil)
+}
@@ -0,0 +1,75 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Record terminators of legacy systems. Some end each record with a
+// byte other than 1D, often a line end or a NUL, and some leave the
+// terminator off the last record of a file. -accept-terminators 0a,00
+// takes the bytes listed, in hex, as record terminators when reading,
+// and -accept-unterminated takes a last record one byte short for one
+// missing its terminator; the records read have the standard 1D, so
+// they are selected and written like any other.
+//
+// To write such a file for the system to load back, -write-terminator
+// 0a ends each binary MARC record written with that byte instead, and
+// -omit-final-terminator leaves it off the last record of each file.
+// The record length in the leader is unchanged either way.
+
+var errInvalidTerminator = errors.New("marcdump: a terminator is a byte in hex, e.g. 0a")
+
+// parseTerminators parses a comma separated list of bytes in hex.
+func parseTerminators(s string) ([]byte, error) {
+	var terminators []byte
+	for _, h := range strings.Split(s, ",") {
+		b, err := hex.DecodeString(strings.TrimSpace(h))
+		if err != nil || len(b) != 1 {
+			return nil, errInvalidTerminator
+		}
+		terminators = append(terminators, b[0])
+	}
+	return terminators, nil
+}
+
+// The terminators of the binary MARC records written.
+var (
+	writeTerminator     *byte
+	omitFinalTerminator bool
+)
+
+// setTerminatorOptions parses the terminator options.
+func setTerminatorOptions(accept string, write string, omitFinal bool) ([]byte, error) {
+	var accepted []byte
+	if accept != "" {
+		var err error
+		if accepted, err = parseTerminators(accept); err != nil {
+			return nil, err
+		}
+	}
+	if write != "" {
+		b, err := parseTerminators(write)
+		if err != nil || len(b) != 1 {
+			return nil, errInvalidTerminator
+		}
+		writeTerminator = &b[0]
+	}
+	omitFinalTerminator = omitFinal
+	return accepted, nil
+}
@@ -0,0 +1,510 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// Validation checks the structure of each record against a set of
+// rules. Unlike the import profiles of -check, the rules are about
+// ISO 2709 and MARC 21 themselves, and every problem is reported with
+// the byte offset it was found at. A file can mix bibliographic,
+// authority and holdings records, so the fields a record must have and
+// may not repeat are those of its own format, by leader/06. Rules
+// registered with marcfilter.RegisterRule, such as local field
+// policies compiled in, run after these and are reported alike.
+//
+// With -j the workers run the rules (see onPrepare), which is where the
+// time goes on a large file, and the action reports what they found in
+// input order, so the report is the same as without -j. Only
+// -unordered changes the order of the records in it.
+
+var errUnknownReportFormat = errors.New("marcdump: unknown validation report format")
+
+// A diagnostic is one problem found in a record. Offset is from the
+// start of the record as a rule reports it, and from the start of the
+// input once the engine has placed it.
+type diagnostic struct {
+	Rule    string `json:"rule"`
+	Tag     string `json:"tag,omitempty"`
+	Offset  int64  `json:"offset"`
+	Message string `json:"message"`
+}
+
+// A validationRule checks one aspect of a record.
+type validationRule struct {
+	name  string
+	check func(record *marcfilter.Record) []diagnostic
+}
+
+var validationRules = []validationRule{
+	{"leader", validateLeader},
+	{"directory", validateDirectory},
+	{"indicators", validateIndicators},
+	{"empty-subfield", validateSubfields},
+	{"non-repeatable", validateRepeats},
+	{"required", validateRequired},
+	{"linkage", validateLinkage},
+}
+
+// A validationSchema is what the rules know of the fields of a format.
+type validationSchema struct {
+	nonRepeatable map[string]bool
+	required      []string // tags, 1XX for any heading
+	oneHeading    bool     // only one 1XX
+}
+
+// validationSchemas are the schemas of the formats.
+var validationSchemas = map[string]*validationSchema{
+	formatBibliographic: {
+		nonRepeatable: tagSet("001", "003", "005", "008", "010", "018", "040", "042", "043", "044",
+			"045", "066", "100", "110", "111", "130", "240", "243", "245", "254",
+			"256", "263", "306", "384", "507", "514"),
+		required: []string{"001", "245"},
+	},
+	formatAuthority: {
+		nonRepeatable: tagSet("001", "003", "005", "008", "010", "040", "042", "066",
+			"100", "110", "111", "130", "147", "148", "150", "151", "155", "162", "180", "181", "182", "185"),
+		required:   []string{"001", "008", "040", "1XX"},
+		oneHeading: true,
+	},
+	formatHoldings: {
+		nonRepeatable: tagSet("001", "003", "004", "005", "008", "066"),
+		required:      []string{"001", "004", "008"},
+	},
+	formatClassification: {
+		nonRepeatable: tagSet("001", "003", "005", "008", "040", "153"),
+		required:      []string{"001", "008", "153"},
+	},
+	formatCommunity: {
+		nonRepeatable: tagSet("001", "003", "005", "008", "040"),
+		required:      []string{"001", "008"},
+	},
+}
+
+func tagSet(tags ...string) map[string]bool {
+	set := make(map[string]bool)
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	return set
+}
+
+// activeValidationRules returns the rules of marcdump followed by those
+// registered in the marcfilter package.
+func activeValidationRules() ([]validationRule, error) {
+	rules := append([]validationRule(nil), validationRules...)
+	for _, r := range marcfilter.Rules() {
+		for _, rule := range validationRules {
+			if rule.name == r.Name() {
+				return nil, fmt.Errorf("marcdump: validation rule %s is registered, but is a rule of marcdump", r.Name())
+			}
+		}
+		check := r.Check
+		rules = append(rules, validationRule{r.Name(), func(record *marcfilter.Record) []diagnostic {
+			var found []diagnostic
+			for _, d := range check(record) {
+				found = append(found, diagnostic{Tag: d.Tag, Offset: d.Offset, Message: d.Message})
+			}
+			return found
+		}})
+	}
+	return rules, nil
+}
+
+// validateRecord runs the rules against a record.
+func validateRecord(record *marcfilter.Record, rules []validationRule) []diagnostic {
+	var found []diagnostic
+	for _, rule := range rules {
+		for _, d := range rule.check(record) {
+			d.Rule = rule.name
+			d.Offset += record.Offset
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+// A directoryEntry is a directory entry as found in the record, before
+// any of it is known to be valid.
+type directoryEntry struct {
+	tag           string
+	length, start int
+	offset        int // of the entry itself
+}
+
+// scanDirectory returns the entries of a record's directory as far as
+// they can be read, and the base address of the data.
+func scanDirectory(raw []byte) ([]directoryEntry, int, []diagnostic) {
+	base, err := strconv.Atoi(string(raw[12:17]))
+	if err != nil || base <= marcfilter.LeaderLength || base > len(raw) {
+		return nil, 0, []diagnostic{{Offset: 12, Message: fmt.Sprintf("invalid base address %q", raw[12:17])}}
+	}
+
+	var entries []directoryEntry
+	var found []diagnostic
+	if raw[base-1] != marcfilter.FieldTerminator {
+		found = append(found, diagnostic{Offset: int64(base - 1), Message: "directory does not end with a field terminator"})
+	}
+	directory := raw[marcfilter.LeaderLength : base-1]
+	if len(directory)%marcfilter.DirectoryEntryLength != 0 {
+		found = append(found, diagnostic{Offset: marcfilter.LeaderLength,
+			Message: fmt.Sprintf("directory length %d is not a multiple of %d", len(directory), marcfilter.DirectoryEntryLength)})
+	}
+	for i := 0; i+marcfilter.DirectoryEntryLength <= len(directory); i += marcfilter.DirectoryEntryLength {
+		entry := directory[i : i+marcfilter.DirectoryEntryLength]
+		length, err1 := strconv.Atoi(string(entry[3:7]))
+		start, err2 := strconv.Atoi(string(entry[7:12]))
+		if err1 != nil || err2 != nil {
+			found = append(found, diagnostic{Tag: string(entry[:3]), Offset: int64(marcfilter.LeaderLength + i),
+				Message: fmt.Sprintf("directory entry %q is not numeric", entry)})
+			continue
+		}
+		entries = append(entries, directoryEntry{string(entry[:3]), length, start, marcfilter.LeaderLength + i})
+	}
+	return entries, base, found
+}
+
+func validateLeader(record *marcfilter.Record) []diagnostic {
+	raw := record.Raw
+	var found []diagnostic
+	if raw[len(raw)-1] != marcfilter.RecordTerminator {
+		msg := fmt.Sprintf("record length %d in the leader does not end at a record terminator", len(raw))
+		if i := strings.IndexByte(string(raw), marcfilter.RecordTerminator); i >= 0 {
+			msg += fmt.Sprintf("; the first terminator is at %d", i)
+		}
+		found = append(found, diagnostic{Offset: 0, Message: msg})
+	}
+	if raw[10] != '2' || raw[11] != '2' {
+		found = append(found, diagnostic{Offset: 10, Message: fmt.Sprintf("indicator and subfield code counts are %q, not \"22\"", raw[10:12])})
+	}
+	if string(raw[20:24]) != "4500" {
+		found = append(found, diagnostic{Offset: 20, Message: fmt.Sprintf("entry map is %q, not \"4500\"", raw[20:24])})
+	}
+	if strings.IndexByte(marc21RecordTypes, raw[6]) < 0 {
+		found = append(found, diagnostic{Offset: 6, Message: fmt.Sprintf("record type %q is not a MARC 21 type; validated as bibliographic", raw[6])})
+	}
+	return found
+}
+
+func validateDirectory(record *marcfilter.Record) []diagnostic {
+	raw := record.Raw
+	entries, base, found := scanDirectory(raw)
+	for _, e := range entries {
+		end := base + e.start + e.length
+		switch {
+		case !tagPatternRegexp.MatchString(e.tag):
+			found = append(found, diagnostic{Tag: e.tag, Offset: int64(e.offset), Message: fmt.Sprintf("invalid tag %q", e.tag)})
+		case e.length == 0 || end > len(raw)-1:
+			found = append(found, diagnostic{Tag: e.tag, Offset: int64(e.offset),
+				Message: fmt.Sprintf("field of %d bytes at %d lies outside the data", e.length, e.start)})
+		case raw[end-1] != marcfilter.FieldTerminator:
+			found = append(found, diagnostic{Tag: e.tag, Offset: int64(end - 1),
+				Message: "field does not end with a field terminator"})
+		}
+	}
+	return found
+}
+
+func validateIndicators(record *marcfilter.Record) []diagnostic {
+	return eachDataField(record, func(f *marcfilter.Field) []diagnostic {
+		if len(f.Indicators) != 2 {
+			return []diagnostic{{Message: fmt.Sprintf("field has %d indicators, not 2", len(f.Indicators))}}
+		}
+		for i := 0; i < 2; i++ {
+			c := f.Indicators[i]
+			if c != ' ' && (c < '0' || c > '9') && (c < 'a' || c > 'z') {
+				return []diagnostic{{Message: fmt.Sprintf("invalid indicator %d %q", i+1, c)}}
+			}
+		}
+		return nil
+	})
+}
+
+func validateSubfields(record *marcfilter.Record) []diagnostic {
+	return eachDataField(record, func(f *marcfilter.Field) []diagnostic {
+		if len(f.Subfields) == 0 {
+			return []diagnostic{{Message: "field has no subfields"}}
+		}
+		var found []diagnostic
+		for _, sf := range f.Subfields {
+			if strings.TrimSpace(sf.Value) == "" {
+				found = append(found, diagnostic{Message: fmt.Sprintf("subfield $%s is empty", sf.Code)})
+			}
+		}
+		return found
+	})
+}
+
+func validateRepeats(record *marcfilter.Record) []diagnostic {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return nil
+	}
+	schema := validationSchemas[recordFormat(string(m.Leader))]
+	var found []diagnostic
+	seen := make(map[string]bool)
+	headings := 0
+	for _, f := range m.Fields {
+		if schema.nonRepeatable[f.Tag] && seen[f.Tag] {
+			found = append(found, diagnostic{Tag: f.Tag, Offset: int64(f.Offset), Message: "non-repeatable field is repeated"})
+		} else if schema.oneHeading && f.Tag[0] == '1' {
+			if headings += 1; headings == 2 {
+				found = append(found, diagnostic{Tag: f.Tag, Offset: int64(f.Offset), Message: "record has a second heading"})
+			}
+		}
+		seen[f.Tag] = true
+	}
+	return found
+}
+
+func validateRequired(record *marcfilter.Record) []diagnostic {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return nil
+	}
+	format := recordFormat(string(m.Leader))
+
+	var found []diagnostic
+	for _, tag := range validationSchemas[format].required {
+		present := len(m.FieldsByTag(tag)) > 0
+		if tag == "1XX" {
+			present = false
+			for _, f := range m.Fields {
+				present = present || f.Tag[0] == '1'
+			}
+		}
+		if !present {
+			found = append(found, diagnostic{Tag: tag, Message: "required field of the " + formatNames[format] + " format is missing"})
+		}
+	}
+	return found
+}
+
+// validateLinkage checks that each $6 naming an 880 has the 880 naming
+// it back with the same occurrence number, and the other way round, and
+// that no two fields share a number (see marcfilter/linkage.go).
+func validateLinkage(record *marcfilter.Record) []diagnostic {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return nil
+	}
+	type link struct {
+		f *marcfilter.Field
+		l marcfilter.Linkage
+	}
+	var fields, alternates []link
+	var found []diagnostic
+	for _, f := range m.Fields {
+		value := f.Subfield("6")
+		if value == "" || strings.HasPrefix(f.Tag, "00") {
+			continue
+		}
+		l, ok := marcfilter.ParseLinkage(value)
+		switch {
+		case !ok:
+			found = append(found, diagnostic{Tag: f.Tag, Offset: int64(f.Offset), Message: fmt.Sprintf("$6 %q is not a tag and occurrence number", value)})
+		case f.Tag == "880":
+			alternates = append(alternates, link{f, l})
+		case l.Tag == "880":
+			fields = append(fields, link{f, l})
+		}
+	}
+
+	// the fields and 880s by occurrence number
+	// a field sharing a number is only reported for that
+	byNumber := make(map[string]link)
+	altByNumber := make(map[string]link)
+	shared := make(map[*marcfilter.Field]bool)
+	for _, a := range fields {
+		if b, ok := byNumber[a.l.Occurrence]; ok {
+			found = append(found, diagnostic{Tag: a.f.Tag, Offset: int64(a.f.Offset),
+				Message: fmt.Sprintf("occurrence number %s is also that of the %s at %d", a.l.Occurrence, b.f.Tag, record.Offset+int64(b.f.Offset))})
+			shared[a.f] = true
+			continue
+		}
+		byNumber[a.l.Occurrence] = a
+	}
+	for _, a := range alternates {
+		if a.l.Occurrence == "00" {
+			continue
+		}
+		if b, ok := altByNumber[a.l.Occurrence]; ok {
+			found = append(found, diagnostic{Tag: a.f.Tag, Offset: int64(a.f.Offset),
+				Message: fmt.Sprintf("occurrence number %s is also that of the 880 at %d", a.l.Occurrence, record.Offset+int64(b.f.Offset))})
+			shared[a.f] = true
+			continue
+		}
+		altByNumber[a.l.Occurrence] = a
+	}
+
+	for _, a := range fields {
+		b, ok := altByNumber[a.l.Occurrence]
+		switch {
+		case shared[a.f]:
+		case !ok:
+			found = append(found, diagnostic{Tag: a.f.Tag, Offset: int64(a.f.Offset),
+				Message: fmt.Sprintf("$6 names 880-%s, but there is no 880 with that number", a.l.Occurrence)})
+		case b.l.Tag != a.f.Tag:
+			found = append(found, diagnostic{Tag: a.f.Tag, Offset: int64(a.f.Offset),
+				Message: fmt.Sprintf("$6 names 880-%s, but that 880 names %s", a.l.Occurrence, b.l)})
+		}
+	}
+	for _, b := range alternates {
+		if b.l.Occurrence == "00" || shared[b.f] {
+			continue
+		}
+		if a, ok := byNumber[b.l.Occurrence]; !ok || a.f.Tag != b.l.Tag {
+			found = append(found, diagnostic{Tag: b.f.Tag, Offset: int64(b.f.Offset),
+				Message: fmt.Sprintf("$6 names %s-%s, but there is no %s with that number", b.l.Tag, b.l.Occurrence, b.l.Tag)})
+		}
+	}
+	return found
+}
+
+// eachDataField runs check on each data field of a record that can be
+// decoded, placing the diagnostics at the field.
+func eachDataField(record *marcfilter.Record, check func(f *marcfilter.Field) []diagnostic) []diagnostic {
+	m, err := marcfilter.DecodeRecord(record.Raw)
+	if err != nil {
+		return nil
+	}
+	var found []diagnostic
+	for _, f := range m.Fields {
+		if f.Value != "" || strings.HasPrefix(f.Tag, "00") {
+			continue
+		}
+		for _, d := range check(f) {
+			d.Tag, d.Offset = f.Tag, int64(f.Offset)
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+// A validationReport is the validation of one record in the JSON
+// report.
+type validationReport struct {
+	Record      int          `json:"record"`
+	Offset      int64        `json:"offset"`
+	ID          string       `json:"id"`
+	Format      string       `json:"format"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+// getValidateAction returns an action validating each record and
+// reporting the problems found in the named format, text or json.
+func getValidateAction(format string) (actionFunc, error) {
+	if format != "text" && format != "json" {
+		return nil, errUnknownReportFormat
+	}
+	rules, err := activeValidationRules()
+	if err != nil {
+		return nil, err
+	}
+
+	// the diagnostics of the records the -j workers have validated
+	var prepared sync.Map
+	onPrepare(func(record *marcfilter.Record) {
+		prepared.Store(record, validateRecord(record, rules))
+	})
+
+	validated, invalid, problems := 0, 0, 0
+	formats := make(map[string]int) // records validated by format
+	byRule := make(map[string]int)  // problems by rule
+	onFinish(func(w *tabwriter.Writer) error {
+		if format == "json" {
+			if invalid == 0 {
+				fmt.Fprint(w, "{\"records\":[")
+			}
+			b, err := json.Marshal(formats)
+			if err != nil {
+				return err
+			}
+			r, err := json.Marshal(byRule)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "\n],\"validated\":%d,\"formats\":%s,\"invalid\":%d,\"problems\":%d,\"rules\":%s}\n", validated, b, invalid, problems, r)
+		} else {
+			var counts []string
+			for _, f := range []string{formatBibliographic, formatAuthority, formatHoldings, formatClassification, formatCommunity} {
+				if formats[f] > 0 {
+					counts = append(counts, fmt.Sprintf("%d %s", formats[f], formatNames[f]))
+				}
+			}
+			fmt.Fprintf(w, "%d records validated (%s), %d with problems, %d problems\n", validated, strings.Join(counts, ", "), invalid, problems)
+			if problems > 0 {
+				var perRule []string
+				for _, rule := range rules {
+					if byRule[rule.name] > 0 {
+						perRule = append(perRule, fmt.Sprintf("%s %d", rule.name, byRule[rule.name]))
+					}
+				}
+				fmt.Fprintf(w, "Problems by rule: %s\n", strings.Join(perRule, ", "))
+			}
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		validated++
+		recordType := recordFormat(record.Leader())
+		formats[recordType]++
+		var found []diagnostic
+		if v, ok := prepared.Load(record); ok {
+			prepared.Delete(record)
+			found = v.([]diagnostic)
+		} else {
+			found = validateRecord(record, rules)
+		}
+		if len(found) == 0 {
+			return nil
+		}
+		invalid++
+		problems += len(found)
+		for _, d := range found {
+			byRule[d.Rule]++
+		}
+
+		id := controlNumber(record)
+		if format == "json" {
+			b, err := json.Marshal(validationReport{record.Number, record.Offset, id, recordType, found})
+			if err != nil {
+				return err
+			}
+			if invalid == 1 {
+				fmt.Fprint(w, "{\"records\":[\n")
+			} else {
+				fmt.Fprint(w, ",\n")
+			}
+			w.Write(b)
+			return w.Flush()
+		}
+
+		for _, d := range found {
+			fmt.Fprintf(w, "record %d\toffset %d\t%s\t%s\t%s\t%s\n", record.Number, d.Offset, id, d.Rule, d.Tag, d.Message)
+		}
+		return w.Flush()
+	}, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// Name lookups in VIAF and Wikidata. Both services search rather than
+// look up, so a search result only counts as a candidate if its name is
+// the heading's. More than one candidate makes the heading ambiguous.
+
+const (
+	viafSuggestURL    = "https://viaf.org/viaf/AutoSuggest?query="
+	viafURI           = "http://viaf.org/viaf/"
+	wikidataSearchURL = "https://www.wikidata.org/w/api.php?action=wbsearchentities&type=item&format=json&limit=20&language=en&search="
+)
+
+// getJSON gets a URL and decodes the JSON it returns into v.
+func getJSON(client *http.Client, limiter *rateLimiter, u string, v interface{}) error {
+	limiter.wait()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", fetchUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// normalizeName reduces a name to lower case letters and digits
+// separated by single spaces, so that punctuation and case don't keep
+// the forms of a name from matching.
+func normalizeName(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// searchName returns the name of a heading as it would be written in
+// running text: a personal name in direct order, "Walter Isaacson", and
+// a corporate name with its subordinate units.
+func searchName(h *enrichHeading) string {
+	if h.personal() {
+		name := trimHeading(h.field.Subfield("a"))
+		if i := strings.Index(name, ", "); i >= 0 {
+			name = name[i+2:] + " " + name[:i]
+		}
+		return name
+	}
+	var parts []string
+	for _, sf := range h.field.Subfields {
+		if sf.Code == "a" || sf.Code == "b" {
+			parts = append(parts, trimHeading(sf.Value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// addCandidate adds a URI to a list of candidates unless it is there.
+func addCandidate(uris []string, uri string) []string {
+	for _, u := range uris {
+		if u == uri {
+			return uris
+		}
+	}
+	return append(uris, uri)
+}
+
+// A viafReconciler looks names up with the VIAF AutoSuggest service,
+// whose terms are the authorized headings of the contributing files.
+type viafReconciler struct {
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+func newViafReconciler(rate float64) *viafReconciler {
+	return &viafReconciler{&http.Client{Timeout: fetchTimeout}, newRateLimiter(rate)}
+}
+
+func (r *viafReconciler) reconcile(h *enrichHeading) ([]string, error) {
+	var response struct {
+		Result []struct {
+			Term     string `json:"term"`
+			NameType string `json:"nametype"`
+			ViafID   string `json:"viafid"`
+		} `json:"result"`
+	}
+	if err := getJSON(r.client, r.limiter, viafSuggestURL+url.QueryEscape(h.label), &response); err != nil {
+		return nil, err
+	}
+
+	nameType := "personal"
+	if h.corporate() {
+		nameType = "corporate"
+	}
+	label := normalizeName(h.label)
+	var uris []string
+	for _, result := range response.Result {
+		if result.NameType == nameType && normalizeName(result.Term) == label {
+			uris = addCandidate(uris, viafURI+result.ViafID)
+		}
+	}
+	return uris, nil
+}
+
+// A wikidataReconciler looks names up with the Wikidata entity search,
+// which matches labels and aliases in running text form.
+type wikidataReconciler struct {
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+func newWikidataReconciler(rate float64) *wikidataReconciler {
+	return &wikidataReconciler{&http.Client{Timeout: fetchTimeout}, newRateLimiter(rate)}
+}
+
+func (r *wikidataReconciler) reconcile(h *enrichHeading) ([]string, error) {
+	name := searchName(h)
+	if name == "" {
+		return nil, nil
+	}
+	var response struct {
+		Search []struct {
+			ConceptURI string `json:"concepturi"`
+			Match      struct {
+				Text string `json:"text"`
+			} `json:"match"`
+		} `json:"search"`
+	}
+	if err := getJSON(r.client, r.limiter, wikidataSearchURL+url.QueryEscape(name), &response); err != nil {
+		return nil, err
+	}
+
+	name = normalizeName(name)
+	var uris []string
+	for _, result := range response.Search {
+		if normalizeName(result.Match.Text) == name {
+			uris = addCandidate(uris, result.ConceptURI)
+		}
+	}
+	return uris, nil
+}
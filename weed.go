@@ -0,0 +1,192 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Weeding projects. The weed list is a CSV file whose first column holds
+// the keys of the items (or records) to withdraw. Keys, being barcodes
+// or control numbers, have digits in them, so a first row whose key has
+// none, such as "Barcode", is taken as the header the spreadsheet the
+// list came from wrote, and skipped. The key field names
+// where to find them: a control field such as 001 matches whole
+// records, while an item field subfield such as 949_p matches
+// individual items. A record with some but not all of its items on the
+// list is split: the withdrawn items go to the withdraw file and the
+// rest stay in the keep file.
+
+var errInvalidWeedKey = errors.New("marcdump: invalid weed key field")
+
+func loadWeedList(name string) (map[string]bool, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(map[string]bool)
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	for first := true; ; first = false {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		key := strings.TrimSpace(strings.TrimPrefix(row[0], "\ufeff"))
+		if first && strings.IndexAny(key, "0123456789") < 0 {
+			continue
+		}
+		if key != "" {
+			keys[key] = false
+		}
+	}
+	return keys, nil
+}
+
+// getWeedAction returns an action that splits the records between the
+// keep and withdraw files according to the weed list.
+func getWeedAction(list string, keyField string, keepName string, withdrawName string) (actionFunc, error) {
+	spec := marcfilter.SpecRegexp.FindStringSubmatch(keyField)
+	if spec == nil || spec[3] != "" || (spec[2] == "") == !marc21.IsControlFieldTag(spec[1]) {
+		return nil, errInvalidWeedKey
+	}
+	tag, code := spec[1], spec[2]
+
+	keys, err := loadWeedList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	keep, err := createMarcWriter(keepName)
+	if err != nil {
+		return nil, err
+	}
+	withdraw, err := createMarcWriter(withdrawName)
+	if err != nil {
+		keep.close()
+		return nil, err
+	}
+
+	kept, withdrawn, split, items := 0, 0, 0, 0
+	onFinish(func(w *tabwriter.Writer) error {
+		var missing []string
+		for key, found := range keys {
+			if !found {
+				missing = append(missing, key)
+			}
+		}
+		sort.Strings(missing)
+		for _, key := range missing {
+			fmt.Fprintf(w, "not found\t%s\n", key)
+		}
+		fmt.Fprintf(w, "%d records kept, %d withdrawn, %d split, %d items withdrawn, %d keys not found\n",
+			kept, withdrawn, split, items, len(missing))
+
+		err1 := keep.close()
+		err2 := withdraw.close()
+		if err1 != nil {
+			return err1
+		}
+		if err2 != nil {
+			return err2
+		}
+		return w.Flush()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		if code == "" {
+			id, _ := record.GetControlField(tag)
+			if _, ok := keys[id]; ok {
+				keys[id] = true
+				withdrawn += 1
+				items += 1
+				return withdraw.write(record.Raw)
+			}
+			kept += 1
+			return keep.write(record.Raw)
+		}
+
+		m, err := marcfilter.DecodeRecord(record.Raw)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %v", record.Offset, err)
+		}
+		var remaining, removed []*marcfilter.Field
+		for _, f := range m.Fields {
+			if f.Tag == tag {
+				if _, ok := keys[f.Subfield(code)]; ok {
+					keys[f.Subfield(code)] = true
+					removed = append(removed, f)
+					continue
+				}
+			}
+			remaining = append(remaining, f)
+		}
+		items += len(removed)
+
+		switch {
+		case len(removed) == 0:
+			kept += 1
+			return keep.write(record.Raw)
+		case len(m.FieldsByTag(tag)) == len(removed):
+			withdrawn += 1
+			return withdraw.write(record.Raw)
+		}
+
+		split += 1
+		all := m.Fields
+		m.Fields = remaining
+		raw, err := m.Encode()
+		if err != nil {
+			return err
+		}
+		if err := keep.write(raw); err != nil {
+			return err
+		}
+
+		m.Fields = nil
+		for _, f := range all {
+			if f.Tag != tag || containsField(removed, f) {
+				m.Fields = append(m.Fields, f)
+			}
+		}
+		if raw, err = m.Encode(); err != nil {
+			return err
+		}
+		return withdraw.write(raw)
+	}, nil
+}
+
+func containsField(list []*marcfilter.Field, f *marcfilter.Field) bool {
+	for _, v := range list {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Record windows. -skip 1000 starts at record 1001; -records 1000-2000
+// reads records 1000 to 2000 inclusive, and -records 1000- everything
+// from record 1000 on. Records are numbered by their position in the
+// input, so the window is the same whatever the selector.
+
+var errInvalidRecordRange = errors.New("marcdump: invalid record range")
+
+// A recordWindow is the range of record numbers to read. last is 0 when
+// the window runs to the end of the input.
+type recordWindow struct {
+	first, last int
+}
+
+func getRecordWindow(skip int, spec string) (recordWindow, error) {
+	w := recordWindow{first: 1}
+	if spec != "" {
+		from, to := spec, spec
+		if i := strings.Index(spec, "-"); i >= 0 {
+			from, to = spec[:i], spec[i+1:]
+		}
+		var err error
+		if w.first, err = strconv.Atoi(from); err != nil || w.first < 1 {
+			return w, errInvalidRecordRange
+		}
+		if to != "" {
+			if w.last, err = strconv.Atoi(to); err != nil || w.last < w.first {
+				return w, errInvalidRecordRange
+			}
+		}
+	}
+	if skip < 0 {
+		return w, errInvalidRecordRange
+	}
+	w.first += skip
+	return w, nil
+}
+
+// past reports whether a record number lies beyond the window.
+func (w recordWindow) past(number int) bool {
+	return w.last > 0 && number > w.last
+}
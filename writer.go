@@ -0,0 +1,161 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"text/tabwriter"
+)
+
+// A marcWriter writes ISO 2709 records to a file.
+type marcWriter struct {
+	file   *os.File
+	w      *bufio.Writer
+	count  int
+	budget *writeBudget
+
+	// the byte ending each record, if not the standard one, and whether
+	// the last record is left without one (see terminators.go)
+	terminator *byte
+	omitFinal  bool
+
+	// the terminator of the last record written, when it is held back
+	// until another record follows
+	pending *byte
+}
+
+// When resuming from a checkpoint the MARC files written are added to
+// rather than replaced. They are all flushed before each checkpoint.
+var (
+	appendMarcWriters bool
+	marcWriters       []*marcWriter
+)
+
+func createMarcWriter(name string) (*marcWriter, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendMarcWriters {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(name, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	mw := &marcWriter{file: file, w: bufio.NewWriter(file), budget: marcBudget,
+		terminator: writeTerminator, omitFinal: omitFinalTerminator}
+	if info, err := file.Stat(); err == nil && appendMarcWriters && omitFinalTerminator && info.Size() > 0 {
+		// the record the file ends with is followed by another after all
+		mw.pending = mw.recordTerminator()
+	}
+	marcWriters = append(marcWriters, mw)
+	return mw, nil
+}
+
+// flushMarcWriters writes out what the MARC writers have buffered.
+func flushMarcWriters() error {
+	for _, mw := range marcWriters {
+		if err := mw.w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mw *marcWriter) write(raw []byte) error {
+	if mw.budget != nil {
+		var err error
+		if raw, err = mw.budget.fit(raw); raw == nil || err != nil {
+			return err
+		}
+	}
+	if err := mw.writePending(); err != nil {
+		return err
+	}
+	if len(raw) == 0 || raw[len(raw)-1] != marcfilter.RecordTerminator || (mw.terminator == nil && !mw.omitFinal) {
+		if _, err := mw.w.Write(raw); err != nil {
+			return err
+		}
+		mw.count += 1
+		return nil
+	}
+
+	if _, err := mw.w.Write(raw[:len(raw)-1]); err != nil {
+		return err
+	}
+	if mw.omitFinal {
+		mw.pending = mw.recordTerminator()
+	} else if err := mw.w.WriteByte(*mw.terminator); err != nil {
+		return err
+	}
+	mw.count += 1
+	return nil
+}
+
+// recordTerminator returns the byte ending the records written.
+func (mw *marcWriter) recordTerminator() *byte {
+	if mw.terminator != nil {
+		return mw.terminator
+	}
+	b := byte(marcfilter.RecordTerminator)
+	return &b
+}
+
+// writePending writes the terminator held back from the last record,
+// now that something follows it.
+func (mw *marcWriter) writePending() error {
+	if mw.pending == nil {
+		return nil
+	}
+	err := mw.w.WriteByte(*mw.pending)
+	mw.pending = nil
+	return err
+}
+
+// writeBytes writes bytes that are not a record.
+func (mw *marcWriter) writeBytes(b []byte) error {
+	if err := mw.writePending(); err != nil {
+		return err
+	}
+	_, err := mw.w.Write(b)
+	return err
+}
+
+func (mw *marcWriter) close() error {
+	if err := mw.w.Flush(); err != nil {
+		mw.file.Close()
+		return err
+	}
+	return mw.file.Close()
+}
+
+// getExtractAction returns an action writing the selected records to
+// the named file in ISO 2709 format. Records are copied through as they
+// were read unless a field filter rewrote them.
+func getExtractAction(name string) (actionFunc, error) {
+	out, err := createMarcWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(os.Stderr, "%d records extracted to %s\n", out.count, name)
+		return out.close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		return out.write(record.Raw)
+	}, nil
+}
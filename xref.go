@@ -0,0 +1,144 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/TreeRex/marc21"
+	"github.com/TreeRex/marcdump/marcfilter"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Cross references in authority records. A 4xx is a form not used for
+// the 1xx heading ("see"); a 5xx is a related heading ("see also"),
+// with the relationship coded in $w/0. Each reference is written as an
+// edge from one heading to the other.
+
+var xrefColumns = []string{"001", "from", "to", "relationship", "tag", "w"}
+
+// seeAlsoRelationships names the 5xx $w/0 codes.
+var seeAlsoRelationships = map[byte]string{
+	'a': "earlier",
+	'b': "later",
+	'd': "acronym",
+	'f': "musical composition",
+	'g': "broader",
+	'h': "narrower",
+	'i': "reference instruction",
+	'r': "relationship designator",
+	't': "immediate parent",
+}
+
+// authorityHeading returns the 1xx heading of an authority record and
+// its tag.
+func authorityHeading(record *marc21.MarcRecord) (string, string) {
+	for _, tag := range record.GetFieldList() {
+		if tag[0] == '1' {
+			field, _ := record.GetDataField(tag)
+			if field.ValueCount() > 0 {
+				return authorityString(&field, 0), tag
+			}
+		}
+	}
+	return "", ""
+}
+
+// authorityString joins the heading subfields of a field instance,
+// separating subdivisions with " -- ".
+func authorityString(field *marc21.VariableField, instance int) string {
+	var b bytes.Buffer
+	for _, sf := range field.GetSubfields(instance) {
+		v := trimISBD(strings.TrimSpace(field.GetNthSubfield(sf, instance)))
+		switch {
+		case v == "":
+		case strings.Contains("vxyz", sf):
+			b.WriteString(" -- " + v)
+		case strings.Contains("abcdefghjklmnopqrstu", sf):
+			if b.Len() > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
+
+// getXrefAction returns an action writing the cross references of the
+// authority records to the named CSV file. Other records are skipped.
+func getXrefAction(name string) (actionFunc, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	out := csv.NewWriter(file)
+	out.Write(xrefColumns)
+
+	edges := 0
+	onFinish(func(w *tabwriter.Writer) error {
+		fmt.Fprintf(os.Stderr, "%d cross references written to %s\n", edges, name)
+		out.Flush()
+		if err := out.Error(); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+
+	return func(record *marcfilter.Record, w *tabwriter.Writer) error {
+		if record.Leader()[6] != 'z' {
+			return nil
+		}
+		authorized, _ := authorityHeading(record.MarcRecord)
+		if authorized == "" {
+			return nil
+		}
+		id := controlNumber(record)
+
+		for _, tag := range record.GetFieldList() {
+			if tag[0] != '4' && tag[0] != '5' {
+				continue
+			}
+			field, _ := record.GetDataField(tag)
+			for i := 0; i < field.ValueCount(); i++ {
+				ref := authorityString(&field, i)
+				if ref == "" {
+					continue
+				}
+				code := field.GetNthSubfield("w", i)
+				var row []string
+				if tag[0] == '4' {
+					row = []string{id, ref, authorized, "see", tag, code}
+				} else {
+					relationship := "see also"
+					if len(code) > 0 {
+						if r, ok := seeAlsoRelationships[code[0]]; ok {
+							relationship = r
+						}
+					}
+					row = []string{id, authorized, ref, relationship, tag, code}
+				}
+				if err := out.Write(row); err != nil {
+					return err
+				}
+				edges += 1
+			}
+		}
+		return nil
+	}, nil
+}